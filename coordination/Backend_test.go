@@ -0,0 +1,259 @@
+package coordination
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 各后端共同的契约测试：每个后端的测试调用 testBackend，行为必须与 Zookeeper 相同。
+// 测试节点都创建在各用例独立的根节点下，可以在已有数据的协调服务上运行。
+
+// backendConnector 建立到同一份数据的新连接
+type backendConnector func(t *testing.T) Backend
+
+// 契约测试根节点的计数器
+var backendTestCounter int32
+
+// receiveEvent 等待监控事件
+func receiveEvent(t *testing.T, event <-chan Event) Event {
+	t.Helper()
+	select {
+	case e := <-event:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting for event timeout")
+		return Event{}
+	}
+}
+
+// testBackend 在后端上运行契约测试
+func testBackend(t *testing.T, connect backendConnector) {
+	cases := []struct {
+		name string
+		test func(t *testing.T, connect backendConnector, root string)
+	}{
+		{"CreateGetSetDelete", testBackendCreateGetSetDelete},
+		{"SequenceAndEphemeral", testBackendSequenceAndEphemeral},
+		{"Watch", testBackendWatch},
+		{"Multi", testBackendMulti},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			conn := connect(t)
+			root := fmt.Sprintf("/backend-test-%d-%d", time.Now().UnixNano(), atomic.AddInt32(&backendTestCounter, 1))
+			if _, err := conn.Create(root, nil, 0); err != nil {
+				t.Fatalf("create %s: %v", root, err)
+			}
+			defer func() {
+				deleteTree(conn, root)
+				conn.Close()
+			}()
+
+			c.test(t, connect, root)
+		})
+	}
+}
+
+// deleteTree 删除节点及其所有子孙节点
+func deleteTree(conn Backend, path string) {
+	children, _, _ := conn.Children(path)
+	for _, name := range children {
+		deleteTree(conn, childPath(path, name))
+	}
+	conn.Delete(path, -1)
+}
+
+func testBackendCreateGetSetDelete(t *testing.T, connect backendConnector, root string) {
+	conn := connect(t)
+	defer conn.Close()
+	a := root + "/a"
+
+	if _, err := conn.Create(a+"/b", nil, 0); err != ErrNoNode {
+		t.Errorf("create without parent: %v", err)
+	}
+	if _, err := conn.Create(a, []byte("1"), 0); err != nil {
+		t.Fatalf("create %s: %v", a, err)
+	}
+	if _, err := conn.Create(a, nil, 0); err != ErrNodeExists {
+		t.Errorf("create twice: %v", err)
+	}
+	if _, err := conn.Create(a+"/", nil, 0); err != ErrInvalidPath {
+		t.Errorf("create invalid path: %v", err)
+	}
+
+	data, stat, err := conn.Get(a)
+	if err != nil || string(data) != "1" || stat.Version != 0 {
+		t.Errorf("get %s: %s, %+v, %v", a, data, stat, err)
+	}
+	if _, _, err := conn.Get(root + "/none"); err != ErrNoNode {
+		t.Errorf("get non-existent node: %v", err)
+	}
+
+	if _, err := conn.Set(a, []byte("2"), 1); err != ErrBadVersion {
+		t.Errorf("set with wrong version: %v", err)
+	}
+	stat, err = conn.Set(a, []byte("2"), 0)
+	if err != nil || stat.Version != 1 {
+		t.Errorf("set %s: %+v, %v", a, stat, err)
+	}
+	if _, err := conn.Set(root+"/none", nil, -1); err != ErrNoNode {
+		t.Errorf("set non-existent node: %v", err)
+	}
+
+	conn.Create(a+"/b", nil, 0)
+	if err := conn.Delete(a, -1); err != ErrNotEmpty {
+		t.Errorf("delete non-empty node: %v", err)
+	}
+	children, stat, err := conn.Children(a)
+	if err != nil || len(children) != 1 || children[0] != "b" || stat.NumChildren != 1 {
+		t.Errorf("children of %s: %v, %+v, %v", a, children, stat, err)
+	}
+
+	if err := conn.Delete(a+"/b", -1); err != nil {
+		t.Errorf("delete %s/b: %v", a, err)
+	}
+	if exists, _, _ := conn.Exists(a + "/b"); exists {
+		t.Errorf("%s/b still exists", a)
+	}
+}
+
+func testBackendSequenceAndEphemeral(t *testing.T, connect backendConnector, root string) {
+	conn1 := connect(t)
+	conn2 := connect(t)
+	defer conn2.Close()
+	election := root + "/election"
+
+	conn1.Create(election, nil, 0)
+
+	path1, err := conn1.Create(election+"/n-", nil, FlagEphemeral|FlagSequence)
+	if err != nil || path1 != election+"/n-0000000000" {
+		t.Fatalf("create sequence node: %s, %v", path1, err)
+	}
+	path2, _ := conn2.Create(election+"/n-", nil, FlagEphemeral|FlagSequence)
+	if path2 != election+"/n-0000000001" {
+		t.Errorf("wrong sequence: %s", path2)
+	}
+
+	_, _, event, err := conn2.ChildrenW(election)
+	if err != nil {
+		t.Fatalf("ChildrenW: %v", err)
+	}
+
+	// 关闭连接后其临时节点被删除
+	conn1.Close()
+
+	e := receiveEvent(t, event)
+	if e.Type != EventNodeChildrenChanged || e.Path != election {
+		t.Errorf("wrong event: %+v", e)
+	}
+	children, _, _ := conn2.Children(election)
+	if len(children) != 1 || children[0] != "n-0000000001" {
+		t.Errorf("wrong children after close: %v", children)
+	}
+
+	if _, _, err := conn1.Get(election); err != ErrClosing {
+		t.Errorf("get after close: %v", err)
+	}
+}
+
+func testBackendWatch(t *testing.T, connect backendConnector, root string) {
+	conn := connect(t)
+	coin := root + "/coin"
+
+	exists, _, existsEvent, _ := conn.ExistsW(coin)
+	if exists {
+		t.Fatalf("%s should not exist", coin)
+	}
+	conn.Create(coin, []byte("btc"), 0)
+	if e := receiveEvent(t, existsEvent); e.Type != EventNodeCreated {
+		t.Errorf("wrong event: %+v", e)
+	}
+
+	_, _, getEvent, _ := conn.GetW(coin)
+	conn.Set(coin, []byte("bcc"), -1)
+	if e := receiveEvent(t, getEvent); e.Type != EventNodeDataChanged || e.Path != coin {
+		t.Errorf("wrong event: %+v", e)
+	}
+	// 监控是一次性的
+	if _, ok := <-getEvent; ok {
+		t.Error("watch channel should be closed")
+	}
+
+	_, _, getEvent, _ = conn.GetW(coin)
+	conn.Delete(coin, -1)
+	if e := receiveEvent(t, getEvent); e.Type != EventNodeDeleted {
+		t.Errorf("wrong event: %+v", e)
+	}
+
+	// 连接关闭时未触发的监控收到 EventNotWatching
+	_, _, existsEvent, _ = conn.ExistsW(coin)
+	conn.Close()
+	if e := receiveEvent(t, existsEvent); e.Type != EventNotWatching || e.Err != ErrClosing {
+		t.Errorf("wrong event: %+v", e)
+	}
+}
+
+func testBackendMulti(t *testing.T, connect backendConnector, root string) {
+	conn := connect(t)
+	defer conn.Close()
+	a, b, c := root+"/a", root+"/b", root+"/c"
+
+	conn.Create(a, []byte("1"), 0)
+	conn.Create(b, []byte("1"), 0)
+	_, _, event, _ := conn.GetW(a)
+
+	// 任一操作失败时全部不执行
+	err := conn.Multi(
+		&SetDataRequest{Path: a, Data: []byte("2"), Version: 0},
+		&CreateRequest{Path: c, Data: []byte("3")},
+		&SetDataRequest{Path: b, Data: []byte("2"), Version: 5},
+	)
+	if err != ErrBadVersion {
+		t.Errorf("multi with wrong version: %v", err)
+	}
+	if data, stat, _ := conn.Get(a); string(data) != "1" || stat.Version != 0 {
+		t.Errorf("%s changed by failed multi: %s, %+v", a, data, stat)
+	}
+	if exists, _, _ := conn.Exists(c); exists {
+		t.Errorf("%s created by failed multi", c)
+	}
+	select {
+	case e := <-event:
+		t.Errorf("event fired by failed multi: %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	err = conn.Multi(
+		&CheckVersionRequest{Path: b, Version: 0},
+		&SetDataRequest{Path: a, Data: []byte("2"), Version: 0},
+		&DeleteRequest{Path: b, Version: -1},
+	)
+	if err != nil {
+		t.Fatalf("multi: %v", err)
+	}
+	if data, _, _ := conn.Get(a); string(data) != "2" {
+		t.Errorf("wrong value of %s: %s", a, data)
+	}
+	if exists, _, _ := conn.Exists(b); exists {
+		t.Errorf("%s not deleted", b)
+	}
+	if e := receiveEvent(t, event); e.Type != EventNodeDataChanged {
+		t.Errorf("wrong event: %+v", e)
+	}
+
+	// 同一批量操作中先创建父节点再创建子节点
+	err = conn.Multi(
+		&CreateRequest{Path: c, Data: []byte("3")},
+		&CreateRequest{Path: c + "/d", Data: []byte("4")},
+	)
+	if err != nil {
+		t.Fatalf("multi create parent and child: %v", err)
+	}
+	if data, _, err := conn.Get(c + "/d"); err != nil || string(data) != "4" {
+		t.Errorf("get %s/d: %s, %v", c, data, err)
+	}
+}
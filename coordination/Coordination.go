@@ -0,0 +1,234 @@
+// Package coordination 协调服务（Zookeeper、etcd等）的统一接口
+//
+// 接口沿用 Zookeeper 的数据模型：以“/”分隔的节点树，每个节点有值和版本号，
+// 支持临时节点、顺序节点、一次性的监控以及原子的批量操作。
+// 各模块通过 Connect 按配置选择后端，测试可以使用内存实现。
+package coordination
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 创建节点的标志
+const (
+	// FlagEphemeral 临时节点，连接关闭或会话过期后自动删除
+	FlagEphemeral = 1
+	// FlagSequence 顺序节点，节点名后附加10位递增序号
+	FlagSequence = 2
+)
+
+// 后端名称
+const (
+	BackendZookeeper = "zookeeper"
+	BackendEtcd      = "etcd"
+	BackendMemory    = "memory"
+)
+
+// 错误
+var (
+	ErrNoNode         = errors.New("coordination: node does not exist")
+	ErrNodeExists     = errors.New("coordination: node already exists")
+	ErrBadVersion     = errors.New("coordination: version conflict")
+	ErrNotEmpty       = errors.New("coordination: node has children")
+	ErrInvalidPath    = errors.New("coordination: invalid path")
+	ErrClosing        = errors.New("coordination: connection closing")
+	ErrSessionExpired = errors.New("coordination: session expired")
+	ErrUnknownBackend = errors.New("coordination: unknown backend")
+)
+
+// EventType 监控事件类型
+type EventType int32
+
+// 监控事件类型
+const (
+	EventNodeCreated         EventType = 1
+	EventNodeDeleted         EventType = 2
+	EventNodeDataChanged     EventType = 3
+	EventNodeChildrenChanged EventType = 4
+	// EventNotWatching 监控已失效（连接关闭或断开），Err 为原因
+	EventNotWatching EventType = -2
+)
+
+func (eventType EventType) String() string {
+	switch eventType {
+	case EventNodeCreated:
+		return "EventNodeCreated"
+	case EventNodeDeleted:
+		return "EventNodeDeleted"
+	case EventNodeDataChanged:
+		return "EventNodeDataChanged"
+	case EventNodeChildrenChanged:
+		return "EventNodeChildrenChanged"
+	case EventNotWatching:
+		return "EventNotWatching"
+	default:
+		return fmt.Sprintf("EventType(%d)", int32(eventType))
+	}
+}
+
+// Event 监控事件
+// 监控是一次性的：每个监控channel最多收到一个事件，之后被关闭。
+type Event struct {
+	Type EventType
+	Path string
+	Err  error
+}
+
+// SessionEvent 会话状态事件
+type SessionEvent int32
+
+// 会话状态事件
+const (
+	// SessionDisconnected 与服务器断开连接，后端会自动重连
+	SessionDisconnected SessionEvent = 1
+	// SessionReconnected 断开后重新连接，会话未过期，监控和临时节点仍然有效
+	SessionReconnected SessionEvent = 2
+	// SessionExpired 会话已过期并已建立新的会话。
+	// 该连接创建的临时节点已被删除，之前的监控可能已失效（收到 Err 为 ErrSessionExpired 的 EventNotWatching），
+	// 使用者应当重新设置监控、重新读取节点的值并重建临时节点。
+	SessionExpired SessionEvent = 3
+)
+
+func (sessionEvent SessionEvent) String() string {
+	switch sessionEvent {
+	case SessionDisconnected:
+		return "SessionDisconnected"
+	case SessionReconnected:
+		return "SessionReconnected"
+	case SessionExpired:
+		return "SessionExpired"
+	default:
+		return fmt.Sprintf("SessionEvent(%d)", int32(sessionEvent))
+	}
+}
+
+// 会话状态事件的缓冲区大小
+const sessionEventsBufferSize = 16
+
+// sessionEvents 会话状态事件的队列，由各后端发送，连接关闭后被关闭
+type sessionEvents chan SessionEvent
+
+func newSessionEvents() sessionEvents {
+	return make(sessionEvents, sessionEventsBufferSize)
+}
+
+// send 发送事件，缓冲区已满（无人读取）时丢弃
+func (events sessionEvents) send(event SessionEvent) {
+	select {
+	case events <- event:
+	default:
+	}
+}
+
+// Stat 节点状态
+type Stat struct {
+	// 数据版本，创建时为0，每次修改加一
+	Version int32
+	// 子节点数
+	NumChildren int32
+}
+
+// CreateRequest 批量操作：创建节点
+type CreateRequest struct {
+	Path  string
+	Data  []byte
+	Flags int32
+}
+
+// SetDataRequest 批量操作：修改节点，Version 为 -1 时不检查版本
+type SetDataRequest struct {
+	Path    string
+	Data    []byte
+	Version int32
+}
+
+// DeleteRequest 批量操作：删除节点，Version 为 -1 时不检查版本
+type DeleteRequest struct {
+	Path    string
+	Version int32
+}
+
+// CheckVersionRequest 批量操作：检查节点版本
+type CheckVersionRequest struct {
+	Path    string
+	Version int32
+}
+
+// Backend 协调服务连接
+type Backend interface {
+	// Get 获取节点的值
+	Get(path string) ([]byte, *Stat, error)
+	// GetW 获取节点的值并监控节点的修改和删除
+	GetW(path string) ([]byte, *Stat, <-chan Event, error)
+	// Exists 节点是否存在
+	Exists(path string) (bool, *Stat, error)
+	// ExistsW 节点是否存在，并监控节点的创建、修改和删除
+	ExistsW(path string) (bool, *Stat, <-chan Event, error)
+	// Children 列出子节点名
+	Children(path string) ([]string, *Stat, error)
+	// ChildrenW 列出子节点名并监控子节点的增减
+	ChildrenW(path string) ([]string, *Stat, <-chan Event, error)
+	// Create 创建节点，父节点必须存在。返回实际的节点路径（顺序节点带有序号）
+	Create(path string, data []byte, flags int32) (string, error)
+	// Set 修改节点的值，version 为 -1 时不检查版本
+	Set(path string, data []byte, version int32) (*Stat, error)
+	// Delete 删除没有子节点的节点，version 为 -1 时不检查版本
+	Delete(path string, version int32) error
+	// Multi 原子地执行多个操作，全部成功或全部不执行
+	// ops 的类型为 *CreateRequest、*SetDataRequest、*DeleteRequest 或 *CheckVersionRequest
+	Multi(ops ...interface{}) error
+	// SessionEvents 会话状态事件，连接关闭后 channel 被关闭。
+	// 应当只有一个使用者读取，读取不及时时事件会被丢弃。
+	SessionEvents() <-chan SessionEvent
+	// Close 关闭连接，该连接创建的临时节点将被删除
+	Close()
+}
+
+// Factory 建立到后端的连接
+type Factory func(endpoints []string, timeout time.Duration) (Backend, error)
+
+var (
+	factoriesLock sync.Mutex
+	factories     = make(map[string]Factory)
+)
+
+// Register 注册后端
+func Register(name string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	factories[name] = factory
+}
+
+// Backends 已注册的后端名称
+func Backends() []string {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Connect 建立到后端的连接，name 为空时使用 Zookeeper
+// timeout 为连接超时时间，超时未连接成功时返回错误
+func Connect(name string, endpoints []string, timeout time.Duration) (Backend, error) {
+	if len(name) < 1 {
+		name = BackendZookeeper
+	}
+
+	factoriesLock.Lock()
+	factory, ok := factories[name]
+	factoriesLock.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%v: %s (available: %v)", ErrUnknownBackend, name, Backends())
+	}
+	return factory(endpoints, timeout)
+}
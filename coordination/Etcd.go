@@ -0,0 +1,582 @@
+//go:build etcd
+// +build etcd
+
+package coordination
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcd 后端依赖 go.etcd.io/etcd/client/v3（已在 vendor 中），使用 go build -tags etcd 编译
+
+func init() {
+	Register(BackendEtcd, ConnectEtcd)
+}
+
+// 临时节点租约的TTL（秒），与 Zookeeper 的会话超时时间相当
+const etcdLeaseTTL = 5
+
+// 单个请求的超时时间
+const etcdRequestTimeout = 10 * time.Second
+
+// 顺序节点计数器的key前缀，不以“/”开头，不会出现在节点列表中
+const etcdSequencePrefix = "#sequence:"
+
+// etcdBackend 基于 etcd v3 的实现
+//
+// 节点路径即为 etcd 的 key，值即为节点的值；节点的版本号为 etcd 的 key 版本减一。
+// 子节点通过前缀查询得到，临时节点绑定到该连接的租约上，连接关闭或租约过期后被删除。
+// 租约过期相当于 Zookeeper 的会话过期：将申请新的租约并发出 SessionExpired 事件。
+// etcd 的监控基于 revision，断开重连后会自动恢复，不受租约过期影响。
+type etcdBackend struct {
+	client *clientv3.Client
+	// 当前租约的ID（clientv3.LeaseID），租约过期后被替换
+	lease         int64
+	ctx           context.Context
+	cancel        context.CancelFunc
+	sessionEvents sessionEvents
+}
+
+// ConnectEtcd 连接到etcd集群，等待连接成功或超时
+func ConnectEtcd(endpoints []string, timeout time.Duration) (Backend, error) {
+	client, err := clientv3.New(clientv3.Config{Endpoints: endpoints, DialTimeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+
+	glog.Info("etcd: waiting for connecting to ", endpoints, "...")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	backend := &etcdBackend{client: client, ctx: ctx, cancel: cancel, sessionEvents: newSessionEvents()}
+
+	keepAlive, err := backend.grantLease(timeout)
+	if err != nil {
+		cancel()
+		client.Close()
+		return nil, errors.New("etcd: connecting failed: " + err.Error())
+	}
+
+	go backend.keepAlive(keepAlive)
+
+	glog.Info("etcd: connected, lease ", backend.currentLease())
+	return backend, nil
+}
+
+// currentLease 当前的租约
+func (backend *etcdBackend) currentLease() clientv3.LeaseID {
+	return clientv3.LeaseID(atomic.LoadInt64(&backend.lease))
+}
+
+// grantLease 申请新的租约并开始续约
+func (backend *etcdBackend) grantLease(timeout time.Duration) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	grantCtx, grantCancel := context.WithTimeout(backend.ctx, timeout)
+	lease, err := backend.client.Grant(grantCtx, etcdLeaseTTL)
+	grantCancel()
+	if err != nil {
+		return nil, err
+	}
+
+	keepAlive, err := backend.client.KeepAlive(backend.ctx, lease.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.StoreInt64(&backend.lease, int64(lease.ID))
+	return keepAlive, nil
+}
+
+// keepAlive 等待租约过期，过期后申请新的租约并发出 SessionExpired 事件，直到连接关闭
+func (backend *etcdBackend) keepAlive(keepAlive <-chan *clientv3.LeaseKeepAliveResponse) {
+	defer close(backend.sessionEvents)
+
+	for {
+		for range keepAlive {
+		}
+		if backend.ctx.Err() != nil {
+			return
+		}
+		glog.Error("etcd: lease ", backend.currentLease(), " expired, ephemeral nodes are lost")
+		backend.sessionEvents.send(SessionDisconnected)
+
+		for {
+			var err error
+			keepAlive, err = backend.grantLease(etcdRequestTimeout)
+			if err == nil {
+				break
+			}
+			if backend.ctx.Err() != nil {
+				return
+			}
+			glog.Error("etcd: grant lease failed: ", err)
+
+			select {
+			case <-backend.ctx.Done():
+				return
+			case <-time.After(etcdLeaseTTL * time.Second):
+			}
+		}
+
+		glog.Info("etcd: granted new lease ", backend.currentLease())
+		backend.sessionEvents.send(SessionExpired)
+	}
+}
+
+func (backend *etcdBackend) requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(backend.ctx, etcdRequestTimeout)
+}
+
+// etcdError 转换 etcd 的错误
+func (backend *etcdBackend) etcdError(err error) error {
+	if err != nil && backend.ctx.Err() != nil {
+		return ErrClosing
+	}
+	return err
+}
+
+// etcdNodeExists 节点存在的比较条件，根节点总是存在
+func etcdNodeExists(path string) []clientv3.Cmp {
+	if path == "/" {
+		return nil
+	}
+	return []clientv3.Cmp{clientv3.Compare(clientv3.CreateRevision(path), ">", 0)}
+}
+
+// etcdNodeVersion 节点版本的比较条件，version 为 -1 时只要求节点存在
+func etcdNodeVersion(path string, version int32) []clientv3.Cmp {
+	if version == -1 {
+		return etcdNodeExists(path)
+	}
+	return []clientv3.Cmp{clientv3.Compare(clientv3.Version(path), "=", int64(version)+1)}
+}
+
+// etcdNoChildren 节点没有子节点的比较条件
+func etcdNoChildren(path string) clientv3.Cmp {
+	return clientv3.Compare(clientv3.CreateRevision(path+"/"), "=", 0).WithPrefix()
+}
+
+// isDirectChild name 是否为 parent 的直接子节点，返回子节点名
+func isDirectChild(parent string, key string) (string, bool) {
+	prefix := childPath(parent, "")
+	if !strings.HasPrefix(key, prefix) {
+		return "", false
+	}
+	name := key[len(prefix):]
+	return name, len(name) > 0 && !strings.Contains(name, "/")
+}
+
+func (backend *etcdBackend) Get(path string) ([]byte, *Stat, error) {
+	data, stat, _, err := backend.get(path, false)
+	return data, stat, err
+}
+
+func (backend *etcdBackend) GetW(path string) ([]byte, *Stat, <-chan Event, error) {
+	return backend.get(path, true)
+}
+
+func (backend *etcdBackend) get(path string, watch bool) ([]byte, *Stat, <-chan Event, error) {
+	if err := validatePath(path); err != nil {
+		return nil, nil, nil, err
+	}
+	if path == "/" {
+		return nil, &Stat{}, nil, nil
+	}
+
+	ctx, cancel := backend.requestContext()
+	response, err := backend.client.Get(ctx, path)
+	cancel()
+	if err != nil {
+		return nil, nil, nil, backend.etcdError(err)
+	}
+	if len(response.Kvs) < 1 {
+		return nil, nil, nil, ErrNoNode
+	}
+
+	kv := response.Kvs[0]
+	var event <-chan Event
+	if watch {
+		event = backend.watchNode(path, response.Header.Revision)
+	}
+	return kv.Value, &Stat{Version: int32(kv.Version - 1)}, event, nil
+}
+
+func (backend *etcdBackend) Exists(path string) (bool, *Stat, error) {
+	exists, stat, _, err := backend.exists(path, false)
+	return exists, stat, err
+}
+
+func (backend *etcdBackend) ExistsW(path string) (bool, *Stat, <-chan Event, error) {
+	return backend.exists(path, true)
+}
+
+func (backend *etcdBackend) exists(path string, watch bool) (bool, *Stat, <-chan Event, error) {
+	if err := validatePath(path); err != nil {
+		return false, nil, nil, err
+	}
+	if path == "/" {
+		return true, &Stat{}, nil, nil
+	}
+
+	ctx, cancel := backend.requestContext()
+	response, err := backend.client.Get(ctx, path, clientv3.WithKeysOnly())
+	cancel()
+	if err != nil {
+		return false, nil, nil, backend.etcdError(err)
+	}
+
+	var event <-chan Event
+	if watch {
+		event = backend.watchNode(path, response.Header.Revision)
+	}
+	if len(response.Kvs) < 1 {
+		return false, nil, event, nil
+	}
+	return true, &Stat{Version: int32(response.Kvs[0].Version - 1)}, event, nil
+}
+
+func (backend *etcdBackend) Children(path string) ([]string, *Stat, error) {
+	children, stat, _, err := backend.children(path, false)
+	return children, stat, err
+}
+
+func (backend *etcdBackend) ChildrenW(path string) ([]string, *Stat, <-chan Event, error) {
+	return backend.children(path, true)
+}
+
+func (backend *etcdBackend) children(path string, watch bool) ([]string, *Stat, <-chan Event, error) {
+	if err := validatePath(path); err != nil {
+		return nil, nil, nil, err
+	}
+
+	ctx, cancel := backend.requestContext()
+	defer cancel()
+
+	// 在同一个版本上读取节点本身和所有子孙节点
+	ops := []clientv3.Op{clientv3.OpGet(childPath(path, ""), clientv3.WithPrefix(), clientv3.WithKeysOnly())}
+	if path != "/" {
+		ops = append(ops, clientv3.OpGet(path, clientv3.WithKeysOnly()))
+	}
+	response, err := backend.client.Txn(ctx).Then(ops...).Commit()
+	if err != nil {
+		return nil, nil, nil, backend.etcdError(err)
+	}
+
+	stat := &Stat{}
+	if path != "/" {
+		kvs := response.Responses[1].GetResponseRange().Kvs
+		if len(kvs) < 1 {
+			return nil, nil, nil, ErrNoNode
+		}
+		stat.Version = int32(kvs[0].Version - 1)
+	}
+
+	children := []string{}
+	for _, kv := range response.Responses[0].GetResponseRange().Kvs {
+		if name, ok := isDirectChild(path, string(kv.Key)); ok {
+			children = append(children, name)
+		}
+	}
+	stat.NumChildren = int32(len(children))
+
+	var event <-chan Event
+	if watch {
+		event = backend.watchChildren(path, response.Header.Revision)
+	}
+	return children, stat, event, nil
+}
+
+// watch 从 revision 之后开始监控，收到第一个 convert 返回 true 的事件后停止
+func (backend *etcdBackend) watch(path string, revision int64, convert func(*clientv3.Event) (Event, bool), opts ...clientv3.OpOption) <-chan Event {
+	event := make(chan Event, 1)
+	ctx, cancel := context.WithCancel(backend.ctx)
+	opts = append(opts, clientv3.WithRev(revision+1))
+	watchChan := backend.client.Watch(ctx, path, opts...)
+
+	go func() {
+		defer close(event)
+		defer cancel()
+
+		for response := range watchChan {
+			if err := response.Err(); err != nil {
+				event <- Event{Type: EventNotWatching, Path: path, Err: err}
+				return
+			}
+			for _, etcdEvent := range response.Events {
+				if e, ok := convert(etcdEvent); ok {
+					event <- e
+					return
+				}
+			}
+		}
+		event <- Event{Type: EventNotWatching, Path: path, Err: ErrClosing}
+	}()
+
+	return event
+}
+
+// watchNode 监控节点的创建、修改和删除
+func (backend *etcdBackend) watchNode(path string, revision int64) <-chan Event {
+	return backend.watch(path, revision, func(etcdEvent *clientv3.Event) (Event, bool) {
+		switch {
+		case etcdEvent.Type == clientv3.EventTypeDelete:
+			return Event{Type: EventNodeDeleted, Path: path}, true
+		case etcdEvent.IsCreate():
+			return Event{Type: EventNodeCreated, Path: path}, true
+		default:
+			return Event{Type: EventNodeDataChanged, Path: path}, true
+		}
+	})
+}
+
+// watchChildren 监控子节点的增减以及节点本身的删除
+func (backend *etcdBackend) watchChildren(path string, revision int64) <-chan Event {
+	return backend.watch(path, revision, func(etcdEvent *clientv3.Event) (Event, bool) {
+		key := string(etcdEvent.Kv.Key)
+		if key == path {
+			if etcdEvent.Type == clientv3.EventTypeDelete {
+				return Event{Type: EventNodeDeleted, Path: path}, true
+			}
+			return Event{}, false
+		}
+		if _, ok := isDirectChild(path, key); !ok {
+			return Event{}, false
+		}
+		if etcdEvent.Type == clientv3.EventTypeDelete || etcdEvent.IsCreate() {
+			return Event{Type: EventNodeChildrenChanged, Path: path}, true
+		}
+		return Event{}, false
+	}, clientv3.WithPrefix())
+}
+
+// nextSequence 为父节点分配下一个顺序节点序号
+func (backend *etcdBackend) nextSequence(parent string) (int64, error) {
+	key := etcdSequencePrefix + parent
+
+	for {
+		ctx, cancel := backend.requestContext()
+		response, err := backend.client.Get(ctx, key)
+		cancel()
+		if err != nil {
+			return 0, backend.etcdError(err)
+		}
+
+		sequence := int64(0)
+		modRevision := int64(0)
+		if len(response.Kvs) > 0 {
+			sequence, _ = strconv.ParseInt(string(response.Kvs[0].Value), 10, 64)
+			modRevision = response.Kvs[0].ModRevision
+		}
+
+		ctx, cancel = backend.requestContext()
+		txn, err := backend.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+			Then(clientv3.OpPut(key, strconv.FormatInt(sequence+1, 10))).
+			Commit()
+		cancel()
+		if err != nil {
+			return 0, backend.etcdError(err)
+		}
+		if txn.Succeeded {
+			return sequence, nil
+		}
+	}
+}
+
+// createOp 创建节点的比较条件和操作
+func (backend *etcdBackend) createOp(path string, data []byte, flags int32, checkParent bool) ([]clientv3.Cmp, clientv3.Op) {
+	var cmps []clientv3.Cmp
+	if checkParent {
+		cmps = append(cmps, etcdNodeExists(parentPath(path))...)
+	}
+	cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(path), "=", 0))
+
+	var opts []clientv3.OpOption
+	if flags&FlagEphemeral != 0 {
+		opts = append(opts, clientv3.WithLease(backend.currentLease()))
+	}
+	return cmps, clientv3.OpPut(path, string(data), opts...)
+}
+
+func (backend *etcdBackend) Create(path string, data []byte, flags int32) (string, error) {
+	if err := validatePath(path); err != nil || path == "/" {
+		return "", ErrInvalidPath
+	}
+
+	if flags&FlagSequence != 0 {
+		sequence, err := backend.nextSequence(parentPath(path))
+		if err != nil {
+			return "", err
+		}
+		path = sequencePath(path, sequence)
+	}
+
+	cmps, op := backend.createOp(path, data, flags, true)
+
+	ctx, cancel := backend.requestContext()
+	defer cancel()
+	response, err := backend.client.Txn(ctx).If(cmps...).Then(op).Commit()
+	if err != nil {
+		return "", backend.etcdError(err)
+	}
+	if !response.Succeeded {
+		if exists, _, err := backend.Exists(parentPath(path)); err == nil && !exists {
+			return "", ErrNoNode
+		}
+		return "", ErrNodeExists
+	}
+	return path, nil
+}
+
+func (backend *etcdBackend) Set(path string, data []byte, version int32) (*Stat, error) {
+	if err := validatePath(path); err != nil || path == "/" {
+		return nil, ErrInvalidPath
+	}
+
+	ctx, cancel := backend.requestContext()
+	defer cancel()
+
+	// 保留节点原有的租约（临时节点）
+	response, err := backend.client.Txn(ctx).
+		If(etcdNodeVersion(path, version)...).
+		Then(clientv3.OpPut(path, string(data), clientv3.WithIgnoreLease()), clientv3.OpGet(path, clientv3.WithKeysOnly())).
+		Else(clientv3.OpGet(path, clientv3.WithKeysOnly())).
+		Commit()
+	if err != nil {
+		return nil, backend.etcdError(err)
+	}
+	if !response.Succeeded {
+		if len(response.Responses[0].GetResponseRange().Kvs) < 1 {
+			return nil, ErrNoNode
+		}
+		return nil, ErrBadVersion
+	}
+	kv := response.Responses[1].GetResponseRange().Kvs[0]
+	return &Stat{Version: int32(kv.Version - 1)}, nil
+}
+
+func (backend *etcdBackend) Delete(path string, version int32) error {
+	return backend.Multi(&DeleteRequest{Path: path, Version: version})
+}
+
+// multiError 批量操作失败后确定失败的原因
+func (backend *etcdBackend) multiError(ops []interface{}) error {
+	for _, op := range ops {
+		var path string
+		var version int32 = -1
+		switch op := op.(type) {
+		case *CreateRequest:
+			exists, _, err := backend.Exists(op.Path)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return ErrNodeExists
+			}
+			continue
+		case *SetDataRequest:
+			path, version = op.Path, op.Version
+		case *DeleteRequest:
+			path, version = op.Path, op.Version
+			children, _, err := backend.Children(path)
+			if err == nil && len(children) > 0 {
+				return ErrNotEmpty
+			}
+		case *CheckVersionRequest:
+			path, version = op.Path, op.Version
+		}
+
+		exists, stat, err := backend.Exists(path)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNoNode
+		}
+		if version != -1 && stat.Version != version {
+			return ErrBadVersion
+		}
+	}
+	// 不满足的条件已被其他客户端修改，或要创建的节点的父节点不存在
+	return ErrNoNode
+}
+
+func (backend *etcdBackend) Multi(ops ...interface{}) error {
+	var cmps []clientv3.Cmp
+	var etcdOps []clientv3.Op
+	// 本次批量操作中创建的节点，作为父节点时不需要检查存在
+	created := make(map[string]bool)
+
+	for _, op := range ops {
+		switch op := op.(type) {
+		case *CreateRequest:
+			if err := validatePath(op.Path); err != nil || op.Path == "/" {
+				return ErrInvalidPath
+			}
+			path := op.Path
+			if op.Flags&FlagSequence != 0 {
+				// 序号在事务之前分配，事务失败时该序号被跳过（与 Zookeeper 相同，序号不保证连续）
+				sequence, err := backend.nextSequence(parentPath(op.Path))
+				if err != nil {
+					return err
+				}
+				path = sequencePath(op.Path, sequence)
+			}
+			opCmps, etcdOp := backend.createOp(path, op.Data, op.Flags, !created[parentPath(path)])
+			cmps = append(cmps, opCmps...)
+			etcdOps = append(etcdOps, etcdOp)
+			created[path] = true
+		case *SetDataRequest:
+			if err := validatePath(op.Path); err != nil || op.Path == "/" {
+				return ErrInvalidPath
+			}
+			cmps = append(cmps, etcdNodeVersion(op.Path, op.Version)...)
+			etcdOps = append(etcdOps, clientv3.OpPut(op.Path, string(op.Data), clientv3.WithIgnoreLease()))
+		case *DeleteRequest:
+			if err := validatePath(op.Path); err != nil || op.Path == "/" {
+				return ErrInvalidPath
+			}
+			cmps = append(cmps, etcdNodeVersion(op.Path, op.Version)...)
+			cmps = append(cmps, etcdNoChildren(op.Path))
+			etcdOps = append(etcdOps, clientv3.OpDelete(op.Path))
+		case *CheckVersionRequest:
+			if err := validatePath(op.Path); err != nil {
+				return ErrInvalidPath
+			}
+			cmps = append(cmps, etcdNodeVersion(op.Path, op.Version)...)
+		default:
+			return errors.New("coordination: unknown operation type")
+		}
+	}
+
+	ctx, cancel := backend.requestContext()
+	defer cancel()
+	response, err := backend.client.Txn(ctx).If(cmps...).Then(etcdOps...).Commit()
+	if err != nil {
+		return backend.etcdError(err)
+	}
+	if !response.Succeeded {
+		return backend.multiError(ops)
+	}
+	return nil
+}
+
+func (backend *etcdBackend) SessionEvents() <-chan SessionEvent {
+	return backend.sessionEvents
+}
+
+func (backend *etcdBackend) Close() {
+	// 撤销租约，删除该连接创建的临时节点
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	backend.client.Revoke(ctx, backend.currentLease())
+	cancel()
+
+	backend.cancel()
+	backend.client.Close()
+}
@@ -0,0 +1,36 @@
+//go:build etcd
+// +build etcd
+
+package coordination
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// etcd 后端的契约测试需要一个 etcd 服务器，通过环境变量指定地址，例如：
+//   ETCD_ENDPOINTS=127.0.0.1:2379 go test -tags etcd github.com/btccom/btcpool-go-modules/coordination
+// 测试节点创建在 /backend-test-* 下，测试结束后被删除。
+
+// etcdTestEndpoints 测试使用的 etcd 地址，未设置时跳过测试
+func etcdTestEndpoints(t *testing.T) []string {
+	endpoints := os.Getenv("ETCD_ENDPOINTS")
+	if len(endpoints) < 1 {
+		t.Skip("ETCD_ENDPOINTS is not set")
+	}
+	return strings.Split(endpoints, ",")
+}
+
+// TestEtcdBackend etcd 后端的契约测试
+func TestEtcdBackend(t *testing.T) {
+	endpoints := etcdTestEndpoints(t)
+	testBackend(t, func(t *testing.T) Backend {
+		conn, err := Connect(BackendEtcd, endpoints, 5*time.Second)
+		if err != nil {
+			t.Fatalf("connect etcd backend: %v", err)
+		}
+		return conn
+	})
+}
@@ -0,0 +1,498 @@
+package coordination
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	Register(BackendMemory, func(endpoints []string, timeout time.Duration) (Backend, error) {
+		return defaultMemoryStore.Connect(), nil
+	})
+}
+
+// 同一进程中通过 Connect("memory", ...) 建立的连接共享该存储
+var defaultMemoryStore = NewMemoryStore()
+
+// memoryNode 内存中的节点
+type memoryNode struct {
+	data     []byte
+	version  int32
+	children map[string]*memoryNode
+	// 子节点增减的次数，用作顺序节点的序号
+	cversion int64
+	// 创建该临时节点的连接，持久节点为 nil
+	owner *MemoryBackend
+}
+
+// memoryWatch 一个监控
+type memoryWatch struct {
+	owner *MemoryBackend
+	event chan Event
+}
+
+// MemoryStore 内存中的节点树，供测试或单进程部署使用
+// 同一存储上的多个连接可以模拟多个进程（如选主、临时节点的删除）。
+type MemoryStore struct {
+	lock sync.Mutex
+	root *memoryNode
+	// 节点路径 -> 数据监控（GetW、ExistsW）
+	dataWatches map[string][]memoryWatch
+	// 节点路径 -> 子节点监控（ChildrenW）
+	childWatches map[string][]memoryWatch
+}
+
+// NewMemoryStore 新建内存存储
+func NewMemoryStore() *MemoryStore {
+	store := new(MemoryStore)
+	store.root = &memoryNode{children: make(map[string]*memoryNode)}
+	store.dataWatches = make(map[string][]memoryWatch)
+	store.childWatches = make(map[string][]memoryWatch)
+	return store
+}
+
+// Connect 建立到该存储的连接
+func (store *MemoryStore) Connect() *MemoryBackend {
+	return &MemoryBackend{store: store, sessionEvents: newSessionEvents()}
+}
+
+// MemoryBackend 内存存储的连接
+type MemoryBackend struct {
+	store         *MemoryStore
+	closed        bool
+	sessionEvents sessionEvents
+}
+
+// find 查找节点，在持有锁时调用
+func (store *MemoryStore) find(path string) *memoryNode {
+	if path == "/" {
+		return store.root
+	}
+	node := store.root
+	for _, name := range strings.Split(path[1:], "/") {
+		node = node.children[name]
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+func (node *memoryNode) stat() *Stat {
+	return &Stat{Version: node.version, NumChildren: int32(len(node.children))}
+}
+
+// pendingEvent 操作成功后要触发的监控事件
+type pendingEvent struct {
+	watches map[string][]memoryWatch
+	path    string
+	event   Event
+}
+
+// fire 触发并移除监控，在持有锁时调用
+func (store *MemoryStore) fire(events []pendingEvent) {
+	for _, pending := range events {
+		for _, watch := range pending.watches[pending.path] {
+			watch.event <- pending.event
+			close(watch.event)
+		}
+		delete(pending.watches, pending.path)
+	}
+}
+
+// addWatch 添加监控，在持有锁时调用
+func (store *MemoryStore) addWatch(watches map[string][]memoryWatch, path string, owner *MemoryBackend) <-chan Event {
+	event := make(chan Event, 1)
+	watches[path] = append(watches[path], memoryWatch{owner, event})
+	return event
+}
+
+// create 创建节点，返回撤销函数和要触发的事件，在持有锁时调用
+func (store *MemoryStore) create(owner *MemoryBackend, path string, data []byte, flags int32) (string, func(), []pendingEvent, error) {
+	if err := validatePath(path); err != nil || path == "/" {
+		return "", nil, nil, ErrInvalidPath
+	}
+
+	parent := store.find(parentPath(path))
+	if parent == nil {
+		return "", nil, nil, ErrNoNode
+	}
+	if parent.owner != nil {
+		// 与 Zookeeper 相同，临时节点不能有子节点
+		return "", nil, nil, errors.New("coordination: ephemeral node cannot have children")
+	}
+
+	if flags&FlagSequence != 0 {
+		path = sequencePath(path, parent.cversion)
+	}
+	name := path[strings.LastIndex(path, "/")+1:]
+	if _, exists := parent.children[name]; exists {
+		return "", nil, nil, ErrNodeExists
+	}
+
+	node := &memoryNode{data: append([]byte(nil), data...), children: make(map[string]*memoryNode)}
+	if flags&FlagEphemeral != 0 {
+		node.owner = owner
+	}
+	parent.children[name] = node
+	parent.cversion++
+
+	undo := func() {
+		delete(parent.children, name)
+		parent.cversion--
+	}
+	events := []pendingEvent{
+		{store.dataWatches, path, Event{Type: EventNodeCreated, Path: path}},
+		{store.childWatches, parentPath(path), Event{Type: EventNodeChildrenChanged, Path: parentPath(path)}},
+	}
+	return path, undo, events, nil
+}
+
+// set 修改节点，在持有锁时调用
+func (store *MemoryStore) set(path string, data []byte, version int32) (*Stat, func(), []pendingEvent, error) {
+	if err := validatePath(path); err != nil {
+		return nil, nil, nil, err
+	}
+	node := store.find(path)
+	if node == nil {
+		return nil, nil, nil, ErrNoNode
+	}
+	if version != -1 && version != node.version {
+		return nil, nil, nil, ErrBadVersion
+	}
+
+	oldData, oldVersion := node.data, node.version
+	node.data = append([]byte(nil), data...)
+	node.version++
+
+	undo := func() {
+		node.data, node.version = oldData, oldVersion
+	}
+	events := []pendingEvent{
+		{store.dataWatches, path, Event{Type: EventNodeDataChanged, Path: path}},
+	}
+	return node.stat(), undo, events, nil
+}
+
+// delete 删除节点，在持有锁时调用
+func (store *MemoryStore) delete(path string, version int32) (func(), []pendingEvent, error) {
+	if err := validatePath(path); err != nil || path == "/" {
+		return nil, nil, ErrInvalidPath
+	}
+	parent := store.find(parentPath(path))
+	node := store.find(path)
+	if node == nil {
+		return nil, nil, ErrNoNode
+	}
+	if version != -1 && version != node.version {
+		return nil, nil, ErrBadVersion
+	}
+	if len(node.children) > 0 {
+		return nil, nil, ErrNotEmpty
+	}
+
+	name := path[strings.LastIndex(path, "/")+1:]
+	delete(parent.children, name)
+	parent.cversion++
+
+	undo := func() {
+		parent.children[name] = node
+		parent.cversion--
+	}
+	events := []pendingEvent{
+		{store.dataWatches, path, Event{Type: EventNodeDeleted, Path: path}},
+		{store.childWatches, path, Event{Type: EventNodeDeleted, Path: path}},
+		{store.childWatches, parentPath(path), Event{Type: EventNodeChildrenChanged, Path: parentPath(path)}},
+	}
+	return undo, events, nil
+}
+
+// lock 锁定存储，连接已关闭时返回错误
+func (backend *MemoryBackend) lock() error {
+	backend.store.lock.Lock()
+	if backend.closed {
+		backend.store.lock.Unlock()
+		return ErrClosing
+	}
+	return nil
+}
+
+func (backend *MemoryBackend) unlock() {
+	backend.store.lock.Unlock()
+}
+
+// Get 获取节点的值
+func (backend *MemoryBackend) Get(path string) ([]byte, *Stat, error) {
+	data, stat, _, err := backend.get(path, false)
+	return data, stat, err
+}
+
+// GetW 获取节点的值并监控节点的修改和删除
+func (backend *MemoryBackend) GetW(path string) ([]byte, *Stat, <-chan Event, error) {
+	return backend.get(path, true)
+}
+
+func (backend *MemoryBackend) get(path string, watch bool) ([]byte, *Stat, <-chan Event, error) {
+	if err := backend.lock(); err != nil {
+		return nil, nil, nil, err
+	}
+	defer backend.unlock()
+
+	if err := validatePath(path); err != nil {
+		return nil, nil, nil, err
+	}
+	node := backend.store.find(path)
+	if node == nil {
+		return nil, nil, nil, ErrNoNode
+	}
+
+	var event <-chan Event
+	if watch {
+		event = backend.store.addWatch(backend.store.dataWatches, path, backend)
+	}
+	return append([]byte(nil), node.data...), node.stat(), event, nil
+}
+
+// Exists 节点是否存在
+func (backend *MemoryBackend) Exists(path string) (bool, *Stat, error) {
+	exists, stat, _, err := backend.exists(path, false)
+	return exists, stat, err
+}
+
+// ExistsW 节点是否存在，并监控节点的创建、修改和删除
+func (backend *MemoryBackend) ExistsW(path string) (bool, *Stat, <-chan Event, error) {
+	return backend.exists(path, true)
+}
+
+func (backend *MemoryBackend) exists(path string, watch bool) (bool, *Stat, <-chan Event, error) {
+	if err := backend.lock(); err != nil {
+		return false, nil, nil, err
+	}
+	defer backend.unlock()
+
+	if err := validatePath(path); err != nil {
+		return false, nil, nil, err
+	}
+
+	var event <-chan Event
+	if watch {
+		event = backend.store.addWatch(backend.store.dataWatches, path, backend)
+	}
+
+	node := backend.store.find(path)
+	if node == nil {
+		return false, nil, event, nil
+	}
+	return true, node.stat(), event, nil
+}
+
+// Children 列出子节点名
+func (backend *MemoryBackend) Children(path string) ([]string, *Stat, error) {
+	children, stat, _, err := backend.children(path, false)
+	return children, stat, err
+}
+
+// ChildrenW 列出子节点名并监控子节点的增减
+func (backend *MemoryBackend) ChildrenW(path string) ([]string, *Stat, <-chan Event, error) {
+	return backend.children(path, true)
+}
+
+func (backend *MemoryBackend) children(path string, watch bool) ([]string, *Stat, <-chan Event, error) {
+	if err := backend.lock(); err != nil {
+		return nil, nil, nil, err
+	}
+	defer backend.unlock()
+
+	if err := validatePath(path); err != nil {
+		return nil, nil, nil, err
+	}
+	node := backend.store.find(path)
+	if node == nil {
+		return nil, nil, nil, ErrNoNode
+	}
+
+	children := make([]string, 0, len(node.children))
+	for name := range node.children {
+		children = append(children, name)
+	}
+	sort.Strings(children)
+
+	var event <-chan Event
+	if watch {
+		event = backend.store.addWatch(backend.store.childWatches, path, backend)
+	}
+	return children, node.stat(), event, nil
+}
+
+// Create 创建节点
+func (backend *MemoryBackend) Create(path string, data []byte, flags int32) (string, error) {
+	if err := backend.lock(); err != nil {
+		return "", err
+	}
+	defer backend.unlock()
+
+	path, _, events, err := backend.store.create(backend, path, data, flags)
+	if err != nil {
+		return "", err
+	}
+	backend.store.fire(events)
+	return path, nil
+}
+
+// Set 修改节点的值
+func (backend *MemoryBackend) Set(path string, data []byte, version int32) (*Stat, error) {
+	if err := backend.lock(); err != nil {
+		return nil, err
+	}
+	defer backend.unlock()
+
+	stat, _, events, err := backend.store.set(path, data, version)
+	if err != nil {
+		return nil, err
+	}
+	backend.store.fire(events)
+	return stat, nil
+}
+
+// Delete 删除节点
+func (backend *MemoryBackend) Delete(path string, version int32) error {
+	if err := backend.lock(); err != nil {
+		return err
+	}
+	defer backend.unlock()
+
+	_, events, err := backend.store.delete(path, version)
+	if err != nil {
+		return err
+	}
+	backend.store.fire(events)
+	return nil
+}
+
+// Multi 原子地执行多个操作，任一操作失败时撤销已执行的操作
+func (backend *MemoryBackend) Multi(ops ...interface{}) (err error) {
+	if err := backend.lock(); err != nil {
+		return err
+	}
+	defer backend.unlock()
+
+	var undos []func()
+	var events []pendingEvent
+
+	for _, op := range ops {
+		var undo func()
+		var opEvents []pendingEvent
+
+		switch op := op.(type) {
+		case *CreateRequest:
+			_, undo, opEvents, err = backend.store.create(backend, op.Path, op.Data, op.Flags)
+		case *SetDataRequest:
+			_, undo, opEvents, err = backend.store.set(op.Path, op.Data, op.Version)
+		case *DeleteRequest:
+			undo, opEvents, err = backend.store.delete(op.Path, op.Version)
+		case *CheckVersionRequest:
+			var node *memoryNode
+			if validatePath(op.Path) == nil {
+				node = backend.store.find(op.Path)
+			}
+			if node == nil {
+				err = ErrNoNode
+			} else if op.Version != -1 && node.version != op.Version {
+				err = ErrBadVersion
+			}
+		default:
+			err = errors.New("coordination: unknown operation type")
+		}
+
+		if err != nil {
+			for i := len(undos) - 1; i >= 0; i-- {
+				undos[i]()
+			}
+			return err
+		}
+		if undo != nil {
+			undos = append(undos, undo)
+		}
+		events = append(events, opEvents...)
+	}
+
+	backend.store.fire(events)
+	return nil
+}
+
+// SessionEvents 会话状态事件，内存存储只会产生由 Expire 模拟的 SessionExpired
+func (backend *MemoryBackend) SessionEvents() <-chan SessionEvent {
+	return backend.sessionEvents
+}
+
+// Expire 模拟会话过期：删除该连接创建的临时节点，该连接的监控收到 Err 为 ErrSessionExpired 的 EventNotWatching，
+// 然后发出 SessionExpired 事件。连接可以继续使用（相当于已建立新的会话）。
+func (backend *MemoryBackend) Expire() {
+	if err := backend.lock(); err != nil {
+		return
+	}
+	defer backend.unlock()
+
+	backend.dropSession(ErrSessionExpired)
+	backend.sessionEvents.send(SessionExpired)
+}
+
+// Close 关闭连接，删除该连接创建的临时节点，该连接的监控收到 EventNotWatching
+func (backend *MemoryBackend) Close() {
+	if err := backend.lock(); err != nil {
+		return
+	}
+	defer backend.unlock()
+
+	backend.closed = true
+	backend.dropSession(ErrClosing)
+	close(backend.sessionEvents)
+}
+
+// dropSession 删除该连接创建的临时节点并使该连接的监控失效，在持有锁时调用
+func (backend *MemoryBackend) dropSession(reason error) {
+	store := backend.store
+
+	// 删除临时节点
+	var ephemerals []string
+	var walk func(path string, node *memoryNode)
+	walk = func(path string, node *memoryNode) {
+		for name, child := range node.children {
+			if child.owner == backend {
+				ephemerals = append(ephemerals, childPath(path, name))
+			} else {
+				walk(childPath(path, name), child)
+			}
+		}
+	}
+	walk("/", store.root)
+	for _, path := range ephemerals {
+		_, events, err := store.delete(path, -1)
+		if err == nil {
+			store.fire(events)
+		}
+	}
+
+	// 使该连接的监控失效
+	for _, watches := range []map[string][]memoryWatch{store.dataWatches, store.childWatches} {
+		for path, pathWatches := range watches {
+			remaining := pathWatches[:0]
+			for _, watch := range pathWatches {
+				if watch.owner == backend {
+					watch.event <- Event{Type: EventNotWatching, Path: path, Err: reason}
+					close(watch.event)
+				} else {
+					remaining = append(remaining, watch)
+				}
+			}
+			if len(remaining) > 0 {
+				watches[path] = remaining
+			} else {
+				delete(watches, path)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package coordination
+
+import (
+	"testing"
+	"time"
+)
+
+// TestMemoryBackend 内存后端的契约测试
+func TestMemoryBackend(t *testing.T) {
+	store := NewMemoryStore()
+	testBackend(t, func(t *testing.T) Backend {
+		return store.Connect()
+	})
+}
+
+func TestMemoryExpire(t *testing.T) {
+	store := NewMemoryStore()
+	conn := store.Connect()
+	other := store.Connect()
+	defer other.Close()
+
+	conn.Create("/switcher", nil, 0)
+	conn.Create("/switcher/1", nil, FlagEphemeral)
+	_, _, event, _ := conn.GetW("/switcher")
+	_, _, otherEvent, _ := other.ExistsW("/switcher/1")
+
+	conn.Expire()
+
+	// 临时节点被删除，该连接的监控失效，其他连接的监控不受影响
+	if e := receiveEvent(t, event); e.Type != EventNotWatching || e.Err != ErrSessionExpired {
+		t.Errorf("wrong event: %+v", e)
+	}
+	if e := receiveEvent(t, otherEvent); e.Type != EventNodeDeleted {
+		t.Errorf("wrong event of other connection: %+v", e)
+	}
+	select {
+	case e := <-conn.SessionEvents():
+		if e != SessionExpired {
+			t.Errorf("wrong session event: %s", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting for session event timeout")
+	}
+
+	// 连接可以继续使用
+	if _, err := conn.Create("/switcher/1", nil, FlagEphemeral); err != nil {
+		t.Errorf("create after expire: %v", err)
+	}
+
+	conn.Close()
+	if _, ok := <-conn.SessionEvents(); ok {
+		t.Error("session events should be closed")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	if _, err := Connect("unknown", nil, time.Second); err == nil {
+		t.Error("connect to unknown backend should fail")
+	}
+
+	conn1, err := Connect(BackendMemory, nil, time.Second)
+	if err != nil {
+		t.Fatalf("connect memory backend: %v", err)
+	}
+	defer conn1.Close()
+	conn2, _ := Connect(BackendMemory, nil, time.Second)
+	defer conn2.Close()
+
+	// 同一进程中的内存后端连接共享数据
+	conn1.Create("/shared", []byte("x"), 0)
+	if data, _, err := conn2.Get("/shared"); err != nil || string(data) != "x" {
+		t.Errorf("get shared node: %s, %v", data, err)
+	}
+}
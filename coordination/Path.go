@@ -0,0 +1,42 @@
+package coordination
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validatePath 检查节点路径：以“/”开头，不以“/”结尾（根节点除外），不含空的路径段
+func validatePath(path string) error {
+	if len(path) < 1 || path[0] != '/' {
+		return ErrInvalidPath
+	}
+	if path == "/" {
+		return nil
+	}
+	if path[len(path)-1] == '/' || strings.Contains(path, "//") {
+		return ErrInvalidPath
+	}
+	return nil
+}
+
+// parentPath 父节点路径
+func parentPath(path string) string {
+	index := strings.LastIndex(path, "/")
+	if index <= 0 {
+		return "/"
+	}
+	return path[:index]
+}
+
+// childPath 子节点路径
+func childPath(parent string, name string) string {
+	if parent == "/" {
+		return "/" + name
+	}
+	return parent + "/" + name
+}
+
+// sequencePath 顺序节点的路径，与 Zookeeper 相同，附加10位序号
+func sequencePath(path string, sequence int64) string {
+	return fmt.Sprintf("%s%010d", path, sequence)
+}
@@ -0,0 +1,202 @@
+package coordination
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+func init() {
+	Register(BackendZookeeper, ConnectZookeeper)
+}
+
+// Zookeeper会话超时时间
+const zookeeperSessionTimeout = 5 * time.Second
+
+// zookeeperBackend 基于 Zookeeper 的实现
+type zookeeperBackend struct {
+	conn          *zk.Conn
+	sessionEvents sessionEvents
+}
+
+// ConnectZookeeper 连接到Zookeeper集群，等待连接成功或超时
+func ConnectZookeeper(brokers []string, timeout time.Duration) (Backend, error) {
+	conn, event, err := zk.Connect(brokers, zookeeperSessionTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	zkConnected := make(chan bool, 1)
+	sessionEvents := newSessionEvents()
+
+	go func() {
+		defer close(sessionEvents)
+
+		glog.Info("Zookeeper: waiting for connecting to ", brokers, "...")
+		connected := false
+		disconnected := false
+		expired := false
+		for e := range event {
+			glog.Info("Zookeeper: ", e)
+
+			switch e.State {
+			case zk.StateConnected:
+				if !connected {
+					connected = true
+					zkConnected <- true
+				}
+			case zk.StateDisconnected:
+				if connected && !disconnected {
+					disconnected = true
+					sessionEvents.send(SessionDisconnected)
+				}
+			case zk.StateExpired:
+				// go-zookeeper 将以新的会话重连，旧会话的监控已收到 ErrSessionExpired
+				expired = true
+			case zk.StateHasSession:
+				if expired {
+					sessionEvents.send(SessionExpired)
+				} else if disconnected {
+					sessionEvents.send(SessionReconnected)
+				}
+				disconnected = false
+				expired = false
+			}
+		}
+	}()
+
+	select {
+	case <-zkConnected:
+		return &zookeeperBackend{conn, sessionEvents}, nil
+	case <-time.After(timeout):
+		conn.Close()
+		return nil, errors.New("Zookeeper: connecting timeout")
+	}
+}
+
+// zookeeperError 将 Zookeeper 的错误转换为本包的错误
+func zookeeperError(err error) error {
+	switch err {
+	case zk.ErrNoNode:
+		return ErrNoNode
+	case zk.ErrNodeExists:
+		return ErrNodeExists
+	case zk.ErrBadVersion:
+		return ErrBadVersion
+	case zk.ErrNotEmpty:
+		return ErrNotEmpty
+	case zk.ErrInvalidPath:
+		return ErrInvalidPath
+	case zk.ErrClosing:
+		return ErrClosing
+	case zk.ErrSessionExpired:
+		return ErrSessionExpired
+	default:
+		return err
+	}
+}
+
+func zookeeperStat(stat *zk.Stat) *Stat {
+	if stat == nil {
+		return nil
+	}
+	return &Stat{Version: stat.Version, NumChildren: stat.NumChildren}
+}
+
+// zookeeperWatch 转发 Zookeeper 的监控事件
+func zookeeperWatch(zkEvent <-chan zk.Event) <-chan Event {
+	event := make(chan Event, 1)
+	go func() {
+		defer close(event)
+		e, ok := <-zkEvent
+		if !ok {
+			return
+		}
+		event <- Event{Type: EventType(e.Type), Path: e.Path, Err: zookeeperError(e.Err)}
+	}()
+	return event
+}
+
+func (backend *zookeeperBackend) Get(path string) ([]byte, *Stat, error) {
+	data, stat, err := backend.conn.Get(path)
+	return data, zookeeperStat(stat), zookeeperError(err)
+}
+
+func (backend *zookeeperBackend) GetW(path string) ([]byte, *Stat, <-chan Event, error) {
+	data, stat, zkEvent, err := backend.conn.GetW(path)
+	if err != nil {
+		return nil, nil, nil, zookeeperError(err)
+	}
+	return data, zookeeperStat(stat), zookeeperWatch(zkEvent), nil
+}
+
+func (backend *zookeeperBackend) Exists(path string) (bool, *Stat, error) {
+	exists, stat, err := backend.conn.Exists(path)
+	return exists, zookeeperStat(stat), zookeeperError(err)
+}
+
+func (backend *zookeeperBackend) ExistsW(path string) (bool, *Stat, <-chan Event, error) {
+	exists, stat, zkEvent, err := backend.conn.ExistsW(path)
+	if err != nil {
+		return false, nil, nil, zookeeperError(err)
+	}
+	return exists, zookeeperStat(stat), zookeeperWatch(zkEvent), nil
+}
+
+func (backend *zookeeperBackend) Children(path string) ([]string, *Stat, error) {
+	children, stat, err := backend.conn.Children(path)
+	return children, zookeeperStat(stat), zookeeperError(err)
+}
+
+func (backend *zookeeperBackend) ChildrenW(path string) ([]string, *Stat, <-chan Event, error) {
+	children, stat, zkEvent, err := backend.conn.ChildrenW(path)
+	if err != nil {
+		return nil, nil, nil, zookeeperError(err)
+	}
+	return children, zookeeperStat(stat), zookeeperWatch(zkEvent), nil
+}
+
+func (backend *zookeeperBackend) Create(path string, data []byte, flags int32) (string, error) {
+	path, err := backend.conn.Create(path, data, flags, zk.WorldACL(zk.PermAll))
+	return path, zookeeperError(err)
+}
+
+func (backend *zookeeperBackend) Set(path string, data []byte, version int32) (*Stat, error) {
+	stat, err := backend.conn.Set(path, data, version)
+	return zookeeperStat(stat), zookeeperError(err)
+}
+
+func (backend *zookeeperBackend) Delete(path string, version int32) error {
+	return zookeeperError(backend.conn.Delete(path, version))
+}
+
+func (backend *zookeeperBackend) Multi(ops ...interface{}) error {
+	zkOps := make([]interface{}, 0, len(ops))
+	for _, op := range ops {
+		switch op := op.(type) {
+		case *CreateRequest:
+			zkOps = append(zkOps, &zk.CreateRequest{Path: op.Path, Data: op.Data, Acl: zk.WorldACL(zk.PermAll), Flags: op.Flags})
+		case *SetDataRequest:
+			zkOps = append(zkOps, &zk.SetDataRequest{Path: op.Path, Data: op.Data, Version: op.Version})
+		case *DeleteRequest:
+			zkOps = append(zkOps, &zk.DeleteRequest{Path: op.Path, Version: op.Version})
+		case *CheckVersionRequest:
+			zkOps = append(zkOps, &zk.CheckVersionRequest{Path: op.Path, Version: op.Version})
+		default:
+			return errors.New("coordination: unknown operation type")
+		}
+	}
+
+	_, err := backend.conn.Multi(zkOps...)
+	return zookeeperError(err)
+}
+
+func (backend *zookeeperBackend) SessionEvents() <-chan SessionEvent {
+	return backend.sessionEvents
+}
+
+func (backend *zookeeperBackend) Close() {
+	backend.conn.Close()
+}
@@ -0,0 +1,8 @@
+module github.com/btccom/btcpool-go-modules/coordination
+
+go 1.12
+
+require (
+	github.com/golang/glog v1.0.0
+	github.com/samuel/go-zookeeper v0.0.0-20180130194729-c4fab1ac1bec
+)
@@ -2,4 +2,6 @@ module github.com/btccom/btcpool-go-modules/initNiceHash
 
 go 1.12
 
-require github.com/samuel/go-zookeeper v0.0.0-20180130194729-c4fab1ac1bec
+require github.com/btccom/btcpool-go-modules/coordination v0.0.0
+
+replace github.com/btccom/btcpool-go-modules/coordination => ../coordination
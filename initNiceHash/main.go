@@ -10,7 +10,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/samuel/go-zookeeper/zk"
+	"github.com/btccom/btcpool-go-modules/coordination"
 )
 
 type Algorithm struct {
@@ -55,7 +55,7 @@ func populateNiceHashNodes(zookeeper string, path string, config Configuration)
 		log.Print("ZooKeeper servers are not specificed, exit now")
 		return
 	}
-	c, _, err := zk.Connect(servers, time.Second*5)
+	c, err := coordination.Connect(coordination.BackendZookeeper, servers, time.Second*5)
 	if err != nil {
 		log.Fatalf("Failed to connect to ZooKeeper: %v", err)
 	}
@@ -72,9 +72,9 @@ func populateNiceHashNodes(zookeeper string, path string, config Configuration)
 			}
 
 			if !exists {
-				_, err = c.Create(prefix, []byte{}, 0, zk.WorldACL(zk.PermAll))
+				_, err = c.Create(prefix, []byte{}, 0)
 
-				if err != nil {
+				if err != nil && err != coordination.ErrNodeExists {
 					log.Fatalf("Failed to create Zookeeper node %s: %v", prefix, err)
 				}
 			}
@@ -101,8 +101,8 @@ func populateNiceHashNodes(zookeeper string, path string, config Configuration)
 			log.Fatalf("Failed to check ZooKeeper node %s: %v", nodeAlgo, err)
 		}
 		if !exists {
-			_, err := c.Create(nodeAlgo, []byte{}, 0, zk.WorldACL(zk.PermAll))
-			if err != nil {
+			_, err := c.Create(nodeAlgo, []byte{}, 0)
+			if err != nil && err != coordination.ErrNodeExists {
 				log.Fatalf("Failed to create ZooKeeper node %s: %v", nodeAlgo, err)
 			}
 		}
@@ -116,7 +116,7 @@ func populateNiceHashNodes(zookeeper string, path string, config Configuration)
 				log.Fatalf("Failed to write ZooKeeper node %s: %v", nodeMinDiff, err)
 			}
 		} else {
-			_, err := c.Create(nodeMinDiff, data, 0, zk.WorldACL(zk.PermAll))
+			_, err := c.Create(nodeMinDiff, data, 0)
 			if err != nil {
 				log.Fatalf("Failed to create ZooKeeper node %s: %v", nodeMinDiff, err)
 			}
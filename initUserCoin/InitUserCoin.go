@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/samuel/go-zookeeper/zk"
 )
 
 // UserIDMapResponse 用户id列表接口响应的数据结构
@@ -156,7 +155,7 @@ func setMiningCoin(puname string, coin string) (apiErr *APIError) {
 			glog.Error("zk.Exists(", zkIndexPath, ",", puname, ") Failed: ", err)
 		}
 		if !exists {
-			_, err = zookeeperConn.Create(zkIndexPath, []byte(puname), 0, zk.WorldACL(zk.PermAll))
+			_, err = zookeeperConn.Create(zkIndexPath, []byte(puname), 0)
 			if err != nil {
 				glog.Error("zk.Create(", zkIndexPath, ",", puname, ") Failed: ", err)
 			}
@@ -183,7 +182,7 @@ func setMiningCoin(puname string, coin string) (apiErr *APIError) {
 	}
 
 	// 不存在，创建
-	_, err = zookeeperConn.Create(zkPath, []byte(coin), 0, zk.WorldACL(zk.PermAll))
+	_, err = zookeeperConn.Create(zkPath, []byte(coin), 0)
 
 	if err != nil {
 		glog.Error("zk.Create(", zkPath, ",", coin, ") Failed: ", err)
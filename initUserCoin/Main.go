@@ -7,12 +7,12 @@ import (
 	"sync"
 	"time"
 
+	"github.com/btccom/btcpool-go-modules/coordination"
 	"github.com/golang/glog"
-	"github.com/samuel/go-zookeeper/zk"
 )
 
-// Zookeeper连接超时时间
-const zookeeperConnTimeout = 5
+// 协调服务连接超时时间（秒）
+const zookeeperConnectingTimeout = 60
 
 // AutoRegAPIConfig 用户自动注册API定义
 type AutoRegAPIConfig struct {
@@ -31,7 +31,9 @@ type ConfigData struct {
 	// IntervalSeconds 每次拉取的间隔时间
 	IntervalSeconds uint
 
-	// Zookeeper集群的IP:端口列表
+	// 协调服务后端：zookeeper（默认）、etcd、memory
+	CoordinationBackend string
+	// Zookeeper（或所选协调服务）集群的IP:端口列表
 	ZKBroker []string
 	// ZKSwitcherWatchDir Switcher监控的Zookeeper路径，以斜杠结尾
 	ZKSwitcherWatchDir string
@@ -49,8 +51,8 @@ type ConfigData struct {
 	ZKUserCaseInsensitiveIndex string
 }
 
-// zookeeperConn Zookeeper连接对象
-var zookeeperConn *zk.Conn
+// zookeeperConn 协调服务（Zookeeper、etcd等）连接对象
+var zookeeperConn coordination.Backend
 
 // 配置数据
 var configData *ConfigData
@@ -92,8 +94,8 @@ func main() {
 		configData.ZKUserCaseInsensitiveIndex += "/"
 	}
 
-	// 建立到Zookeeper集群的连接
-	conn, _, err := zk.Connect(configData.ZKBroker, time.Duration(zookeeperConnTimeout)*time.Second)
+	// 建立到Zookeeper（或所选协调服务）集群的连接
+	conn, err := coordination.Connect(configData.CoordinationBackend, configData.ZKBroker, zookeeperConnectingTimeout*time.Second)
 
 	if err != nil {
 		glog.Fatal("Connect Zookeeper Failed: ", err)
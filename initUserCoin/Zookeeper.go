@@ -4,7 +4,6 @@ import (
 	"strings"
 
 	"github.com/golang/glog"
-	"github.com/samuel/go-zookeeper/zk"
 )
 
 // 递归创建Zookeeper Node
@@ -30,7 +29,7 @@ func createZookeeperPath(path string) error {
 		}
 
 		// 不存在，创建
-		_, err = zookeeperConn.Create(currPath, []byte{}, 0, zk.WorldACL(zk.PermAll))
+		_, err = zookeeperConn.Create(currPath, []byte{}, 0)
 
 		if err != nil {
 			return err
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// AdminAPIResponse 管理API响应数据结构
+type AdminAPIResponse struct {
+	ErrNo   int         `json:"err_no"`
+	ErrMsg  string      `json:"err_msg"`
+	Success bool        `json:"success"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// StratumSessionInfo 会话信息（用于管理API展示）
+type StratumSessionInfo struct {
+	SessionID        string `json:"session_id"`
+	ClientIP         string `json:"client_ip"`
+	FullWorkerName   string `json:"full_worker_name"`
+	SubaccountName   string `json:"subaccount"`
+	MiningCoin       string `json:"mining_coin"`
+	ServerURL        string `json:"server_url"`
+	ProtocolType     string `json:"protocol_type"`
+	IsBTCAgent       bool   `json:"is_btcagent"`
+	BTCAgentWorkers  int    `json:"btcagent_workers,omitempty"`
+	IsNiceHashClient bool   `json:"is_nicehash_client"`
+	VersionMask      string `json:"version_mask"`
+	ReconnectCounter uint32 `json:"reconnect_counter"`
+	ConnectedSince   int64  `json:"connected_since"`
+	CoinOverridden   bool   `json:"coin_overridden"`
+}
+
+var (
+	// AdminErrSessionIDInvalid 会话ID不合法
+	AdminErrSessionIDInvalid = NewStratumError(401, "session_id invalid")
+	// AdminErrSessionNotFound 会话不存在
+	AdminErrSessionNotFound = NewStratumError(402, "session not found")
+	// AdminErrCoinIsEmpty 币种为空
+	AdminErrCoinIsEmpty = NewStratumError(403, "coin is empty")
+	// AdminErrCoinIsInexistent 币种对应的Stratum服务器不存在
+	AdminErrCoinIsInexistent = NewStratumError(404, "coin is inexistent")
+	// AdminErrSwitchFailed 切换失败
+	AdminErrSwitchFailed = NewStratumError(405, "switch failed")
+	// AdminErrMethodNotAllowed 请求方式不允许
+	AdminErrMethodNotAllowed = NewStratumError(406, "method not allowed, use POST")
+	// AdminErrIPInvalid IP不合法
+	AdminErrIPInvalid = NewStratumError(407, "ip invalid")
+	// AdminErrIPNotBanned IP未被封禁
+	AdminErrIPNotBanned = NewStratumError(408, "ip not banned")
+	// AdminErrSecondsInvalid 封禁时长不合法
+	AdminErrSecondsInvalid = NewStratumError(409, "seconds invalid")
+	// AdminErrAlreadyDraining 已经在排空
+	AdminErrAlreadyDraining = NewStratumError(410, "already draining")
+)
+
+// BannedIPInfo 被封禁的IP（用于管理API展示）
+type BannedIPInfo struct {
+	IP          string `json:"ip"`
+	BannedUntil int64  `json:"banned_until"`
+}
+
+// GetSessionInfo 获取会话信息
+func (session *StratumSession) GetSessionInfo() (info StratumSessionInfo) {
+	info.SessionID = Uint32ToHex(session.sessionID)
+	info.ClientIP = SplitClientIP(session.clientIPPort)
+	info.SubaccountName = session.subaccountName
+	info.ProtocolType = session.protocolType.ToString()
+	info.IsBTCAgent = session.isBTCAgent
+	info.IsNiceHashClient = session.isNiceHashClient
+	info.VersionMask = session.getVersionMaskStr()
+	info.ConnectedSince = session.connectTime.Unix()
+
+	// 币种、服务器地址等在切换币种时被修改，需要加锁读取
+	session.lock.Lock()
+	info.FullWorkerName = session.fullWorkerName
+	info.MiningCoin = session.miningCoin
+	info.ServerURL = session.serverURL
+	info.ReconnectCounter = session.reconnectCounter
+	info.CoinOverridden = session.coinOverridden
+	if session.btcAgent != nil {
+		info.BTCAgentWorkers = len(session.btcAgent.workers)
+	}
+	session.lock.Unlock()
+	return
+}
+
+// GetSessionInfos 获取所有正在代理的会话的信息，参数为空表示不过滤
+func (manager *StratumSessionManager) GetSessionInfos(subaccountName string, miningCoin string) (infos []StratumSessionInfo) {
+	// 会话重连时会在持有会话锁的情况下获取 manager.lock，
+	// 因此先复制会话列表，释放 manager.lock 之后再读取各会话的信息
+	manager.lock.Lock()
+	sessions := make([]*StratumSession, 0, len(manager.sessions))
+	for _, session := range manager.sessions {
+		sessions = append(sessions, session)
+	}
+	manager.lock.Unlock()
+
+	infos = make([]StratumSessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		info := session.GetSessionInfo()
+		if len(subaccountName) > 0 && info.SubaccountName != subaccountName {
+			continue
+		}
+		if len(miningCoin) > 0 && info.MiningCoin != miningCoin {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].SessionID < infos[j].SessionID
+	})
+	return
+}
+
+// findSession 根据会话ID查找正在代理的会话
+func (manager *StratumSessionManager) findSession(sessionID uint32) (session *StratumSession, ok bool) {
+	manager.lock.Lock()
+	session, ok = manager.sessions[sessionID]
+	manager.lock.Unlock()
+	return
+}
+
+// KickSession 断开指定的会话
+func (manager *StratumSessionManager) KickSession(sessionID uint32) *StratumError {
+	session, ok := manager.findSession(sessionID)
+	if !ok {
+		return AdminErrSessionNotFound
+	}
+
+	glog.Info("Kick Session: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.getMiningCoin())
+	session.Stop(StopReasonAdminKick)
+	return nil
+}
+
+// ForceSwitchSession 不经过Zookeeper，强制将指定会话切换到另一个币种。
+// 会话将一直挖该币种，直到Zookeeper中记录的币种发生改变。
+func (manager *StratumSessionManager) ForceSwitchSession(sessionID uint32, newMiningCoin string) *StratumError {
+	if len(newMiningCoin) < 1 {
+		return AdminErrCoinIsEmpty
+	}
+	if _, exists := manager.getStratumServerInfo(newMiningCoin); !exists {
+		return AdminErrCoinIsInexistent
+	}
+
+	session, ok := manager.findSession(sessionID)
+	if !ok {
+		return AdminErrSessionNotFound
+	}
+
+	oldMiningCoin := session.getMiningCoin()
+	if oldMiningCoin == newMiningCoin {
+		return nil
+	}
+
+	// 在切换之前标记覆盖，使切换期间到达的Zookeeper事件不会把币种切换回去
+	currentReconnectCounter, overridden := session.setCoinOverride()
+
+	glog.Info("Force Switch Session: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", oldMiningCoin, " -> ", newMiningCoin)
+	// 会话已停止、已被其他线程切换或重连失败时，均视为切换失败
+	if !session.switchCoinType(newMiningCoin, currentReconnectCounter) {
+		// 切换失败，撤销本次标记的覆盖
+		if !overridden {
+			session.clearCoinOverride()
+		}
+		return AdminErrSwitchFailed
+	}
+	return nil
+}
+
+// RunAdminAPI 启动管理API
+func (manager *StratumSessionManager) RunAdminAPI(listenAddr string, apiUser string, apiPassword string) {
+	mux := http.NewServeMux()
+	auth := func(f http.HandlerFunc) http.HandlerFunc {
+		return adminBasicAuth(apiUser, apiPassword, f)
+	}
+
+	mux.HandleFunc("/sessions", auth(manager.adminSessionsHandle))
+	mux.HandleFunc("/sessions/kick", auth(manager.adminKickHandle))
+	mux.HandleFunc("/sessions/switch", auth(manager.adminSwitchHandle))
+	mux.HandleFunc("/bans", auth(manager.adminBansHandle))
+	mux.HandleFunc("/bans/add", auth(manager.adminBanHandle))
+	mux.HandleFunc("/bans/remove", auth(manager.adminUnbanHandle))
+	mux.HandleFunc("/drain", auth(manager.adminDrainHandle))
+	mux.HandleFunc("/drain/status", auth(manager.adminDrainStatusHandle))
+
+	glog.Info("Admin API enabled: ", listenAddr)
+	err := http.ListenAndServe(listenAddr, mux)
+	if err != nil {
+		glog.Fatal("Admin API Listen Failed: ", err)
+	}
+}
+
+// adminBasicAuth 执行Basic认证
+func adminBasicAuth(apiUser string, apiPassword string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, passwd, ok := r.BasicAuth()
+
+		// 检查用户名密码是否正确
+		if ok && subtle.ConstantTimeCompare([]byte(apiUser), []byte(user)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(apiPassword), []byte(passwd)) == 1 {
+			f(w, r)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`<h1>401 - Unauthorized</h1>`))
+	}
+}
+
+// adminSessionsHandle 列出正在代理的会话
+func (manager *StratumSessionManager) adminSessionsHandle(w http.ResponseWriter, req *http.Request) {
+	subaccountName := req.FormValue("subaccount")
+	miningCoin := req.FormValue("coin")
+
+	writeAdminSuccess(w, manager.GetSessionInfos(subaccountName, miningCoin))
+}
+
+// adminKickHandle 断开会话
+func (manager *StratumSessionManager) adminKickHandle(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeAdminError(w, AdminErrMethodNotAllowed)
+		return
+	}
+
+	sessionID, err := parseAdminSessionID(req.FormValue("session_id"))
+	if err != nil {
+		writeAdminError(w, AdminErrSessionIDInvalid)
+		return
+	}
+
+	stratumErr := manager.KickSession(sessionID)
+	if stratumErr != nil {
+		writeAdminError(w, stratumErr)
+		return
+	}
+	writeAdminSuccess(w, nil)
+}
+
+// adminSwitchHandle 强制切换会话的币种
+func (manager *StratumSessionManager) adminSwitchHandle(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeAdminError(w, AdminErrMethodNotAllowed)
+		return
+	}
+
+	sessionID, err := parseAdminSessionID(req.FormValue("session_id"))
+	if err != nil {
+		writeAdminError(w, AdminErrSessionIDInvalid)
+		return
+	}
+
+	stratumErr := manager.ForceSwitchSession(sessionID, req.FormValue("coin"))
+	if stratumErr != nil {
+		writeAdminError(w, stratumErr)
+		return
+	}
+
+	session, ok := manager.findSession(sessionID)
+	if !ok {
+		writeAdminError(w, AdminErrSessionNotFound)
+		return
+	}
+	writeAdminSuccess(w, session.GetSessionInfo())
+}
+
+// adminBansHandle 列出被封禁的IP
+func (manager *StratumSessionManager) adminBansHandle(w http.ResponseWriter, req *http.Request) {
+	bans := manager.connLimiter.GetBans()
+
+	infos := make([]BannedIPInfo, 0, len(bans))
+	for ip, until := range bans {
+		infos = append(infos, BannedIPInfo{ip, until.Unix()})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].IP < infos[j].IP
+	})
+	writeAdminSuccess(w, infos)
+}
+
+// adminBanHandle 封禁IP
+func (manager *StratumSessionManager) adminBanHandle(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeAdminError(w, AdminErrMethodNotAllowed)
+		return
+	}
+
+	ip := net.ParseIP(req.FormValue("ip"))
+	if ip == nil {
+		writeAdminError(w, AdminErrIPInvalid)
+		return
+	}
+
+	seconds := defaultBanSeconds
+	if secondsStr := req.FormValue("seconds"); len(secondsStr) > 0 {
+		var err error
+		seconds, err = strconv.Atoi(secondsStr)
+		if err != nil || seconds <= 0 {
+			writeAdminError(w, AdminErrSecondsInvalid)
+			return
+		}
+	}
+
+	manager.connLimiter.Ban(ip.String(), time.Duration(seconds)*time.Second)
+	writeAdminSuccess(w, nil)
+}
+
+// adminUnbanHandle 解除IP的封禁
+func (manager *StratumSessionManager) adminUnbanHandle(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeAdminError(w, AdminErrMethodNotAllowed)
+		return
+	}
+
+	ip := net.ParseIP(req.FormValue("ip"))
+	if ip == nil {
+		writeAdminError(w, AdminErrIPInvalid)
+		return
+	}
+
+	if !manager.connLimiter.Unban(ip.String()) {
+		writeAdminError(w, AdminErrIPNotBanned)
+		return
+	}
+	writeAdminSuccess(w, nil)
+}
+
+// adminDrainHandle 开始排空
+func (manager *StratumSessionManager) adminDrainHandle(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeAdminError(w, AdminErrMethodNotAllowed)
+		return
+	}
+
+	seconds := 0
+	if secondsStr := req.FormValue("seconds"); len(secondsStr) > 0 {
+		var err error
+		seconds, err = strconv.Atoi(secondsStr)
+		if err != nil || seconds <= 0 {
+			writeAdminError(w, AdminErrSecondsInvalid)
+			return
+		}
+	}
+
+	glog.Info("Drain requested by Admin API: ", req.RemoteAddr)
+	err := manager.Drain(time.Duration(seconds) * time.Second)
+	if err != nil {
+		writeAdminError(w, AdminErrAlreadyDraining)
+		return
+	}
+	writeAdminSuccess(w, manager.GetDrainStatus())
+}
+
+// adminDrainStatusHandle 获取排空状态
+func (manager *StratumSessionManager) adminDrainStatusHandle(w http.ResponseWriter, req *http.Request) {
+	writeAdminSuccess(w, manager.GetDrainStatus())
+}
+
+// parseAdminSessionID 解析十六进制的会话ID
+func parseAdminSessionID(sessionIDStr string) (sessionID uint32, err error) {
+	if len(sessionIDStr) < 1 {
+		err = errors.New("session_id is empty")
+		return
+	}
+
+	id, err := strconv.ParseUint(sessionIDStr, 16, 32)
+	sessionID = uint32(id)
+	return
+}
+
+func writeAdminSuccess(w http.ResponseWriter, data interface{}) {
+	response := AdminAPIResponse{0, "", true, data}
+	responseJSON, _ := json.Marshal(response)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+func writeAdminError(w http.ResponseWriter, err *StratumError) {
+	response := AdminAPIResponse{err.ErrNo, err.ErrMsg, false, nil}
+	responseJSON, _ := json.Marshal(response)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
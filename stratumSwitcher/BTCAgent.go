@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// BTCAgent ex-message 的消息头：magic number(1) | type(1) | length(2, 小端序，包含消息头)
+const btcAgentExMessageHeaderSize = 4
+
+// 需要跟踪的 BTCAgent ex-message 类型
+const (
+	// 注册AgentSession：header | session_id(2) | client_agent(\0结尾) | worker_name(\0结尾)
+	btcAgentCmdRegisterWorker = 0x01
+	// 注销AgentSession：header | session_id(2)
+	btcAgentCmdUnregisterWorker = 0x04
+)
+
+// BTCAgent 查询服务器能力的方法
+const btcAgentGetCapabilitiesMethod = "agent.get_capabilities"
+
+// btcAgentTracker 跟踪BTCAgent连接中的AgentSession
+//
+// 一个BTCAgent连接里包含多个AgentSession（对应多台矿机），它们是用 ex-message 注册到服务器上的。
+// 切换币种或重连服务器后，需要把这些注册消息重放给新服务器，矿机才能继续挖矿。
+// 只在持有 session.lock 时访问。
+type btcAgentTracker struct {
+	// BTCAgent发送的 agent.get_capabilities 请求（原始JSON行）
+	capabilities []byte
+	// AgentSession ID -> 原始的注册消息
+	workers map[uint16][]byte
+}
+
+func newBTCAgentTracker() *btcAgentTracker {
+	tracker := new(btcAgentTracker)
+	tracker.workers = make(map[uint16][]byte)
+	return tracker
+}
+
+// readBTCAgentMessage 从BTCAgent读取一个完整的消息（ex-message 或以换行结尾的JSON）
+func readBTCAgentMessage(reader *bufio.Reader) ([]byte, error) {
+	magicNumber, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if magicNumber[0] != btcAgentExMessageMagicNumber {
+		return reader.ReadBytes('\n')
+	}
+
+	header, err := reader.Peek(btcAgentExMessageHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	length := int(binary.LittleEndian.Uint16(header[2:4]))
+	if length < btcAgentExMessageHeaderSize {
+		return nil, ErrBTCAgentMessageInvalid
+	}
+
+	message := make([]byte, length)
+	_, err = io.ReadFull(reader, message)
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// track 记录消息，返回该消息是否会在重连后被重放（或因被重放而无需再发送）
+func (tracker *btcAgentTracker) track(message []byte) bool {
+	if len(message) < 1 {
+		return false
+	}
+
+	if message[0] != btcAgentExMessageMagicNumber {
+		if !bytes.Contains(message, []byte(btcAgentGetCapabilitiesMethod)) {
+			return false
+		}
+		request, err := NewJSONRPCRequest(message)
+		if err != nil || request.Method != btcAgentGetCapabilitiesMethod {
+			return false
+		}
+		tracker.capabilities = message
+		return true
+	}
+
+	if len(message) < btcAgentExMessageHeaderSize+2 {
+		return false
+	}
+	agentSessionID := binary.LittleEndian.Uint16(message[btcAgentExMessageHeaderSize:])
+
+	switch message[1] {
+	case btcAgentCmdRegisterWorker:
+		tracker.workers[agentSessionID] = message
+		return true
+	case btcAgentCmdUnregisterWorker:
+		delete(tracker.workers, agentSessionID)
+		return true
+	default:
+		return false
+	}
+}
+
+// messages 需要重放的消息，能力查询在前，注册消息按AgentSession ID排序
+func (tracker *btcAgentTracker) messages() (messages [][]byte) {
+	if tracker.capabilities != nil {
+		messages = append(messages, tracker.capabilities)
+	}
+
+	ids := make([]int, 0, len(tracker.workers))
+	for id := range tracker.workers {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		messages = append(messages, tracker.workers[uint16(id)])
+	}
+	return
+}
+
+// proxyBTCAgentUpstream 将BTCAgent的消息逐个转发给服务器
+// 与普通矿机的流复制不同，该协程在整个会话期间只运行一个，切换币种和重连时不会中断消息的边界。
+func (session *StratumSession) proxyBTCAgentUpstream(reader *bufio.Reader) {
+	for {
+		message, err := readBTCAgentMessage(reader)
+		if err != nil {
+			if err == ErrBTCAgentMessageInvalid {
+				glog.Warning("BTCAgent Message Invalid: ", session.clientIPPort, "; ", session.fullWorkerName)
+			}
+			// 客户端关闭了连接，结束会话
+			session.Stop(StopReasonClientClosed)
+			break
+		}
+
+		if !session.forwardBTCAgentMessage(message) {
+			break
+		}
+	}
+
+	if glog.V(3) {
+		glog.Info("BTCAgent UpStream: exited; ", session.clientIPPort, "; ", session.fullWorkerName)
+	}
+}
+
+// forwardBTCAgentMessage 跟踪并转发一个消息，服务器关闭了连接时进行重连
+// 返回 false 表示会话已不在运行
+func (session *StratumSession) forwardBTCAgentMessage(message []byte) bool {
+	// 锁定会话，切换币种或重连期间的消息将等到重放完成后再发送
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	if session.runningStat != StatRunning {
+		return false
+	}
+
+	replayed := session.btcAgent.track(message)
+	_, err := session.serverConn.Write(message)
+	if err == nil {
+		return true
+	}
+
+	// 服务器关闭了连接，尝试重连
+	// 状态设为“正在重连服务器”，重连计数器加一
+	session.setStatNonLock(StatReconnecting)
+	session.reconnectCounter++
+	session.reconnectStratumServer(retryTimeWhenServerDown)
+
+	if session.runningStat != StatRunning {
+		return false
+	}
+	// 重连成功，将该消息转发到新服务器
+	if !replayed {
+		session.serverConn.Write(message)
+	}
+	return true
+}
+
+// replayBTCAgentSessions 向新服务器重放AgentSession的注册消息（在持有 session.lock 时调用）
+func (session *StratumSession) replayBTCAgentSessions() error {
+	messages := session.btcAgent.messages()
+	for _, message := range messages {
+		_, err := session.serverConn.Write(message)
+		if err != nil {
+			return err
+		}
+	}
+
+	if glog.V(2) {
+		glog.Info("Replay BTCAgent Sessions: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin, "; ", len(session.btcAgent.workers))
+	}
+	return nil
+}
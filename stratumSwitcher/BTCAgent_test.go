@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// makeBTCAgentMessage 构造一个 ex-message
+func makeBTCAgentMessage(cmd byte, agentSessionID uint16, payload ...string) []byte {
+	body := make([]byte, 2)
+	binary.LittleEndian.PutUint16(body, agentSessionID)
+	for _, str := range payload {
+		body = append(body, str...)
+		body = append(body, 0)
+	}
+
+	message := []byte{btcAgentExMessageMagicNumber, cmd, 0, 0}
+	binary.LittleEndian.PutUint16(message[2:], uint16(btcAgentExMessageHeaderSize+len(body)))
+	return append(message, body...)
+}
+
+func TestReadBTCAgentMessage(t *testing.T) {
+	register := makeBTCAgentMessage(btcAgentCmdRegisterWorker, 1, "cgminer/4.10", "miner1")
+	share := []byte{btcAgentExMessageMagicNumber, 0x02, 6, 0, 1, 0}
+	jsonLine := []byte(`{"id":1,"method":"mining.suggest_difficulty","params":[1024]}` + "\n")
+
+	stream := bytes.Join([][]byte{register, jsonLine, share}, nil)
+	reader := bufio.NewReaderSize(bytes.NewReader(stream), 16)
+
+	for i, expected := range [][]byte{register, jsonLine, share} {
+		message, err := readBTCAgentMessage(reader)
+		if err != nil {
+			t.Fatalf("message %d: read failed: %s", i, err)
+		}
+		if !bytes.Equal(message, expected) {
+			t.Errorf("message %d: expected %q, but got %q", i, expected, message)
+		}
+	}
+	if _, err := readBTCAgentMessage(reader); err != io.EOF {
+		t.Errorf("EOF expected, but got %v", err)
+	}
+
+	reader = bufio.NewReader(bytes.NewReader([]byte{btcAgentExMessageMagicNumber, 0x02, 2, 0}))
+	if _, err := readBTCAgentMessage(reader); err != ErrBTCAgentMessageInvalid {
+		t.Errorf("ErrBTCAgentMessageInvalid expected, but got %v", err)
+	}
+}
+
+func TestBTCAgentTracker(t *testing.T) {
+	tracker := newBTCAgentTracker()
+
+	capabilities := []byte(`{"id":"agent.get_capabilities","method":"agent.get_capabilities","params":[["verrol"]]}` + "\n")
+	register2 := makeBTCAgentMessage(btcAgentCmdRegisterWorker, 2, "cgminer/4.10", "miner2")
+	register1 := makeBTCAgentMessage(btcAgentCmdRegisterWorker, 1, "cgminer/4.10", "miner1")
+	register3 := makeBTCAgentMessage(btcAgentCmdRegisterWorker, 3, "cgminer/4.10", "miner3")
+
+	for _, message := range [][]byte{capabilities, register2, register1, register3} {
+		if !tracker.track(message) {
+			t.Errorf("message should be tracked: %q", message)
+		}
+	}
+	if !tracker.track(makeBTCAgentMessage(btcAgentCmdUnregisterWorker, 3)) {
+		t.Errorf("unregister message should be tracked")
+	}
+	if tracker.track([]byte{btcAgentExMessageMagicNumber, 0x02, 6, 0, 1, 0}) {
+		t.Errorf("share should not be tracked")
+	}
+	if tracker.track([]byte(`{"id":2,"method":"mining.submit","params":["a.b","1","2","3","4"]}` + "\n")) {
+		t.Errorf("mining.submit should not be tracked")
+	}
+
+	messages := tracker.messages()
+	expected := [][]byte{capabilities, register1, register2}
+	if len(messages) != len(expected) {
+		t.Fatalf("%d messages expected, but got %d", len(expected), len(messages))
+	}
+	for i := range expected {
+		if !bytes.Equal(messages[i], expected[i]) {
+			t.Errorf("message %d: expected %q, but got %q", i, expected[i], messages[i])
+		}
+	}
+}
+
+func TestStratumSessionForwardAndReplayBTCAgent(t *testing.T) {
+	manager, clientSides := newDrainTestManager(t, 1)
+	defer manager.tcpListener.Close()
+	defer clientSides[0].Close()
+
+	var session *StratumSession
+	for _, session = range manager.sessions {
+	}
+	session.isBTCAgent = true
+	session.btcAgent = newBTCAgentTracker()
+
+	serverConn, serverSide := net.Pipe()
+	defer serverSide.Close()
+	session.serverConn = serverConn
+
+	register := makeBTCAgentMessage(btcAgentCmdRegisterWorker, 7, "cgminer/4.10", "miner7")
+	forwarded := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, len(register))
+		io.ReadFull(serverSide, buf)
+		forwarded <- buf
+	}()
+
+	if !session.forwardBTCAgentMessage(register) {
+		t.Fatalf("forwardBTCAgentMessage failed")
+	}
+	if message := <-forwarded; !bytes.Equal(message, register) {
+		t.Errorf("wrong forwarded message: %q", message)
+	}
+	if info := session.GetSessionInfo(); info.BTCAgentWorkers != 1 {
+		t.Errorf("1 worker expected, but got %d", info.BTCAgentWorkers)
+	}
+
+	// 切换到新服务器后重放
+	newServerConn, newServerSide := net.Pipe()
+	defer newServerSide.Close()
+	session.serverConn = newServerConn
+	go func() {
+		buf := make([]byte, len(register))
+		io.ReadFull(newServerSide, buf)
+		forwarded <- buf
+	}()
+
+	session.lock.Lock()
+	err := session.replayBTCAgentSessions()
+	session.lock.Unlock()
+	if err != nil {
+		t.Fatalf("replayBTCAgentSessions failed: %s", err)
+	}
+	if message := <-forwarded; !bytes.Equal(message, register) {
+		t.Errorf("wrong replayed message: %q", message)
+	}
+}
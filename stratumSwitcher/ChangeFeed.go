@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/btccom/btcpool-go-modules/coordination"
+	"github.com/golang/glog"
+)
+
+// 变更日志模式
+//
+// 默认情况下，会话用到的每个子账户节点（和矿工节点）都在Zookeeper中设置一个监控，
+// 并且监控只在节点改变后释放，子账户数量很大时会给Zookeeper和stratumSwitcher带来很大的压力。
+//
+// 配置 ZKChangeLogDir 后，switcherAPIServer 每次修改币种节点时都会向该目录追加一个顺序节点（变更记录），
+// stratumSwitcher 只监控该目录的子节点，按记录中的节点名通知本地的会话重新读取节点。
+// ZKSwitcherWatchDir 下的节点只读取、不监控，没有会话使用的节点立即被释放。
+
+// 变更记录节点名的前缀
+const changeLogEntryPrefix = "c-"
+
+// changeLogEntry 变更记录，由 switcherAPIServer 写入
+type changeLogEntry struct {
+	// 币种节点相对于 ZKSwitcherWatchDir 的名称（子账户名，或 子账户名.矿机名）
+	Name string `json:"name"`
+}
+
+// changeLogEntries 按时间顺序排列的变更记录节点名
+func changeLogEntries(children []string) []string {
+	entries := make([]string, 0, len(children))
+	for _, child := range children {
+		if strings.HasPrefix(child, changeLogEntryPrefix) {
+			entries = append(entries, child)
+		}
+	}
+	// 顺序节点的序号是定长的，按名称排序即按时间排序
+	sort.Strings(entries)
+	return entries
+}
+
+// StartChangeFeed 开启变更日志模式，watchDir 下的节点改为由 changeLogDir 中的变更记录通知
+// 从当前最新的记录之后开始读取，需要在会话开始前调用。
+func (manager *ZookeeperManager) StartChangeFeed(watchDir string, changeLogDir string) error {
+	err := manager.createZookeeperPath(changeLogDir)
+	if err != nil {
+		return err
+	}
+
+	dir := strings.TrimSuffix(changeLogDir, "/")
+	children, _, err := manager.zookeeperConn.Children(dir)
+	if err != nil {
+		return err
+	}
+
+	manager.lock.Lock()
+	manager.changeFeedWatchDir = watchDir
+	manager.changeLogDir = dir
+	manager.lock.Unlock()
+
+	entries := changeLogEntries(children)
+	if len(entries) > 0 {
+		manager.changeLogLast = entries[len(entries)-1]
+	}
+
+	glog.Info("ChangeFeed: started, ", dir, "; last entry: ", manager.changeLogLast)
+	go manager.runChangeFeed()
+	return nil
+}
+
+// isFedPath 节点是否由变更日志通知，在持有锁时调用
+func (manager *ZookeeperManager) isFedPath(path string) bool {
+	dir := manager.changeFeedWatchDir
+	return len(dir) > 0 && strings.HasPrefix(path, dir) && !strings.Contains(path[len(dir):], "/")
+}
+
+// runChangeFeed 监控变更日志目录并读取新的变更记录，直到连接关闭
+func (manager *ZookeeperManager) runChangeFeed() {
+	for {
+		children, _, event, err := manager.zookeeperConn.ChildrenW(manager.changeLogDir)
+
+		if err == coordination.ErrClosing {
+			break
+		}
+
+		if err == nil {
+			err = manager.readChangeLog(children)
+		}
+
+		if err != nil {
+			glog.Error("ChangeFeed: read ", manager.changeLogDir, " failed, retry in ", zookeeperConnAliveTimeout, "s: ", err)
+			time.Sleep(zookeeperConnAliveTimeout * time.Second)
+			continue
+		}
+
+		// 监控因会话过期等原因失效时，重新设置监控即可，变更记录不会丢失
+		e := <-event
+		if e.Type == coordination.EventNotWatching {
+			if e.Err == coordination.ErrClosing {
+				break
+			}
+			glog.Warning("ChangeFeed: watch lost: ", e.Err)
+		}
+	}
+
+	glog.Info("ChangeFeed: exited")
+}
+
+// readChangeLog 读取上次读取之后的变更记录，并通知相应节点的监控者
+func (manager *ZookeeperManager) readChangeLog(children []string) error {
+	entries := changeLogEntries(children)
+	index := sort.SearchStrings(entries, manager.changeLogLast)
+
+	// 旧的记录被 switcherAPIServer 清理。若上次读取的记录已被清理，之后的记录可能也已丢失
+	if len(manager.changeLogLast) > 0 && (index >= len(entries) || entries[index] != manager.changeLogLast) {
+		glog.Warning("ChangeFeed: entries after ", manager.changeLogLast, " may have been trimmed, rereading all nodes")
+		manager.resyncFedWatchers()
+	}
+
+	for _, entry := range entries[index:] {
+		if entry == manager.changeLogLast {
+			continue
+		}
+
+		data, _, err := manager.zookeeperConn.Get(manager.changeLogDir + "/" + entry)
+
+		if err == coordination.ErrNoNode {
+			// 记录在读取前被清理
+			glog.Warning("ChangeFeed: entry ", entry, " has been trimmed, rereading all nodes")
+			manager.resyncFedWatchers()
+			manager.changeLogLast = entries[len(entries)-1]
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var record changeLogEntry
+		if err := json.Unmarshal(data, &record); err != nil || len(record.Name) < 1 {
+			glog.Warning("ChangeFeed: invalid entry ", entry, ": ", string(data))
+		} else {
+			manager.notifyFedWatcher(manager.changeFeedWatchDir + record.Name)
+		}
+
+		manager.changeLogLast = entry
+	}
+
+	return nil
+}
+
+// notifyFedWatcher 通知由变更日志通知的节点的监控者重新读取节点
+func (manager *ZookeeperManager) notifyFedWatcher(path string) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	watcher, exists := manager.watcherMap[path]
+	if !exists || !watcher.fed {
+		return
+	}
+
+	if glog.V(3) {
+		glog.Info("ChangeFeed: node changed: ", path)
+	}
+
+	eventType := coordination.EventNodeDataChanged
+	if !watcher.nodeExists {
+		eventType = coordination.EventNodeCreated
+	}
+	watcher.notify(coordination.Event{Type: eventType, Path: path})
+	manager.removeNodeWatcher(watcher)
+}
+
+// resyncFedWatchers 重新读取所有由变更日志通知的节点，通知值发生了改变的节点的监控者
+// 逐个节点加锁，以免长时间阻塞会话。
+func (manager *ZookeeperManager) resyncFedWatchers() {
+	manager.lock.Lock()
+	watchers := make([]*NodeWatcher, 0, len(manager.watcherMap))
+	for _, watcher := range manager.watcherMap {
+		if watcher.fed {
+			watchers = append(watchers, watcher)
+		}
+	}
+	manager.lock.Unlock()
+
+	for _, watcher := range watchers {
+		value, exists, _, err := manager.readNode(watcher.nodePath, false)
+		if err != nil {
+			// 无法确定节点是否改变，通知监控者自行重新读取
+			glog.Error("ChangeFeed: read ", watcher.nodePath, " failed: ", err)
+			manager.notifyFedWatcher(watcher.nodePath)
+			continue
+		}
+
+		manager.lock.Lock()
+		// 读取期间已被释放或已通知的节点不再处理
+		if manager.watcherMap[watcher.nodePath] == watcher {
+			watcher.update(value, exists)
+			if len(watcher.watcherChannels) == 0 {
+				manager.removeNodeWatcher(watcher)
+			}
+		}
+		manager.lock.Unlock()
+	}
+}
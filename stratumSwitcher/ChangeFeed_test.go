@@ -0,0 +1,161 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btccom/btcpool-go-modules/coordination"
+)
+
+const (
+	testChangeFeedWatchDir = "/stratumSwitcher/btcbcc/"
+	testChangeLogDir       = "/stratumSwitcher/btcbcc_changelog/"
+)
+
+// newChangeFeedZookeeperManager 新建开启了变更日志模式的Zookeeper管理器，同时返回模拟 switcherAPIServer 的连接
+// prepare 在开启变更日志模式前写入初始数据，可以为空。
+func newChangeFeedZookeeperManager(t *testing.T, prepare func(apiServer coordination.Backend)) (*ZookeeperManager, coordination.Backend) {
+	store := coordination.NewMemoryStore()
+	manager := newZookeeperManager(store.Connect())
+	apiServer := store.Connect()
+
+	manager.createZookeeperPath(testChangeFeedWatchDir)
+	manager.createZookeeperPath(testChangeLogDir)
+	if prepare != nil {
+		prepare(apiServer)
+	}
+
+	if err := manager.StartChangeFeed(testChangeFeedWatchDir, testChangeLogDir); err != nil {
+		t.Fatalf("StartChangeFeed failed: %s", err)
+	}
+	return manager, apiServer
+}
+
+// writeCoinWithChangeLog 与 switcherAPIServer 相同：在一个事务中修改币种节点并追加变更记录
+func writeCoinWithChangeLog(t *testing.T, conn coordination.Backend, name string, coin string) {
+	t.Helper()
+	path := testChangeFeedWatchDir + name
+
+	var op interface{} = &coordination.CreateRequest{Path: path, Data: []byte(coin)}
+	if exists, _, _ := conn.Exists(path); exists {
+		op = &coordination.SetDataRequest{Path: path, Data: []byte(coin), Version: -1}
+	}
+	entry := &coordination.CreateRequest{
+		Path:  testChangeLogDir + changeLogEntryPrefix,
+		Data:  []byte(`{"time":0,"name":"` + name + `","coin":"` + coin + `"}`),
+		Flags: coordination.FlagSequence,
+	}
+	if err := conn.Multi(op, entry); err != nil {
+		t.Fatalf("write %s failed: %s", name, err)
+	}
+}
+
+// expectEvent 等待事件，eventType 为0时期望一段时间内没有事件
+func expectEvent(t *testing.T, event <-chan coordination.Event, eventType coordination.EventType) {
+	t.Helper()
+	timeout := time.Second
+	if eventType == 0 {
+		timeout = 100 * time.Millisecond
+	}
+	select {
+	case e := <-event:
+		if eventType == 0 {
+			t.Fatalf("unexpected event: %+v", e)
+		}
+		if e.Type != eventType {
+			t.Errorf("wrong event: %+v", e)
+		}
+	case <-time.After(timeout):
+		if eventType != 0 {
+			t.Fatal("waiting for event timeout")
+		}
+	}
+}
+
+func TestChangeFeedNotify(t *testing.T) {
+	manager, apiServer := newChangeFeedZookeeperManager(t, func(apiServer coordination.Backend) {
+		apiServer.Create(testChangeFeedWatchDir+"aaaa", []byte("btc"), 0)
+	})
+	defer manager.zookeeperConn.Close()
+	defer apiServer.Close()
+
+	value, event1, err := manager.GetW(testChangeFeedWatchDir+"aaaa", 1)
+	if err != nil || string(value) != "btc" {
+		t.Fatalf("GetW failed: %s, %v", value, err)
+	}
+	_, event2, _ := manager.GetW(testChangeFeedWatchDir+"aaaa", 2)
+	_, exists, workerEvent, _ := manager.GetExistsW(testChangeFeedWatchDir+"aaaa.rig01", 1)
+	if exists {
+		t.Fatal("worker node should not exist")
+	}
+
+	// 币种节点本身不被监控，没有变更记录的修改不会通知
+	apiServer.Set(testChangeFeedWatchDir+"aaaa", []byte("btc"), -1)
+	expectEvent(t, event1, 0)
+
+	writeCoinWithChangeLog(t, apiServer, "aaaa", "bcc")
+	expectEvent(t, event1, coordination.EventNodeDataChanged)
+	expectEvent(t, event2, coordination.EventNodeDataChanged)
+
+	writeCoinWithChangeLog(t, apiServer, "aaaa.rig01", "bcc")
+	expectEvent(t, workerEvent, coordination.EventNodeCreated)
+
+	// 已通知的节点被释放，重新读取得到新的值
+	value, _, _ = manager.GetW(testChangeFeedWatchDir+"aaaa", 1)
+	if string(value) != "bcc" {
+		t.Errorf("wrong value after change: %s", value)
+	}
+}
+
+func TestChangeFeedReleaseW(t *testing.T) {
+	manager, apiServer := newChangeFeedZookeeperManager(t, func(apiServer coordination.Backend) {
+		apiServer.Create(testChangeFeedWatchDir+"aaaa", []byte("btc"), 0)
+	})
+	defer manager.zookeeperConn.Close()
+	defer apiServer.Close()
+
+	manager.GetW(testChangeFeedWatchDir+"aaaa", 1)
+	manager.GetW(testChangeFeedWatchDir+"aaaa", 2)
+
+	// 没有监控者的节点立即被释放
+	manager.ReleaseW(testChangeFeedWatchDir+"aaaa", 1)
+	if len(manager.watcherMap) != 1 {
+		t.Errorf("watcher should be kept while in use: %d", len(manager.watcherMap))
+	}
+	manager.ReleaseW(testChangeFeedWatchDir+"aaaa", 2)
+	if len(manager.watcherMap) != 0 {
+		t.Errorf("watcher should be released: %d", len(manager.watcherMap))
+	}
+
+	// 其他目录中的节点仍然使用Zookeeper监控
+	manager.createZookeeperPath("/stratumSwitcher/autoreg/aaaa")
+	_, event, err := manager.GetW("/stratumSwitcher/autoreg/aaaa", 1)
+	if err != nil || manager.watcherMap["/stratumSwitcher/autoreg/aaaa"].fed {
+		t.Fatalf("GetW of other directory: %v", err)
+	}
+	apiServer.Delete("/stratumSwitcher/autoreg/aaaa", -1)
+	expectEvent(t, event, coordination.EventNodeDeleted)
+}
+
+func TestChangeFeedResync(t *testing.T) {
+	manager, apiServer := newChangeFeedZookeeperManager(t, func(apiServer coordination.Backend) {
+		writeCoinWithChangeLog(t, apiServer, "aaaa", "btc")
+		writeCoinWithChangeLog(t, apiServer, "bbbb", "btc")
+	})
+	defer manager.zookeeperConn.Close()
+	defer apiServer.Close()
+
+	_, unchangedEvent, _ := manager.GetW(testChangeFeedWatchDir+"aaaa", 1)
+	_, changedEvent, _ := manager.GetW(testChangeFeedWatchDir+"bbbb", 1)
+
+	// 模拟 stratumSwitcher 落后时记录被清理：修改后删除所有记录，再追加一条无关的记录
+	apiServer.Set(testChangeFeedWatchDir+"bbbb", []byte("bcc"), -1)
+	children, _, _ := apiServer.Children(testChangeLogDir[:len(testChangeLogDir)-1])
+	for _, child := range children {
+		apiServer.Delete(testChangeLogDir+child, -1)
+	}
+	writeCoinWithChangeLog(t, apiServer, "cccc", "btc")
+
+	expectEvent(t, changedEvent, coordination.EventNodeDataChanged)
+	expectEvent(t, unchangedEvent, 0)
+}
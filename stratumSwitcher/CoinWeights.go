@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// CoinWeights 按比例分配的币种，如 {"btc":70,"bch":30}
+//
+// Zookeeper中子账户节点的值除了币种名外，也可以是一个币种到权重的JSON对象。
+// 该子账户在本进程中的会话将按权重分配到各币种上（按会话数，而不是算力）。
+type CoinWeights map[string]float64
+
+// ParseCoinWeights 解析按比例分配的币种，值不是JSON对象时 ok 为 false
+func ParseCoinWeights(value string) (weights CoinWeights, ok bool) {
+	value = strings.TrimSpace(value)
+	if len(value) < 1 || value[0] != '{' {
+		return nil, false
+	}
+
+	err := json.Unmarshal([]byte(value), &weights)
+	if err != nil {
+		glog.Warning("Parse Coin Weights Failed: ", value, "; ", err)
+		return nil, false
+	}
+
+	for coin, weight := range weights {
+		if weight <= 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+			delete(weights, coin)
+		}
+	}
+	return weights, len(weights) > 0
+}
+
+// coins 按权重从大到小（权重相同时按名称）排列的币种
+func (weights CoinWeights) coins() []string {
+	coins := make([]string, 0, len(weights))
+	for coin := range weights {
+		coins = append(coins, coin)
+	}
+	sort.Slice(coins, func(i, j int) bool {
+		if weights[coins[i]] != weights[coins[j]] {
+			return weights[coins[i]] > weights[coins[j]]
+		}
+		return coins[i] < coins[j]
+	})
+	return coins
+}
+
+// apportion 将 n 个会话按权重分配到各币种（最大余额法），返回各币种的目标会话数
+func (weights CoinWeights) apportion(n int) map[string]int {
+	coins := weights.coins()
+	total := 0.0
+	for _, coin := range coins {
+		total += weights[coin]
+	}
+
+	targets := make(map[string]int, len(coins))
+	remainders := make(map[string]float64, len(coins))
+	assigned := 0
+	for _, coin := range coins {
+		exact := weights[coin] / total * float64(n)
+		targets[coin] = int(exact)
+		remainders[coin] = exact - float64(targets[coin])
+		assigned += targets[coin]
+	}
+
+	// 剩余的会话分给余数最大的币种
+	sort.SliceStable(coins, func(i, j int) bool {
+		return remainders[coins[i]] > remainders[coins[j]]
+	})
+	for i := 0; assigned < n; i++ {
+		targets[coins[i%len(coins)]]++
+		assigned++
+	}
+	return targets
+}
+
+// pick 为一个会话选择币种
+// counts 为同一子账户其他会话在各币种上的数量，currentCoin 为该会话当前的币种（新会话为空）。
+// 当前币种仍在目标数量以内时保持不变，否则选择离目标数量差距最大的币种，
+// 因此权重改变后只有超出目标的那部分会话会被切换。
+func (weights CoinWeights) pick(counts map[string]int, currentCoin string) string {
+	n := 1
+	for _, count := range counts {
+		n += count
+	}
+	targets := weights.apportion(n)
+
+	if target, ok := targets[currentCoin]; ok && counts[currentCoin] < target {
+		return currentCoin
+	}
+
+	bestCoin := ""
+	bestDeficit := math.MinInt32
+	for _, coin := range weights.coins() {
+		if deficit := targets[coin] - counts[coin]; deficit > bestDeficit {
+			bestCoin = coin
+			bestDeficit = deficit
+		}
+	}
+	return bestCoin
+}
+
+// assignCoin 记录会话分配到的币种并返回，weights 为空表示子账户只有一个币种 coin
+// 记录在会话实际切换之前写入，切换被放弃或失败时需调用 restoreCoinAssignment 恢复
+func (manager *StratumSessionManager) assignCoin(session *StratumSession, weights CoinWeights, coin string) string {
+	manager.coinAssignmentsLock.Lock()
+	defer manager.coinAssignmentsLock.Unlock()
+
+	if manager.coinAssignments == nil {
+		manager.coinAssignments = make(map[string]map[uint32]string)
+	}
+	assignments, ok := manager.coinAssignments[session.subaccountName]
+	if !ok {
+		assignments = make(map[uint32]string)
+		manager.coinAssignments[session.subaccountName] = assignments
+	}
+
+	if weights != nil {
+		counts := make(map[string]int)
+		for sessionID, assignedCoin := range assignments {
+			if sessionID != session.sessionID {
+				counts[assignedCoin]++
+			}
+		}
+		coin = weights.pick(counts, session.getMiningCoin())
+	}
+
+	assignments[session.sessionID] = coin
+	return coin
+}
+
+// restoreCoinAssignment 将会话的币种分配记录恢复为会话实际挖的币种 coin，
+// 会话没有分配记录（跟随矿工节点或已结束）时不做任何事
+func (manager *StratumSessionManager) restoreCoinAssignment(session *StratumSession, coin string) {
+	manager.coinAssignmentsLock.Lock()
+	defer manager.coinAssignmentsLock.Unlock()
+
+	assignments, ok := manager.coinAssignments[session.subaccountName]
+	if !ok {
+		return
+	}
+	if _, ok := assignments[session.sessionID]; ok {
+		assignments[session.sessionID] = coin
+	}
+}
+
+// unassignCoin 删除会话的币种分配记录（会话结束或改为跟随矿工节点时调用）
+func (manager *StratumSessionManager) unassignCoin(session *StratumSession) {
+	manager.coinAssignmentsLock.Lock()
+	defer manager.coinAssignmentsLock.Unlock()
+
+	assignments, ok := manager.coinAssignments[session.subaccountName]
+	if !ok {
+		return
+	}
+	delete(assignments, session.sessionID)
+	if len(assignments) == 0 {
+		delete(manager.coinAssignments, session.subaccountName)
+	}
+}
+
+// getSubaccountCoin 根据Zookeeper中子账户节点的值为会话分配币种
+func (session *StratumSession) getSubaccountCoin() string {
+	weights, ok := ParseCoinWeights(session.zkSubaccountCoin)
+	if !ok {
+		return session.manager.assignCoin(session, nil, session.zkSubaccountCoin)
+	}
+
+	// 忽略没有对应服务器的币种
+	for coin := range weights {
+		if _, exists := session.manager.getStratumServerInfo(coin); !exists {
+			glog.Warning("Stratum Server Not Found for Weighted Coin: ", session.zkWatchPath, "; ", coin)
+			delete(weights, coin)
+		}
+	}
+	if len(weights) < 1 {
+		return session.zkSubaccountCoin
+	}
+
+	return session.manager.assignCoin(session, weights, "")
+}
+
+// keepWeightedCoin 恢复会话时，若子账户按比例分配且包含原来的币种，则保留原来的币种
+func (session *StratumSession) keepWeightedCoin(coin string) bool {
+	if len(session.zkWorkerCoin) > 0 {
+		return false
+	}
+	weights, ok := ParseCoinWeights(session.zkSubaccountCoin)
+	if !ok || weights[coin] <= 0 {
+		return false
+	}
+
+	coin = session.manager.assignCoin(session, nil, coin)
+	session.lock.Lock()
+	session.miningCoin = coin
+	session.lock.Unlock()
+	return true
+}
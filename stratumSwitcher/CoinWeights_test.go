@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseCoinWeights(t *testing.T) {
+	if _, ok := ParseCoinWeights("btc"); ok {
+		t.Errorf("a plain coin should not be parsed as weights")
+	}
+	if _, ok := ParseCoinWeights(`{"btc":`); ok {
+		t.Errorf("invalid JSON should not be parsed as weights")
+	}
+	if _, ok := ParseCoinWeights(`{"btc":0,"bch":-1}`); ok {
+		t.Errorf("weights without positive values should be invalid")
+	}
+
+	weights, ok := ParseCoinWeights(` {"btc":70,"bch":30,"ltc":0} `)
+	if !ok || len(weights) != 2 || weights["btc"] != 70 || weights["bch"] != 30 {
+		t.Errorf("wrong weights: %v, %v", weights, ok)
+	}
+}
+
+func TestCoinWeightsApportion(t *testing.T) {
+	weights := CoinWeights{"btc": 70, "bch": 30}
+	for n, expected := range map[int]map[string]int{
+		0:  {"btc": 0, "bch": 0},
+		1:  {"btc": 1, "bch": 0},
+		3:  {"btc": 2, "bch": 1},
+		10: {"btc": 7, "bch": 3},
+		11: {"btc": 8, "bch": 3},
+	} {
+		targets := weights.apportion(n)
+		for coin, count := range expected {
+			if targets[coin] != count {
+				t.Errorf("n = %d: %s should be %d, but is %d", n, coin, count, targets[coin])
+			}
+		}
+	}
+}
+
+func TestStratumSessionManagerAssignCoin(t *testing.T) {
+	manager := new(StratumSessionManager)
+
+	sessions := make([]*StratumSession, 10)
+	for i := range sessions {
+		sessions[i] = &StratumSession{sessionID: uint32(i), subaccountName: "aaaa", manager: manager}
+	}
+
+	countCoins := func() map[string]int {
+		counts := make(map[string]int)
+		for _, session := range sessions {
+			counts[session.miningCoin]++
+		}
+		return counts
+	}
+
+	// 新会话按权重分配
+	weights := CoinWeights{"btc": 70, "bch": 30}
+	for _, session := range sessions {
+		session.miningCoin = manager.assignCoin(session, weights, "")
+	}
+	if counts := countCoins(); counts["btc"] != 7 || counts["bch"] != 3 {
+		t.Fatalf("wrong distribution: %v", counts)
+	}
+
+	// 权重改变，只切换最少的会话
+	weights = CoinWeights{"btc": 50, "bch": 30, "ltc": 20}
+	switches := 0
+	for _, session := range sessions {
+		coin := manager.assignCoin(session, weights, "")
+		if coin != session.miningCoin {
+			switches++
+			session.miningCoin = coin
+		}
+	}
+	if counts := countCoins(); counts["btc"] != 5 || counts["bch"] != 3 || counts["ltc"] != 2 {
+		t.Errorf("wrong distribution after weights changed: %v", counts)
+	}
+	if switches != 2 {
+		t.Errorf("2 switches expected, but got %d", switches)
+	}
+
+	// 权重不变时再次计算不会切换
+	for _, session := range sessions {
+		if coin := manager.assignCoin(session, weights, ""); coin != session.miningCoin {
+			t.Errorf("session %d should keep %s, but got %s", session.sessionID, session.miningCoin, coin)
+		}
+	}
+
+	// 未实际切换时恢复分配记录，之后的分配按实际挖的币种计数
+	session := sessions[0]
+	oldCoin := session.miningCoin
+	if coin := manager.assignCoin(session, CoinWeights{"doge": 100}, ""); coin != "doge" {
+		t.Fatalf("should be assigned to doge, but got %s", coin)
+	}
+	manager.restoreCoinAssignment(session, oldCoin)
+	if coin := manager.coinAssignments["aaaa"][session.sessionID]; coin != oldCoin {
+		t.Errorf("assignment should be restored to %s, but is %s", oldCoin, coin)
+	}
+
+	for _, session := range sessions {
+		manager.unassignCoin(session)
+	}
+	// 没有分配记录的会话不会被恢复出记录
+	manager.restoreCoinAssignment(session, oldCoin)
+	if len(manager.coinAssignments) != 0 {
+		t.Errorf("assignments should be removed: %v", manager.coinAssignments)
+	}
+}
@@ -43,9 +43,12 @@ type ConfigData struct {
 	ChainType                    string
 	ListenAddr                   string
 	StratumServerMap             StratumServerInfoMap
+	CoordinationBackend          string // 协调服务后端：zookeeper（默认）、etcd、memory
 	ZKBroker                     []string
 	ZKServerIDAssignDir          string // 以斜杠结尾
 	ZKSwitcherWatchDir           string // 以斜杠结尾
+	EnableWorkerCoinRouting      bool   // 监控矿工级别的币种节点（ZKSwitcherWatchDir/子账户名.矿机名）
+	ZKChangeLogDir               string // 币种变更日志的路径（以斜杠结尾），为空表示逐个监控币种节点
 	EnableUserAutoReg            bool
 	ZKAutoRegWatchDir            string // 以斜杠结尾
 	AutoRegMaxWaitUsers          int64
@@ -53,6 +56,34 @@ type ConfigData struct {
 	ZKUserCaseInsensitiveIndex   string // 以斜杠结尾
 	EnableHTTPDebug              bool
 	HTTPDebugListenAddr          string
+	EnableAdminAPI               bool
+	AdminAPIListenAddr           string
+	AdminAPIUser                 string
+	AdminAPIPassword             string
+	UpstreamCheckIntervalSeconds int    // 为0则使用默认值
+	UpstreamCheckTimeoutSeconds  int    // 为0则使用默认值
+	MaxConnsPerIP                int    // 单IP最大并发连接数，0为不限制
+	MaxConnsPerIPPerMinute       int    // 单IP每分钟最多新建连接数，0为不限制
+	MaxAcceptsPerSecond          int    // 全局每秒最多接受连接数，0为不限制
+	BanAfterViolations           int    // 触发单IP限制多少次（每分钟）后临时封禁，0为不封禁
+	BanSeconds                   int    // 临时封禁时长，为0则使用默认值
+	DrainTimeoutSeconds          int    // 排空时会话可继续代理的时长，为0则使用默认值
+	DrainBatchSize               int    // 排空时每批断开的会话数，为0则使用默认值
+	DrainBatchIntervalSeconds    int    // 排空时的批次间隔，为0则使用默认值
+	ZKConfigNode                 string // 可重新载入的配置所在的Zookeeper节点，为空表示不监控
+	RemovedCoinPolicy            string // 重新载入时被移除的币种上的会话的处理策略：close（默认）或 migrate
+	RemovedCoinMigrateTo         string // migrate 策略下会话切换到的币种
+	EventLogFile                 string // 会话事件日志（JSON Lines）文件，为空表示不输出
+	SwitchMinDwellSeconds        int    // 会话在一个币种上至少停留多久才再次切换，0为不限制
+	SwitchDebounceSeconds        int    // 币种改变后多久内没有再改变才切换，0为不防抖
+	SwitchJitterSeconds          int    // 切换前附加的最大随机延迟，0为不延迟
+	EnableProxyProtocol          bool   // 所有监听端口均要求PROXY协议头
+	TLSListenAddr                string // 为空表示不开启TLS监听
+	TLSCertFile                  string
+	TLSKeyFile                   string
+	SV2ListenAddr                string // 为空表示不开启Stratum V2
+	SV2StaticKey                 string // secp256k1私钥（十六进制或base58check），为空则每次启动随机生成
+	SV2AuthoritySecretKey        string // 签名证书的secp256k1私钥（十六进制或base58check），为空则不签名
 }
 
 // LoadFromFile 从文件载入配置
@@ -65,6 +96,9 @@ func (conf *ConfigData) LoadFromFile(file string) (err error) {
 	}
 
 	err = json.Unmarshal(configJSON, conf)
+	if err != nil {
+		return
+	}
 
 	// 若zookeeper路径不以“/”结尾，则添加
 	if conf.ZKServerIDAssignDir[len(conf.ZKServerIDAssignDir)-1] != '/' {
@@ -76,22 +110,29 @@ func (conf *ConfigData) LoadFromFile(file string) (err error) {
 	if conf.ZKAutoRegWatchDir[len(conf.ZKAutoRegWatchDir)-1] != '/' {
 		conf.ZKAutoRegWatchDir += "/"
 	}
+	if len(conf.ZKChangeLogDir) > 0 && conf.ZKChangeLogDir[len(conf.ZKChangeLogDir)-1] != '/' {
+		conf.ZKChangeLogDir += "/"
+	}
 	if !conf.StratumServerCaseInsensitive &&
 		len(conf.ZKUserCaseInsensitiveIndex) > 0 &&
 		conf.ZKUserCaseInsensitiveIndex[len(conf.ZKUserCaseInsensitiveIndex)-1] != '/' {
 		conf.ZKUserCaseInsensitiveIndex += "/"
 	}
 
-	// 若UserSuffix为空，设为与币种相同
-	for k, v := range conf.StratumServerMap {
+	conf.StratumServerMap.setDefaultUserSuffix()
+
+	return
+}
+
+// setDefaultUserSuffix 若UserSuffix为空，设为与币种相同
+func (serverInfoMap StratumServerInfoMap) setDefaultUserSuffix() {
+	for k, v := range serverInfoMap {
 		if v.UserSuffix == "" {
 			v.UserSuffix = k
-			conf.StratumServerMap[k] = v
+			serverInfoMap[k] = v
 		}
-		glog.Info("Chain: ", k, ", UserSuffix: ", conf.StratumServerMap[k].UserSuffix)
+		glog.Info("Chain: ", k, ", UserSuffix: ", serverInfoMap[k].UserSuffix)
 	}
-
-	return
 }
 
 // SaveToFile 保存配置到文件
@@ -122,6 +163,17 @@ type StratumSessionData struct {
 
 	// 比特币AsicBoost挖矿版本掩码
 	VersionMask uint32 `json:",omitempty"`
+
+	// 客户端连接建立的时间
+	ConnectTime int64 `json:",omitempty"`
+	// 币种被管理API覆盖时Zookeeper中记录的币种（未覆盖时为空）
+	OverriddenZKCoin string `json:",omitempty"`
+	// 当前连接的服务器地址
+	ServerURL string `json:",omitempty"`
+	// 客户端IP地址及端口（可能来自PROXY协议头，与连接本身的地址不同）
+	ClientIPPort string `json:",omitempty"`
+	// BTCAgent的能力查询及AgentSession注册消息
+	BTCAgentMessages [][]byte `json:",omitempty"`
 }
 
 // RuntimeData 运行时数据
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 自动封禁的默认时长
+const defaultBanSeconds = 600
+
+// 清理过期限流状态的间隔
+const connLimiterCleanupIntervalSeconds = 60
+
+// tokenBucket 令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take 取走一个令牌，桶中没有令牌时返回false
+func (bucket *tokenBucket) take(now time.Time, ratePerSecond float64, burst float64) bool {
+	if bucket.last.IsZero() {
+		bucket.tokens = burst
+	} else {
+		bucket.tokens += now.Sub(bucket.last).Seconds() * ratePerSecond
+		if bucket.tokens > burst {
+			bucket.tokens = burst
+		}
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// isFull 桶是否已满（满的桶与新建的桶等价，可以删除）
+func (bucket *tokenBucket) isFull(now time.Time, ratePerSecond float64, burst float64) bool {
+	return bucket.tokens+now.Sub(bucket.last).Seconds()*ratePerSecond >= burst
+}
+
+// ConnLimiter 连接限制器
+//
+// 依次检查：封禁列表、全局接受速率、单IP连接速率、单IP并发连接数。
+// 单IP的限制被触发 banAfterViolations 次（每分钟清零）后，该IP会被临时封禁 banDuration。
+// 所有限制值为0表示不限制。
+type ConnLimiter struct {
+	lock sync.Mutex
+
+	// 单IP最大并发连接数
+	maxConnsPerIP int
+	// 单IP每分钟最多新建的连接数
+	maxConnsPerIPPerMinute int
+	// 全局每秒最多接受的连接数
+	maxAcceptsPerSecond int
+	// 触发多少次单IP限制后自动封禁
+	banAfterViolations int
+	// 自动封禁的时长
+	banDuration time.Duration
+
+	// 各IP当前的连接数
+	conns map[string]int
+	// 各IP的连接速率令牌桶
+	ipBuckets map[string]*tokenBucket
+	// 各IP触发限制的次数
+	violations map[string]int
+	// 全局接受速率令牌桶
+	acceptBucket tokenBucket
+	// 封禁列表，值为解封时间
+	bans map[string]time.Time
+
+	// 获取当前时间（可在测试中替换）
+	now func() time.Time
+}
+
+// NewConnLimiter 创建连接限制器
+func NewConnLimiter(maxConnsPerIP int, maxConnsPerIPPerMinute int, maxAcceptsPerSecond int, banAfterViolations int, banSeconds int) (limiter *ConnLimiter) {
+	if banSeconds <= 0 {
+		banSeconds = defaultBanSeconds
+	}
+
+	limiter = new(ConnLimiter)
+	limiter.maxConnsPerIP = maxConnsPerIP
+	limiter.maxConnsPerIPPerMinute = maxConnsPerIPPerMinute
+	limiter.maxAcceptsPerSecond = maxAcceptsPerSecond
+	limiter.banAfterViolations = banAfterViolations
+	limiter.banDuration = time.Duration(banSeconds) * time.Second
+	limiter.conns = make(map[string]int)
+	limiter.ipBuckets = make(map[string]*tokenBucket)
+	limiter.violations = make(map[string]int)
+	limiter.bans = make(map[string]time.Time)
+	limiter.now = time.Now
+	return
+}
+
+// Acquire 检查是否允许来自该IP的新连接，允许时计入该IP的连接数
+// 返回nil表示允许，此后必须调用 Release 释放。
+func (limiter *ConnLimiter) Acquire(ip string) *StratumError {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := limiter.now()
+
+	if until, ok := limiter.bans[ip]; ok {
+		if now.Before(until) {
+			return StratumErrIPBanned
+		}
+		delete(limiter.bans, ip)
+	}
+
+	if limiter.maxAcceptsPerSecond > 0 {
+		rate := float64(limiter.maxAcceptsPerSecond)
+		if !limiter.acceptBucket.take(now, rate, rate) {
+			return StratumErrServerBusy
+		}
+	}
+
+	if limiter.maxConnsPerIPPerMinute > 0 {
+		bucket, ok := limiter.ipBuckets[ip]
+		if !ok {
+			bucket = new(tokenBucket)
+			limiter.ipBuckets[ip] = bucket
+		}
+		if !bucket.take(now, float64(limiter.maxConnsPerIPPerMinute)/60, float64(limiter.maxConnsPerIPPerMinute)) {
+			limiter.addViolation(ip, now)
+			return StratumErrConnRateLimited
+		}
+	}
+
+	if limiter.maxConnsPerIP > 0 && limiter.conns[ip] >= limiter.maxConnsPerIP {
+		limiter.addViolation(ip, now)
+		return StratumErrTooManyConnsFromIP
+	}
+
+	limiter.conns[ip]++
+	return nil
+}
+
+// AddConn 不经检查计入该IP的连接数（用于恢复的会话）
+func (limiter *ConnLimiter) AddConn(ip string) {
+	limiter.lock.Lock()
+	limiter.conns[ip]++
+	limiter.lock.Unlock()
+}
+
+// Release 释放该IP的一个连接
+func (limiter *ConnLimiter) Release(ip string) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	if limiter.conns[ip] <= 1 {
+		delete(limiter.conns, ip)
+		return
+	}
+	limiter.conns[ip]--
+}
+
+// GetConnCount 获取该IP当前的连接数
+func (limiter *ConnLimiter) GetConnCount(ip string) int {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	return limiter.conns[ip]
+}
+
+// addViolation 记录一次触发限制，达到次数后封禁（已加锁）
+func (limiter *ConnLimiter) addViolation(ip string, now time.Time) {
+	if limiter.banAfterViolations <= 0 {
+		return
+	}
+
+	limiter.violations[ip]++
+	if limiter.violations[ip] >= limiter.banAfterViolations {
+		delete(limiter.violations, ip)
+		limiter.bans[ip] = now.Add(limiter.banDuration)
+		glog.Warning("IP Banned: ", ip, "; ", limiter.banAfterViolations, " violations; until ", limiter.bans[ip].Format(time.RFC3339))
+	}
+}
+
+// Ban 封禁IP
+func (limiter *ConnLimiter) Ban(ip string, duration time.Duration) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	limiter.bans[ip] = limiter.now().Add(duration)
+	glog.Warning("IP Banned: ", ip, "; until ", limiter.bans[ip].Format(time.RFC3339))
+}
+
+// Unban 解除IP的封禁，IP未被封禁时返回false
+func (limiter *ConnLimiter) Unban(ip string) bool {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	_, ok := limiter.bans[ip]
+	delete(limiter.bans, ip)
+	delete(limiter.violations, ip)
+	if ok {
+		glog.Info("IP Unbanned: ", ip)
+	}
+	return ok
+}
+
+// GetBans 获取未过期的封禁列表，值为解封时间
+func (limiter *ConnLimiter) GetBans() map[string]time.Time {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := limiter.now()
+	bans := make(map[string]time.Time)
+	for ip, until := range limiter.bans {
+		if now.Before(until) {
+			bans[ip] = until
+		}
+	}
+	return bans
+}
+
+// Cleanup 清理过期的封禁、已满的令牌桶和触发次数
+func (limiter *ConnLimiter) Cleanup() {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := limiter.now()
+	for ip, until := range limiter.bans {
+		if !now.Before(until) {
+			delete(limiter.bans, ip)
+		}
+	}
+
+	rate := float64(limiter.maxConnsPerIPPerMinute) / 60
+	burst := float64(limiter.maxConnsPerIPPerMinute)
+	for ip, bucket := range limiter.ipBuckets {
+		if bucket.isFull(now, rate, burst) {
+			delete(limiter.ipBuckets, ip)
+		}
+	}
+
+	limiter.violations = make(map[string]int)
+}
+
+// RunCleanup 定时清理
+func (limiter *ConnLimiter) RunCleanup() {
+	for {
+		time.Sleep(connLimiterCleanupIntervalSeconds * time.Second)
+		limiter.Cleanup()
+	}
+}
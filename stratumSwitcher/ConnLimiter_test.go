@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestConnLimiter 创建使用可控时钟的连接限制器
+func newTestConnLimiter(maxConnsPerIP int, maxConnsPerIPPerMinute int, maxAcceptsPerSecond int, banAfterViolations int) (*ConnLimiter, *time.Time) {
+	limiter := NewConnLimiter(maxConnsPerIP, maxConnsPerIPPerMinute, maxAcceptsPerSecond, banAfterViolations, 60)
+	now := time.Unix(1500000000, 0)
+	limiter.now = func() time.Time { return now }
+	return limiter, &now
+}
+
+func TestConnLimiterMaxConnsPerIP(t *testing.T) {
+	limiter, _ := newTestConnLimiter(2, 0, 0, 0)
+
+	for i := 0; i < 2; i++ {
+		if err := limiter.Acquire("10.0.0.1"); err != nil {
+			t.Fatalf("Acquire #%d should succeed, but got %s", i, err)
+		}
+	}
+	if err := limiter.Acquire("10.0.0.1"); err != StratumErrTooManyConnsFromIP {
+		t.Errorf("the third Acquire should be rejected with StratumErrTooManyConnsFromIP, but got %v", err)
+	}
+	if err := limiter.Acquire("10.0.0.2"); err != nil {
+		t.Errorf("other IPs should not be affected, but got %s", err)
+	}
+
+	limiter.Release("10.0.0.1")
+	if err := limiter.Acquire("10.0.0.1"); err != nil {
+		t.Errorf("Acquire after Release should succeed, but got %s", err)
+	}
+	if count := limiter.GetConnCount("10.0.0.1"); count != 2 {
+		t.Errorf("conn count should be 2, but is %d", count)
+	}
+}
+
+func TestConnLimiterRates(t *testing.T) {
+	limiter, now := newTestConnLimiter(0, 3, 0, 0)
+
+	for i := 0; i < 3; i++ {
+		if err := limiter.Acquire("10.0.0.1"); err != nil {
+			t.Fatalf("Acquire #%d should succeed, but got %s", i, err)
+		}
+	}
+	if err := limiter.Acquire("10.0.0.1"); err != StratumErrConnRateLimited {
+		t.Errorf("Acquire should be rate limited, but got %v", err)
+	}
+
+	// 每分钟3个，20秒恢复一个
+	*now = now.Add(20 * time.Second)
+	if err := limiter.Acquire("10.0.0.1"); err != nil {
+		t.Errorf("Acquire should succeed after 20 seconds, but got %s", err)
+	}
+
+	limiter, now = newTestConnLimiter(0, 0, 2, 0)
+	limiter.Acquire("10.0.0.1")
+	limiter.Acquire("10.0.0.2")
+	if err := limiter.Acquire("10.0.0.3"); err != StratumErrServerBusy {
+		t.Errorf("Acquire should be rejected with StratumErrServerBusy, but got %v", err)
+	}
+	*now = now.Add(time.Second)
+	if err := limiter.Acquire("10.0.0.3"); err != nil {
+		t.Errorf("Acquire should succeed after 1 second, but got %s", err)
+	}
+}
+
+func TestConnLimiterBan(t *testing.T) {
+	limiter, now := newTestConnLimiter(1, 0, 0, 3)
+
+	limiter.Acquire("10.0.0.1")
+	for i := 0; i < 3; i++ {
+		if err := limiter.Acquire("10.0.0.1"); err != StratumErrTooManyConnsFromIP {
+			t.Fatalf("Acquire #%d should be rejected with StratumErrTooManyConnsFromIP, but got %v", i, err)
+		}
+	}
+
+	// 触发3次后被封禁，即使释放了连接也无法连接
+	limiter.Release("10.0.0.1")
+	if err := limiter.Acquire("10.0.0.1"); err != StratumErrIPBanned {
+		t.Errorf("Acquire should be rejected with StratumErrIPBanned, but got %v", err)
+	}
+	if _, ok := limiter.GetBans()["10.0.0.1"]; !ok {
+		t.Errorf("10.0.0.1 should be in the ban list")
+	}
+
+	// 60秒后解封
+	*now = now.Add(61 * time.Second)
+	if err := limiter.Acquire("10.0.0.1"); err != nil {
+		t.Errorf("Acquire should succeed after the ban expired, but got %s", err)
+	}
+
+	// 手动封禁与解封
+	limiter.Ban("10.0.0.2", time.Hour)
+	if err := limiter.Acquire("10.0.0.2"); err != StratumErrIPBanned {
+		t.Errorf("Acquire should be rejected with StratumErrIPBanned, but got %v", err)
+	}
+	if !limiter.Unban("10.0.0.2") || limiter.Unban("10.0.0.2") {
+		t.Errorf("Unban should return true only once")
+	}
+	if err := limiter.Acquire("10.0.0.2"); err != nil {
+		t.Errorf("Acquire should succeed after Unban, but got %s", err)
+	}
+}
+
+func TestStratumSessionManagerRejectConnection(t *testing.T) {
+	manager := new(StratumSessionManager)
+	manager.serverID = 1
+	manager.metrics = NewSwitcherMetrics()
+	manager.connLimiter = NewConnLimiter(0, 0, 0, 0, 0)
+	manager.connLimiter.Ban("127.0.0.1", time.Hour)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			manager.RunStratumSession(conn, nil)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	line, err := readLineWithTimeout(bufio.NewReader(conn), 5*time.Second)
+	if err != nil {
+		t.Fatalf("read error response failed: %s", err)
+	}
+	response, err := NewJSONRPCResponse(line)
+	if err != nil {
+		t.Fatalf("decode error response failed: %s, %s", err, line)
+	}
+	errArr, ok := response.Error.([]interface{})
+	if !ok || len(errArr) < 2 || errArr[0] != float64(StratumErrIPBanned.ErrNo) {
+		t.Errorf("wrong error response: %s", line)
+	}
+
+	if count := manager.metrics.rejectedConnections.Get(StratumErrIPBanned.ErrMsg); count != 1 {
+		t.Errorf("rejected connections should be 1, but is %d", count)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 默认的排空截止时间（从开始排空算起）
+const defaultDrainTimeoutSeconds = 600
+
+// 默认每批断开的会话数
+const defaultDrainBatchSize = 100
+
+// 默认的批次间隔
+const defaultDrainBatchIntervalSeconds = 1
+
+// 等待会话自行断开时检查会话数的间隔
+const drainPollInterval = time.Second
+
+// DrainStatus 排空状态（用于管理API展示）
+type DrainStatus struct {
+	Draining bool  `json:"draining"`
+	Deadline int64 `json:"deadline"`
+	Sessions int   `json:"sessions"`
+}
+
+// IsDraining 是否正在排空
+func (manager *StratumSessionManager) IsDraining() bool {
+	return atomic.LoadInt32(&manager.draining) != 0
+}
+
+// GetDrainStatus 获取排空状态
+func (manager *StratumSessionManager) GetDrainStatus() (status DrainStatus) {
+	status.Draining = manager.IsDraining()
+
+	manager.lock.Lock()
+	if status.Draining {
+		status.Deadline = manager.drainDeadline.Unix()
+	}
+	status.Sessions = len(manager.sessions)
+	manager.lock.Unlock()
+	return
+}
+
+// Drain 开始排空：停止接受新连接，删除Zookeeper中的服务器ID节点，
+// 已有会话继续代理到截止时间，之后分批断开，以免矿机同时重连到其他 switcher。
+// timeout 为0表示使用配置的截止时间。所有会话断开后 Run 返回。
+func (manager *StratumSessionManager) Drain(timeout time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&manager.draining, 0, 1) {
+		return ErrAlreadyDraining
+	}
+
+	if timeout <= 0 {
+		timeout = manager.drainTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	manager.lock.Lock()
+	manager.drainDeadline = deadline
+	sessionNum := len(manager.sessions)
+	manager.lock.Unlock()
+
+	glog.Info("Draining: ", sessionNum, " sessions, deadline ", deadline.Format(time.RFC3339))
+
+	manager.closeListeners()
+	manager.removeServerIDNode()
+
+	go manager.drainSessions(deadline)
+	return nil
+}
+
+// closeListeners 关闭所有监听端口
+func (manager *StratumSessionManager) closeListeners() {
+	for _, listener := range []net.Listener{manager.tcpListener, manager.tlsListener, manager.sv2Listener} {
+		if listener != nil {
+			listener.Close()
+		}
+	}
+}
+
+// removeServerIDNode 删除从Zookeeper分配服务器ID时创建的临时节点
+func (manager *StratumSessionManager) removeServerIDNode() {
+	if len(manager.serverIDNodePath) < 1 || manager.zookeeperManager == nil {
+		return
+	}
+
+	err := manager.zookeeperManager.zookeeperConn.Delete(manager.serverIDNodePath, -1)
+	if err != nil {
+		glog.Warning("Draining: delete ", manager.serverIDNodePath, " failed. errmsg: ", err)
+		return
+	}
+	glog.Info("Draining: deleted ", manager.serverIDNodePath)
+}
+
+// drainSessions 等待到截止时间，然后分批断开剩余的会话
+func (manager *StratumSessionManager) drainSessions(deadline time.Time) {
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 || manager.GetDrainStatus().Sessions == 0 {
+			break
+		}
+		if remaining > drainPollInterval {
+			remaining = drainPollInterval
+		}
+		time.Sleep(remaining)
+	}
+
+	for {
+		batch := manager.takeSessionBatch(manager.drainBatchSize)
+		if len(batch) == 0 {
+			break
+		}
+
+		glog.Info("Draining: closing ", len(batch), " sessions")
+		for _, session := range batch {
+			session.Stop(StopReasonDrain)
+		}
+
+		if manager.GetDrainStatus().Sessions > 0 {
+			time.Sleep(manager.drainBatchInterval)
+		}
+	}
+
+	glog.Info("Draining: all sessions closed")
+	close(manager.drainDone)
+}
+
+// takeSessionBatch 取出最多 size 个正在代理的会话
+func (manager *StratumSessionManager) takeSessionBatch(size int) []*StratumSession {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	batch := make([]*StratumSession, 0, size)
+	for _, session := range manager.sessions {
+		if len(batch) >= size {
+			break
+		}
+		batch = append(batch, session)
+	}
+	return batch
+}
+
+// Drainable 使StratumSwitcher在收到SIGTERM时排空
+// 排空过程中再次收到SIGTERM将立即退出。
+func (manager *StratumSessionManager) Drainable() {
+	go signalTERMListener(func() {
+		err := manager.Drain(0)
+		if err == ErrAlreadyDraining {
+			glog.Warning("SIGTERM received again while draining, exit now.")
+			glog.Flush()
+			os.Exit(1)
+		}
+	})
+}
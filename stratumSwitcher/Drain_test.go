@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newDrainTestManager 创建带有 sessionNum 个正在代理的会话的管理器
+func newDrainTestManager(t *testing.T, sessionNum int) (manager *StratumSessionManager, clientSides []net.Conn) {
+	var err error
+
+	manager = new(StratumSessionManager)
+	manager.sessions = make(StratumSessionMap)
+	manager.zookeeperManager = new(ZookeeperManager)
+	manager.metrics = NewSwitcherMetrics()
+	manager.drainDone = make(chan struct{})
+	manager.drainTimeout = 50 * time.Millisecond
+	manager.drainBatchSize = 2
+	manager.drainBatchInterval = 10 * time.Millisecond
+	manager.sessionIDManager, err = NewSessionIDManager(1, 24)
+	if err != nil {
+		t.Fatalf("NewSessionIDManager failed: %s", err)
+	}
+
+	manager.tcpListener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+
+	for i := 0; i < sessionNum; i++ {
+		sessionID, _ := manager.sessionIDManager.AllocSessionID()
+		clientConn, clientSide := net.Pipe()
+		session := NewStratumSession(manager, clientConn, sessionID)
+		session.runningStat = StatRunning
+		manager.RegisterStratumSession(session)
+		clientSides = append(clientSides, clientSide)
+	}
+	return
+}
+
+func TestStratumSessionManagerDrain(t *testing.T) {
+	manager, clientSides := newDrainTestManager(t, 5)
+	for _, clientSide := range clientSides {
+		defer clientSide.Close()
+	}
+
+	serveExited := make(chan struct{})
+	go func() {
+		manager.serve(manager.tcpListener, nil)
+		close(serveExited)
+	}()
+
+	err := manager.Drain(0)
+	if err != nil {
+		t.Fatalf("Drain failed: %s", err)
+	}
+	if err := manager.Drain(0); err != ErrAlreadyDraining {
+		t.Errorf("the second Drain should return ErrAlreadyDraining, but got %v", err)
+	}
+
+	status := manager.GetDrainStatus()
+	if !status.Draining || status.Sessions != 5 {
+		t.Errorf("wrong drain status: %+v", status)
+	}
+
+	select {
+	case <-serveExited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("serve should return after the listener is closed")
+	}
+	if _, err := net.Dial("tcp", manager.tcpListener.Addr().String()); err == nil {
+		t.Errorf("new connections should be refused while draining")
+	}
+
+	// 截止时间之前会话继续代理
+	time.Sleep(20 * time.Millisecond)
+	if sessions := manager.GetDrainStatus().Sessions; sessions != 5 {
+		t.Errorf("sessions should not be closed before the deadline, but %d left", sessions)
+	}
+
+	select {
+	case <-manager.drainDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("drain should finish after all sessions closed")
+	}
+	if sessions := manager.GetDrainStatus().Sessions; sessions != 0 {
+		t.Errorf("all sessions should be closed, but %d left", sessions)
+	}
+	if used, _ := manager.sessionIDManager.GetUsage(); used != 0 {
+		t.Errorf("all session IDs should be freed, but %d used", used)
+	}
+}
+
+func TestTakeSessionBatch(t *testing.T) {
+	manager, clientSides := newDrainTestManager(t, 5)
+	defer manager.tcpListener.Close()
+	for _, clientSide := range clientSides {
+		defer clientSide.Close()
+	}
+
+	for _, expected := range []int{2, 2, 1, 0} {
+		batch := manager.takeSessionBatch(manager.drainBatchSize)
+		if len(batch) != expected {
+			t.Fatalf("batch size should be %d, but is %d", expected, len(batch))
+		}
+		for _, session := range batch {
+			session.Stop(StopReasonDrain)
+		}
+	}
+}
@@ -36,6 +36,8 @@ func (err *StratumError) ToJSONRPCArray(extData interface{}) JSONRPCArray {
 var (
 	// ErrBufIOReadTimeout 从bufio.Reader中读取数据时超时
 	ErrBufIOReadTimeout = errors.New("BufIO Read Timeout")
+	// ErrAlreadyDraining 已经在排空
+	ErrAlreadyDraining = errors.New("Already Draining")
 	// ErrSessionIDFull SessionID已满（所有可用值均已分配）
 	ErrSessionIDFull = errors.New("Session ID is Full")
 	// ErrSessionIDOccupied SessionID已被占用（恢复SessionID时）
@@ -48,6 +50,8 @@ var (
 	ErrAuthorizeFailed = errors.New("Authorize Failed")
 	// ErrTooMuchPendingAutoRegReq 太多等待中的自动注册请求
 	ErrTooMuchPendingAutoRegReq = errors.New("Too much pending auto reg request")
+	// ErrBTCAgentMessageInvalid BTCAgent的ex-message格式错误
+	ErrBTCAgentMessageInvalid = errors.New("BTCAgent Message Invalid")
 )
 
 var (
@@ -69,6 +73,15 @@ var (
 
 	// StratumErrUnknownChainType 未知区块链类型
 	StratumErrUnknownChainType = NewStratumError(500, "Unknown Chain Type")
+
+	// StratumErrTooManyConnsFromIP 来自该IP的并发连接过多
+	StratumErrTooManyConnsFromIP = NewStratumError(601, "Too Many Connections From IP")
+	// StratumErrConnRateLimited 来自该IP的新建连接过于频繁
+	StratumErrConnRateLimited = NewStratumError(602, "Connection Rate Limit Exceeded")
+	// StratumErrServerBusy 服务器接受连接的速率已达上限
+	StratumErrServerBusy = NewStratumError(603, "Server Busy")
+	// StratumErrIPBanned IP已被临时封禁
+	StratumErrIPBanned = NewStratumError(604, "IP Banned")
 )
 
 var (
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 会话事件类型
+const (
+	// EventConnect 矿机连接
+	EventConnect = "connect"
+	// EventSubscribe 矿机订阅
+	EventSubscribe = "subscribe"
+	// EventAuthorize 向服务器认证（包括重连和切换币种后的认证）
+	EventAuthorize = "authorize"
+	// EventSwitch 切换币种
+	EventSwitch = "switch"
+	// EventReconnect 重连服务器（切换币种或服务器断开后）
+	EventReconnect = "reconnect"
+	// EventResume 平滑重启后恢复会话
+	EventResume = "resume"
+	// EventStop 会话结束
+	EventStop = "stop"
+)
+
+// 会话结束的原因
+const (
+	// StopReasonClientClosed 矿机断开了连接
+	StopReasonClientClosed = "client_closed"
+	// StopReasonProtocolUnknown 无法识别的协议
+	StopReasonProtocolUnknown = "protocol_unknown"
+	// StopReasonFindWorkerFailed 读取矿工名失败（超时或格式错误）
+	StopReasonFindWorkerFailed = "find_worker_failed"
+	// StopReasonFindCoinFailed 子账户不存在或自动注册失败
+	StopReasonFindCoinFailed = "find_coin_failed"
+	// StopReasonServerFailed 连接服务器或向服务器认证失败
+	StopReasonServerFailed = "server_failed"
+	// StopReasonReconnectFailed 重连服务器失败
+	StopReasonReconnectFailed = "reconnect_failed"
+	// StopReasonResumeFailed 平滑重启后恢复会话失败
+	StopReasonResumeFailed = "resume_failed"
+	// StopReasonAdminKick 被管理API断开
+	StopReasonAdminKick = "admin_kick"
+	// StopReasonDrain 排空
+	StopReasonDrain = "drain"
+	// StopReasonCoinRemoved 重新载入配置后币种被移除
+	StopReasonCoinRemoved = "coin_removed"
+)
+
+// SessionEvent 会话事件，以JSON格式输出，字段名保持稳定
+// 不适用于该事件的字段将被省略。
+type SessionEvent struct {
+	Time       string `json:"time"`
+	Event      string `json:"event"`
+	ServerID   uint8  `json:"server_id"`
+	SessionID  string `json:"session_id"`
+	ClientAddr string `json:"client_addr"`
+	Protocol   string `json:"protocol,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+	Worker     string `json:"worker,omitempty"`
+	Subaccount string `json:"subaccount,omitempty"`
+	Coin       string `json:"coin,omitempty"`
+	ServerURL  string `json:"server_url,omitempty"`
+	// authorize：发给服务器的矿工名及附加的子账户名后缀（未附加后缀时为空）
+	AuthWorker string `json:"auth_worker,omitempty"`
+	UserSuffix string `json:"user_suffix,omitempty"`
+	// switch：切换前后的币种
+	OldCoin string `json:"old_coin,omitempty"`
+	NewCoin string `json:"new_coin,omitempty"`
+	// switch / reconnect / authorize
+	ReconnectCounter uint32 `json:"reconnect_counter,omitempty"`
+	// authorize / reconnect / resume 的结果
+	Success *bool `json:"success,omitempty"`
+	// stop：结束原因及会话持续的秒数
+	Reason           string `json:"reason,omitempty"`
+	ConnectedSeconds int64  `json:"connected_seconds,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// setResult 设置事件的结果
+func (event *SessionEvent) setResult(err error) *SessionEvent {
+	success := err == nil
+	event.Success = &success
+	if err != nil {
+		event.Error = err.Error()
+	}
+	return event
+}
+
+// EventSink 会话事件的输出目标
+// WriteEvent 会被多个会话并发调用，实现须线程安全。
+type EventSink interface {
+	WriteEvent(event *SessionEvent) error
+}
+
+// JSONLinesEventSink 将事件以每行一个JSON对象的格式追加到文件
+type JSONLinesEventSink struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+}
+
+// NewJSONLinesEventSink 创建输出到文件的事件输出目标
+func NewJSONLinesEventSink(path string) (sink *JSONLinesEventSink, err error) {
+	sink = new(JSONLinesEventSink)
+	sink.path = path
+	sink.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	return
+}
+
+// WriteEvent 写入一个事件
+func (sink *JSONLinesEventSink) WriteEvent(event *SessionEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	_, err = sink.file.Write(line)
+	return err
+}
+
+// Reopen 重新打开文件（用于日志轮转）
+func (sink *JSONLinesEventSink) Reopen() error {
+	file, err := os.OpenFile(sink.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	sink.lock.Lock()
+	oldFile := sink.file
+	sink.file = file
+	sink.lock.Unlock()
+
+	return oldFile.Close()
+}
+
+// SetEventSink 设置会话事件的输出目标，为空表示不输出
+func (manager *StratumSessionManager) SetEventSink(sink EventSink) {
+	manager.eventSink = sink
+}
+
+// emitEvent 输出会话事件
+func (manager *StratumSessionManager) emitEvent(event *SessionEvent) {
+	if manager.eventSink == nil {
+		return
+	}
+
+	err := manager.eventSink.WriteEvent(event)
+	if err != nil {
+		glog.Warning("Write Session Event Failed: ", event.Event, "; ", event.SessionID, "; ", err)
+	}
+}
+
+// reopenEventSink 重新打开事件输出文件（若输出目标支持）
+func (manager *StratumSessionManager) reopenEventSink() {
+	sink, ok := manager.eventSink.(interface{ Reopen() error })
+	if !ok {
+		return
+	}
+
+	err := sink.Reopen()
+	if err != nil {
+		glog.Error("Reopen Event Log Failed: ", err)
+	}
+}
+
+// newEvent 创建带有会话公共字段的事件
+func (session *StratumSession) newEvent(eventType string) *SessionEvent {
+	event := &SessionEvent{
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		Event:      eventType,
+		SessionID:  Uint32ToHex(session.sessionID),
+		ClientAddr: session.clientIPPort,
+		Worker:     session.fullWorkerName,
+		Subaccount: session.subaccountName,
+		Coin:       session.miningCoin,
+		ServerURL:  session.serverURL,
+		Protocol:   session.protocolType.ToString(),
+	}
+	if session.manager != nil {
+		event.ServerID = session.manager.serverID
+	}
+	return event
+}
+
+// emitEvent 输出会话事件
+func (session *StratumSession) emitEvent(event *SessionEvent) {
+	if session.manager == nil {
+		return
+	}
+	session.manager.emitEvent(event)
+}
+
+// getClientUserAgent 获取矿机在 mining.subscribe 中发送的 user agent
+func (session *StratumSession) getClientUserAgent() string {
+	if session.stratumSubscribeRequest == nil || len(session.stratumSubscribeRequest.Params) < 1 {
+		return ""
+	}
+	userAgent, _ := session.stratumSubscribeRequest.Params[0].(string)
+	return userAgent
+}
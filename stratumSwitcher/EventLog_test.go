@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testEventSink 将事件保存在内存中
+type testEventSink struct {
+	lock   sync.Mutex
+	events []SessionEvent
+}
+
+func (sink *testEventSink) WriteEvent(event *SessionEvent) error {
+	sink.lock.Lock()
+	sink.events = append(sink.events, *event)
+	sink.lock.Unlock()
+	return nil
+}
+
+// waitEvents 等待至少 n 个事件
+func (sink *testEventSink) waitEvents(n int) []SessionEvent {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		sink.lock.Lock()
+		if len(sink.events) >= n {
+			events := append([]SessionEvent{}, sink.events...)
+			sink.lock.Unlock()
+			return events
+		}
+		sink.lock.Unlock()
+	}
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	return append([]SessionEvent{}, sink.events...)
+}
+
+func TestSessionEventConnectAndStop(t *testing.T) {
+	var err error
+	sink := new(testEventSink)
+
+	manager := new(StratumSessionManager)
+	manager.serverID = 1
+	manager.sessions = make(StratumSessionMap)
+	manager.zookeeperManager = new(ZookeeperManager)
+	manager.metrics = NewSwitcherMetrics()
+	manager.connLimiter = NewConnLimiter(0, 0, 0, 0, 0)
+	manager.SetEventSink(sink)
+	manager.sessionIDManager, err = NewSessionIDManager(1, 24)
+	if err != nil {
+		t.Fatalf("NewSessionIDManager failed: %s", err)
+	}
+
+	serverSide, clientSide := net.Pipe()
+	go manager.RunStratumSession(serverSide, nil)
+	// 不发送任何数据即断开，协议检测失败
+	clientSide.Close()
+
+	events := sink.waitEvents(2)
+	if len(events) != 2 {
+		t.Fatalf("2 events expected, but got %d: %+v", len(events), events)
+	}
+
+	if events[0].Event != EventConnect || events[0].ServerID != 1 || len(events[0].SessionID) != 8 || events[0].Protocol != "" {
+		t.Errorf("wrong connect event: %+v", events[0])
+	}
+	if events[1].Event != EventStop || events[1].Reason != StopReasonProtocolUnknown || events[1].SessionID != events[0].SessionID {
+		t.Errorf("wrong stop event: %+v", events[1])
+	}
+}
+
+func TestJSONLinesEventSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventlog")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.log")
+	sink, err := NewJSONLinesEventSink(path)
+	if err != nil {
+		t.Fatalf("NewJSONLinesEventSink failed: %s", err)
+	}
+
+	event := &SessionEvent{Event: EventSwitch, SessionID: "0100002a", OldCoin: "btc", NewCoin: "bcc", ReconnectCounter: 1}
+	sink.WriteEvent(event)
+
+	// 模拟日志轮转
+	os.Rename(path, path+".1")
+	if err := sink.Reopen(); err != nil {
+		t.Fatalf("Reopen failed: %s", err)
+	}
+	event = &SessionEvent{Event: EventReconnect, SessionID: "0100002a"}
+	sink.WriteEvent(event.setResult(errors.New("connection refused")))
+
+	checkLines := func(path string, expected []map[string]interface{}) {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Open failed: %s", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		i := 0
+		for ; scanner.Scan(); i++ {
+			var fields map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+				t.Fatalf("decode line failed: %s, %s", err, scanner.Text())
+			}
+			if i >= len(expected) {
+				continue
+			}
+			for key, value := range expected[i] {
+				if fields[key] != value {
+					t.Errorf("%s: field %s should be %v, but is %v", path, key, value, fields[key])
+				}
+			}
+			if _, ok := fields["user_suffix"]; ok {
+				t.Errorf("%s: empty fields should be omitted: %s", path, scanner.Text())
+			}
+		}
+		if i != len(expected) {
+			t.Errorf("%s: %d lines expected, but got %d", path, len(expected), i)
+		}
+	}
+
+	checkLines(path+".1", []map[string]interface{}{
+		{"event": "switch", "session_id": "0100002a", "old_coin": "btc", "new_coin": "bcc", "reconnect_counter": float64(1)},
+	})
+	checkLines(path, []map[string]interface{}{
+		{"event": "reconnect", "success": false, "error": "connection refused"},
+	})
+}
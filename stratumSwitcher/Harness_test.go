@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btccom/btcpool-go-modules/coordination"
+)
+
+// 端到端测试的辅助设施：
+//   - testSwitcher：使用内存协调服务（代替Zookeeper）的 stratumSwitcher
+//   - fakeSServer：可编排行为的假 sserver（比特币和以太坊）
+//   - fakeMiner：假矿机
+
+// 等待消息的超时时间
+const harnessTimeout = 5 * time.Second
+
+// 每个 testSwitcher 使用内存存储中不同的目录
+var testSwitcherCounter int32
+
+// fakeMessage 假矿机收到的消息（响应或通知）
+type fakeMessage struct {
+	ID     interface{}   `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+	Result interface{}   `json:"result"`
+	Error  interface{}   `json:"error"`
+}
+
+// fakeSServer 假 sserver
+// 在调用 Start 之前设置各字段以编排其行为。
+type fakeSServer struct {
+	t *testing.T
+	// 名称，认证成功后在 mining.notify 的第一个参数中下发，用于区分矿机连到的服务器
+	name      string
+	chainType ChainType
+	// 判断是否接受认证请求中的矿工名，为空时接受所有矿工名
+	acceptWorker func(worker string) bool
+	// 响应 mining.configure 后通过 mining.set_version_mask 下发的版本掩码（为空时不下发）
+	versionMask string
+
+	listener net.Listener
+	// 收到的所有请求
+	requests chan *JSONRPCRequest
+
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+// newFakeSServer 新建假 sserver（未开始监听）
+func newFakeSServer(t *testing.T, name string, chainType ChainType) *fakeSServer {
+	server := new(fakeSServer)
+	server.t = t
+	server.name = name
+	server.chainType = chainType
+	server.requests = make(chan *JSONRPCRequest, 100)
+	return server
+}
+
+// Start 开始监听
+func (server *fakeSServer) Start() *fakeSServer {
+	var err error
+	server.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		server.t.Fatalf("Listen failed: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := server.listener.Accept()
+			if err != nil {
+				return
+			}
+			server.lock.Lock()
+			server.conns = append(server.conns, conn)
+			server.lock.Unlock()
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+// URL 监听地址
+func (server *fakeSServer) URL() string {
+	return server.listener.Addr().String()
+}
+
+// DropConnections 断开所有连接（服务器仍在监听）
+func (server *fakeSServer) DropConnections() {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	for _, conn := range server.conns {
+		conn.Close()
+	}
+	server.conns = nil
+}
+
+// Close 停止监听并断开所有连接，模拟服务器宕机
+func (server *fakeSServer) Close() {
+	server.listener.Close()
+	server.DropConnections()
+}
+
+// expectRequest 等待指定方法的请求，跳过其他请求
+func (server *fakeSServer) expectRequest(method string) *JSONRPCRequest {
+	server.t.Helper()
+	timeout := time.After(harnessTimeout)
+	for {
+		select {
+		case request := <-server.requests:
+			if request.Method == method {
+				return request
+			}
+		case <-timeout:
+			server.t.Fatalf("%s: waiting for %s timeout", server.name, method)
+			return nil
+		}
+	}
+}
+
+func (server *fakeSServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	write := func(data []byte, err error) {
+		if err == nil {
+			conn.Write(append(data, '\n'))
+		}
+	}
+	respond := func(id interface{}, result interface{}, stratumErr *StratumError) {
+		response := JSONRPCResponse{id, result, stratumErr.ToJSONRPCArray(nil)}
+		write(response.ToJSONBytes(1))
+	}
+	notify := func(method string, params ...interface{}) {
+		request := JSONRPCRequest{nil, method, params, ""}
+		write(request.ToJSONBytes())
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		request, err := NewJSONRPCRequest(line)
+		if err != nil {
+			continue
+		}
+		server.requests <- request
+
+		switch request.Method {
+		case "mining.configure":
+			respond(request.ID, JSONRPCObj{"version-rolling": true, "version-rolling.mask": server.versionMask}, nil)
+			if len(server.versionMask) > 0 {
+				notify("mining.set_version_mask", server.versionMask)
+			}
+
+		case "mining.subscribe":
+			respond(request.ID, server.subscribeResult(request), nil)
+
+		case "mining.authorize", "eth_submitLogin":
+			worker, _ := request.Params[0].(string)
+			if server.acceptWorker != nil && !server.acceptWorker(worker) {
+				respond(request.ID, false, NewStratumError(201, "Invalid Sub-account Name"))
+				continue
+			}
+			respond(request.ID, true, nil)
+			notify("mining.notify", server.name, worker)
+
+		default:
+			respond(request.ID, true, nil)
+		}
+	}
+}
+
+// subscribeResult 按 stratumSwitcher 转发的订阅请求生成响应
+func (server *fakeSServer) subscribeResult(request *JSONRPCRequest) interface{} {
+	if server.chainType == ChainTypeBitcoin {
+		// 参数：user agent, session id, 矿机IP
+		sessionID, _ := request.Params[1].(string)
+		return JSONRPCArray{JSONRPCArray{JSONRPCArray{"mining.set_difficulty", sessionID}, JSONRPCArray{"mining.notify", sessionID}}, sessionID, 8}
+	}
+
+	// 参数：user agent, protocol, session id, 矿机IP
+	userAgent, _ := request.Params[0].(string)
+	protocol, _ := request.Params[1].(string)
+	sessionID, _ := request.Params[2].(string)
+	if !strings.HasPrefix(strings.ToLower(protocol), ethereumStratumNiceHashPrefix) {
+		return true
+	}
+
+	extraNonce := sessionID
+	if strings.HasPrefix(strings.ToLower(userAgent), niceHashClientTypePrefix) {
+		extraNonce = extraNonce[0:4]
+	}
+	return JSONRPCArray{JSONRPCArray{"mining.notify", sessionID, ethereumStratumNiceHashVersion}, extraNonce}
+}
+
+// testSwitcher 使用内存协调服务的 stratumSwitcher
+type testSwitcher struct {
+	t       *testing.T
+	manager *StratumSessionManager
+	// 模拟 switcherAPIServer 等外部进程的协调服务连接，用于写入币种
+	zk       coordination.Backend
+	watchDir string
+}
+
+// newTestSwitcher 新建并启动 stratumSwitcher，servers 为各币种的服务器
+func newTestSwitcher(t *testing.T, chainType string, servers StratumServerInfoMap) *testSwitcher {
+	id := atomic.AddInt32(&testSwitcherCounter, 1)
+
+	conf := ConfigData{
+		ServerID:            1,
+		ChainType:           chainType,
+		ListenAddr:          "127.0.0.1:0",
+		StratumServerMap:    servers,
+		CoordinationBackend: coordination.BackendMemory,
+		ZKSwitcherWatchDir:  fmt.Sprintf("/switcher-test-%d/", id),
+	}
+
+	manager, err := NewStratumSessionManager(conf, RuntimeData{})
+	if err != nil {
+		t.Fatalf("NewStratumSessionManager failed: %s", err)
+	}
+
+	manager.tcpListener, err = net.Listen("tcp", conf.ListenAddr)
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	go manager.serve(manager.tcpListener, nil)
+
+	// 每个 testSwitcher 使用独立的内存存储，避免测试间互相影响
+	store := coordination.NewMemoryStore()
+	manager.zookeeperManager.zookeeperConn.Close()
+	manager.zookeeperManager = newZookeeperManager(store.Connect())
+
+	switcher := &testSwitcher{t, manager, store.Connect(), conf.ZKSwitcherWatchDir}
+	if err := manager.zookeeperManager.createZookeeperPath(switcher.watchDir); err != nil {
+		t.Fatalf("createZookeeperPath failed: %s", err)
+	}
+	return switcher
+}
+
+// Close 排空 stratumSwitcher（停止监听并立即断开所有会话），然后关闭协调服务连接
+func (switcher *testSwitcher) Close() {
+	switcher.manager.Drain(time.Nanosecond)
+	switcher.zk.Close()
+}
+
+// setCoin 写入子账户（或矿工）的币种，与 switcherAPIServer 的写法相同
+func (switcher *testSwitcher) setCoin(name string, coin string) {
+	switcher.t.Helper()
+	path := switcher.watchDir + name
+	exists, _, err := switcher.zk.Exists(path)
+	if err == nil && exists {
+		_, err = switcher.zk.Set(path, []byte(coin), -1)
+	} else if err == nil {
+		_, err = switcher.zk.Create(path, []byte(coin), 0)
+	}
+	if err != nil {
+		switcher.t.Fatalf("set coin of %s failed: %s", name, err)
+	}
+}
+
+// fakeMiner 假矿机
+type fakeMiner struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	nextID int
+}
+
+// dialFakeMiner 连接到 stratumSwitcher
+func dialFakeMiner(t *testing.T, switcher *testSwitcher) *fakeMiner {
+	conn, err := net.Dial("tcp", switcher.manager.tcpListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	return &fakeMiner{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Close 断开连接
+func (miner *fakeMiner) Close() {
+	miner.conn.Close()
+}
+
+// send 发送请求，返回请求ID
+func (miner *fakeMiner) send(method string, params ...interface{}) float64 {
+	miner.t.Helper()
+	miner.nextID++
+	data, _ := json.Marshal(map[string]interface{}{"id": miner.nextID, "method": method, "params": params})
+	if _, err := miner.conn.Write(append(data, '\n')); err != nil {
+		miner.t.Fatalf("write %s failed: %s", method, err)
+	}
+	return float64(miner.nextID)
+}
+
+// read 读取一条消息
+func (miner *fakeMiner) read() *fakeMessage {
+	miner.t.Helper()
+	miner.conn.SetReadDeadline(time.Now().Add(harnessTimeout))
+	line, err := miner.reader.ReadBytes('\n')
+	if err != nil {
+		miner.t.Fatalf("read failed: %s", err)
+	}
+	message := new(fakeMessage)
+	if err := json.Unmarshal(line, message); err != nil {
+		miner.t.Fatalf("decode %s failed: %s", line, err)
+	}
+	return message
+}
+
+// expectResponse 等待指定ID的响应，跳过通知
+func (miner *fakeMiner) expectResponse(id float64) *fakeMessage {
+	miner.t.Helper()
+	for {
+		message := miner.read()
+		if len(message.Method) < 1 && message.ID == id {
+			return message
+		}
+	}
+}
+
+// expectNotify 等待指定方法的通知，跳过其他消息
+func (miner *fakeMiner) expectNotify(method string) *fakeMessage {
+	miner.t.Helper()
+	for {
+		message := miner.read()
+		if message.Method == method {
+			return message
+		}
+	}
+}
+
+// expectClosed 等待 stratumSwitcher 断开连接
+func (miner *fakeMiner) expectClosed() {
+	miner.t.Helper()
+	miner.conn.SetReadDeadline(time.Now().Add(harnessTimeout))
+	for {
+		if _, err := miner.reader.ReadBytes('\n'); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				miner.t.Fatal("waiting for connection closed timeout")
+			}
+			return
+		}
+	}
+}
+
+// login 订阅并认证，返回认证响应
+func (miner *fakeMiner) login(userAgent string, worker string) *fakeMessage {
+	miner.t.Helper()
+	miner.expectResponse(miner.send("mining.subscribe", userAgent))
+	return miner.expectResponse(miner.send("mining.authorize", worker, "x"))
+}
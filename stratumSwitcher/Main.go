@@ -44,5 +44,19 @@ func main() {
 		glog.Fatal("create session manager failed: ", err)
 		return
 	}
+
+	// 在HTTP Debug端口上导出运行指标
+	if configData.EnableHTTPDebug {
+		http.HandleFunc("/metrics", sessionManager.ServeMetrics)
+	}
+
+	// 在运行时重新载入服务器列表
+	sessionManager.Reloadable(*configFilePath)
+
+	// 开启管理API
+	if configData.EnableAdminAPI {
+		go sessionManager.RunAdminAPI(configData.AdminAPIListenAddr, configData.AdminAPIUser, configData.AdminAPIPassword)
+	}
+
 	sessionManager.Run(runtimeData)
 }
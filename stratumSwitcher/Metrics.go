@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 导出的指标名前缀
+const metricsNamePrefix = "stratum_switcher_"
+
+// metricCounterVec 带标签的计数器
+type metricCounterVec struct {
+	lock sync.Mutex
+	// 标签名
+	labelNames []string
+	// 以标签值（用"\x00"连接）为键的计数值
+	values map[string]uint64
+}
+
+// newMetricCounterVec 创建带标签的计数器
+func newMetricCounterVec(labelNames ...string) *metricCounterVec {
+	counter := new(metricCounterVec)
+	counter.labelNames = labelNames
+	counter.values = make(map[string]uint64)
+	return counter
+}
+
+// Inc 计数器加一，标签值的个数须与标签名相同
+func (counter *metricCounterVec) Inc(labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+
+	counter.lock.Lock()
+	counter.values[key]++
+	counter.lock.Unlock()
+}
+
+// Get 获取计数值
+func (counter *metricCounterVec) Get(labelValues ...string) uint64 {
+	key := strings.Join(labelValues, "\x00")
+
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	return counter.values[key]
+}
+
+// writeTo 以 Prometheus 文本格式输出
+func (counter *metricCounterVec) writeTo(w io.Writer, name string, help string) {
+	counter.lock.Lock()
+	keys := make([]string, 0, len(counter.values))
+	for key := range counter.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]uint64, len(keys))
+	for i, key := range keys {
+		values[i] = counter.values[key]
+	}
+	counter.lock.Unlock()
+
+	writeMetricHeader(w, name, help, "counter")
+	for i, key := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", name, formatMetricLabels(counter.labelNames, strings.Split(key, "\x00")), values[i])
+	}
+}
+
+// SwitcherMetrics StratumSwitcher 的运行指标
+// 计数器在事件发生时累加，会话数等瞬时值在导出时从会话管理器中统计。
+type SwitcherMetrics struct {
+	// 币种切换次数，标签为切换前后的币种
+	coinSwitches *metricCounterVec
+	// 等待切换期间币种被改回而取消的切换次数，标签为当前币种
+	coinSwitchesCancelled *metricCounterVec
+	// 重连服务器的尝试次数（每次连接尝试计一次）
+	reconnectAttempts *metricCounterVec
+	// 重连服务器失败（放弃重连）的次数
+	reconnectFailures *metricCounterVec
+	// 向服务器认证失败的次数
+	authorizeFailures *metricCounterVec
+	// 被连接限制器拒绝的连接数，标签为拒绝原因
+	rejectedConnections *metricCounterVec
+}
+
+// NewSwitcherMetrics 创建运行指标对象
+func NewSwitcherMetrics() (metrics *SwitcherMetrics) {
+	metrics = new(SwitcherMetrics)
+	metrics.coinSwitches = newMetricCounterVec("from", "to")
+	metrics.coinSwitchesCancelled = newMetricCounterVec("coin")
+	metrics.reconnectAttempts = newMetricCounterVec("coin")
+	metrics.reconnectFailures = newMetricCounterVec("coin")
+	metrics.authorizeFailures = newMetricCounterVec("coin")
+	metrics.rejectedConnections = newMetricCounterVec("reason")
+	return
+}
+
+// writeMetricHeader 输出指标的 HELP 和 TYPE 行
+func writeMetricHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+// formatMetricLabels 生成形如 {a="1",b="2"} 的标签字符串
+func formatMetricLabels(labelNames []string, labelValues []string) string {
+	if len(labelNames) == 0 {
+		return ""
+	}
+
+	labels := make([]string, len(labelNames))
+	for i, name := range labelNames {
+		value := ""
+		if i < len(labelValues) {
+			value = labelValues[i]
+		}
+		labels[i] = name + "=\"" + escapeMetricLabelValue(value) + "\""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// escapeMetricLabelValue 转义标签值中的特殊字符
+func escapeMetricLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return value
+}
+
+// writeGaugeMap 将以单个标签值为键的散列表输出为 gauge
+func writeGaugeMap(w io.Writer, name string, help string, labelName string, values map[string]int) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writeMetricHeader(w, name, help, "gauge")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", name, formatMetricLabels([]string{labelName}, []string{key}), values[key])
+	}
+}
+
+// WriteMetrics 以 Prometheus 文本格式输出会话管理器的全部指标
+func (manager *StratumSessionManager) WriteMetrics(w io.Writer) {
+	coinSessions := make(map[string]int)
+	protocolSessions := make(map[string]int)
+
+	// 先复制会话列表，释放 manager.lock 之后再加会话锁读取币种（与重连时的加锁顺序一致）
+	manager.lock.Lock()
+	sessions := make([]*StratumSession, 0, len(manager.sessions))
+	for _, session := range manager.sessions {
+		sessions = append(sessions, session)
+	}
+	manager.lock.Unlock()
+
+	for _, session := range sessions {
+		coinSessions[session.getMiningCoin()]++
+		protocolSessions[session.protocolType.ToString()]++
+	}
+
+	writeGaugeMap(w, metricsNamePrefix+"sessions", "Number of proxying sessions by mining coin.", "coin", coinSessions)
+	writeGaugeMap(w, metricsNamePrefix+"protocol_sessions", "Number of proxying sessions by stratum protocol.", "protocol", protocolSessions)
+
+	manager.metrics.coinSwitches.writeTo(w, metricsNamePrefix+"coin_switches_total", "Number of coin switches.")
+	manager.metrics.coinSwitchesCancelled.writeTo(w, metricsNamePrefix+"coin_switches_cancelled_total", "Number of delayed coin switches cancelled because the coin was changed back.")
+	manager.metrics.reconnectAttempts.writeTo(w, metricsNamePrefix+"reconnect_attempts_total", "Number of attempts to reconnect stratum servers.")
+	manager.metrics.reconnectFailures.writeTo(w, metricsNamePrefix+"reconnect_failures_total", "Number of sessions dropped after reconnecting failed.")
+	manager.metrics.authorizeFailures.writeTo(w, metricsNamePrefix+"authorize_failures_total", "Number of failed subscribe/authorize exchanges with stratum servers.")
+	manager.metrics.rejectedConnections.writeTo(w, metricsNamePrefix+"rejected_connections_total", "Number of connections rejected by the connection limiter.")
+
+	if manager.sessionIDManager != nil {
+		used, capacity := manager.sessionIDManager.GetUsage()
+		writeMetricHeader(w, metricsNamePrefix+"session_ids_used", "Number of allocated session IDs.", "gauge")
+		fmt.Fprintf(w, "%ssession_ids_used %d\n", metricsNamePrefix, used)
+		writeMetricHeader(w, metricsNamePrefix+"session_ids_capacity", "Number of session IDs that can be allocated.", "gauge")
+		fmt.Fprintf(w, "%ssession_ids_capacity %d\n", metricsNamePrefix, capacity)
+	}
+
+	if manager.upstreamHealth != nil {
+		manager.upstreamHealth.writeMetrics(w, metricsNamePrefix+"upstream_healthy", manager.getStratumServerInfoMap())
+	}
+
+	draining := 0
+	if manager.IsDraining() {
+		draining = 1
+	}
+	writeMetricHeader(w, metricsNamePrefix+"draining", "Whether the switcher is draining (1) or not (0).", "gauge")
+	fmt.Fprintf(w, "%sdraining %d\n", metricsNamePrefix, draining)
+
+	writeMetricHeader(w, metricsNamePrefix+"autoreg_allow_users", "Number of remaining slots for pending auto register requests.", "gauge")
+	fmt.Fprintf(w, "%sautoreg_allow_users %d\n", metricsNamePrefix, atomic.LoadInt64(&manager.autoRegAllowUsers))
+	writeMetricHeader(w, metricsNamePrefix+"autoreg_max_wait_users", "Configured limit of pending auto register requests.", "gauge")
+	fmt.Fprintf(w, "%sautoreg_max_wait_users %d\n", metricsNamePrefix, atomic.LoadInt64(&manager.autoRegMaxWaitUsers))
+}
+
+// ServeMetrics 处理 /metrics 请求
+func (manager *StratumSessionManager) ServeMetrics(w http.ResponseWriter, req *http.Request) {
+	var buffer bytes.Buffer
+	manager.WriteMetrics(&buffer)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buffer.Bytes())
+}
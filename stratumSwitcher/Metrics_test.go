@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSwitcherMetrics(t *testing.T) {
+	manager := new(StratumSessionManager)
+	manager.sessions = make(StratumSessionMap)
+	manager.metrics = NewSwitcherMetrics()
+	manager.autoRegAllowUsers = 48
+	manager.autoRegMaxWaitUsers = 50
+
+	var err error
+	manager.sessionIDManager, err = NewSessionIDManager(1, 16)
+	if err != nil {
+		t.Errorf("NewSessionIDManager return an error: %s", err.Error())
+		return
+	}
+
+	coins := []string{"btc", "btc", "bcc"}
+	for _, coin := range coins {
+		sessionID, err := manager.sessionIDManager.AllocSessionID()
+		if err != nil {
+			t.Errorf("AllocSessionID return an error: %s", err.Error())
+			return
+		}
+		session := new(StratumSession)
+		session.sessionID = sessionID
+		session.miningCoin = coin
+		session.protocolType = ProtocolBitcoinStratum
+		manager.sessions[sessionID] = session
+	}
+
+	manager.metrics.coinSwitches.Inc("btc", "bcc")
+	manager.metrics.coinSwitches.Inc("btc", "bcc")
+	manager.metrics.reconnectFailures.Inc("b\"c\\c")
+
+	var buffer bytes.Buffer
+	manager.WriteMetrics(&buffer)
+	output := buffer.String()
+
+	expectedLines := []string{
+		`stratum_switcher_sessions{coin="bcc"} 1`,
+		`stratum_switcher_sessions{coin="btc"} 2`,
+		`stratum_switcher_protocol_sessions{protocol="bitcoin-stratum"} 3`,
+		`stratum_switcher_coin_switches_total{from="btc",to="bcc"} 2`,
+		`stratum_switcher_reconnect_failures_total{coin="b\"c\\c"} 1`,
+		`stratum_switcher_session_ids_used 3`,
+		`stratum_switcher_session_ids_capacity 65536`,
+		`stratum_switcher_autoreg_allow_users 48`,
+		`stratum_switcher_autoreg_max_wait_users 50`,
+		`# TYPE stratum_switcher_authorize_failures_total counter`,
+	}
+
+	for _, line := range expectedLines {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("metrics output should contain %q, but it is:\n%s", line, output)
+		}
+	}
+}
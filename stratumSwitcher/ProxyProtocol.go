@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HAProxy PROXY 协议（v1/v2）
+// <https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt>
+//
+// 负载均衡器在连接建立后首先发送一个PROXY头，其中包含矿机的真实地址。
+// 解析时只读取PROXY头本身，不会多读后续的Stratum数据。
+
+// PROXY v2 签名
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY v1 头的最大长度（包括结尾的CRLF）
+const proxyProtocolV1MaxLength = 107
+
+// PROXY 头的读取超时时间
+const proxyProtocolTimeoutSeconds = 15
+
+var (
+	// ErrProxyProtocolInvalidHeader 非法的PROXY头
+	ErrProxyProtocolInvalidHeader = errors.New("Invalid PROXY Protocol Header")
+	// ErrProxyProtocolMissingHeader 连接上没有PROXY头
+	ErrProxyProtocolMissingHeader = errors.New("Missing PROXY Protocol Header")
+)
+
+// proxyProtocolConn 以PROXY头中的地址做为 RemoteAddr 的连接
+type proxyProtocolConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+// RemoteAddr 矿机的真实地址
+func (conn *proxyProtocolConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+// unwrapProxyProtocolConn 返回被 proxyProtocolConn 包装的原始连接
+func unwrapProxyProtocolConn(conn net.Conn) net.Conn {
+	if ppConn, ok := conn.(*proxyProtocolConn); ok {
+		return ppConn.Conn
+	}
+	return conn
+}
+
+// wrapProxyProtocolConn 读取并解析PROXY头，返回以真实地址做为 RemoteAddr 的连接
+func wrapProxyProtocolConn(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeoutSeconds * time.Second))
+	remoteAddr, err := readProxyProtocolHeader(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		return nil, err
+	}
+	if remoteAddr == nil {
+		// LOCAL / UNKNOWN：使用连接本身的地址
+		return conn, nil
+	}
+	return &proxyProtocolConn{conn, remoteAddr}, nil
+}
+
+// readProxyProtocolHeader 读取PROXY头并返回其中的源地址。
+// 头中未携带地址（v2 LOCAL 命令、v1 UNKNOWN 或不支持的地址族）时返回 nil。
+func readProxyProtocolHeader(reader io.Reader) (net.Addr, error) {
+	// v1 头至少有 "PROXY UNKNOWN\r\n" 15个字节，v2 签名为12个字节，因此先读取12个字节不会多读
+	prefix := make([]byte, len(proxyProtocolV2Signature))
+	_, err := io.ReadFull(reader, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(prefix, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(reader)
+	}
+	if bytes.HasPrefix(prefix, []byte("PROXY ")) {
+		return readProxyProtocolV1(reader, prefix)
+	}
+	return nil, ErrProxyProtocolMissingHeader
+}
+
+// readProxyProtocolV1 解析文本格式的头，如 "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func readProxyProtocolV1(reader io.Reader, prefix []byte) (net.Addr, error) {
+	line := prefix
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, ErrProxyProtocolInvalidHeader
+		}
+		_, err := io.ReadFull(reader, b)
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrProxyProtocolInvalidHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrProxyProtocolInvalidHeader
+	}
+	if (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, ErrProxyProtocolInvalidHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 解析二进制格式的头（签名之后的部分）
+// | ver_cmd (1) | fam (1) | len (2, 大端序) | 地址 (len) |
+func readProxyProtocolV2(reader io.Reader) (net.Addr, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+
+	version := header[0] >> 4
+	command := header[0] & 0x0f
+	family := header[1]
+	length := binary.BigEndian.Uint16(header[2:4])
+
+	if version != 2 || command > 1 {
+		return nil, ErrProxyProtocolInvalidHeader
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// LOCAL 命令：负载均衡器自己的连接（如健康检查）
+	if command == 0 {
+		return nil, nil
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, ErrProxyProtocolInvalidHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte{}, payload[0:4]...)),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, ErrProxyProtocolInvalidHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte{}, payload[0:16]...)),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+
+	default:
+		// UNSPEC、UDP或UNIX套接字，忽略其中的地址
+		return nil, nil
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func makeProxyProtocolV2Header(command byte, family byte, addr []byte) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addr)))
+	return append(header, addr...)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v2IPv4Addr := []byte{
+		192, 168, 1, 10, // 源地址
+		10, 0, 0, 1, // 目的地址
+		0xdc, 0x05, // 源端口 56325
+		0x0d, 0x05, // 目的端口 3333
+	}
+	v2IPv6Addr := make([]byte, 36)
+	copy(v2IPv6Addr[0:16], net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(v2IPv6Addr[32:34], 4444)
+
+	testCases := []struct {
+		header   []byte
+		expected string
+	}{
+		{[]byte("PROXY TCP4 192.168.1.10 10.0.0.1 56324 3333\r\n"), "192.168.1.10:56324"},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 4444 3333\r\n"), "[2001:db8::1]:4444"},
+		{[]byte("PROXY UNKNOWN\r\n"), ""},
+		{makeProxyProtocolV2Header(1, 0x11, v2IPv4Addr), "192.168.1.10:56325"},
+		{makeProxyProtocolV2Header(1, 0x21, v2IPv6Addr), "[2001:db8::1]:4444"},
+		{makeProxyProtocolV2Header(0, 0x00, nil), ""},
+	}
+
+	stratumData := []byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n")
+
+	for _, testCase := range testCases {
+		reader := bytes.NewReader(append(append([]byte{}, testCase.header...), stratumData...))
+		addr, err := readProxyProtocolHeader(reader)
+		if err != nil {
+			t.Errorf("readProxyProtocolHeader(%q) returned an error: %s", testCase.header, err)
+			continue
+		}
+
+		addrStr := ""
+		if addr != nil {
+			addrStr = addr.String()
+		}
+		if addrStr != testCase.expected {
+			t.Errorf("readProxyProtocolHeader(%q) = %s, expected %s", testCase.header, addrStr, testCase.expected)
+		}
+
+		// 不能多读PROXY头之后的数据
+		remaining, _ := ioutil.ReadAll(reader)
+		if !bytes.Equal(remaining, stratumData) {
+			t.Errorf("readProxyProtocolHeader(%q) over-read, remaining: %q", testCase.header, remaining)
+		}
+	}
+}
+
+func TestReadProxyProtocolHeaderInvalid(t *testing.T) {
+	invalidHeaders := [][]byte{
+		[]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n"),
+		[]byte("PROXY TCP4 192.168.1.10 10.0.0.1 56324\r\n"),
+		[]byte("PROXY TCP4 2001:db8::1 10.0.0.1 56324 3333\r\n"),
+		append([]byte("PROXY TCP4 "), bytes.Repeat([]byte{'1'}, 200)...),
+		makeProxyProtocolV2Header(1, 0x11, []byte{1, 2, 3}),
+	}
+
+	for _, header := range invalidHeaders {
+		_, err := readProxyProtocolHeader(bytes.NewReader(header))
+		if err == nil {
+			t.Errorf("readProxyProtocolHeader(%q) should return an error", header)
+		}
+	}
+}
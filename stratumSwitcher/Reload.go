@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 被移除的币种上的会话的处理策略
+const (
+	// RemovedCoinPolicyClose 断开会话，矿机重连后按Zookeeper中的币种重新选择服务器
+	RemovedCoinPolicyClose = "close"
+	// RemovedCoinPolicyMigrate 将会话切换到 RemovedCoinMigrateTo 指定的币种（无法切换的会话将被断开）
+	RemovedCoinPolicyMigrate = "migrate"
+)
+
+var (
+	// ErrReloadEmptyServerMap 重新载入的服务器列表为空
+	ErrReloadEmptyServerMap = errors.New("StratumServerMap is empty")
+	// ErrUnknownRemovedCoinPolicy 未知的币种移除策略
+	ErrUnknownRemovedCoinPolicy = errors.New("Unknown RemovedCoinPolicy")
+)
+
+// ReloadableConfig 可以在运行时重新载入的配置
+// 其他配置项仍需通过平滑重启（USR2）生效。
+type ReloadableConfig struct {
+	StratumServerMap StratumServerInfoMap
+	// 为空表示不修改
+	AutoRegMaxWaitUsers *int64
+}
+
+// parseReloadableConfig 解析Zookeeper配置节点中的JSON，格式与配置文件相同，只读取可重新载入的字段
+func parseReloadableConfig(data []byte) (conf ReloadableConfig, err error) {
+	err = json.Unmarshal(data, &conf)
+	return
+}
+
+// checkRemovedCoinPolicy 检查币种移除策略是否合法，为空时返回默认值
+func checkRemovedCoinPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return RemovedCoinPolicyClose, nil
+	case RemovedCoinPolicyClose, RemovedCoinPolicyMigrate:
+		return policy, nil
+	default:
+		return "", ErrUnknownRemovedCoinPolicy
+	}
+}
+
+// newUpstreamTLSConfigs 为开启了TLS的币种创建连接服务器使用的TLS配置
+func newUpstreamTLSConfigs(serverInfoMap StratumServerInfoMap) (configs map[string]*tls.Config, err error) {
+	configs = make(map[string]*tls.Config)
+	for coin, serverInfo := range serverInfoMap {
+		if !serverInfo.EnableTLS {
+			continue
+		}
+		configs[coin], err = NewTLSClientConfig(serverInfo.TLSCAFile, serverInfo.TLSServerName)
+		if err != nil {
+			err = errors.New("Cannot create TLS config of " + coin + ": " + err.Error())
+			return
+		}
+	}
+	return
+}
+
+// getStratumServerInfo 获取币种对应的服务器信息
+func (manager *StratumSessionManager) getStratumServerInfo(coin string) (serverInfo StratumServerInfo, ok bool) {
+	manager.serverInfoLock.RLock()
+	serverInfo, ok = manager.stratumServerInfoMap[coin]
+	manager.serverInfoLock.RUnlock()
+	return
+}
+
+// getStratumServerInfoMap 获取当前的服务器列表
+// 重新载入时会整体替换服务器列表，因此返回的散列表不会被修改，只读即可。
+func (manager *StratumSessionManager) getStratumServerInfoMap() StratumServerInfoMap {
+	manager.serverInfoLock.RLock()
+	defer manager.serverInfoLock.RUnlock()
+	return manager.stratumServerInfoMap
+}
+
+// getUpstreamTLSConfig 获取币种连接服务器使用的TLS配置，未开启TLS时 ok 为 false
+func (manager *StratumSessionManager) getUpstreamTLSConfig(coin string) (config *tls.Config, ok bool) {
+	manager.serverInfoLock.RLock()
+	config, ok = manager.upstreamTLSConfigs[coin]
+	manager.serverInfoLock.RUnlock()
+	return
+}
+
+// Reload 在运行时重新载入服务器列表和自动注册等待人数上限
+// 正在代理的会话保持原有连接，新的服务器地址在下次连接（切换币种或重连）时生效；
+// 被移除的币种上的会话按 RemovedCoinPolicy 处理。
+func (manager *StratumSessionManager) Reload(conf ReloadableConfig) error {
+	if len(conf.StratumServerMap) < 1 {
+		return ErrReloadEmptyServerMap
+	}
+	conf.StratumServerMap.setDefaultUserSuffix()
+
+	tlsConfigs, err := newUpstreamTLSConfigs(conf.StratumServerMap)
+	if err != nil {
+		return err
+	}
+
+	manager.serverInfoLock.Lock()
+	oldServerInfoMap := manager.stratumServerInfoMap
+	manager.stratumServerInfoMap = conf.StratumServerMap
+	manager.upstreamTLSConfigs = tlsConfigs
+	manager.serverInfoLock.Unlock()
+
+	removedCoins := make(map[string]bool)
+	for coin := range oldServerInfoMap {
+		if _, ok := conf.StratumServerMap[coin]; !ok {
+			removedCoins[coin] = true
+			glog.Info("Reload: coin removed: ", coin)
+		}
+	}
+	for coin, serverInfo := range conf.StratumServerMap {
+		oldServerInfo, ok := oldServerInfoMap[coin]
+		if !ok {
+			glog.Info("Reload: coin added: ", coin, "; ", serverInfo.GetURLs(), "; UserSuffix: ", serverInfo.UserSuffix)
+		} else if !reflect.DeepEqual(serverInfo, oldServerInfo) {
+			glog.Info("Reload: coin changed: ", coin, "; ", serverInfo.GetURLs(), "; UserSuffix: ", serverInfo.UserSuffix)
+		}
+	}
+
+	if conf.AutoRegMaxWaitUsers != nil {
+		newMaxWaitUsers := *conf.AutoRegMaxWaitUsers
+		oldMaxWaitUsers := atomic.SwapInt64(&manager.autoRegMaxWaitUsers, newMaxWaitUsers)
+		// 正在等待的用户数不变，剩余名额随上限一起增减（可能暂时为负值）
+		atomic.AddInt64(&manager.autoRegAllowUsers, newMaxWaitUsers-oldMaxWaitUsers)
+		if newMaxWaitUsers != oldMaxWaitUsers {
+			glog.Info("Reload: AutoRegMaxWaitUsers: ", oldMaxWaitUsers, " -> ", newMaxWaitUsers)
+		}
+	}
+
+	if manager.hasFailoverUpstreams() {
+		manager.startUpstreamHealthCheck()
+	}
+
+	if len(removedCoins) > 0 {
+		go manager.handleRemovedCoinSessions(removedCoins)
+	}
+	return nil
+}
+
+// handleRemovedCoinSessions 按策略处理被移除的币种上的会话
+func (manager *StratumSessionManager) handleRemovedCoinSessions(removedCoins map[string]bool) {
+	// 先复制会话列表，释放 manager.lock 之后再读取各会话的币种，
+	// 切换和停止会话时都需要获取 manager.lock
+	manager.lock.Lock()
+	allSessions := make([]*StratumSession, 0, len(manager.sessions))
+	for _, session := range manager.sessions {
+		allSessions = append(allSessions, session)
+	}
+	manager.lock.Unlock()
+
+	var sessions []*StratumSession
+	for _, session := range allSessions {
+		if removedCoins[session.getMiningCoin()] {
+			sessions = append(sessions, session)
+		}
+	}
+
+	// 按会话ID排序，使日志顺序稳定
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].sessionID < sessions[j].sessionID
+	})
+
+	for _, session := range sessions {
+		if manager.removedCoinPolicy == RemovedCoinPolicyMigrate {
+			glog.Info("Reload: migrate session: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.getMiningCoin(), " -> ", manager.removedCoinMigrateTo)
+			stratumErr := manager.ForceSwitchSession(session.sessionID, manager.removedCoinMigrateTo)
+			if stratumErr == nil {
+				continue
+			}
+			glog.Warning("Reload: migrate session failed, close it: ", session.fullWorkerName, "; ", stratumErr)
+		} else {
+			glog.Info("Reload: close session: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.getMiningCoin())
+		}
+		session.Stop(StopReasonCoinRemoved)
+	}
+}
+
+// ReloadFromFile 从配置文件重新载入
+func (manager *StratumSessionManager) ReloadFromFile(configFilePath string) error {
+	var configData ConfigData
+	err := configData.LoadFromFile(configFilePath)
+	if err != nil {
+		return err
+	}
+
+	return manager.Reload(ReloadableConfig{configData.StratumServerMap, &configData.AutoRegMaxWaitUsers})
+}
+
+// watchZKConfigNode 监控Zookeeper配置节点，节点的值改变时重新载入
+func (manager *StratumSessionManager) watchZKConfigNode(nodePath string) {
+	for {
+		data, _, event, err := manager.zookeeperManager.zookeeperConn.GetW(nodePath)
+		if err != nil {
+			glog.Error("Read Config Node Failed, sleep ", zookeeperConnAliveTimeout, "s: ", nodePath, "; ", err)
+			time.Sleep(zookeeperConnAliveTimeout * time.Second)
+			continue
+		}
+
+		conf, err := parseReloadableConfig(data)
+		if err == nil {
+			err = manager.Reload(conf)
+		}
+		if err != nil {
+			glog.Error("Reload From Config Node Failed: ", nodePath, "; ", err)
+		} else {
+			glog.Info("Reloaded From Config Node: ", nodePath)
+		}
+
+		<-event
+	}
+}
+
+// Reloadable 使StratumSwitcher可在收到SIGHUP时从配置文件重新载入（同时重新打开事件日志文件），
+// 并在配置了 ZKConfigNode 时监控该节点
+func (manager *StratumSessionManager) Reloadable(configFilePath string) {
+	go signalHUPListener(func() {
+		manager.reopenEventSink()
+
+		err := manager.ReloadFromFile(configFilePath)
+		if err != nil {
+			glog.Error("Reload From File Failed: ", configFilePath, "; ", err)
+			return
+		}
+		glog.Info("Reloaded From File: ", configFilePath)
+	})
+
+	if len(manager.zkConfigNode) > 0 {
+		go manager.watchZKConfigNode(manager.zkConfigNode)
+	}
+}
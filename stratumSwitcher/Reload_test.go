@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStratumSessionManagerReload(t *testing.T) {
+	manager, clientSides := newDrainTestManager(t, 4)
+	defer manager.tcpListener.Close()
+	for _, clientSide := range clientSides {
+		defer clientSide.Close()
+	}
+
+	manager.stratumServerInfoMap = StratumServerInfoMap{
+		"btc": {URL: "127.0.0.1:3333", UserSuffix: "btc"},
+		"bcc": {URL: "127.0.0.1:3334", UserSuffix: "bcc"},
+	}
+	manager.upstreamHealth = NewUpstreamHealthChecker(0, 0)
+	manager.removedCoinPolicy = RemovedCoinPolicyClose
+	manager.autoRegMaxWaitUsers = 50
+	manager.autoRegAllowUsers = 45
+
+	// 两个会话在btc上，两个会话在将被移除的bcc上
+	i := 0
+	for _, session := range manager.sessions {
+		session.miningCoin = "btc"
+		if i%2 == 1 {
+			session.miningCoin = "bcc"
+		}
+		i++
+	}
+
+	autoRegMaxWaitUsers := int64(100)
+	err := manager.Reload(ReloadableConfig{
+		StratumServerMap: StratumServerInfoMap{
+			"btc": {URL: "127.0.0.1:4444"},
+			"ltc": {URL: "127.0.0.1:5555", UserSuffix: "litecoin"},
+		},
+		AutoRegMaxWaitUsers: &autoRegMaxWaitUsers,
+	})
+	if err != nil {
+		t.Fatalf("Reload failed: %s", err)
+	}
+
+	if serverInfo, ok := manager.getStratumServerInfo("btc"); !ok || serverInfo.URL != "127.0.0.1:4444" || serverInfo.UserSuffix != "btc" {
+		t.Errorf("wrong server info of btc: %+v", serverInfo)
+	}
+	if serverInfo, ok := manager.getStratumServerInfo("ltc"); !ok || serverInfo.UserSuffix != "litecoin" {
+		t.Errorf("wrong server info of ltc: %+v", serverInfo)
+	}
+	if _, ok := manager.getStratumServerInfo("bcc"); ok {
+		t.Errorf("bcc should be removed")
+	}
+	if manager.autoRegMaxWaitUsers != 100 || manager.autoRegAllowUsers != 95 {
+		t.Errorf("wrong auto reg limits: %d, %d", manager.autoRegMaxWaitUsers, manager.autoRegAllowUsers)
+	}
+
+	// 被移除的币种上的会话将被断开，其他会话保持连接
+	for start := time.Now(); manager.GetDrainStatus().Sessions != 2 && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, info := range manager.GetSessionInfos("", "") {
+		if info.MiningCoin != "btc" {
+			t.Errorf("session on the removed coin should be closed: %+v", info)
+		}
+	}
+	if sessions := manager.GetDrainStatus().Sessions; sessions != 2 {
+		t.Errorf("2 sessions should be kept, but %d left", sessions)
+	}
+}
+
+func TestStratumSessionManagerReloadFailed(t *testing.T) {
+	manager := new(StratumSessionManager)
+	manager.stratumServerInfoMap = StratumServerInfoMap{"btc": {URL: "127.0.0.1:3333"}}
+
+	if err := manager.Reload(ReloadableConfig{}); err != ErrReloadEmptyServerMap {
+		t.Errorf("Reload with empty server map should fail, but got %v", err)
+	}
+
+	err := manager.Reload(ReloadableConfig{StratumServerMap: StratumServerInfoMap{
+		"bcc": {URL: "127.0.0.1:3334", EnableTLS: true, TLSCAFile: "/nonexistent/ca.pem"},
+	}})
+	if err == nil {
+		t.Errorf("Reload with invalid TLS CA file should fail")
+	}
+
+	if _, ok := manager.getStratumServerInfo("btc"); !ok {
+		t.Errorf("server map should not be changed after failed reloads")
+	}
+}
+
+func TestParseReloadableConfig(t *testing.T) {
+	conf, err := parseReloadableConfig([]byte(`{"StratumServerMap":{"btc":{"URLs":["a:1","b:2"]}},"ListenAddr":"0.0.0.0:1"}`))
+	if err != nil {
+		t.Fatalf("parseReloadableConfig failed: %s", err)
+	}
+	if len(conf.StratumServerMap["btc"].GetURLs()) != 2 {
+		t.Errorf("wrong StratumServerMap: %+v", conf.StratumServerMap)
+	}
+	if conf.AutoRegMaxWaitUsers != nil {
+		t.Errorf("AutoRegMaxWaitUsers should be nil if not set")
+	}
+
+	if _, err := checkRemovedCoinPolicy("unknown"); err != ErrUnknownRemovedCoinPolicy {
+		t.Errorf("checkRemovedCoinPolicy should fail with unknown policy")
+	}
+	if policy, _ := checkRemovedCoinPolicy(""); policy != RemovedCoinPolicyClose {
+		t.Errorf("default policy should be %s, but is %s", RemovedCoinPolicyClose, policy)
+	}
+}
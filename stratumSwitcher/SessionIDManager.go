@@ -81,6 +81,14 @@ func (manager *SessionIDManager) IsFull() bool {
 	return manager.isFullWithoutLock()
 }
 
+// GetUsage 获取已分配的会话ID数量及可分配的会话ID总数
+func (manager *SessionIDManager) GetUsage() (used uint32, capacity uint32) {
+	defer manager.lock.Unlock()
+	manager.lock.Lock()
+
+	return manager.count, manager.sessionIDMask + 1
+}
+
 // AllocSessionID 为调用者分配一个会话ID
 func (manager *SessionIDManager) AllocSessionID() (sessionID uint32, err error) {
 	defer manager.lock.Unlock()
@@ -12,8 +12,8 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/btccom/btcpool-go-modules/coordination"
 	"github.com/golang/glog"
-	"github.com/samuel/go-zookeeper/zk"
 )
 
 // BTCAgent的客户端类型前缀
@@ -43,6 +43,9 @@ const findWorkerNameTimeoutSeconds = 60
 // 服务器响应subscribe、authorize等消息的超时时间
 const readServerResponseTimeoutSeconds = 10
 
+// 连接单个服务器地址的超时时间（超时后尝试下一个地址）
+const connectServerTimeoutSeconds = 5
+
 // 纯代理模式下接收消息的超时时间
 // 若长时间接收不到消息，就无法及时处理对端已断开事件，
 // 因此设置接收超时时间，每隔一定时间就放弃接收，检查状态，并重新开始接收
@@ -70,6 +73,22 @@ const (
 	ProtocolUnknown
 )
 
+// ToString 转换为字符串
+func (protocolType ProtocolType) ToString() string {
+	switch protocolType {
+	case ProtocolBitcoinStratum:
+		return "bitcoin-stratum"
+	case ProtocolEthereumStratum:
+		return "ethereum-stratum"
+	case ProtocolEthereumStratumNiceHash:
+		return "ethereum-stratum-nicehash"
+	case ProtocolEthereumProxy:
+		return "ethereum-proxy"
+	default:
+		return "unknown"
+	}
+}
+
 // RunningStat 运行状态
 type RunningStat uint8
 
@@ -103,6 +122,8 @@ type StratumSession struct {
 	protocolType ProtocolType
 	// 是否为BTCAgent
 	isBTCAgent bool
+	// BTCAgent连接中的AgentSession（仅BTCAgent会话）
+	btcAgent *btcAgentTracker
 	// 是否为NiceHash客户端
 	isNiceHashClient bool
 	// JSON-RPC的版本
@@ -122,9 +143,15 @@ type StratumSession struct {
 
 	// 客户端IP地址及端口
 	clientIPPort string
+	// 客户端连接建立的时间
+	connectTime time.Time
+	// 开始挖当前币种的时间（连接或上次切换币种的时间）
+	coinSince time.Time
 
 	serverConn   net.Conn
 	serverReader *bufio.Reader
+	// 当前连接的服务器地址
+	serverURL string
 
 	// sessionID 会话ID，也做为矿机挖矿时的 Extranonce1
 	sessionID       uint32
@@ -142,7 +169,20 @@ type StratumSession struct {
 	// 监控的Zookeeper路径
 	zkWatchPath string
 	// 监控的Zookeeper事件
-	zkWatchEvent <-chan zk.Event
+	zkWatchEvent <-chan coordination.Event
+	// 监控的矿工币种节点路径（未监控时为空）
+	zkWorkerWatchPath string
+	// 监控的矿工币种节点事件
+	zkWorkerWatchEvent <-chan coordination.Event
+	// Zookeeper中子账户的币种
+	zkSubaccountCoin string
+	// Zookeeper中矿工的币种（节点不存在时为空）
+	zkWorkerCoin string
+
+	// 币种是否被管理API强制覆盖（覆盖后不再跟随Zookeeper，直到Zookeeper中的币种发生改变）
+	coinOverridden bool
+	// 币种被覆盖时Zookeeper中记录的币种
+	overriddenZKCoin string
 }
 
 // NewStratumSession 创建一个新的 Stratum 会话
@@ -159,6 +199,8 @@ func NewStratumSession(manager *StratumSessionManager, clientConn net.Conn, sess
 	session.clientReader = bufio.NewReaderSize(clientConn, bufioReaderBufSize)
 
 	session.clientIPPort = clientConn.RemoteAddr().String()
+	session.connectTime = time.Now()
+	session.coinSince = session.connectTime
 
 	switch manager.chainType {
 	case ChainTypeBitcoin:
@@ -213,6 +255,54 @@ func (session *StratumSession) getStatNonLock() RunningStat {
 	return session.runningStat
 }
 
+// setCoinOverride 标记币种已被管理API覆盖，返回当前的重连计数以及之前是否已被覆盖（线程安全）
+func (session *StratumSession) setCoinOverride() (uint32, bool) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	overridden := session.coinOverridden
+	if !overridden {
+		session.coinOverridden = true
+		session.overriddenZKCoin = session.miningCoin
+	}
+	return session.reconnectCounter, overridden
+}
+
+// clearCoinOverride 取消币种覆盖的标记（线程安全）
+func (session *StratumSession) clearCoinOverride() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	session.coinOverridden = false
+	session.overriddenZKCoin = ""
+}
+
+// checkCoinOverride 检查Zookeeper中的新币种是否应被覆盖后的币种忽略（线程安全）
+// Zookeeper中的币种一旦改变，覆盖即失效
+func (session *StratumSession) checkCoinOverride(newZKCoin string) bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	if !session.coinOverridden {
+		return false
+	}
+	if newZKCoin == session.overriddenZKCoin {
+		return true
+	}
+
+	session.coinOverridden = false
+	session.overriddenZKCoin = ""
+	return false
+}
+
+// getMiningCoin 获取当前挖的币种（线程安全）
+func (session *StratumSession) getMiningCoin() string {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	return session.miningCoin
+}
+
 // getReconnectCounter 获取币种切换计数（线程安全）
 func (session *StratumSession) getReconnectCounter() uint32 {
 	session.lock.Lock()
@@ -238,7 +328,7 @@ func (session *StratumSession) Run() {
 	// 其实目前只有一种协议，即Stratum协议
 	// BTCAgent在认证完成之前走的也是Stratum协议
 	if session.protocolType == ProtocolUnknown {
-		session.Stop()
+		session.Stop(StopReasonProtocolUnknown)
 		return
 	}
 
@@ -263,16 +353,23 @@ func (session *StratumSession) Resume(sessionData StratumSessionData, serverConn
 	// 恢复服务器连接
 	session.serverConn = serverConn
 	session.serverReader = bufio.NewReaderSize(serverConn, bufioReaderBufSize)
+	session.serverURL = sessionData.ServerURL
 	stat := StatConnected
 
 	// 恢复版本位
 	session.versionMask = sessionData.VersionMask
 
+	// 恢复连接时间
+	if sessionData.ConnectTime > 0 {
+		session.connectTime = time.Unix(sessionData.ConnectTime, 0)
+		session.coinSince = session.connectTime
+	}
+
 	if sessionData.StratumSubscribeRequest != nil {
 		_, stratumErr := session.stratumHandleRequest(sessionData.StratumSubscribeRequest, &stat)
 		if stratumErr != nil {
 			glog.Error("Resume session ", session.clientIPPort, " failed: ", stratumErr)
-			session.Stop()
+			session.resumeFailed(stratumErr)
 			return
 		}
 	}
@@ -281,39 +378,65 @@ func (session *StratumSession) Resume(sessionData StratumSessionData, serverConn
 		_, stratumErr := session.stratumHandleRequest(sessionData.StratumAuthorizeRequest, &stat)
 		if stratumErr != nil {
 			glog.Error("Resume session ", session.clientIPPort, " failed: ", stratumErr)
-			session.Stop()
+			session.resumeFailed(stratumErr)
 			return
 		}
 	}
 
 	if stat != StatAuthorized {
 		glog.Error("Resume session ", session.clientIPPort, " failed: stat should be StatAuthorized, but is ", stat)
-		session.Stop()
+		session.resumeFailed(errors.New("not authorized"))
 		return
 	}
 
 	err := session.findMiningCoin(false)
 	if err != nil {
 		glog.Error("Resume session ", session.clientIPPort, " failed: ", err)
-		session.Stop()
+		session.resumeFailed(err)
 		return
 	}
 
+	// 子账户按比例分配币种时，保留原来分配的币种
+	if session.miningCoin != sessionData.MiningCoin {
+		session.keepWeightedCoin(sessionData.MiningCoin)
+	}
+
+	// 币种被管理API覆盖，且Zookeeper中的币种未改变，保留覆盖后的币种
+	if len(sessionData.OverriddenZKCoin) > 0 && session.miningCoin == sessionData.OverriddenZKCoin {
+		session.miningCoin = sessionData.MiningCoin
+		session.coinOverridden = true
+		session.overriddenZKCoin = sessionData.OverriddenZKCoin
+	}
+
 	if session.miningCoin != sessionData.MiningCoin {
 		glog.Error("Resume session ", session.clientIPPort, " failed: mining coin changed: ",
 			sessionData.MiningCoin, " -> ", session.miningCoin)
-		session.Stop()
+		session.resumeFailed(errors.New("mining coin changed: " + sessionData.MiningCoin + " -> " + session.miningCoin))
 		return
 	}
 
+	// 恢复BTCAgent的AgentSession
+	if session.btcAgent != nil {
+		for _, message := range sessionData.BTCAgentMessages {
+			session.btcAgent.track(message)
+		}
+	}
+
 	glog.Info("Resume Session Success: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
+	session.emitEvent(session.newEvent(EventResume).setResult(nil))
 
 	// 此后转入纯代理模式
 	session.proxyStratum()
 }
 
-// Stop 停止一个 Stratum 会话
-func (session *StratumSession) Stop() {
+// resumeFailed 恢复会话失败，停止会话
+func (session *StratumSession) resumeFailed(err error) {
+	session.emitEvent(session.newEvent(EventResume).setResult(err))
+	session.Stop(StopReasonResumeFailed)
+}
+
+// Stop 停止一个 Stratum 会话，reason 为结束原因（StopReason*）
+func (session *StratumSession) Stop(reason string) {
 	session.lock.Lock()
 
 	if session.runningStat == StatStoped {
@@ -324,6 +447,11 @@ func (session *StratumSession) Stop() {
 	session.runningStat = StatStoped
 	session.lock.Unlock()
 
+	event := session.newEvent(EventStop)
+	event.Reason = reason
+	event.ConnectedSeconds = int64(time.Since(session.connectTime).Seconds())
+	session.emitEvent(event)
+
 	if session.serverConn != nil {
 		session.serverConn.Close()
 	}
@@ -333,7 +461,10 @@ func (session *StratumSession) Stop() {
 	}
 
 	session.manager.ReleaseStratumSession(session)
+	// 其他协程在锁内读取 manager（如 proxyStratum），置空也需要加锁
+	session.lock.Lock()
 	session.manager = nil
+	session.lock.Unlock()
 
 	if glog.V(2) {
 		glog.Info("Session Stoped: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
@@ -391,21 +522,21 @@ func (session *StratumSession) runProxyStratum() {
 	err = session.stratumFindWorkerName()
 
 	if err != nil {
-		session.Stop()
+		session.Stop(StopReasonFindWorkerFailed)
 		return
 	}
 
 	err = session.findMiningCoin(session.manager.enableUserAutoReg)
 
 	if err != nil {
-		session.Stop()
+		session.Stop(StopReasonFindCoinFailed)
 		return
 	}
 
 	err = session.connectStratumServer()
 
 	if err != nil {
-		session.Stop()
+		session.Stop(StopReasonServerFailed)
 		return
 	}
 
@@ -429,6 +560,7 @@ func (session *StratumSession) parseSubscribeRequest(request *JSONRPCRequest) (r
 			// 判断是否为BTCAgent
 			if ok && strings.HasPrefix(strings.ToLower(userAgent), btcAgentClientTypePrefix) {
 				session.isBTCAgent = true
+				session.btcAgent = newBTCAgentTracker()
 			}
 		}
 
@@ -449,6 +581,7 @@ func (session *StratumSession) parseSubscribeRequest(request *JSONRPCRequest) (r
 				// 判断是否为BTCAgent
 				if strings.HasPrefix(strings.ToLower(userAgent), btcAgentClientTypePrefix) {
 					session.isBTCAgent = true
+					session.btcAgent = newBTCAgentTracker()
 					session.protocolType = ProtocolEthereumStratumNiceHash
 				}
 			}
@@ -657,8 +790,15 @@ func (session *StratumSession) stratumFindWorkerName() error {
 			}
 
 			// stat will be changed in stratumHandleRequest
+			oldStat := stat
 			result, stratumErr := session.stratumHandleRequest(request, &stat)
 
+			if oldStat == StatConnected && stat == StatSubScribed {
+				event := session.newEvent(EventSubscribe)
+				event.UserAgent = session.getClientUserAgent()
+				session.emitEvent(event)
+			}
+
 			// 两个均为空说明没有想要返回的响应
 			if result != nil || stratumErr != nil {
 				response.ID = request.ID
@@ -721,9 +861,13 @@ func (session *StratumSession) findMiningCoin(autoReg bool) error {
 		return err
 	}
 
-	session.miningCoin = string(data)
+	session.zkSubaccountCoin = string(data)
 	session.zkWatchEvent = event
 
+	// 矿工节点优先
+	session.watchWorkerCoin()
+	session.miningCoin = session.getZKMiningCoin()
+
 	return nil
 }
 
@@ -774,7 +918,7 @@ func (session *StratumSession) connectStratumServer() error {
 	// 获取当前运行状态
 	runningStat := session.getStatNonLock()
 	// 寻找币种对应的服务器
-	serverInfo, ok := session.manager.stratumServerInfoMap[session.miningCoin]
+	serverInfo, ok := session.manager.getStratumServerInfo(session.miningCoin)
 
 	var rpcID interface{}
 	if session.stratumAuthorizeRequest != nil {
@@ -791,11 +935,21 @@ func (session *StratumSession) connectStratumServer() error {
 		return StratumErrStratumServerNotFound
 	}
 
-	// 连接服务器
-	serverConn, err := net.Dial("tcp", serverInfo.URL)
+	// 连接服务器，健康的地址优先，依次尝试
+	var serverConn net.Conn
+	var serverURL string
+	var err error
+	for _, serverURL = range session.manager.upstreamHealth.SortURLs(serverInfo.GetURLs()) {
+		serverConn, err = session.manager.dialStratumServer(session.miningCoin, serverURL)
+		if err == nil {
+			session.manager.upstreamHealth.MarkHealthy(serverURL)
+			break
+		}
+		glog.Error("Connect Stratum Server Failed: ", session.miningCoin, "; ", serverURL, "; ", err)
+		session.manager.upstreamHealth.MarkUnhealthy(serverURL, err)
+	}
 
-	if err != nil {
-		glog.Error("Connect Stratum Server Failed: ", session.miningCoin, "; ", serverInfo.URL, "; ", err)
+	if serverConn == nil {
 		if runningStat != StatReconnecting {
 			response := JSONRPCResponse{rpcID, nil, StratumErrConnectStratumServerFailed.ToJSONRPCArray(session.manager.serverID)}
 			session.writeJSONResponseToClient(&response)
@@ -804,10 +958,11 @@ func (session *StratumSession) connectStratumServer() error {
 	}
 
 	if glog.V(3) {
-		glog.Info("Connect Stratum Server Success: ", session.miningCoin, "; ", serverInfo.URL)
+		glog.Info("Connect Stratum Server Success: ", session.miningCoin, "; ", serverURL)
 	}
 
 	session.serverConn = serverConn
+	session.serverURL = serverURL
 	session.serverReader = bufio.NewReaderSize(serverConn, bufioReaderBufSize)
 
 	return session.serverSubscribeAndAuthorize()
@@ -856,11 +1011,14 @@ func (session *StratumSession) sendMiningSubscribeToServer() (userAgent string,
 		}
 
 		// 为了保证Web侧“最近提交IP”显示正确，将矿机的IP做为第三个参数传递给Stratum Server
-		clientIP := session.clientIPPort[:strings.LastIndex(session.clientIPPort, ":")]
-		clientIPLong := IP2Long(clientIP)
+		// IPv6矿机的第三个参数为0，IPv6地址字符串做为第四个参数传递
+		clientIPLong, clientIPv6 := ClientIPParams(SplitClientIP(session.clientIPPort))
 		// 不直接使用 session.sessionIDString，因为在DCR币种里，它已经进行了填充和字节序颠倒。
 		sessionIDString := Uint32ToHex(session.sessionID)
 		session.stratumSubscribeRequest.SetParam(userAgent, sessionIDString, clientIPLong)
+		if len(clientIPv6) > 0 {
+			session.stratumSubscribeRequest.AddParam(clientIPv6)
+		}
 
 	case ProtocolEthereumStratum:
 		fallthrough
@@ -878,12 +1036,14 @@ func (session *StratumSession) sendMiningSubscribeToServer() (userAgent string,
 			glog.Info("UserAgent: ", userAgent, "; Protocol: ", protocol)
 		}
 
-		clientIP := session.clientIPPort[:strings.LastIndex(session.clientIPPort, ":")]
-		clientIPLong := IP2Long(clientIP)
+		clientIPLong, clientIPv6 := ClientIPParams(SplitClientIP(session.clientIPPort))
 
 		// Session ID 做为第三个参数传递
-		// 矿机IP做为第四个参数传递
+		// 矿机IP做为第四个参数传递（IPv6矿机为0，IPv6地址字符串做为第五个参数传递）
 		session.stratumSubscribeRequest.SetParam(userAgent, protocol, session.sessionIDString, clientIPLong)
+		if len(clientIPv6) > 0 {
+			session.stratumSubscribeRequest.AddParam(clientIPv6)
+		}
 
 	default:
 		glog.Fatal("Unimplemented Stratum Protocol: ", session.protocolType)
@@ -902,7 +1062,7 @@ func (session *StratumSession) sendMiningSubscribeToServer() (userAgent string,
 
 // 获取认证时添加的子账户名后缀
 func (session *StratumSession) getUserSuffix() string {
-	serverInfo, ok := session.manager.stratumServerInfoMap[session.miningCoin]
+	serverInfo, ok := session.manager.getStratumServerInfo(session.miningCoin)
 	if !ok {
 		return session.miningCoin
 	}
@@ -953,6 +1113,8 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 	if err != nil {
 		return
 	}
+	// 认证使用的子账户名后缀（首次认证不带后缀）
+	userSuffix := ""
 
 	// 接收响应
 	e := make(chan error, 1)
@@ -991,6 +1153,7 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 						e <- err
 						return
 					}
+					userSuffix = session.getUserSuffix()
 				}
 				continue
 			}
@@ -1047,6 +1210,7 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 	select {
 	case err = <-e:
 		if err != nil {
+			session.manager.metrics.authorizeFailures.Inc(session.miningCoin)
 			if glog.V(2) {
 				glog.Warning("Authorize Failed: ", session.clientIPPort, "; ", session.miningCoin, "; ",
 					authWorkerName, "; ", authWorkerPasswd, "; ", userAgent, ";",
@@ -1062,9 +1226,17 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 
 	case <-time.After(readServerResponseTimeoutSeconds * time.Second):
 		err = errors.New("Authorize Timeout")
+		session.manager.metrics.authorizeFailures.Inc(session.miningCoin)
 		glog.Warning(err)
 	}
 
+	event := session.newEvent(EventAuthorize).setResult(err)
+	event.UserAgent = userAgent
+	event.AuthWorker = authWorkerName
+	event.UserSuffix = userSuffix
+	event.ReconnectCounter = session.reconnectCounter
+	session.emitEvent(event)
+
 	return
 }
 
@@ -1210,153 +1382,187 @@ func (session *StratumSession) stratumHandleServerSubscribeResponse(response *JS
 }
 
 func (session *StratumSession) proxyStratum() {
-	if session.getStat() != StatRunning {
+	// 在锁内取得本轮代理使用的连接和bufio，重连时会在锁内替换它们
+	// bufio 交给下面的协程后从会话中移除，重连不会再读取协程正在使用的 bufio
+	session.lock.Lock()
+	if session.runningStat != StatRunning {
+		session.lock.Unlock()
 		glog.Info("proxyStratum: session stopped by another goroutine")
 		return
 	}
+	// 记录当前的币种切换计数
+	currentReconnectCounter := session.reconnectCounter
+	serverConn := session.serverConn
+	serverReader := session.serverReader
+	session.serverReader = nil
+	// BTCAgent会话的 clientReader 一直由 proxyBTCAgentUpstream 使用
+	clientReader := session.clientReader
+	if !session.isBTCAgent {
+		session.clientReader = nil
+	}
+	// 会话停止后 session.manager 被置空，在锁内取得
+	manager := session.manager
+	session.lock.Unlock()
 
 	// 注册会话
-	session.manager.RegisterStratumSession(session)
+	manager.RegisterStratumSession(session)
+
+	// BTCAgent的消息需要逐个转发并跟踪，首次进入代理模式时（重连计数为0）启动，此后不再中断
+	if session.isBTCAgent && currentReconnectCounter == 0 {
+		go session.proxyBTCAgentUpstream(clientReader)
+	}
 
 	// 从服务器到客户端
 	go func() {
-		// 记录当前的币种切换计数
-		currentReconnectCounter := session.getReconnectCounter()
-
-		if session.serverReader != nil {
-			bufLen := session.serverReader.Buffered()
+		if serverReader != nil {
+			bufLen := serverReader.Buffered()
 			// 将bufio中的剩余内容写入对端
 			if bufLen > 0 {
 				buf := make([]byte, bufLen)
-				session.serverReader.Read(buf)
+				serverReader.Read(buf)
 				session.clientConn.Write(buf)
 			}
-			// 释放bufio
-			session.serverReader = nil
 		}
 		// 简单的流复制
 		buffer := make([]byte, bufioReaderBufSize)
-		_, err := IOCopyBuffer(session.clientConn, session.serverConn, buffer)
+		_, err := IOCopyBuffer(session.clientConn, serverConn, buffer)
 		// 流复制结束，说明其中一方关闭了连接
-		// 不对BTCAgent应用重连
-		if err == ErrReadFailed && !session.isBTCAgent {
+		if err == ErrReadFailed {
 			// 服务器关闭了连接，尝试重连
 			session.tryReconnect(currentReconnectCounter)
 		} else {
 			// 客户端关闭了连接，结束会话
-			session.tryStop(currentReconnectCounter)
+			session.tryStop(currentReconnectCounter, StopReasonClientClosed)
 		}
 		if glog.V(3) {
-			glog.Info("DownStream: exited; ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
+			glog.Info("DownStream: exited; ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.getMiningCoin())
 		}
 	}()
 
-	// 从客户端到服务器
+	// 从客户端到服务器（BTCAgent由 proxyBTCAgentUpstream 转发）
 	go func() {
-		// 记录当前的币种切换计数
-		currentReconnectCounter := session.getReconnectCounter()
+		if session.isBTCAgent {
+			return
+		}
 
-		if session.clientReader != nil {
-			bufLen := session.clientReader.Buffered()
+		if clientReader != nil {
+			bufLen := clientReader.Buffered()
 			// 将bufio中的剩余内容写入对端
 			if bufLen > 0 {
 				buf := make([]byte, bufLen)
-				session.clientReader.Read(buf)
-				session.serverConn.Write(buf)
+				clientReader.Read(buf)
+				serverConn.Write(buf)
 			}
-			// 释放bufio
-			session.clientReader = nil
 		}
 		// 简单的流复制
 		buffer := make([]byte, bufioReaderBufSize)
-		bufferLen, err := IOCopyBuffer(session.serverConn, session.clientConn, buffer)
+		bufferLen, err := IOCopyBuffer(serverConn, session.clientConn, buffer)
 		// 流复制结束，说明其中一方关闭了连接
-		// 不对BTCAgent应用重连
-		if err == ErrWriteFailed && !session.isBTCAgent {
+		if err == ErrWriteFailed {
 			// 服务器关闭了连接，尝试重连
 			session.tryReconnect(currentReconnectCounter)
 			// 若重连成功，尝试将缓存中的内容转发到新服务器
-			// getStat() 会锁定到重连成功或放弃重连为止
-			if bufferLen > 0 && session.getStat() == StatRunning {
-				session.serverConn.Write(buffer[0:bufferLen])
+			// 锁会等到重连成功或放弃重连为止
+			if bufferLen > 0 {
+				session.lock.Lock()
+				if session.runningStat == StatRunning {
+					session.serverConn.Write(buffer[0:bufferLen])
+				}
+				session.lock.Unlock()
 			}
 		} else {
 			// 客户端关闭了连接，结束会话
-			session.tryStop(currentReconnectCounter)
+			session.tryStop(currentReconnectCounter, StopReasonClientClosed)
 		}
 		if glog.V(3) {
-			glog.Info("UpStream: exited; ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
+			glog.Info("UpStream: exited; ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.getMiningCoin())
 		}
 	}()
 
 	// 监控来自zookeeper的切换指令并进行Stratum切换
-	go func() {
-		// 记录当前的币种切换计数
-		currentReconnectCounter := session.getReconnectCounter()
-
-		for {
-			<-session.zkWatchEvent
+	// 与BTCAgent相同，只在首次进入代理模式时启动，重连后继续使用同一个协程，避免新旧协程同时等待同一个Zookeeper事件
+	if currentReconnectCounter == 0 {
+		go session.watchMiningCoin(manager)
+	}
+}
 
-			if !session.IsRunning() {
-				break
-			}
+// watchMiningCoin 监控来自zookeeper的切换指令并进行Stratum切换，会话停止后退出
+// manager 在启动时传入，会话停止后 session.manager 被置空，不能在等待之后再读取
+func (session *StratumSession) watchMiningCoin(manager *StratumSessionManager) {
+	for {
+		workerNode := session.waitZKEvent()
 
-			if currentReconnectCounter != session.getReconnectCounter() {
-				break
-			}
+		if !session.IsRunning() {
+			break
+		}
 
-			data, event, err := session.manager.zookeeperManager.GetW(session.zkWatchPath, session.sessionID)
+		// 记录当前的币种切换计数，切换期间发生重连时放弃本次切换
+		currentReconnectCounter := session.getReconnectCounter()
 
-			if err != nil {
-				glog.Error("Read From Zookeeper Failed, sleep ", zookeeperConnAliveTimeout, "s: ", session.zkWatchPath, "; ", err)
-				time.Sleep(zookeeperConnAliveTimeout * time.Second)
-				continue
-			}
+		newMiningCoin, err := session.rereadZKMiningCoin(manager, workerNode)
 
-			session.zkWatchEvent = event
-			newMiningCoin := string(data)
+		if err != nil {
+			glog.Error("Read From Zookeeper Failed, sleep ", zookeeperConnAliveTimeout, "s: ", session.fullWorkerName, "; ", err)
+			time.Sleep(zookeeperConnAliveTimeout * time.Second)
+			continue
+		}
 
-			// 若币种未改变，则继续监控
-			if newMiningCoin == session.miningCoin {
-				if glog.V(3) {
-					glog.Info("Mining Coin Not Changed: ", session.fullWorkerName, ": ", session.miningCoin, " -> ", newMiningCoin)
-				}
-				continue
+		// 币种已被管理API覆盖，且Zookeeper中的币种未改变，则继续监控
+		miningCoin := session.getMiningCoin()
+		if session.checkCoinOverride(newMiningCoin) {
+			if glog.V(3) {
+				glog.Info("Mining Coin Overridden: ", session.fullWorkerName, ": ", miningCoin, "; ", newMiningCoin)
 			}
+			manager.restoreCoinAssignment(session, miningCoin)
+			continue
+		}
 
-			// 若币种对应的Stratum服务器不存在，则忽略事件并继续监控
-			_, exists := session.manager.stratumServerInfoMap[newMiningCoin]
-			if !exists {
-				glog.Error("Stratum Server Not Found for New Mining Coin: ", newMiningCoin)
-				continue
+		// 若币种未改变，则继续监控
+		if newMiningCoin == miningCoin {
+			if glog.V(3) {
+				glog.Info("Mining Coin Not Changed: ", session.fullWorkerName, ": ", miningCoin, " -> ", newMiningCoin)
 			}
+			continue
+		}
 
-			// 币种已改变
-			if glog.V(2) {
-				glog.Info("Mining Coin Changed: ", session.fullWorkerName, "; ", session.miningCoin, " -> ", newMiningCoin, "; ", currentReconnectCounter)
-			}
+		// 若币种对应的Stratum服务器不存在，则忽略事件并继续监控
+		_, exists := manager.getStratumServerInfo(newMiningCoin)
+		if !exists {
+			glog.Error("Stratum Server Not Found for New Mining Coin: ", newMiningCoin)
+			manager.restoreCoinAssignment(session, miningCoin)
+			continue
+		}
 
-			// 进行币种切换
-			if session.isBTCAgent {
-				// 因为BTCAgent会话是有状态的（一个连接里包含多个AgentSession，
-				// 对应多台矿机），所以没有办法安全的无缝切换BTCAgent会话，
-				// 只能采用断开连接的方法。
-				session.tryStop(currentReconnectCounter)
-			} else {
-				// 普通连接，直接切换币种
-				session.switchCoinType(newMiningCoin, currentReconnectCounter)
+		// 按切换策略等待，期间币种可能再次改变或被改回
+		newMiningCoin = session.waitCoinSwitch(manager, newMiningCoin, currentReconnectCounter)
+		if newMiningCoin == "" {
+			if !session.IsRunning() {
+				break
 			}
-			break
+			// 放弃切换，分配记录改回实际挖的币种
+			manager.restoreCoinAssignment(session, session.getMiningCoin())
+			continue
 		}
 
-		if glog.V(3) {
-			glog.Info("CoinWatcher: exited; ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
+		// 币种已改变
+		if glog.V(2) {
+			glog.Info("Mining Coin Changed: ", session.fullWorkerName, "; ", miningCoin, " -> ", newMiningCoin, "; ", currentReconnectCounter)
 		}
-	}()
+
+		// 进行币种切换（BTCAgent会话的AgentSession将在重连后重放）
+		if !session.switchCoinType(newMiningCoin, currentReconnectCounter) {
+			// 切换失败，分配记录改回实际挖的币种（会话停止时分配记录会被删除）
+			manager.restoreCoinAssignment(session, session.getMiningCoin())
+		}
+	}
+
+	if glog.V(3) {
+		glog.Info("CoinWatcher: exited; ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.getMiningCoin())
+	}
 }
 
 // 检查是否发生了重连，若未发生重连，则停止会话
-func (session *StratumSession) tryStop(currentReconnectCounter uint32) bool {
+func (session *StratumSession) tryStop(currentReconnectCounter uint32, reason string) bool {
 	session.lock.Lock()
 	defer session.lock.Unlock()
 
@@ -1368,7 +1574,7 @@ func (session *StratumSession) tryStop(currentReconnectCounter uint32) bool {
 	// 判断是否已经重连过
 	if currentReconnectCounter == session.reconnectCounter {
 		//未发生重连，尝试停止
-		go session.Stop()
+		go session.Stop(reason)
 		return true
 	}
 
@@ -1405,10 +1611,9 @@ func (session *StratumSession) tryReconnect(currentReconnectCounter uint32) bool
 	return false
 }
 
-func (session *StratumSession) switchCoinType(newMiningCoin string, currentReconnectCounter uint32) {
-	// 设置新币种
-	session.miningCoin = newMiningCoin
-
+// switchCoinType 切换币种并重连服务器，返回是否已切换到新币种的服务器
+// 会话未在运行或已被其他线程重连时放弃操作，币种保持不变。
+func (session *StratumSession) switchCoinType(newMiningCoin string, currentReconnectCounter uint32) bool {
 	// 锁定会话，防止会话被其他线程停止
 	session.lock.Lock()
 	defer session.lock.Unlock()
@@ -1416,24 +1621,35 @@ func (session *StratumSession) switchCoinType(newMiningCoin string, currentRecon
 	// 会话未在运行，放弃操作
 	if session.runningStat != StatRunning {
 		glog.Warning("SwitchCoinType: session not running")
-		return
+		return false
 	}
 	// 会话已被其他线程重连，放弃操作
 	if currentReconnectCounter != session.reconnectCounter {
 		glog.Warning("SwitchCoinType: session reconnected by other goroutine")
-		return
+		return false
 	}
 	// 会话未被重连，可操作
+	// 设置新币种
+	oldMiningCoin := session.miningCoin
+	session.miningCoin = newMiningCoin
 	// 状态设为“正在重连服务器”，重连计数器加一
 	session.setStatNonLock(StatReconnecting)
 	session.reconnectCounter++
+	session.coinSince = time.Now()
+	session.manager.metrics.coinSwitches.Inc(oldMiningCoin, newMiningCoin)
+
+	event := session.newEvent(EventSwitch)
+	event.OldCoin = oldMiningCoin
+	event.NewCoin = newMiningCoin
+	event.ReconnectCounter = session.reconnectCounter
+	session.emitEvent(event)
 
 	// 重连服务器
-	session.reconnectStratumServer(retryTimeWhenServerDown)
+	return session.reconnectStratumServer(retryTimeWhenServerDown) == nil
 }
 
-// reconnectStratumServer 重连服务器
-func (session *StratumSession) reconnectStratumServer(retryTime int) {
+// reconnectStratumServer 重连服务器，失败时停止会话
+func (session *StratumSession) reconnectStratumServer(retryTime int) error {
 	// 移除会话注册
 	session.manager.UnRegisterStratumSession(session)
 
@@ -1462,19 +1678,31 @@ func (session *StratumSession) reconnectStratumServer(retryTime int) {
 	var err error
 	// 至少要尝试一次，所以从-1开始
 	for i := -1; i < retryTime; i++ {
+		session.manager.metrics.reconnectAttempts.Inc(session.miningCoin)
 		err = session.connectStratumServer()
+		if err == nil && session.isBTCAgent {
+			err = session.replayBTCAgentSessions()
+			if err != nil {
+				session.serverConn.Close()
+			}
+		}
 		if err == nil {
 			break
 		} else {
 			time.Sleep(1 * time.Second)
 		}
 	}
+	event := session.newEvent(EventReconnect).setResult(err)
+	event.ReconnectCounter = session.reconnectCounter
+	session.emitEvent(event)
+
 	if err != nil {
+		session.manager.metrics.reconnectFailures.Inc(session.miningCoin)
 		if glog.V(2) {
 			glog.Info("Reconnect Server Failed: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin, "; ", err)
 		}
-		go session.Stop()
-		return
+		go session.Stop(StopReasonReconnectFailed)
+		return err
 	}
 
 	// 回到运行状态
@@ -1486,6 +1714,7 @@ func (session *StratumSession) reconnectStratumServer(retryTime int) {
 	if glog.V(2) {
 		glog.Info("Reconnect Server Success: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
 	}
+	return nil
 }
 
 func peekWithTimeout(reader *bufio.Reader, len int, timeout time.Duration) ([]byte, error) {
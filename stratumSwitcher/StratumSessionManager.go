@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"net"
@@ -8,16 +9,25 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/btccom/btcpool-go-modules/coordination"
 	"github.com/golang/glog"
-	"github.com/samuel/go-zookeeper/zk"
 	"github.com/willf/bitset"
 )
 
 // StratumServerInfo Stratum服务器的信息
 type StratumServerInfo struct {
-	URL        string
+	URL string
+	// 按优先级排列的多个服务器地址（可空，配置后将代替URL）
+	URLs       []string
 	UserSuffix string
+	// 是否使用TLS连接服务器
+	EnableTLS bool
+	// 信任的CA证书文件（可空，为空则使用系统CA）
+	TLSCAFile string
+	// 验证服务器证书时使用的主机名（可空，为空则使用服务器地址中的主机名）
+	TLSServerName string
 }
 
 // StratumServerInfoMap Stratum服务器的信息散列表
@@ -30,6 +40,8 @@ type StratumSessionMap map[uint32]*StratumSession
 type StratumSessionManager struct {
 	// 修改StratumSessionMap时加的锁
 	lock sync.Mutex
+	// 重新载入时替换 stratumServerInfoMap 和 upstreamTLSConfigs 加的锁
+	serverInfoLock sync.RWMutex
 	// 所有处于正常代理状态的会话
 	sessions StratumSessionMap
 	// 会话ID管理器
@@ -43,11 +55,16 @@ type StratumSessionManager struct {
 	zookeeperSwitcherWatchDir string
 	// enableUserAutoReg 是否打开子账户自动注册功能
 	enableUserAutoReg bool
+	// enableWorkerCoinRouting 是否监控矿工级别的币种节点
+	// 具体监控的路径为 zookeeperSwitcherWatchDir/子账户名.矿机名
+	enableWorkerCoinRouting bool
 	// zookeeperAutoRegWatchDir 自动注册服务监控的zookeeper目录路径
 	// 具体监控的路径为 zookeeperAutoRegWatchDir/子账户名
 	zookeeperAutoRegWatchDir string
 	// 当前允许的自动注册用户数（注册一个减1，完成后加回来，到0拒绝自动注册，以防DDoS）
 	autoRegAllowUsers int64
+	// 配置的最大自动注册等待用户数（原子操作）
+	autoRegMaxWaitUsers int64
 	// stratum server对子账户名大小写不敏感
 	stratumServerCaseInsensitive bool
 	// 大小写不敏感的用户名索引（可空，仅在 stratumServerCaseInsensitive == false 时用到）
@@ -56,12 +73,65 @@ type StratumSessionManager struct {
 	tcpListenAddr string
 	// TCP监听对象
 	tcpListener net.Listener
+	// 是否从PROXY协议头中获取客户端地址
+	enableProxyProtocol bool
+	// TLS监听的IP和TCP端口（为空表示不开启）
+	tlsListenAddr string
+	// TLS监听对象
+	tlsListener net.Listener
+	// TLS监听使用的配置
+	tlsServerConfig *tls.Config
+	// 各币种连接服务器使用的TLS配置（未开启TLS的币种不在其中）
+	upstreamTLSConfigs map[string]*tls.Config
+	// Stratum V2 监听的IP和TCP端口（为空表示不开启）
+	sv2ListenAddr string
+	// Stratum V2 监听对象
+	sv2Listener net.Listener
+	// Stratum V2 Noise 握手的响应方
+	sv2Responder *StratumV2NoiseResponder
 	// 无停机升级对象
 	upgradable *Upgradable
 	// 区块链类型
 	chainType ChainType
 	// 用于在错误信息中展示的serverID
 	serverID uint8
+	// 运行指标
+	metrics *SwitcherMetrics
+	// 上游服务器健康检查
+	upstreamHealth *UpstreamHealthChecker
+	// 保证健康检查只启动一次
+	upstreamHealthOnce sync.Once
+	// 连接限制器
+	connLimiter *ConnLimiter
+	// 会话事件的输出目标（为空表示不输出）
+	eventSink EventSink
+	// 从Zookeeper分配服务器ID时创建的临时节点（未从Zookeeper分配时为空）
+	serverIDNodePath string
+	// 服务器ID临时节点的值，会话过期后用于重建节点
+	serverIDNodeData []byte
+	// 是否正在排空（原子操作）
+	draining int32
+	// 排空的截止时间
+	drainDeadline time.Time
+	// 排空完成（所有会话已断开）时关闭
+	drainDone chan struct{}
+	// 默认的排空截止时间
+	drainTimeout time.Duration
+	// 排空时每批断开的会话数
+	drainBatchSize int
+	// 排空时的批次间隔
+	drainBatchInterval time.Duration
+	// 可重新载入的配置所在的Zookeeper节点（为空表示不监控）
+	zkConfigNode string
+	// 重新载入时被移除的币种上的会话的处理策略
+	removedCoinPolicy string
+	// migrate 策略下会话切换到的币种
+	removedCoinMigrateTo string
+	// 币种切换策略
+	coinSwitchPolicy CoinSwitchPolicy
+	// 各子账户的会话分配到的币种（子账户名 -> 会话ID -> 币种），用于按比例分配币种
+	coinAssignments     map[string]map[uint32]string
+	coinAssignmentsLock sync.Mutex
 }
 
 // NewStratumSessionManager 创建Stratum会话管理器
@@ -94,18 +164,90 @@ func NewStratumSessionManager(conf ConfigData, runtimeData RuntimeData) (manager
 	manager.stratumServerInfoMap = conf.StratumServerMap
 	manager.zookeeperSwitcherWatchDir = conf.ZKSwitcherWatchDir
 	manager.enableUserAutoReg = conf.EnableUserAutoReg
+	manager.enableWorkerCoinRouting = conf.EnableWorkerCoinRouting
 	manager.zookeeperAutoRegWatchDir = conf.ZKAutoRegWatchDir
 	manager.autoRegAllowUsers = conf.AutoRegMaxWaitUsers
+	manager.autoRegMaxWaitUsers = conf.AutoRegMaxWaitUsers
 	manager.stratumServerCaseInsensitive = conf.StratumServerCaseInsensitive
 	manager.zkUserCaseInsensitiveIndex = conf.ZKUserCaseInsensitiveIndex
 	manager.tcpListenAddr = conf.ListenAddr
+	manager.enableProxyProtocol = conf.EnableProxyProtocol
+	manager.tlsListenAddr = conf.TLSListenAddr
+	manager.sv2ListenAddr = conf.SV2ListenAddr
 	manager.chainType = chainType
+	manager.metrics = NewSwitcherMetrics()
+	manager.upstreamHealth = NewUpstreamHealthChecker(conf.UpstreamCheckIntervalSeconds, conf.UpstreamCheckTimeoutSeconds)
+	manager.connLimiter = NewConnLimiter(conf.MaxConnsPerIP, conf.MaxConnsPerIPPerMinute, conf.MaxAcceptsPerSecond, conf.BanAfterViolations, conf.BanSeconds)
+	manager.coinSwitchPolicy = NewCoinSwitchPolicy(conf.SwitchMinDwellSeconds, conf.SwitchDebounceSeconds, conf.SwitchJitterSeconds)
+	manager.drainDone = make(chan struct{})
+	manager.drainTimeout = time.Duration(conf.DrainTimeoutSeconds) * time.Second
+	manager.drainBatchSize = conf.DrainBatchSize
+	manager.drainBatchInterval = time.Duration(conf.DrainBatchIntervalSeconds) * time.Second
+
+	if manager.drainTimeout <= 0 {
+		manager.drainTimeout = defaultDrainTimeoutSeconds * time.Second
+	}
+	if manager.drainBatchSize <= 0 {
+		manager.drainBatchSize = defaultDrainBatchSize
+	}
+	if manager.drainBatchInterval <= 0 {
+		manager.drainBatchInterval = defaultDrainBatchIntervalSeconds * time.Second
+	}
+
+	if len(manager.tlsListenAddr) > 0 {
+		manager.tlsServerConfig, err = NewTLSServerConfig(conf.TLSCertFile, conf.TLSKeyFile)
+		if err != nil {
+			err = errors.New("Cannot load TLS certificate: " + err.Error())
+			return
+		}
+	}
+
+	manager.upstreamTLSConfigs, err = newUpstreamTLSConfigs(manager.stratumServerInfoMap)
+	if err != nil {
+		return
+	}
+
+	if len(conf.EventLogFile) > 0 {
+		manager.eventSink, err = NewJSONLinesEventSink(conf.EventLogFile)
+		if err != nil {
+			err = errors.New("Cannot open event log file: " + err.Error())
+			return
+		}
+	}
+
+	manager.zkConfigNode = conf.ZKConfigNode
+	manager.removedCoinMigrateTo = conf.RemovedCoinMigrateTo
+	manager.removedCoinPolicy, err = checkRemovedCoinPolicy(conf.RemovedCoinPolicy)
+	if err != nil {
+		err = errors.New(err.Error() + ": " + conf.RemovedCoinPolicy)
+		return
+	}
+
+	if len(manager.sv2ListenAddr) > 0 {
+		if manager.chainType != ChainTypeBitcoin {
+			err = errors.New("Stratum V2 only supports ChainType bitcoin")
+			return
+		}
+		manager.sv2Responder, err = NewStratumV2NoiseResponder(conf.SV2StaticKey, conf.SV2AuthoritySecretKey)
+		if err != nil {
+			err = errors.New("Cannot create Stratum V2 responder: " + err.Error())
+			return
+		}
+	}
 
-	manager.zookeeperManager, err = NewZookeeperManager(conf.ZKBroker)
+	manager.zookeeperManager, err = NewZookeeperManager(conf.CoordinationBackend, conf.ZKBroker)
 	if err != nil {
 		return
 	}
 
+	if len(conf.ZKChangeLogDir) > 0 {
+		err = manager.zookeeperManager.StartChangeFeed(conf.ZKSwitcherWatchDir, conf.ZKChangeLogDir)
+		if err != nil {
+			err = errors.New("Cannot start change feed: " + err.Error())
+			return
+		}
+	}
+
 	if manager.serverID == 0 {
 		// 尝试从zookeeper分配ID
 		manager.serverID, err = manager.AssignServerIDFromZK(conf.ZKServerIDAssignDir, runtimeData.ServerID)
@@ -113,6 +255,7 @@ func NewStratumSessionManager(conf ConfigData, runtimeData RuntimeData) (manager
 			err = errors.New("Cannot assign server id from zk: " + err.Error())
 			return
 		}
+		manager.zookeeperManager.OnSessionExpired(manager.recreateServerIDNode)
 	}
 
 	manager.sessionIDManager, err = NewSessionIDManager(manager.serverID, indexBits)
@@ -168,7 +311,7 @@ func (manager *StratumSessionManager) AssignServerIDFromZK(assignDir string, old
 	data.ChainType = manager.chainType.ToString()
 	data.HostName, _ = os.Hostname()
 	data.ListenAddr = manager.tcpListenAddr
-	for coin := range manager.stratumServerInfoMap {
+	for coin := range manager.getStratumServerInfoMap() {
 		data.Coins = append(data.Coins, coin)
 	}
 	if ips, err := net.InterfaceAddrs(); err == nil {
@@ -189,7 +332,7 @@ func (manager *StratumSessionManager) AssignServerIDFromZK(assignDir string, old
 		}
 
 		nodePath := assignDir + strconv.Itoa(int(newID))
-		_, err = manager.zookeeperManager.zookeeperConn.Create(nodePath, dataJSON, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+		_, err = manager.zookeeperManager.zookeeperConn.Create(nodePath, dataJSON, coordination.FlagEphemeral)
 		if err != nil {
 			glog.Warning("AssignServerIDFromZK: create ", nodePath, " failed. errmsg: ", err)
 			continue
@@ -197,22 +340,82 @@ func (manager *StratumSessionManager) AssignServerIDFromZK(assignDir string, old
 
 		glog.Info("AssignServerIDFromZK: got server id ", newID, " (", nodePath, ")")
 		serverID = uint8(newID)
+		manager.serverIDNodePath = nodePath
+		manager.serverIDNodeData = dataJSON
 		return
 	}
 }
 
-// RunStratumSession 运行一个Stratum会话
-func (manager *StratumSessionManager) RunStratumSession(conn net.Conn) {
+// recreateServerIDNode 会话过期后以相同的服务器ID重建临时节点，失败时重试直到成功或开始排空
+func (manager *StratumSessionManager) recreateServerIDNode() {
+	for !manager.IsDraining() {
+		_, err := manager.zookeeperManager.zookeeperConn.Create(manager.serverIDNodePath, manager.serverIDNodeData, coordination.FlagEphemeral)
+
+		if err == nil {
+			glog.Info("Recreated server id node: ", manager.serverIDNodePath)
+			return
+		}
+
+		if err == coordination.ErrNodeExists {
+			// 会话过期期间该ID被其他 stratumSwitcher 分配，两者分配的 SessionID 可能重复
+			glog.Error("Server id node ", manager.serverIDNodePath, " has been taken by another stratumSwitcher, session ids may conflict!")
+			return
+		}
+
+		glog.Error("Recreate server id node ", manager.serverIDNodePath, " failed, retry in ", zookeeperConnAliveTimeout, "s: ", err)
+		time.Sleep(zookeeperConnAliveTimeout * time.Second)
+	}
+}
+
+// ConnWrapper 在会话开始前对客户端连接进行包装（如协议转换），返回包装后的连接
+type ConnWrapper func(conn net.Conn) (net.Conn, error)
+
+// RunStratumSession 运行一个Stratum会话，wrapper 可为空
+func (manager *StratumSessionManager) RunStratumSession(conn net.Conn, wrapper ConnWrapper) {
+	// PROXY协议头在TLS等其他协议之前
+	if manager.enableProxyProtocol {
+		ppConn, err := wrapProxyProtocolConn(conn)
+		if err != nil {
+			conn.Close()
+			glog.Warning("Read PROXY protocol header failed: ", conn.RemoteAddr(), "; ", err)
+			return
+		}
+		conn = ppConn
+	}
+
+	// 连接限制（在得到真实IP之后、进行耗时的握手之前检查）
+	clientIP := SplitClientIP(conn.RemoteAddr().String())
+	stratumErr := manager.connLimiter.Acquire(clientIP)
+	if stratumErr != nil {
+		manager.rejectConnection(conn, clientIP, stratumErr, wrapper == nil)
+		return
+	}
+
+	if wrapper != nil {
+		wrappedConn, err := wrapper(conn)
+		if err != nil {
+			conn.Close()
+			manager.connLimiter.Release(clientIP)
+			glog.Warning("Wrap conn failed: ", conn.RemoteAddr(), "; ", err)
+			return
+		}
+		conn = wrappedConn
+	}
+
 	// 产生 sessionID （Extranonce1）
 	sessionID, err := manager.sessionIDManager.AllocSessionID()
 
 	if err != nil {
 		conn.Close()
+		manager.connLimiter.Release(clientIP)
 		glog.Error("NewStratumSession failed: ", err)
 		return
 	}
 
 	session := NewStratumSession(manager, conn, sessionID)
+	connectEvent := session.newEvent(EventConnect)
+	connectEvent.Protocol = ""
+	manager.emitEvent(connectEvent)
 	session.Run()
 }
 
@@ -223,24 +426,36 @@ func (manager *StratumSessionManager) ResumeStratumSession(sessionData StratumSe
 
 	if clientErr != nil {
 		glog.Error("Resume client conn failed: ", clientErr)
+		manager.emitResumeFailedEvent(sessionData, clientErr)
 		return
 	}
 
 	if serverErr != nil {
 		glog.Error("Resume server conn failed: ", clientErr)
+		manager.emitResumeFailedEvent(sessionData, serverErr)
 		return
 	}
 
 	if clientConn.RemoteAddr() == nil {
 		glog.Error("Resume client conn failed: downstream exited.")
+		manager.emitResumeFailedEvent(sessionData, errors.New("downstream exited"))
 		return
 	}
 
 	if serverConn.RemoteAddr() == nil {
 		glog.Error("Resume client conn failed: upstream exited.")
+		manager.emitResumeFailedEvent(sessionData, errors.New("upstream exited"))
 		return
 	}
 
+	// 恢复来自PROXY协议头的客户端地址
+	if len(sessionData.ClientIPPort) > 0 && sessionData.ClientIPPort != clientConn.RemoteAddr().String() {
+		clientAddr, err := net.ResolveTCPAddr("tcp", sessionData.ClientIPPort)
+		if err == nil {
+			clientConn = &proxyProtocolConn{clientConn, clientAddr}
+		}
+	}
+
 	//恢复sessionID
 	err := manager.sessionIDManager.ResumeSessionID(sessionData.SessionID)
 	if err != nil {
@@ -248,9 +463,24 @@ func (manager *StratumSessionManager) ResumeStratumSession(sessionData StratumSe
 	}
 
 	session := NewStratumSession(manager, clientConn, sessionData.SessionID)
+	manager.connLimiter.AddConn(SplitClientIP(session.clientIPPort))
 	session.Resume(sessionData, serverConn)
 }
 
+// emitResumeFailedEvent 输出连接无法恢复的会话的 resume 事件
+func (manager *StratumSessionManager) emitResumeFailedEvent(sessionData StratumSessionData, err error) {
+	event := &SessionEvent{
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		Event:      EventResume,
+		ServerID:   manager.serverID,
+		SessionID:  Uint32ToHex(sessionData.SessionID),
+		ClientAddr: sessionData.ClientIPPort,
+		Coin:       sessionData.MiningCoin,
+		ServerURL:  sessionData.ServerURL,
+	}
+	manager.emitEvent(event.setResult(err))
+}
+
 // RegisterStratumSession 注册Stratum会话（在Stratum会话开始正常代理之后调用）
 func (manager *StratumSessionManager) RegisterStratumSession(session *StratumSession) {
 	manager.lock.Lock()
@@ -266,7 +496,7 @@ func (manager *StratumSessionManager) UnRegisterStratumSession(session *StratumS
 	manager.lock.Unlock()
 
 	// 从Zookeeper管理器中删除币种监控
-	manager.zookeeperManager.ReleaseW(session.zkWatchPath, session.sessionID)
+	manager.releaseZKWatch(session)
 }
 
 // ReleaseStratumSession 释放Stratum会话（在Stratum会话停止时调用）
@@ -278,8 +508,14 @@ func (manager *StratumSessionManager) ReleaseStratumSession(session *StratumSess
 
 	// 释放会话ID
 	manager.sessionIDManager.FreeSessionID(session.sessionID)
+	// 释放连接限制器中的连接数
+	if manager.connLimiter != nil {
+		manager.connLimiter.Release(SplitClientIP(session.clientIPPort))
+	}
 	// 从Zookeeper管理器中删除币种监控
-	manager.zookeeperManager.ReleaseW(session.zkWatchPath, session.sessionID)
+	manager.releaseZKWatch(session)
+	// 删除币种分配记录
+	manager.unassignCoin(session)
 }
 
 // Run 开始运行StratumSwitcher服务
@@ -302,17 +538,114 @@ func (manager *StratumSessionManager) Run(runtimeData RuntimeData) {
 		return
 	}
 
+	go manager.connLimiter.RunCleanup()
+
+	// 有币种配置了多个服务器地址时，开启健康检查
+	if manager.hasFailoverUpstreams() {
+		manager.startUpstreamHealthCheck()
+	}
+
+	// TLS监听
+	if len(manager.tlsListenAddr) > 0 {
+		glog.Info("Listen TLS ", manager.tlsListenAddr)
+		manager.tlsListener, err = net.Listen("tcp", manager.tlsListenAddr)
+
+		if err != nil {
+			glog.Fatal("listen failed: ", err)
+			return
+		}
+
+		go manager.serve(manager.tlsListener, manager.wrapTLSServerConn)
+	}
+
+	// Stratum V2 监听
+	if len(manager.sv2ListenAddr) > 0 {
+		glog.Info("Listen Stratum V2 ", manager.sv2ListenAddr)
+		manager.sv2Listener, err = net.Listen("tcp", manager.sv2ListenAddr)
+
+		if err != nil {
+			glog.Fatal("listen failed: ", err)
+			return
+		}
+
+		go manager.serve(manager.sv2Listener, manager.sv2Responder.WrapStratumV2Conn)
+	}
+
 	manager.Upgradable()
+	manager.Drainable()
+
+	manager.serve(manager.tcpListener, nil)
 
+	// 监听端口已因排空而关闭，等待所有会话断开
+	<-manager.drainDone
+	glog.Info("Drain finished, exit.")
+	glog.Flush()
+}
+
+// rejectConnection 拒绝被连接限制器拦截的连接
+// 明文连接上会先发送一个错误响应（TLS和Stratum V2连接在握手前无法发送）
+func (manager *StratumSessionManager) rejectConnection(conn net.Conn, clientIP string, stratumErr *StratumError, plaintext bool) {
+	manager.metrics.rejectedConnections.Inc(stratumErr.ErrMsg)
+	if glog.V(2) {
+		glog.Warning("Connection Rejected: ", clientIP, "; ", stratumErr.ErrNo, " ", stratumErr.ErrMsg)
+	}
+
+	if plaintext {
+		response := JSONRPCResponse{nil, nil, stratumErr.ToJSONRPCArray(manager.serverID)}
+		data, err := response.ToJSONBytes(1)
+		if err == nil {
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			conn.Write(append(data, '\n'))
+		}
+	}
+	conn.Close()
+}
+
+// serve 接受连接并为每个连接运行Stratum会话
+func (manager *StratumSessionManager) serve(listener net.Listener, wrapper ConnWrapper) {
 	for {
-		conn, err := manager.tcpListener.Accept()
+		conn, err := listener.Accept()
 
 		if err != nil {
+			if manager.IsDraining() {
+				return
+			}
 			continue
 		}
 
-		go manager.RunStratumSession(conn)
+		go manager.RunStratumSession(conn, wrapper)
+	}
+}
+
+// startUpstreamHealthCheck 开启上游服务器健康检查（只启动一次，重新载入后新增的地址也会被检查）
+func (manager *StratumSessionManager) startUpstreamHealthCheck() {
+	manager.upstreamHealthOnce.Do(func() {
+		go manager.upstreamHealth.Run(manager.getAllUpstreamURLs)
+	})
+}
+
+// hasFailoverUpstreams 是否有币种配置了多个服务器地址
+func (manager *StratumSessionManager) hasFailoverUpstreams() bool {
+	for _, serverInfo := range manager.getStratumServerInfoMap() {
+		if len(serverInfo.GetURLs()) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// getAllUpstreamURLs 获取所有币种的服务器地址（已去重）
+func (manager *StratumSessionManager) getAllUpstreamURLs() (urls []string) {
+	exists := make(map[string]bool)
+	for _, serverInfo := range manager.getStratumServerInfoMap() {
+		for _, url := range serverInfo.GetURLs() {
+			if !exists[url] {
+				exists[url] = true
+				urls = append(urls, url)
+			}
+		}
 	}
+	return
 }
 
 // Upgradable 使StratumSwitcher可无停机升级
@@ -320,6 +653,10 @@ func (manager *StratumSessionManager) Upgradable() {
 	manager.upgradable = NewUpgradable(manager)
 
 	go signalUSR2Listener(func() {
+		if manager.IsDraining() {
+			glog.Warning("Upgrade Skipped: the switcher is draining.")
+			return
+		}
 		err := manager.upgradable.upgradeStratumSwitcher()
 		if err != nil {
 			glog.Error("Upgrade Failed: ", err)
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// subscribeParamsForClient 以指定的客户端地址发送 mining.subscribe，返回服务器收到的参数
+func subscribeParamsForClient(t *testing.T, protocolType ProtocolType, clientIPPort string) []interface{} {
+	manager := new(StratumSessionManager)
+	manager.chainType = ChainTypeBitcoin
+	if protocolType != ProtocolBitcoinStratum {
+		manager.chainType = ChainTypeEthereum
+	}
+
+	serverConn, serverSide := net.Pipe()
+	defer serverConn.Close()
+	defer serverSide.Close()
+
+	session := new(StratumSession)
+	session.manager = manager
+	session.protocolType = protocolType
+	session.sessionID = 0x0100002a
+	session.sessionIDString = "0100002a"
+	session.clientIPPort = clientIPPort
+	session.serverConn = serverConn
+	session.stratumSubscribeRequest = &JSONRPCRequest{1, "mining.subscribe", JSONRPCArray{"miner/1.0", "EthereumStratum/1.0.0"}, ""}
+
+	lines := make(chan []byte, 1)
+	go func() {
+		line, _ := bufio.NewReader(serverSide).ReadBytes('\n')
+		lines <- line
+	}()
+
+	_, _, err := session.sendMiningSubscribeToServer()
+	if err != nil {
+		t.Fatalf("sendMiningSubscribeToServer failed: %s", err)
+	}
+
+	request, err := NewJSONRPCRequest(<-lines)
+	if err != nil {
+		t.Fatalf("decode mining.subscribe failed: %s", err)
+	}
+	return request.Params
+}
+
+func TestSendMiningSubscribeClientIP(t *testing.T) {
+	testCases := []struct {
+		protocolType ProtocolType
+		clientIPPort string
+		expected     []interface{}
+	}{
+		{ProtocolBitcoinStratum, "192.168.1.10:3333", []interface{}{"miner/1.0", "0100002a", float64(0xc0a8010a)}},
+		{ProtocolBitcoinStratum, "[2001:db8::1]:3333", []interface{}{"miner/1.0", "0100002a", float64(0), "2001:db8::1"}},
+		{ProtocolEthereumStratum, "192.168.1.10:3333", []interface{}{"miner/1.0", "EthereumStratum/1.0.0", "0100002a", float64(0xc0a8010a)}},
+		{ProtocolEthereumStratum, "[2001:db8::1]:3333", []interface{}{"miner/1.0", "EthereumStratum/1.0.0", "0100002a", float64(0), "2001:db8::1"}},
+	}
+
+	for _, testCase := range testCases {
+		params := subscribeParamsForClient(t, testCase.protocolType, testCase.clientIPPort)
+		if !reflect.DeepEqual(params, testCase.expected) {
+			t.Errorf("mining.subscribe params of %s (%s) = %v, expected %v",
+				testCase.clientIPPort, testCase.protocolType.ToString(), params, testCase.expected)
+		}
+	}
+}
+
+func TestStratumSessionAuthorizeSuffixRetry(t *testing.T) {
+	btc := newFakeSServer(t, "btc", ChainTypeBitcoin)
+	// sserver 只接受带币种后缀的子账户名
+	btc.acceptWorker = func(worker string) bool { return strings.HasPrefix(worker, "aaaa_btc.") }
+	btc.Start()
+	defer btc.Close()
+
+	switcher := newTestSwitcher(t, "bitcoin", StratumServerInfoMap{"btc": {URL: btc.URL(), UserSuffix: "btc"}})
+	defer switcher.Close()
+	switcher.setCoin("aaaa", "btc")
+
+	miner := dialFakeMiner(t, switcher)
+	defer miner.Close()
+
+	subscribe := miner.expectResponse(miner.send("mining.subscribe", "cgminer/4.10.0"))
+	result, ok := subscribe.Result.([]interface{})
+	if !ok || len(result) < 3 {
+		t.Fatalf("wrong subscribe response: %+v", subscribe)
+	}
+	sessionID, _ := result[1].(string)
+
+	auth := miner.expectResponse(miner.send("mining.authorize", "aaaa.rig01", "x"))
+	if auth.Result != true || auth.Error != nil {
+		t.Fatalf("authorize should succeed: %+v", auth)
+	}
+
+	// 转发给 sserver 的订阅请求带有会话ID（Extranonce1）
+	if request := btc.expectRequest("mining.subscribe"); request.Params[1] != sessionID {
+		t.Errorf("wrong session id in subscribe request: %v, expected %s", request.Params, sessionID)
+	}
+	// 首次认证不带币种后缀，失败后带后缀重试
+	if request := btc.expectRequest("mining.authorize"); request.Params[0] != "aaaa.rig01" {
+		t.Errorf("wrong worker of the first authorize: %v", request.Params)
+	}
+	if request := btc.expectRequest("mining.authorize"); request.Params[0] != "aaaa_btc.rig01" {
+		t.Errorf("wrong worker of the second authorize: %v", request.Params)
+	}
+
+	if notify := miner.expectNotify("mining.notify"); notify.Params[0] != "btc" {
+		t.Errorf("wrong notify: %+v", notify)
+	}
+
+	// 认证后矿机的请求被原样转发
+	miner.send("mining.submit", "aaaa.rig01", "job1", "00000000", "5c5f6a1b", "12345678")
+	if request := btc.expectRequest("mining.submit"); request.Params[1] != "job1" {
+		t.Errorf("wrong submit: %v", request.Params)
+	}
+}
+
+func TestStratumSessionAuthorizeFailed(t *testing.T) {
+	btc := newFakeSServer(t, "btc", ChainTypeBitcoin)
+	btc.acceptWorker = func(worker string) bool { return false }
+	btc.Start()
+	defer btc.Close()
+
+	switcher := newTestSwitcher(t, "bitcoin", StratumServerInfoMap{"btc": {URL: btc.URL()}})
+	defer switcher.Close()
+	switcher.setCoin("aaaa", "btc")
+
+	// sserver 拒绝两次认证，矿机收到认证失败后被断开
+	miner := dialFakeMiner(t, switcher)
+	defer miner.Close()
+	auth := miner.login("cgminer/4.10.0", "aaaa.rig01")
+	if auth.Result != false || auth.Error == nil {
+		t.Errorf("authorize should fail: %+v", auth)
+	}
+	miner.expectClosed()
+
+	// Zookeeper中没有该子账户
+	miner = dialFakeMiner(t, switcher)
+	defer miner.Close()
+	auth = miner.login("cgminer/4.10.0", "bbbb.rig01")
+	if errInfo, ok := auth.Error.([]interface{}); !ok || errInfo[0] != float64(201) {
+		t.Errorf("authorize of unknown sub-account should fail with 201: %+v", auth)
+	}
+	miner.expectClosed()
+}
+
+func TestStratumSessionVersionMask(t *testing.T) {
+	btc := newFakeSServer(t, "btc", ChainTypeBitcoin)
+	btc.versionMask = "00ffe000"
+	btc.Start()
+	defer btc.Close()
+
+	switcher := newTestSwitcher(t, "bitcoin", StratumServerInfoMap{"btc": {URL: btc.URL()}})
+	defer switcher.Close()
+	switcher.setCoin("aaaa", "btc")
+
+	miner := dialFakeMiner(t, switcher)
+	defer miner.Close()
+
+	// 连接服务器之前先以矿机请求的掩码响应
+	configure := miner.expectResponse(miner.send("mining.configure",
+		[]interface{}{"version-rolling"},
+		map[string]interface{}{"version-rolling.mask": "1fffe000", "version-rolling.min-bit-count": 2}))
+	if result, ok := configure.Result.(map[string]interface{}); !ok || result["version-rolling"] != true || result["version-rolling.mask"] != "1fffe000" {
+		t.Errorf("wrong configure response: %+v", configure)
+	}
+
+	if auth := miner.login("bmminer/2.0.0", "aaaa.rig01"); auth.Result != true {
+		t.Fatalf("authorize should succeed: %+v", auth)
+	}
+
+	if request := btc.expectRequest("mining.configure"); request.Params[1].(map[string]interface{})["version-rolling.mask"] != "1fffe000" {
+		t.Errorf("wrong configure request: %v", request.Params)
+	}
+	// 认证后下发矿机请求的掩码与服务器允许的掩码的交集
+	if notify := miner.expectNotify("mining.set_version_mask"); notify.Params[0] != "00ffe000" {
+		t.Errorf("wrong version mask: %+v", notify)
+	}
+}
+
+func TestStratumSessionCoinSwitch(t *testing.T) {
+	btc := newFakeSServer(t, "btc", ChainTypeBitcoin).Start()
+	defer btc.Close()
+	bcc := newFakeSServer(t, "bcc", ChainTypeBitcoin).Start()
+	defer bcc.Close()
+
+	switcher := newTestSwitcher(t, "bitcoin", StratumServerInfoMap{
+		"btc": {URL: btc.URL()},
+		"bcc": {URL: bcc.URL()},
+	})
+	defer switcher.Close()
+	switcher.setCoin("aaaa", "btc")
+
+	miner := dialFakeMiner(t, switcher)
+	defer miner.Close()
+	if auth := miner.login("cgminer/4.10.0", "aaaa.rig01"); auth.Result != true {
+		t.Fatalf("authorize should succeed: %+v", auth)
+	}
+	sessionID := btc.expectRequest("mining.subscribe").Params[1]
+	if notify := miner.expectNotify("mining.notify"); notify.Params[0] != "btc" {
+		t.Fatalf("wrong notify: %+v", notify)
+	}
+
+	switcher.setCoin("aaaa", "bcc")
+
+	// 切换后使用同一个会话ID连接新币种的服务器
+	if request := bcc.expectRequest("mining.subscribe"); request.Params[1] != sessionID {
+		t.Errorf("session id changed after switching: %v, expected %v", request.Params[1], sessionID)
+	}
+	for miner.expectNotify("mining.notify").Params[0] != "bcc" {
+	}
+
+	miner.send("mining.submit", "aaaa.rig01", "job2", "00000000", "5c5f6a1b", "12345678")
+	if request := bcc.expectRequest("mining.submit"); request.Params[1] != "job2" {
+		t.Errorf("wrong submit: %v", request.Params)
+	}
+}
+
+func TestStratumSessionForceSwitch(t *testing.T) {
+	btc := newFakeSServer(t, "btc", ChainTypeBitcoin).Start()
+	defer btc.Close()
+	bcc := newFakeSServer(t, "bcc", ChainTypeBitcoin).Start()
+	defer bcc.Close()
+
+	switcher := newTestSwitcher(t, "bitcoin", StratumServerInfoMap{
+		"btc": {URL: btc.URL()},
+		"bcc": {URL: bcc.URL()},
+	})
+	defer switcher.Close()
+	switcher.setCoin("aaaa", "btc")
+
+	miner := dialFakeMiner(t, switcher)
+	defer miner.Close()
+	if auth := miner.login("cgminer/4.10.0", "aaaa.rig01"); auth.Result != true {
+		t.Fatalf("authorize should succeed: %+v", auth)
+	}
+	sessionIDString, _ := btc.expectRequest("mining.subscribe").Params[1].(string)
+	miner.expectNotify("mining.notify")
+
+	sessionID, _ := strconv.ParseUint(sessionIDString, 16, 32)
+	session, ok := switcher.manager.findSession(uint32(sessionID))
+	if !ok {
+		t.Fatalf("session %s not found", sessionIDString)
+	}
+
+	// 已被其他线程重连（重连计数已改变）时放弃切换，币种不变
+	if session.switchCoinType("bcc", session.getReconnectCounter()+1) {
+		t.Error("switch with a stale reconnect counter should fail")
+	}
+	if coin := session.getMiningCoin(); coin != "btc" {
+		t.Errorf("mining coin changed by an aborted switch: %s", coin)
+	}
+
+	// 切换失败时不保留币种覆盖的标记
+	session.setStat(StatReconnecting)
+	if err := switcher.manager.ForceSwitchSession(uint32(sessionID), "bcc"); err != AdminErrSwitchFailed {
+		t.Errorf("switch a reconnecting session: %v", err)
+	}
+	if info := session.GetSessionInfo(); info.CoinOverridden || info.MiningCoin != "btc" {
+		t.Errorf("coin overridden by a failed switch: %+v", info)
+	}
+	session.setStat(StatRunning)
+
+	if err := switcher.manager.ForceSwitchSession(uint32(sessionID), "bcc"); err != nil {
+		t.Fatalf("ForceSwitchSession failed: %v", err)
+	}
+	bcc.expectRequest("mining.subscribe")
+	for miner.expectNotify("mining.notify").Params[0] != "bcc" {
+	}
+	if coin := session.getMiningCoin(); coin != "bcc" {
+		t.Errorf("wrong mining coin after switching: %s", coin)
+	}
+
+	if err := switcher.manager.ForceSwitchSession(uint32(sessionID), "ltc"); err != AdminErrCoinIsInexistent {
+		t.Errorf("switch to an inexistent coin: %v", err)
+	}
+}
+
+func TestStratumSessionServerDownReconnect(t *testing.T) {
+	primary := newFakeSServer(t, "primary", ChainTypeBitcoin).Start()
+	defer primary.Close()
+	backup := newFakeSServer(t, "backup", ChainTypeBitcoin).Start()
+	defer backup.Close()
+
+	switcher := newTestSwitcher(t, "bitcoin", StratumServerInfoMap{
+		"btc": {URLs: []string{primary.URL(), backup.URL()}},
+	})
+	defer switcher.Close()
+	switcher.setCoin("aaaa", "btc")
+
+	miner := dialFakeMiner(t, switcher)
+	defer miner.Close()
+	if auth := miner.login("cgminer/4.10.0", "aaaa.rig01"); auth.Result != true {
+		t.Fatalf("authorize should succeed: %+v", auth)
+	}
+	primary.expectRequest("mining.subscribe")
+	if notify := miner.expectNotify("mining.notify"); notify.Params[0] != "primary" {
+		t.Fatalf("wrong notify: %+v", notify)
+	}
+
+	// 服务器断开连接，重连到同一个服务器，矿机连接保持不变
+	primary.DropConnections()
+	primary.expectRequest("mining.subscribe")
+	if notify := miner.expectNotify("mining.notify"); notify.Params[0] != "primary" {
+		t.Fatalf("wrong notify after reconnecting: %+v", notify)
+	}
+
+	// 服务器宕机，重连到备用服务器
+	primary.Close()
+	backup.expectRequest("mining.subscribe")
+	for miner.expectNotify("mining.notify").Params[0] != "backup" {
+	}
+
+	miner.send("mining.submit", "aaaa.rig01", "job3", "00000000", "5c5f6a1b", "12345678")
+	if request := backup.expectRequest("mining.submit"); request.Params[1] != "job3" {
+		t.Errorf("wrong submit: %v", request.Params)
+	}
+}
+
+// 服务器连续断开时，重连与代理协程交接连接和bufio，需要在 -race 下运行
+func TestStratumSessionRepeatedServerDrop(t *testing.T) {
+	btc := newFakeSServer(t, "btc", ChainTypeBitcoin).Start()
+	defer btc.Close()
+
+	switcher := newTestSwitcher(t, "bitcoin", StratumServerInfoMap{"btc": {URL: btc.URL()}})
+	defer switcher.Close()
+	switcher.setCoin("aaaa", "btc")
+
+	miner := dialFakeMiner(t, switcher)
+	defer miner.Close()
+	if auth := miner.login("cgminer/4.10.0", "aaaa.rig01"); auth.Result != true {
+		t.Fatalf("authorize should succeed: %+v", auth)
+	}
+	btc.expectRequest("mining.subscribe")
+	miner.expectNotify("mining.notify")
+
+	for i := 0; i < 5; i++ {
+		btc.DropConnections()
+		btc.expectRequest("mining.subscribe")
+		miner.expectNotify("mining.notify")
+
+		job := "job" + strconv.Itoa(i)
+		miner.send("mining.submit", "aaaa.rig01", job, "00000000", "5c5f6a1b", "12345678")
+		if request := btc.expectRequest("mining.submit"); request.Params[1] != job {
+			t.Errorf("wrong submit after reconnecting %d times: %v", i+1, request.Params)
+		}
+	}
+}
+
+// 重连后仍由同一个监控协程切换币种，切换后继续监控
+func TestStratumSessionCoinSwitchAfterReconnect(t *testing.T) {
+	btc := newFakeSServer(t, "btc", ChainTypeBitcoin).Start()
+	defer btc.Close()
+	bcc := newFakeSServer(t, "bcc", ChainTypeBitcoin).Start()
+	defer bcc.Close()
+
+	switcher := newTestSwitcher(t, "bitcoin", StratumServerInfoMap{
+		"btc": {URL: btc.URL()},
+		"bcc": {URL: bcc.URL()},
+	})
+	defer switcher.Close()
+	switcher.setCoin("aaaa", "btc")
+
+	miner := dialFakeMiner(t, switcher)
+	defer miner.Close()
+	if auth := miner.login("cgminer/4.10.0", "aaaa.rig01"); auth.Result != true {
+		t.Fatalf("authorize should succeed: %+v", auth)
+	}
+	btc.expectRequest("mining.subscribe")
+	miner.expectNotify("mining.notify")
+
+	btc.DropConnections()
+	btc.expectRequest("mining.subscribe")
+	miner.expectNotify("mining.notify")
+
+	for _, coin := range []string{"bcc", "btc", "bcc"} {
+		server := bcc
+		if coin == "btc" {
+			server = btc
+		}
+		switcher.setCoin("aaaa", coin)
+		server.expectRequest("mining.subscribe")
+		for miner.expectNotify("mining.notify").Params[0] != coin {
+		}
+	}
+}
+
+func TestStratumSessionEthereumNiceHashExtraNonce(t *testing.T) {
+	eth := newFakeSServer(t, "eth", ChainTypeEthereum).Start()
+	defer eth.Close()
+
+	switcher := newTestSwitcher(t, "ethereum", StratumServerInfoMap{"eth": {URL: eth.URL()}})
+	defer switcher.Close()
+	switcher.setCoin("aaaa", "eth")
+
+	testCases := []struct {
+		userAgent     string
+		extraNonceLen int
+	}{
+		// NiceHash以太坊客户端只支持2字节的ExtraNonce
+		{"NiceHash/1.0.0", 4},
+		{"ethminer-0.19.0", 6},
+	}
+
+	for _, testCase := range testCases {
+		miner := dialFakeMiner(t, switcher)
+		defer miner.Close()
+
+		subscribe := miner.expectResponse(miner.send("mining.subscribe", testCase.userAgent, "EthereumStratum/1.0.0"))
+		result, ok := subscribe.Result.([]interface{})
+		if !ok || len(result) < 2 {
+			t.Fatalf("wrong subscribe response: %+v", subscribe)
+		}
+		sessionID := result[0].([]interface{})[1].(string)
+		extraNonce, _ := result[1].(string)
+		if len(sessionID) != 6 || len(extraNonce) != testCase.extraNonceLen || !strings.HasPrefix(sessionID, extraNonce) {
+			t.Errorf("%s: wrong session id or extra nonce: %s, %s", testCase.userAgent, sessionID, extraNonce)
+		}
+
+		auth := miner.expectResponse(miner.send("mining.authorize", "aaaa.rig01", "x"))
+		if auth.Result != true {
+			t.Errorf("%s: authorize should succeed: %+v", testCase.userAgent, auth)
+		}
+
+		// sserver 收到完整的会话ID，并返回与矿机相同的 ExtraNonce
+		if request := eth.expectRequest("mining.subscribe"); request.Params[2] != sessionID {
+			t.Errorf("%s: wrong subscribe request: %v", testCase.userAgent, request.Params)
+		}
+		if notify := miner.expectNotify("mining.notify"); notify.Params[0] != "eth" {
+			t.Errorf("%s: wrong notify: %+v", testCase.userAgent, notify)
+		}
+	}
+}
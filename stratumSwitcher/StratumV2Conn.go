@@ -0,0 +1,749 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Stratum V2 下游连接到 Stratum V1 字节流的转换
+//
+// StratumV2Conn 实现了 net.Conn 接口。从矿机收到的 Stratum V2 消息被转换为 Stratum V1 JSON 行，
+// 供 StratumSession 读取；StratumSession 写入的 Stratum V1 JSON 行被转换为 Stratum V2 消息发给矿机。
+// 因此 StratumSession 的认证、代理、币种切换和重连逻辑无需任何改动即可用于 Stratum V2 矿机，
+// 会话ID也同样做为 Extranonce1（即 Stratum V2 的 extranonce_prefix）下发给矿机。
+//
+// 每个连接只支持一个挖矿通道（标准通道或扩展通道）。
+
+// 使用的 Stratum V2 协议版本
+const sv2ProtocolVersion = 2
+
+// 翻译器发给 StratumSession 的 Stratum V1 请求的 ID
+const (
+	sv2V1ConfigureID = 1
+	sv2V1SubscribeID = 2
+	sv2V1AuthorizeID = 3
+	// 提交share时使用的第一个ID
+	sv2V1FirstSubmitID = 100
+)
+
+// 每个通道保留的最大任务数
+const sv2MaxJobsPerChannel = 32
+
+// 向服务器请求的版本位掩码（BIP320 通用位）
+const sv2DefaultVersionRollingMask = 0x1fffe000
+
+// StratumV2 协议下发给矿机的 user agent 前缀
+const sv2UserAgentPrefix = "stratumSwitcher-sv2/"
+
+// 比特币难度1对应的目标值
+var sv2Diff1Target, _ = new(big.Int).SetString("00000000FFFF0000000000000000000000000000000000000000000000000000", 16)
+
+// ErrSV2UnexpectedMessage 收到了不符合预期的消息
+var ErrSV2UnexpectedMessage = errors.New("Stratum V2 Unexpected Message")
+
+// sv2Job 已下发给矿机的任务
+type sv2Job struct {
+	// Stratum V1 任务ID
+	v1JobID string
+	// 任务的版本号
+	version uint32
+}
+
+// sv2PendingSubmit 等待服务器响应的share
+type sv2PendingSubmit struct {
+	channelID      uint32
+	sequenceNumber uint32
+}
+
+// sv2Channel 矿机打开的挖矿通道
+type sv2Channel struct {
+	channelID uint32
+	request   SV2OpenMiningChannel
+	// 是否已向矿机发送 OpenMiningChannel.Success
+	opened bool
+
+	// 由 mining.subscribe 响应得到的 Extranonce1 和 Extranonce2 长度
+	extranonce1     []byte
+	extranonce2Size int
+	// 标准通道使用的固定 Extranonce2
+	standardExtranonce2 []byte
+
+	// 当前目标值（小端序 U256）
+	target []byte
+	// 服务器允许的版本位掩码
+	versionMask uint32
+
+	lastPrevHash string
+	nextJobID    uint32
+	jobs         map[uint32]*sv2Job
+	jobIDs       []uint32
+	// 通道打开前收到的最后一个任务
+	pendingNotify *JSONRPCRequest
+}
+
+// StratumV2Conn 翻译 Stratum V2 连接的 net.Conn
+type StratumV2Conn struct {
+	conn      net.Conn
+	transport *StratumV2NoiseTransport
+	setup     SV2SetupConnection
+
+	// 翻译后的 Stratum V1 消息，由 StratumSession 读取
+	pipeReader *io.PipeReader
+	pipeWriter *io.PipeWriter
+
+	// 访问以下字段时加的锁
+	lock sync.Mutex
+	// StratumSession 写入的、尚未构成完整行的数据
+	writeBuffer []byte
+	channel     *sv2Channel
+	// 等待响应的share，以 Stratum V1 请求ID为键
+	pendingSubmits map[uint64]sv2PendingSubmit
+	nextSubmitID   uint64
+	closed         bool
+
+	closeOnce sync.Once
+}
+
+// WrapStratumV2Conn 完成 Noise 握手和 SetupConnection，返回翻译后的连接
+func (responder *StratumV2NoiseResponder) WrapStratumV2Conn(conn net.Conn) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(protocolDetectTimeoutSeconds * time.Second))
+
+	transport, err := responder.Handshake(conn)
+	if err != nil {
+		return nil, errors.New("Stratum V2 handshake failed: " + err.Error())
+	}
+
+	frame, err := transport.ReadFrame()
+	if err != nil {
+		return nil, errors.New("Stratum V2 read SetupConnection failed: " + err.Error())
+	}
+	if frame.MsgType != sv2MsgSetupConnection {
+		return nil, ErrSV2UnexpectedMessage
+	}
+
+	setup, err := parseSV2SetupConnection(frame.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var errorCode string
+	if setup.Protocol != sv2ProtocolMining {
+		errorCode = "unsupported-protocol"
+	} else if setup.MinVersion > sv2ProtocolVersion || setup.MaxVersion < sv2ProtocolVersion {
+		errorCode = "protocol-version-mismatch"
+	}
+	if len(errorCode) > 0 {
+		var w sv2Writer
+		w.u32(0)
+		w.str0255([]byte(errorCode))
+		transport.WriteFrame(NewStratumV2Frame(sv2MsgSetupConnectionError, false, w.bytes()))
+		return nil, errors.New("Stratum V2 SetupConnection failed: " + errorCode)
+	}
+
+	var w sv2Writer
+	w.u16(sv2ProtocolVersion)
+	w.u32(0)
+	err = transport.WriteFrame(NewStratumV2Frame(sv2MsgSetupConnectionSuccess, false, w.bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	if glog.V(3) {
+		glog.Info("Stratum V2 SetupConnection: ", conn.RemoteAddr(), "; ", setup.Vendor, "; ",
+			setup.HardwareVersion, "; ", setup.Firmware, "; ", setup.DeviceID)
+	}
+
+	return NewStratumV2Conn(conn, transport, setup), nil
+}
+
+// NewStratumV2Conn 创建翻译后的连接并开始接收矿机消息
+func NewStratumV2Conn(conn net.Conn, transport *StratumV2NoiseTransport, setup SV2SetupConnection) *StratumV2Conn {
+	sv2Conn := new(StratumV2Conn)
+	sv2Conn.conn = conn
+	sv2Conn.transport = transport
+	sv2Conn.setup = setup
+	sv2Conn.pipeReader, sv2Conn.pipeWriter = io.Pipe()
+	sv2Conn.pendingSubmits = make(map[uint64]sv2PendingSubmit)
+	sv2Conn.nextSubmitID = sv2V1FirstSubmitID
+
+	go sv2Conn.readLoop()
+	return sv2Conn
+}
+
+// Read 读取翻译后的 Stratum V1 消息
+func (sv2Conn *StratumV2Conn) Read(b []byte) (int, error) {
+	return sv2Conn.pipeReader.Read(b)
+}
+
+// Write 写入 Stratum V1 消息，完整的行将被翻译为 Stratum V2 消息发给矿机
+func (sv2Conn *StratumV2Conn) Write(b []byte) (int, error) {
+	sv2Conn.lock.Lock()
+	defer sv2Conn.lock.Unlock()
+
+	if sv2Conn.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	sv2Conn.writeBuffer = append(sv2Conn.writeBuffer, b...)
+	for {
+		pos := bytes.IndexByte(sv2Conn.writeBuffer, '\n')
+		if pos < 0 {
+			break
+		}
+		line := sv2Conn.writeBuffer[:pos]
+		sv2Conn.writeBuffer = sv2Conn.writeBuffer[pos+1:]
+
+		if len(line) == 0 {
+			continue
+		}
+		err := sv2Conn.handleV1Line(line)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Close 关闭连接
+func (sv2Conn *StratumV2Conn) Close() (err error) {
+	sv2Conn.closeOnce.Do(func() {
+		sv2Conn.lock.Lock()
+		sv2Conn.closed = true
+		sv2Conn.lock.Unlock()
+
+		err = sv2Conn.conn.Close()
+		sv2Conn.pipeReader.Close()
+		sv2Conn.pipeWriter.Close()
+	})
+	return
+}
+
+// LocalAddr 本地地址
+func (sv2Conn *StratumV2Conn) LocalAddr() net.Addr { return sv2Conn.conn.LocalAddr() }
+
+// RemoteAddr 矿机地址
+func (sv2Conn *StratumV2Conn) RemoteAddr() net.Addr { return sv2Conn.conn.RemoteAddr() }
+
+// SetDeadline 设置底层连接的超时
+func (sv2Conn *StratumV2Conn) SetDeadline(t time.Time) error { return sv2Conn.conn.SetDeadline(t) }
+
+// SetReadDeadline 设置底层连接的读超时
+func (sv2Conn *StratumV2Conn) SetReadDeadline(t time.Time) error {
+	return sv2Conn.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline 设置底层连接的写超时
+func (sv2Conn *StratumV2Conn) SetWriteDeadline(t time.Time) error {
+	return sv2Conn.conn.SetWriteDeadline(t)
+}
+
+// readLoop 接收矿机发来的 Stratum V2 消息
+func (sv2Conn *StratumV2Conn) readLoop() {
+	for {
+		frame, err := sv2Conn.transport.ReadFrame()
+		if err != nil {
+			if glog.V(3) {
+				glog.Info("Stratum V2 read frame failed: ", sv2Conn.conn.RemoteAddr(), "; ", err)
+			}
+			sv2Conn.pipeWriter.CloseWithError(io.EOF)
+			return
+		}
+
+		err = sv2Conn.handleFrame(frame)
+		if err != nil {
+			glog.Warning("Stratum V2 handle frame failed: ", sv2Conn.conn.RemoteAddr(), "; ", err)
+			sv2Conn.pipeWriter.CloseWithError(io.EOF)
+			return
+		}
+	}
+}
+
+// writeV1Message 将 Stratum V1 消息交给 StratumSession
+func (sv2Conn *StratumV2Conn) writeV1Message(request *JSONRPCRequest) error {
+	data, err := request.ToJSONBytes()
+	if err != nil {
+		return err
+	}
+	_, err = sv2Conn.pipeWriter.Write(append(data, '\n'))
+	return err
+}
+
+// handleFrame 处理矿机发来的 Stratum V2 消息
+func (sv2Conn *StratumV2Conn) handleFrame(frame *StratumV2Frame) error {
+	switch frame.MsgType {
+	case sv2MsgOpenStandardMiningChannel, sv2MsgOpenExtendedMiningChannel:
+		request, err := parseSV2OpenMiningChannel(frame.Payload, frame.MsgType == sv2MsgOpenExtendedMiningChannel)
+		if err != nil {
+			return err
+		}
+		return sv2Conn.handleOpenMiningChannel(request)
+
+	case sv2MsgSubmitSharesStandard, sv2MsgSubmitSharesExtended:
+		submit, err := parseSV2SubmitShares(frame.Payload, frame.MsgType == sv2MsgSubmitSharesExtended)
+		if err != nil {
+			return err
+		}
+		return sv2Conn.handleSubmitShares(submit)
+
+	case sv2MsgCloseChannel:
+		return errors.New("channel closed by client")
+
+	case sv2MsgUpdateChannel:
+		// 难度由sserver决定，忽略
+		return nil
+
+	default:
+		if glog.V(3) {
+			glog.Info("Stratum V2 ignored message: ", sv2Conn.conn.RemoteAddr(), "; type ", frame.MsgType)
+		}
+		return nil
+	}
+}
+
+func (sv2Conn *StratumV2Conn) handleOpenMiningChannel(request SV2OpenMiningChannel) error {
+	sv2Conn.lock.Lock()
+	if sv2Conn.channel != nil {
+		sv2Conn.lock.Unlock()
+		return sv2Conn.sendOpenMiningChannelError(request.RequestID, "only-one-channel-supported")
+	}
+
+	channel := new(sv2Channel)
+	channel.channelID = 1
+	channel.request = request
+	channel.target = sv2DifficultyToTarget(1)
+	channel.jobs = make(map[uint32]*sv2Job)
+	sv2Conn.channel = channel
+	sv2Conn.lock.Unlock()
+
+	// 版本位滚动
+	configure := JSONRPCRequest{
+		sv2V1ConfigureID,
+		"mining.configure",
+		JSONRPCArray{
+			JSONRPCArray{"version-rolling"},
+			JSONRPCObj{"version-rolling.mask": fmt.Sprintf("%08x", sv2DefaultVersionRollingMask), "version-rolling.min-bit-count": 2}},
+		""}
+	err := sv2Conn.writeV1Message(&configure)
+	if err != nil {
+		return err
+	}
+
+	userAgent := sv2UserAgentPrefix + sv2Conn.setup.Vendor
+	if len(sv2Conn.setup.Firmware) > 0 {
+		userAgent += "/" + sv2Conn.setup.Firmware
+	}
+	subscribe := JSONRPCRequest{sv2V1SubscribeID, "mining.subscribe", JSONRPCArray{userAgent}, ""}
+	err = sv2Conn.writeV1Message(&subscribe)
+	if err != nil {
+		return err
+	}
+
+	authorize := JSONRPCRequest{sv2V1AuthorizeID, "mining.authorize", JSONRPCArray{request.UserIdentity, ""}, ""}
+	return sv2Conn.writeV1Message(&authorize)
+}
+
+func (sv2Conn *StratumV2Conn) handleSubmitShares(submit SV2SubmitShares) error {
+	sv2Conn.lock.Lock()
+	channel := sv2Conn.channel
+	if channel == nil || !channel.opened || submit.ChannelID != channel.channelID {
+		sv2Conn.lock.Unlock()
+		return sv2Conn.sendSubmitSharesError(submit.ChannelID, submit.SequenceNumber, "invalid-channel-id")
+	}
+
+	job, ok := channel.jobs[submit.JobID]
+	if !ok {
+		sv2Conn.lock.Unlock()
+		return sv2Conn.sendSubmitSharesError(submit.ChannelID, submit.SequenceNumber, "invalid-job-id")
+	}
+
+	extranonce2 := channel.standardExtranonce2
+	if channel.request.Extended {
+		extranonce2 = submit.Extranonce
+	}
+	if len(extranonce2) != channel.extranonce2Size {
+		sv2Conn.lock.Unlock()
+		return sv2Conn.sendSubmitSharesError(submit.ChannelID, submit.SequenceNumber, "invalid-extranonce")
+	}
+
+	params := JSONRPCArray{
+		channel.request.UserIdentity,
+		job.v1JobID,
+		hex.EncodeToString(extranonce2),
+		fmt.Sprintf("%08x", submit.NTime),
+		fmt.Sprintf("%08x", submit.Nonce)}
+	if channel.versionMask != 0 {
+		params = append(params, fmt.Sprintf("%08x", submit.Version^job.version))
+	}
+
+	submitID := sv2Conn.nextSubmitID
+	sv2Conn.nextSubmitID++
+	sv2Conn.pendingSubmits[submitID] = sv2PendingSubmit{submit.ChannelID, submit.SequenceNumber}
+	sv2Conn.lock.Unlock()
+
+	request := JSONRPCRequest{submitID, "mining.submit", params, ""}
+	return sv2Conn.writeV1Message(&request)
+}
+
+// handleV1Line 处理 StratumSession 写入的一行 Stratum V1 消息（已加锁）
+func (sv2Conn *StratumV2Conn) handleV1Line(line []byte) error {
+	request, err := NewJSONRPCRequest(line)
+	if err == nil && len(request.Method) > 0 {
+		return sv2Conn.handleV1Notify(request)
+	}
+
+	response, err := NewJSONRPCResponse(line)
+	if err != nil {
+		if glog.V(3) {
+			glog.Info("Stratum V2: JSON decode failed: ", err, "; ", string(line))
+		}
+		return nil
+	}
+	return sv2Conn.handleV1Response(response)
+}
+
+func (sv2Conn *StratumV2Conn) handleV1Response(response *JSONRPCResponse) error {
+	idFloat, ok := response.ID.(float64)
+	if !ok {
+		return nil
+	}
+	id := uint64(idFloat)
+
+	channel := sv2Conn.channel
+
+	switch id {
+	case sv2V1ConfigureID:
+		return nil
+
+	case sv2V1SubscribeID:
+		if channel == nil {
+			return nil
+		}
+		result, ok := response.Result.([]interface{})
+		if !ok || len(result) < 3 {
+			return sv2Conn.sendOpenMiningChannelError(channel.request.RequestID, "subscribe-failed")
+		}
+		extranonce1Hex, _ := result[1].(string)
+		extranonce2Size, _ := result[2].(float64)
+		extranonce1, err := hex.DecodeString(extranonce1Hex)
+		if err != nil {
+			return sv2Conn.sendOpenMiningChannelError(channel.request.RequestID, "subscribe-failed")
+		}
+		channel.extranonce1 = extranonce1
+		channel.extranonce2Size = int(extranonce2Size)
+		channel.standardExtranonce2 = make([]byte, channel.extranonce2Size)
+		return nil
+
+	case sv2V1AuthorizeID:
+		if channel == nil || channel.opened {
+			// 币种切换后重新认证的响应，通道保持打开
+			return nil
+		}
+		success, ok := response.Result.(bool)
+		if !ok || !success || channel.extranonce1 == nil {
+			return sv2Conn.sendOpenMiningChannelError(channel.request.RequestID, "unknown-user")
+		}
+		if channel.request.Extended && int(channel.request.MinExtranonceSize) > channel.extranonce2Size {
+			return sv2Conn.sendOpenMiningChannelError(channel.request.RequestID, "min-extranonce-size-too-large")
+		}
+		return sv2Conn.openChannel(channel)
+
+	default:
+		submit, ok := sv2Conn.pendingSubmits[id]
+		if !ok {
+			return nil
+		}
+		delete(sv2Conn.pendingSubmits, id)
+
+		success, ok := response.Result.(bool)
+		if ok && success {
+			var w sv2Writer
+			w.u32(submit.channelID)
+			w.u32(submit.sequenceNumber)
+			w.u32(1)
+			w.u64(1)
+			return sv2Conn.writeFrame(NewStratumV2Frame(sv2MsgSubmitSharesSuccess, true, w.bytes()))
+		}
+		return sv2Conn.sendSubmitSharesError(submit.channelID, submit.sequenceNumber, sv2SubmitErrorCode(response.Error))
+	}
+}
+
+// sv2SubmitErrorCode 将 Stratum V1 的share错误转换为 Stratum V2 错误码
+func sv2SubmitErrorCode(v1Err interface{}) string {
+	errArr, ok := v1Err.([]interface{})
+	if !ok || len(errArr) < 1 {
+		return "invalid-share"
+	}
+	code, _ := errArr[0].(float64)
+	switch int(code) {
+	case 21:
+		// Job not found (=stale)
+		return "stale-share"
+	case 23:
+		// Low difficulty share
+		return "difficulty-too-low"
+	default:
+		return "invalid-share"
+	}
+}
+
+func (sv2Conn *StratumV2Conn) handleV1Notify(notify *JSONRPCRequest) error {
+	channel := sv2Conn.channel
+	if channel == nil {
+		return nil
+	}
+
+	switch notify.Method {
+	case "mining.set_difficulty":
+		if len(notify.Params) < 1 {
+			return nil
+		}
+		difficulty, ok := notify.Params[0].(float64)
+		if !ok {
+			return nil
+		}
+		channel.target = sv2DifficultyToTarget(difficulty)
+		if !channel.opened {
+			return nil
+		}
+		var w sv2Writer
+		w.u32(channel.channelID)
+		w.u256(channel.target)
+		return sv2Conn.writeFrame(NewStratumV2Frame(sv2MsgSetTarget, true, w.bytes()))
+
+	case "mining.set_version_mask":
+		if len(notify.Params) < 1 {
+			return nil
+		}
+		if maskStr, ok := notify.Params[0].(string); ok {
+			if mask, err := strconv.ParseUint(maskStr, 16, 32); err == nil {
+				channel.versionMask = uint32(mask)
+			}
+		}
+		return nil
+
+	case "mining.notify":
+		if !channel.opened {
+			channel.pendingNotify = notify
+			return nil
+		}
+		return sv2Conn.sendJob(channel, notify)
+
+	default:
+		return nil
+	}
+}
+
+// openChannel 向矿机发送 OpenMiningChannel.Success（已加锁）
+func (sv2Conn *StratumV2Conn) openChannel(channel *sv2Channel) error {
+	var w sv2Writer
+	w.u32(channel.request.RequestID)
+	w.u32(channel.channelID)
+	w.u256(channel.target)
+
+	msgType := uint8(sv2MsgOpenStandardMiningChannelSuccess)
+	if channel.request.Extended {
+		msgType = sv2MsgOpenExtendedMiningChannelSuccess
+		w.u16(uint16(channel.extranonce2Size))
+		w.str0255(channel.extranonce1)
+	} else {
+		w.str0255(append(append([]byte{}, channel.extranonce1...), channel.standardExtranonce2...))
+		w.u32(0) // group_channel_id
+	}
+
+	err := sv2Conn.writeFrame(NewStratumV2Frame(msgType, false, w.bytes()))
+	if err != nil {
+		return err
+	}
+	channel.opened = true
+
+	glog.Info("Stratum V2 Channel Opened: ", sv2Conn.conn.RemoteAddr(), "; ", channel.request.UserIdentity,
+		"; extended: ", channel.request.Extended)
+
+	if channel.pendingNotify != nil {
+		notify := channel.pendingNotify
+		channel.pendingNotify = nil
+		return sv2Conn.sendJob(channel, notify)
+	}
+	return nil
+}
+
+// sendJob 将 mining.notify 转换为 Stratum V2 任务（已加锁）
+// mining.notify 参数：job_id, prevhash, coinb1, coinb2, merkle_branch, version, nbits, ntime, clean_jobs
+func (sv2Conn *StratumV2Conn) sendJob(channel *sv2Channel, notify *JSONRPCRequest) error {
+	if len(notify.Params) < 9 {
+		glog.Warning("Stratum V2: too few params of mining.notify: ", notify.Params)
+		return nil
+	}
+
+	v1JobID, _ := notify.Params[0].(string)
+	prevHashStr, _ := notify.Params[1].(string)
+	coinb1, err1 := hexParam(notify.Params[2])
+	coinb2, err2 := hexParam(notify.Params[3])
+	version, err3 := uint32HexParam(notify.Params[5])
+	nBits, err4 := uint32HexParam(notify.Params[6])
+	nTime, err5 := uint32HexParam(notify.Params[7])
+	cleanJobs, _ := notify.Params[8].(bool)
+	prevHash, err6 := hex.DecodeString(prevHashStr)
+
+	var merkleBranch [][]byte
+	branchArr, _ := notify.Params[4].([]interface{})
+	for _, branch := range branchArr {
+		branchBytes, err := hexParam(branch)
+		if err != nil {
+			glog.Warning("Stratum V2: invalid merkle branch: ", branch)
+			return nil
+		}
+		merkleBranch = append(merkleBranch, branchBytes)
+	}
+
+	for _, err := range []error{err1, err2, err3, err4, err5, err6} {
+		if err != nil {
+			glog.Warning("Stratum V2: invalid mining.notify: ", err, "; ", notify.Params)
+			return nil
+		}
+	}
+	if len(prevHash) != 32 {
+		glog.Warning("Stratum V2: invalid prevhash: ", prevHashStr)
+		return nil
+	}
+
+	isFutureJob := cleanJobs || prevHashStr != channel.lastPrevHash
+	channel.lastPrevHash = prevHashStr
+
+	// 旧任务的share仍然交给服务器判断是否过期
+	jobID := channel.nextJobID
+	channel.nextJobID++
+	channel.jobs[jobID] = &sv2Job{v1JobID, version}
+	channel.jobIDs = append(channel.jobIDs, jobID)
+	if len(channel.jobIDs) > sv2MaxJobsPerChannel {
+		delete(channel.jobs, channel.jobIDs[0])
+		channel.jobIDs = channel.jobIDs[1:]
+	}
+
+	var w sv2Writer
+	w.u32(channel.channelID)
+	w.u32(jobID)
+	w.optionU32(nTime, !isFutureJob)
+	w.u32(version)
+
+	msgType := uint8(sv2MsgNewMiningJob)
+	if channel.request.Extended {
+		msgType = sv2MsgNewExtendedMiningJob
+		w.boolean(channel.versionMask != 0)
+		w.seqU256(merkleBranch)
+		w.b064k(coinb1)
+		w.b064k(coinb2)
+	} else {
+		coinbase := append(append(append(append([]byte{}, coinb1...), channel.extranonce1...), channel.standardExtranonce2...), coinb2...)
+		w.u256(sv2MerkleRoot(coinbase, merkleBranch))
+	}
+
+	err := sv2Conn.writeFrame(NewStratumV2Frame(msgType, true, w.bytes()))
+	if err != nil || !isFutureJob {
+		return err
+	}
+
+	w = sv2Writer{}
+	w.u32(channel.channelID)
+	w.u32(jobID)
+	w.u256(sv2PrevHashFromV1(prevHash))
+	w.u32(nTime)
+	w.u32(nBits)
+	return sv2Conn.writeFrame(NewStratumV2Frame(sv2MsgSetNewPrevHash, true, w.bytes()))
+}
+
+func (sv2Conn *StratumV2Conn) writeFrame(frame *StratumV2Frame) error {
+	return sv2Conn.transport.WriteFrame(frame)
+}
+
+func (sv2Conn *StratumV2Conn) sendOpenMiningChannelError(requestID uint32, errorCode string) error {
+	var w sv2Writer
+	w.u32(requestID)
+	w.str0255([]byte(errorCode))
+	return sv2Conn.writeFrame(NewStratumV2Frame(sv2MsgOpenMiningChannelError, false, w.bytes()))
+}
+
+func (sv2Conn *StratumV2Conn) sendSubmitSharesError(channelID uint32, sequenceNumber uint32, errorCode string) error {
+	var w sv2Writer
+	w.u32(channelID)
+	w.u32(sequenceNumber)
+	w.str0255([]byte(errorCode))
+	return sv2Conn.writeFrame(NewStratumV2Frame(sv2MsgSubmitSharesError, true, w.bytes()))
+}
+
+// sv2DifficultyToTarget 将难度转换为小端序的 U256 目标值
+func sv2DifficultyToTarget(difficulty float64) []byte {
+	target := new(big.Int).Set(sv2Diff1Target)
+	if difficulty > 0 {
+		targetFloat := new(big.Float).SetPrec(256).SetInt(sv2Diff1Target)
+		targetFloat.Quo(targetFloat, new(big.Float).SetPrec(256).SetFloat64(difficulty))
+		targetFloat.Int(target)
+	}
+
+	bigEndian := target.Bytes()
+	if len(bigEndian) > 32 {
+		bigEndian = bigEndian[len(bigEndian)-32:]
+	}
+	littleEndian := make([]byte, 32)
+	for i, b := range bigEndian {
+		littleEndian[len(bigEndian)-1-i] = b
+	}
+	return littleEndian
+}
+
+// sv2PrevHashFromV1 将 mining.notify 中的 prevhash（每4字节颠倒）转换为区块头中的字节序
+func sv2PrevHashFromV1(v1PrevHash []byte) []byte {
+	prevHash := make([]byte, len(v1PrevHash))
+	for i := 0; i+4 <= len(v1PrevHash); i += 4 {
+		prevHash[i] = v1PrevHash[i+3]
+		prevHash[i+1] = v1PrevHash[i+2]
+		prevHash[i+2] = v1PrevHash[i+1]
+		prevHash[i+3] = v1PrevHash[i]
+	}
+	return prevHash
+}
+
+// sv2MerkleRoot 由coinbase交易和merkle分支计算merkle根
+func sv2MerkleRoot(coinbase []byte, merkleBranch [][]byte) []byte {
+	root := doubleSHA256(coinbase)
+	for _, branch := range merkleBranch {
+		root = doubleSHA256(append(root, branch...))
+	}
+	return root
+}
+
+func doubleSHA256(data []byte) []byte {
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+func hexParam(param interface{}) ([]byte, error) {
+	str, ok := param.(string)
+	if !ok {
+		return nil, errors.New("param is not a string")
+	}
+	return hex.DecodeString(str)
+}
+
+func uint32HexParam(param interface{}) (uint32, error) {
+	str, ok := param.(string)
+	if !ok {
+		return 0, errors.New("param is not a string")
+	}
+	value, err := strconv.ParseUint(str, 16, 32)
+	return uint32(value), err
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Stratum V2 帧及消息的编解码
+//
+// 帧格式：
+//     | extension_type (U16) | msg_type (U8) | msg_length (U24) | payload |
+// extension_type 的最高位为 channel_msg 标志。所有整数均为小端序。
+
+// 帧头长度
+const sv2FrameHeaderSize = 6
+
+// channel_msg 标志位
+const sv2ChannelMsgBit = 0x8000
+
+// Stratum V2 子协议
+const (
+	// sv2ProtocolMining 挖矿协议
+	sv2ProtocolMining = 0
+)
+
+// SetupConnection 中挖矿协议的标志位
+const (
+	// sv2FlagRequiresStandardJobs 下游只支持标准任务
+	sv2FlagRequiresStandardJobs = 1 << 0
+	// sv2FlagRequiresVersionRolling 下游要求版本位滚动
+	sv2FlagRequiresVersionRolling = 1 << 2
+)
+
+// Stratum V2 消息类型
+const (
+	sv2MsgSetupConnection                  = 0x00
+	sv2MsgSetupConnectionSuccess           = 0x01
+	sv2MsgSetupConnectionError             = 0x02
+	sv2MsgOpenStandardMiningChannel        = 0x10
+	sv2MsgOpenStandardMiningChannelSuccess = 0x11
+	sv2MsgOpenMiningChannelError           = 0x12
+	sv2MsgOpenExtendedMiningChannel        = 0x13
+	sv2MsgOpenExtendedMiningChannelSuccess = 0x14
+	sv2MsgNewMiningJob                     = 0x15
+	sv2MsgUpdateChannel                    = 0x16
+	sv2MsgCloseChannel                     = 0x18
+	sv2MsgSubmitSharesStandard             = 0x1a
+	sv2MsgSubmitSharesExtended             = 0x1b
+	sv2MsgSubmitSharesSuccess              = 0x1c
+	sv2MsgSubmitSharesError                = 0x1d
+	sv2MsgNewExtendedMiningJob             = 0x1f
+	sv2MsgSetNewPrevHash                   = 0x20
+	sv2MsgSetTarget                        = 0x21
+)
+
+// ErrSV2MessageTooShort 消息长度不足
+var ErrSV2MessageTooShort = errors.New("Stratum V2 Message Too Short")
+
+// StratumV2Frame Stratum V2 帧
+type StratumV2Frame struct {
+	ExtensionType uint16
+	MsgType       uint8
+	msgLength     uint32
+	Payload       []byte
+}
+
+// NewStratumV2Frame 创建帧，channelMsg 表示是否设置 channel_msg 标志
+func NewStratumV2Frame(msgType uint8, channelMsg bool, payload []byte) *StratumV2Frame {
+	frame := new(StratumV2Frame)
+	frame.MsgType = msgType
+	if channelMsg {
+		frame.ExtensionType = sv2ChannelMsgBit
+	}
+	frame.Payload = payload
+	return frame
+}
+
+func (frame *StratumV2Frame) headerBytes() []byte {
+	header := make([]byte, sv2FrameHeaderSize)
+	binary.LittleEndian.PutUint16(header[0:2], frame.ExtensionType)
+	header[2] = frame.MsgType
+	length := uint32(len(frame.Payload))
+	header[3] = byte(length)
+	header[4] = byte(length >> 8)
+	header[5] = byte(length >> 16)
+	return header
+}
+
+func parseStratumV2FrameHeader(header []byte) *StratumV2Frame {
+	frame := new(StratumV2Frame)
+	frame.ExtensionType = binary.LittleEndian.Uint16(header[0:2])
+	frame.MsgType = header[2]
+	frame.msgLength = uint32(header[3]) | uint32(header[4])<<8 | uint32(header[5])<<16
+	return frame
+}
+
+// sv2Writer Stratum V2 数据类型编码器
+type sv2Writer struct {
+	buf []byte
+}
+
+func (w *sv2Writer) bytes() []byte { return w.buf }
+
+func (w *sv2Writer) u8(v uint8) { w.buf = append(w.buf, v) }
+
+func (w *sv2Writer) boolean(v bool) {
+	if v {
+		w.u8(1)
+	} else {
+		w.u8(0)
+	}
+}
+
+func (w *sv2Writer) u16(v uint16) {
+	w.buf = append(w.buf, byte(v), byte(v>>8))
+}
+
+func (w *sv2Writer) u32(v uint32) {
+	w.buf = append(w.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (w *sv2Writer) u64(v uint64) {
+	w.u32(uint32(v))
+	w.u32(uint32(v >> 32))
+}
+
+func (w *sv2Writer) u256(v []byte) {
+	var u256 [32]byte
+	copy(u256[:], v)
+	w.buf = append(w.buf, u256[:]...)
+}
+
+// str0255 STR0_255 / B0_32 / B0_255：1字节长度前缀
+func (w *sv2Writer) str0255(v []byte) {
+	if len(v) > 255 {
+		v = v[:255]
+	}
+	w.u8(uint8(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+// b064k B0_64K：2字节长度前缀
+func (w *sv2Writer) b064k(v []byte) {
+	if len(v) > 65535 {
+		v = v[:65535]
+	}
+	w.u16(uint16(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+// seqU256 SEQ0_255[U256]
+func (w *sv2Writer) seqU256(v [][]byte) {
+	w.u8(uint8(len(v)))
+	for _, item := range v {
+		w.u256(item)
+	}
+}
+
+// optionU32 OPTION[U32]
+func (w *sv2Writer) optionU32(v uint32, present bool) {
+	if !present {
+		w.u8(0)
+		return
+	}
+	w.u8(1)
+	w.u32(v)
+}
+
+// sv2Reader Stratum V2 数据类型解码器，出错后的读取均返回零值
+type sv2Reader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *sv2Reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if r.pos+n > len(r.buf) {
+		r.err = ErrSV2MessageTooShort
+		return nil
+	}
+	data := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return data
+}
+
+func (r *sv2Reader) u8() uint8 {
+	data := r.next(1)
+	if data == nil {
+		return 0
+	}
+	return data[0]
+}
+
+func (r *sv2Reader) u16() uint16 {
+	data := r.next(2)
+	if data == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(data)
+}
+
+func (r *sv2Reader) u32() uint32 {
+	data := r.next(4)
+	if data == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(data)
+}
+
+func (r *sv2Reader) f32() float32 {
+	return math.Float32frombits(r.u32())
+}
+
+func (r *sv2Reader) u256() []byte {
+	return append([]byte{}, r.next(32)...)
+}
+
+func (r *sv2Reader) str0255() []byte {
+	length := int(r.u8())
+	return append([]byte{}, r.next(length)...)
+}
+
+// SV2SetupConnection SetupConnection 消息
+type SV2SetupConnection struct {
+	Protocol        uint8
+	MinVersion      uint16
+	MaxVersion      uint16
+	Flags           uint32
+	EndpointHost    string
+	EndpointPort    uint16
+	Vendor          string
+	HardwareVersion string
+	Firmware        string
+	DeviceID        string
+}
+
+func parseSV2SetupConnection(payload []byte) (msg SV2SetupConnection, err error) {
+	r := sv2Reader{buf: payload}
+	msg.Protocol = r.u8()
+	msg.MinVersion = r.u16()
+	msg.MaxVersion = r.u16()
+	msg.Flags = r.u32()
+	msg.EndpointHost = string(r.str0255())
+	msg.EndpointPort = r.u16()
+	msg.Vendor = string(r.str0255())
+	msg.HardwareVersion = string(r.str0255())
+	msg.Firmware = string(r.str0255())
+	msg.DeviceID = string(r.str0255())
+	err = r.err
+	return
+}
+
+// SV2OpenMiningChannel OpenStandardMiningChannel / OpenExtendedMiningChannel 消息
+type SV2OpenMiningChannel struct {
+	Extended          bool
+	RequestID         uint32
+	UserIdentity      string
+	NominalHashRate   float32
+	MaxTarget         []byte
+	MinExtranonceSize uint16
+}
+
+func parseSV2OpenMiningChannel(payload []byte, extended bool) (msg SV2OpenMiningChannel, err error) {
+	r := sv2Reader{buf: payload}
+	msg.Extended = extended
+	msg.RequestID = r.u32()
+	msg.UserIdentity = string(r.str0255())
+	msg.NominalHashRate = r.f32()
+	msg.MaxTarget = r.u256()
+	if extended {
+		msg.MinExtranonceSize = r.u16()
+	}
+	err = r.err
+	return
+}
+
+// SV2SubmitShares SubmitSharesStandard / SubmitSharesExtended 消息
+type SV2SubmitShares struct {
+	ChannelID      uint32
+	SequenceNumber uint32
+	JobID          uint32
+	Nonce          uint32
+	NTime          uint32
+	Version        uint32
+	Extranonce     []byte
+}
+
+func parseSV2SubmitShares(payload []byte, extended bool) (msg SV2SubmitShares, err error) {
+	r := sv2Reader{buf: payload}
+	msg.ChannelID = r.u32()
+	msg.SequenceNumber = r.u32()
+	msg.JobID = r.u32()
+	msg.Nonce = r.u32()
+	msg.NTime = r.u32()
+	msg.Version = r.u32()
+	if extended {
+		msg.Extranonce = r.str0255()
+	}
+	err = r.err
+	return
+}
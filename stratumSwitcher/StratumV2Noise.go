@@ -0,0 +1,478 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ellswift"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Stratum V2 连接的 Noise 加密层
+//
+// 按 Stratum V2 规范，握手采用 Noise_NX_Secp256k1+EllSwift_ChaChaPoly_SHA256：
+//     -> e
+//     <- e, ee, s, es, SIGNATURE_NOISE_MESSAGE
+// 公钥为 secp256k1 公钥的 ElligatorSwift 编码（64字节），DH 为 BIP324 的 x-only ECDH
+// （发起方的公钥在前），证书为矿池 authority 密钥对静态公钥的 BIP340 Schnorr 签名。
+//
+// 握手完成后，每个 Stratum V2 帧的帧头（6字节）单独加密，
+// 负载按每块最多 65519 字节分块加密，每块附带 16 字节 MAC。
+
+// Noise协议名
+const sv2NoiseProtocolName = "Noise_NX_Secp256k1+EllSwift_ChaChaPoly_SHA256"
+
+// Noise公钥（ElligatorSwift编码）长度
+const sv2NoiseKeySize = 64
+
+// Noise MAC长度
+const sv2NoiseMacSize = 16
+
+// Noise单个加密消息的最大长度
+const sv2NoiseMaxMessageSize = 65535
+
+// Noise单个加密消息的最大明文长度
+const sv2NoiseMaxPlaintextSize = sv2NoiseMaxMessageSize - sv2NoiseMacSize
+
+// SIGNATURE_NOISE_MESSAGE 的长度
+const sv2SignatureNoiseMessageSize = 2 + 4 + 4 + schnorr.SignatureSize
+
+// 证书生效时间提前量（容忍矿机时钟误差）
+const sv2CertificateBackdateSeconds = 3600
+
+// 证书有效期
+const sv2CertificateValidSeconds = 86400
+
+// base58check 编码的 authority 公钥的版本前缀（与 Stratum V2 参考实现相同）
+var sv2AuthorityPublicKeyVersion = []byte{1, 0}
+
+var (
+	// ErrSV2NoiseDecryptFailed 解密失败
+	ErrSV2NoiseDecryptFailed = errors.New("Stratum V2 Noise Decrypt Failed")
+	// ErrSV2NoiseBadKey 非法的密钥
+	ErrSV2NoiseBadKey = errors.New("Stratum V2 Noise Bad Key")
+)
+
+// noiseCipherState Noise CipherState
+type noiseCipherState struct {
+	aead   cipher.AEAD
+	nonce  uint64
+	hasKey bool
+}
+
+func (cs *noiseCipherState) initializeKey(key []byte) {
+	cs.aead, _ = chacha20poly1305.New(key)
+	cs.nonce = 0
+	cs.hasKey = true
+}
+
+func (cs *noiseCipherState) nextNonce() []byte {
+	// ChaChaPoly: 4字节0 + 8字节小端序计数器
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], cs.nonce)
+	cs.nonce++
+	return nonce
+}
+
+func (cs *noiseCipherState) encryptWithAd(ad []byte, plaintext []byte) []byte {
+	if !cs.hasKey {
+		return append([]byte{}, plaintext...)
+	}
+	return cs.aead.Seal(nil, cs.nextNonce(), plaintext, ad)
+}
+
+func (cs *noiseCipherState) decryptWithAd(ad []byte, ciphertext []byte) ([]byte, error) {
+	if !cs.hasKey {
+		return append([]byte{}, ciphertext...), nil
+	}
+	plaintext, err := cs.aead.Open(nil, cs.nextNonce(), ciphertext, ad)
+	if err != nil {
+		return nil, ErrSV2NoiseDecryptFailed
+	}
+	return plaintext, nil
+}
+
+// noiseSymmetricState Noise SymmetricState
+type noiseSymmetricState struct {
+	cs noiseCipherState
+	ck []byte
+	h  []byte
+}
+
+func (ss *noiseSymmetricState) initialize(protocolName string) {
+	if len(protocolName) <= sha256.Size {
+		ss.h = make([]byte, sha256.Size)
+		copy(ss.h, protocolName)
+	} else {
+		sum := sha256.Sum256([]byte(protocolName))
+		ss.h = sum[:]
+	}
+	ss.ck = append([]byte{}, ss.h...)
+}
+
+func (ss *noiseSymmetricState) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(ss.h)
+	hash.Write(data)
+	ss.h = hash.Sum(nil)
+}
+
+func (ss *noiseSymmetricState) mixKey(ikm []byte) {
+	var tempK []byte
+	ss.ck, tempK = noiseHKDF(ss.ck, ikm)
+	ss.cs.initializeKey(tempK)
+}
+
+func (ss *noiseSymmetricState) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := ss.cs.encryptWithAd(ss.h, plaintext)
+	ss.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (ss *noiseSymmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := ss.cs.decryptWithAd(ss.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split 返回 (发起方->响应方, 响应方->发起方) 两个方向的 CipherState
+func (ss *noiseSymmetricState) split() (c1 *noiseCipherState, c2 *noiseCipherState) {
+	k1, k2 := noiseHKDF(ss.ck, nil)
+	c1 = new(noiseCipherState)
+	c1.initializeKey(k1)
+	c2 = new(noiseCipherState)
+	c2.initializeKey(k2)
+	return
+}
+
+// noiseHKDF Noise规范中的HKDF（输出两个32字节的值）
+func noiseHKDF(chainingKey []byte, ikm []byte) (output1 []byte, output2 []byte) {
+	mac := hmac.New(sha256.New, chainingKey)
+	mac.Write(ikm)
+	tempKey := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write([]byte{0x01})
+	output1 = mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write(output1)
+	mac.Write([]byte{0x02})
+	output2 = mac.Sum(nil)
+	return
+}
+
+// StratumV2NoiseResponder Noise握手的响应方（即矿池侧）
+type StratumV2NoiseResponder struct {
+	// 静态密钥
+	staticKey *btcec.PrivateKey
+	// 静态公钥的 ElligatorSwift 编码
+	staticKeyEllswift [sv2NoiseKeySize]byte
+	// 为静态公钥签名的证书颁发者密钥（可空）
+	authorityKey *btcec.PrivateKey
+}
+
+// NewStratumV2NoiseResponder 创建Noise响应方
+// staticKeyString 为 secp256k1 私钥，为空则随机生成；
+// authorityKeyString 为签名证书的 secp256k1 私钥，为空则不对证书签名（签名全为0）。
+// 私钥可以是十六进制，也可以是 Stratum V2 参考实现使用的 base58check 编码。
+func NewStratumV2NoiseResponder(staticKeyString string, authorityKeyString string) (responder *StratumV2NoiseResponder, err error) {
+	responder = new(StratumV2NoiseResponder)
+
+	if len(staticKeyString) > 0 {
+		responder.staticKey, err = parseSV2SecretKey(staticKeyString)
+		if err != nil {
+			return
+		}
+	} else {
+		responder.staticKey, err = btcec.NewPrivateKey()
+		if err != nil {
+			return
+		}
+		glog.Warning("Stratum V2: SV2StaticKey is empty, using a random static key. It will change after restart.")
+	}
+
+	var x btcec.FieldVal
+	x.SetByteSlice(schnorr.SerializePubKey(responder.staticKey.PubKey()))
+	u, t, err := ellswift.XElligatorSwift(&x)
+	if err != nil {
+		return
+	}
+	u.PutBytesUnchecked(responder.staticKeyEllswift[0:32])
+	t.PutBytesUnchecked(responder.staticKeyEllswift[32:64])
+
+	if len(authorityKeyString) > 0 {
+		responder.authorityKey, err = parseSV2SecretKey(authorityKeyString)
+		if err != nil {
+			return
+		}
+		publicKey := schnorr.SerializePubKey(responder.authorityKey.PubKey())
+		glog.Info("Stratum V2: authority public key: ", sv2Base58CheckEncode(append(append([]byte{}, sv2AuthorityPublicKeyVersion...), publicKey...)),
+			" (hex: ", hex.EncodeToString(publicKey), ")")
+	}
+
+	glog.Info("Stratum V2: static public key: ", hex.EncodeToString(schnorr.SerializePubKey(responder.staticKey.PubKey())))
+	return
+}
+
+// parseSV2SecretKey 解析十六进制或 base58check 编码的 secp256k1 私钥
+func parseSV2SecretKey(keyString string) (*btcec.PrivateKey, error) {
+	keyBytes, err := hex.DecodeString(keyString)
+	if err != nil {
+		keyBytes, err = sv2Base58CheckDecode(keyString)
+		if err != nil {
+			return nil, ErrSV2NoiseBadKey
+		}
+	}
+	if len(keyBytes) != btcec.PrivKeyBytesLen {
+		return nil, ErrSV2NoiseBadKey
+	}
+
+	var scalar btcec.ModNScalar
+	if overflow := scalar.SetByteSlice(keyBytes); overflow || scalar.IsZero() {
+		return nil, ErrSV2NoiseBadKey
+	}
+	return btcec.PrivKeyFromScalar(&scalar), nil
+}
+
+// signatureNoiseMessage 生成 SIGNATURE_NOISE_MESSAGE
+// | version (U16) | valid_from (U32) | not_valid_after (U32) | signature (64 bytes) |
+// 签名内容为 SHA-256(version || valid_from || not_valid_after || 静态公钥的x坐标)。
+func (responder *StratumV2NoiseResponder) signatureNoiseMessage(now time.Time) []byte {
+	message := make([]byte, sv2SignatureNoiseMessageSize)
+	binary.LittleEndian.PutUint16(message[0:2], 0)
+	binary.LittleEndian.PutUint32(message[2:6], uint32(now.Unix()-sv2CertificateBackdateSeconds))
+	binary.LittleEndian.PutUint32(message[6:10], uint32(now.Unix()+sv2CertificateValidSeconds))
+
+	if responder.authorityKey != nil {
+		hash := sv2CertificateHash(message[0:10], schnorr.SerializePubKey(responder.staticKey.PubKey()))
+		signature, err := schnorr.Sign(responder.authorityKey, hash)
+		if err != nil {
+			glog.Error("Stratum V2: sign certificate failed: ", err)
+		} else {
+			copy(message[10:], signature.Serialize())
+		}
+	}
+	return message
+}
+
+// sv2CertificateHash 证书签名的消息哈希
+func sv2CertificateHash(header []byte, staticPublicKey []byte) []byte {
+	hash := sha256.New()
+	hash.Write(header)
+	hash.Write(staticPublicKey)
+	return hash.Sum(nil)
+}
+
+// Handshake 在连接上执行Noise握手（作为响应方），返回加密传输层
+func (responder *StratumV2NoiseResponder) Handshake(conn net.Conn) (transport *StratumV2NoiseTransport, err error) {
+	var ss noiseSymmetricState
+	ss.initialize(sv2NoiseProtocolName)
+	ss.mixHash(nil) // 空的 prologue
+
+	// -> e
+	var remoteEphemeral [sv2NoiseKeySize]byte
+	_, err = io.ReadFull(conn, remoteEphemeral[:])
+	if err != nil {
+		return
+	}
+	ss.mixHash(remoteEphemeral[:])
+	_, err = ss.decryptAndHash(nil)
+	if err != nil {
+		return
+	}
+
+	// <- e, ee, s, es, SIGNATURE_NOISE_MESSAGE
+	ephemeral, ephemeralEllswift, err := ellswift.EllswiftCreate()
+	if err != nil {
+		return
+	}
+	message := append([]byte{}, ephemeralEllswift[:]...)
+	ss.mixHash(message)
+
+	dh, err := ellswift.V2Ecdh(ephemeral, remoteEphemeral, ephemeralEllswift, false)
+	if err != nil {
+		return
+	}
+	ss.mixKey(dh[:])
+
+	message = append(message, ss.encryptAndHash(responder.staticKeyEllswift[:])...)
+
+	dh, err = ellswift.V2Ecdh(responder.staticKey, remoteEphemeral, responder.staticKeyEllswift, false)
+	if err != nil {
+		return
+	}
+	ss.mixKey(dh[:])
+
+	message = append(message, ss.encryptAndHash(responder.signatureNoiseMessage(time.Now()))...)
+
+	_, err = conn.Write(message)
+	if err != nil {
+		return
+	}
+
+	recvCipher, sendCipher := ss.split()
+	transport = NewStratumV2NoiseTransport(conn, recvCipher, sendCipher)
+	return
+}
+
+// base58 字母表
+const sv2Base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// sv2Base58CheckEncode base58check 编码（4字节校验和为两次SHA-256的前4字节）
+func sv2Base58CheckEncode(data []byte) string {
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	data = append(append([]byte{}, data...), second[:4]...)
+
+	num := new(big.Int).SetBytes(data)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	var encoded []byte
+	for num.Sign() > 0 {
+		num.DivMod(num, radix, mod)
+		encoded = append(encoded, sv2Base58Alphabet[mod.Int64()])
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		encoded = append(encoded, sv2Base58Alphabet[0])
+	}
+
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+	return string(encoded)
+}
+
+// sv2Base58CheckDecode base58check 解码并验证校验和
+func sv2Base58CheckDecode(encoded string) ([]byte, error) {
+	num := new(big.Int)
+	radix := big.NewInt(58)
+	zeros := 0
+	for i := 0; i < len(encoded); i++ {
+		digit := -1
+		for j := 0; j < len(sv2Base58Alphabet); j++ {
+			if sv2Base58Alphabet[j] == encoded[i] {
+				digit = j
+				break
+			}
+		}
+		if digit < 0 {
+			return nil, ErrSV2NoiseBadKey
+		}
+		if digit == 0 && zeros == i {
+			zeros++
+		}
+		num.Mul(num, radix)
+		num.Add(num, big.NewInt(int64(digit)))
+	}
+
+	data := append(make([]byte, zeros), num.Bytes()...)
+	if len(data) < 4 {
+		return nil, ErrSV2NoiseBadKey
+	}
+	payload := data[:len(data)-4]
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	if !hmac.Equal(second[:4], data[len(data)-4:]) {
+		return nil, ErrSV2NoiseBadKey
+	}
+	return payload, nil
+}
+
+// StratumV2NoiseTransport 握手完成后的加密传输层
+type StratumV2NoiseTransport struct {
+	conn       net.Conn
+	recvCipher *noiseCipherState
+	sendCipher *noiseCipherState
+	// 发送时加的锁（nonce必须与发送顺序一致）
+	sendLock sync.Mutex
+}
+
+// NewStratumV2NoiseTransport 创建加密传输层
+func NewStratumV2NoiseTransport(conn net.Conn, recvCipher *noiseCipherState, sendCipher *noiseCipherState) *StratumV2NoiseTransport {
+	transport := new(StratumV2NoiseTransport)
+	transport.conn = conn
+	transport.recvCipher = recvCipher
+	transport.sendCipher = sendCipher
+	return transport
+}
+
+// sv2EncryptedPayloadLength 计算负载加密后的长度
+func sv2EncryptedPayloadLength(plaintextLength int) int {
+	chunks := (plaintextLength + sv2NoiseMaxPlaintextSize - 1) / sv2NoiseMaxPlaintextSize
+	return plaintextLength + chunks*sv2NoiseMacSize
+}
+
+// WriteFrame 加密并发送一个 Stratum V2 帧
+func (transport *StratumV2NoiseTransport) WriteFrame(frame *StratumV2Frame) error {
+	header := frame.headerBytes()
+
+	transport.sendLock.Lock()
+	defer transport.sendLock.Unlock()
+
+	data := transport.sendCipher.encryptWithAd(nil, header)
+	for pos := 0; pos < len(frame.Payload); pos += sv2NoiseMaxPlaintextSize {
+		end := pos + sv2NoiseMaxPlaintextSize
+		if end > len(frame.Payload) {
+			end = len(frame.Payload)
+		}
+		data = append(data, transport.sendCipher.encryptWithAd(nil, frame.Payload[pos:end])...)
+	}
+
+	_, err := transport.conn.Write(data)
+	return err
+}
+
+// ReadFrame 接收并解密一个 Stratum V2 帧（只允许在一个goroutine中调用）
+func (transport *StratumV2NoiseTransport) ReadFrame() (frame *StratumV2Frame, err error) {
+	encryptedHeader := make([]byte, sv2FrameHeaderSize+sv2NoiseMacSize)
+	_, err = io.ReadFull(transport.conn, encryptedHeader)
+	if err != nil {
+		return
+	}
+	header, err := transport.recvCipher.decryptWithAd(nil, encryptedHeader)
+	if err != nil {
+		return
+	}
+
+	frame = parseStratumV2FrameHeader(header)
+
+	encryptedPayload := make([]byte, sv2EncryptedPayloadLength(int(frame.msgLength)))
+	_, err = io.ReadFull(transport.conn, encryptedPayload)
+	if err != nil {
+		return
+	}
+
+	frame.Payload = make([]byte, 0, frame.msgLength)
+	for pos := 0; pos < len(encryptedPayload); pos += sv2NoiseMaxMessageSize {
+		end := pos + sv2NoiseMaxMessageSize
+		if end > len(encryptedPayload) {
+			end = len(encryptedPayload)
+		}
+		var chunk []byte
+		chunk, err = transport.recvCipher.decryptWithAd(nil, encryptedPayload[pos:end])
+		if err != nil {
+			return
+		}
+		frame.Payload = append(frame.Payload, chunk...)
+	}
+	return
+}
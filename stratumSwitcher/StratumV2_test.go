@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ellswift"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// sv2TestInitiatorHandshake 以发起方（矿机）身份执行Noise握手，authorityPublicKey 为 x-only 公钥
+func sv2TestInitiatorHandshake(conn net.Conn, authorityPublicKey []byte) (*StratumV2NoiseTransport, error) {
+	var ss noiseSymmetricState
+	ss.initialize(sv2NoiseProtocolName)
+	ss.mixHash(nil)
+
+	// -> e
+	ephemeral, ephemeralEllswift, err := ellswift.EllswiftCreate()
+	if err != nil {
+		return nil, err
+	}
+	message := append([]byte{}, ephemeralEllswift[:]...)
+	ss.mixHash(message)
+	message = append(message, ss.encryptAndHash(nil)...)
+	_, err = conn.Write(message)
+	if err != nil {
+		return nil, err
+	}
+
+	// <- e, ee, s, es, SIGNATURE_NOISE_MESSAGE
+	reply := make([]byte, sv2NoiseKeySize+sv2NoiseKeySize+sv2NoiseMacSize+sv2SignatureNoiseMessageSize+sv2NoiseMacSize)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return nil, err
+	}
+
+	var remoteEphemeral [sv2NoiseKeySize]byte
+	copy(remoteEphemeral[:], reply)
+	ss.mixHash(remoteEphemeral[:])
+	dh, err := ellswift.V2Ecdh(ephemeral, remoteEphemeral, ephemeralEllswift, true)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(dh[:])
+
+	pos := sv2NoiseKeySize
+	remoteStaticBytes, err := ss.decryptAndHash(reply[pos : pos+sv2NoiseKeySize+sv2NoiseMacSize])
+	if err != nil {
+		return nil, err
+	}
+	pos += sv2NoiseKeySize + sv2NoiseMacSize
+	var remoteStatic [sv2NoiseKeySize]byte
+	copy(remoteStatic[:], remoteStaticBytes)
+	dh, err = ellswift.V2Ecdh(ephemeral, remoteStatic, ephemeralEllswift, true)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(dh[:])
+
+	signatureMessage, err := ss.decryptAndHash(reply[pos:])
+	if err != nil {
+		return nil, err
+	}
+
+	// 证书签名的是静态公钥的x坐标
+	var u, v btcec.FieldVal
+	u.SetByteSlice(remoteStatic[0:32])
+	v.SetByteSlice(remoteStatic[32:64])
+	x, err := ellswift.XSwiftEC(&u, &v)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := schnorr.ParsePubKey(authorityPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := schnorr.ParseSignature(signatureMessage[10:])
+	if err != nil {
+		return nil, err
+	}
+	if !signature.Verify(sv2CertificateHash(signatureMessage[0:10], x.Bytes()[:]), publicKey) {
+		return nil, ErrSV2NoiseBadKey
+	}
+
+	sendCipher, recvCipher := ss.split()
+	return NewStratumV2NoiseTransport(conn, recvCipher, sendCipher), nil
+}
+
+func sv2TestReadFrame(t *testing.T, transport *StratumV2NoiseTransport, msgType uint8) *sv2Reader {
+	frame, err := transport.ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame failed: %s", err)
+	}
+	if frame.MsgType != msgType {
+		t.Fatalf("message type mismatched: %#x != %#x", frame.MsgType, msgType)
+	}
+	return &sv2Reader{buf: frame.Payload}
+}
+
+func sv2TestReadV1Request(t *testing.T, reader *bufio.Reader, method string) *JSONRPCRequest {
+	line, err := readLineWithTimeout(reader, 5*time.Second)
+	if err != nil {
+		t.Fatalf("read V1 line failed: %s", err)
+	}
+	request, err := NewJSONRPCRequest(line)
+	if err != nil {
+		t.Fatalf("decode V1 line failed: %s, %s", err, line)
+	}
+	if request.Method != method {
+		t.Fatalf("V1 method mismatched: %s != %s", request.Method, method)
+	}
+	return request
+}
+
+func TestStratumV2Translate(t *testing.T) {
+	authorityKey, _ := btcec.NewPrivateKey()
+	responder, err := NewStratumV2NoiseResponder("", hex.EncodeToString(authorityKey.Serialize()))
+	if err != nil {
+		t.Fatalf("NewStratumV2NoiseResponder failed: %s", err)
+	}
+	authorityPublicKey := schnorr.SerializePubKey(authorityKey.PubKey())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	wrapped := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(wrapped)
+			return
+		}
+		sv2Conn, err := responder.WrapStratumV2Conn(conn)
+		if err != nil {
+			t.Errorf("WrapStratumV2Conn failed: %s", err)
+			conn.Close()
+			close(wrapped)
+			return
+		}
+		wrapped <- sv2Conn
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer clientConn.Close()
+
+	client, err := sv2TestInitiatorHandshake(clientConn, authorityPublicKey)
+	if err != nil {
+		t.Fatalf("handshake failed: %s", err)
+	}
+
+	// SetupConnection
+	var w sv2Writer
+	w.u8(sv2ProtocolMining)
+	w.u16(2)
+	w.u16(2)
+	w.u32(sv2FlagRequiresVersionRolling)
+	w.str0255([]byte("127.0.0.1"))
+	w.u16(3333)
+	w.str0255([]byte("test-vendor"))
+	w.str0255([]byte("hw"))
+	w.str0255([]byte("fw"))
+	w.str0255([]byte("dev"))
+	client.WriteFrame(NewStratumV2Frame(sv2MsgSetupConnection, false, w.bytes()))
+
+	r := sv2TestReadFrame(t, client, sv2MsgSetupConnectionSuccess)
+	if version := r.u16(); version != sv2ProtocolVersion {
+		t.Errorf("used_version mismatched: %d", version)
+	}
+
+	sessionConn, ok := <-wrapped
+	if !ok {
+		t.FailNow()
+	}
+	defer sessionConn.Close()
+	sessionReader := bufio.NewReader(sessionConn)
+
+	// OpenExtendedMiningChannel
+	w = sv2Writer{}
+	w.u32(7)
+	w.str0255([]byte("user.worker"))
+	w.u32(0)
+	w.u256(bytes.Repeat([]byte{0xff}, 32))
+	w.u16(4)
+	client.WriteFrame(NewStratumV2Frame(sv2MsgOpenExtendedMiningChannel, false, w.bytes()))
+
+	sv2TestReadV1Request(t, sessionReader, "mining.configure")
+	sv2TestReadV1Request(t, sessionReader, "mining.subscribe")
+	authorize := sv2TestReadV1Request(t, sessionReader, "mining.authorize")
+	if len(authorize.Params) < 1 || authorize.Params[0] != "user.worker" {
+		t.Errorf("wrong mining.authorize params: %v", authorize.Params)
+	}
+
+	// StratumSession 的响应及服务器下发的任务
+	sessionConn.Write([]byte(`{"id":1,"result":{"version-rolling":true,"version-rolling.mask":"1fffe000"},"error":null}` + "\n"))
+	sessionConn.Write([]byte(`{"id":2,"result":[[["mining.set_difficulty","0100002a"],["mining.notify","0100002a"]],"0100002a",8],"error":null}` + "\n"))
+	sessionConn.Write([]byte(`{"id":3,"result":true,"error":null}` + "\n"))
+	sessionConn.Write([]byte(`{"id":null,"method":"mining.set_version_mask","params":["1fffe000"]}` + "\n"))
+	sessionConn.Write([]byte(`{"id":null,"method":"mining.set_difficulty","params":[2]}` + "\n"))
+	sessionConn.Write([]byte(`{"id":null,"method":"mining.notify","params":["v1job","00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff",` +
+		`"aabb","ccdd",[],"20000000","1d00ffff","5f5e1000",true]}` + "\n"))
+
+	r = sv2TestReadFrame(t, client, sv2MsgOpenExtendedMiningChannelSuccess)
+	if requestID := r.u32(); requestID != 7 {
+		t.Errorf("request_id mismatched: %d", requestID)
+	}
+	channelID := r.u32()
+	r.u256()
+	if extranonceSize := r.u16(); extranonceSize != 8 {
+		t.Errorf("extranonce_size mismatched: %d", extranonceSize)
+	}
+	if prefix := hex.EncodeToString(r.str0255()); prefix != "0100002a" {
+		t.Errorf("extranonce_prefix mismatched: %s", prefix)
+	}
+
+	r = sv2TestReadFrame(t, client, sv2MsgSetTarget)
+	r.u32()
+	if target := r.u256(); !bytes.Equal(target, sv2DifficultyToTarget(2)) {
+		t.Errorf("target mismatched: %x", target)
+	}
+
+	r = sv2TestReadFrame(t, client, sv2MsgNewExtendedMiningJob)
+	r.u32()
+	jobID := r.u32()
+	if hasMinNTime := r.u8(); hasMinNTime != 0 {
+		t.Errorf("the first job should be a future job")
+	}
+
+	r = sv2TestReadFrame(t, client, sv2MsgSetNewPrevHash)
+	r.u32()
+	if prevHashJobID := r.u32(); prevHashJobID != jobID {
+		t.Errorf("job_id of SetNewPrevHash mismatched: %d != %d", prevHashJobID, jobID)
+	}
+	if prevHash := hex.EncodeToString(r.u256()); prevHash != "3322110077665544bbaa9988ffeeddcc3322110077665544bbaa9988ffeeddcc" {
+		t.Errorf("prev_hash mismatched: %s", prevHash)
+	}
+
+	// SubmitSharesExtended
+	w = sv2Writer{}
+	w.u32(channelID)
+	w.u32(5)
+	w.u32(jobID)
+	w.u32(0x12345678)
+	w.u32(0x5f5e1001)
+	w.u32(0x20002000)
+	w.str0255([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	client.WriteFrame(NewStratumV2Frame(sv2MsgSubmitSharesExtended, true, w.bytes()))
+
+	submit := sv2TestReadV1Request(t, sessionReader, "mining.submit")
+	expectedParams := []interface{}{"user.worker", "v1job", "0102030405060708", "5f5e1001", "12345678", "00002000"}
+	if len(submit.Params) != len(expectedParams) {
+		t.Fatalf("wrong mining.submit params: %v", submit.Params)
+	}
+	for i := range expectedParams {
+		if submit.Params[i] != expectedParams[i] {
+			t.Errorf("wrong mining.submit params: %v", submit.Params)
+			break
+		}
+	}
+
+	sessionConn.Write([]byte(`{"id":` + strconv.FormatUint(uint64(submit.ID.(float64)), 10) + `,"result":true,"error":null}` + "\n"))
+
+	r = sv2TestReadFrame(t, client, sv2MsgSubmitSharesSuccess)
+	r.u32()
+	if sequenceNumber := r.u32(); sequenceNumber != 5 {
+		t.Errorf("last_sequence_number mismatched: %d", sequenceNumber)
+	}
+}
+
+func TestSV2SecretKey(t *testing.T) {
+	// Stratum V2 参考实现示例配置中的 authority 密钥对（base58check 编码）
+	key, err := parseSV2SecretKey("mkDLTBBRxdBv998612qipDYoTK3YUrqLe8uWw7gu3iXbSrn2n")
+	if err != nil {
+		t.Fatalf("parse base58check key failed: %s", err)
+	}
+	publicKey := sv2Base58CheckEncode(append(append([]byte{}, sv2AuthorityPublicKeyVersion...), schnorr.SerializePubKey(key.PubKey())...))
+	if publicKey != "9auqWEzQDVyd2oe1JVGFLMLHZtCo2FFqZwtKA5gd9xbuEu7PH72" {
+		t.Errorf("wrong authority public key: %s", publicKey)
+	}
+
+	// 十六进制与 base58check 编码的同一私钥
+	hexKey, err := parseSV2SecretKey(hex.EncodeToString(key.Serialize()))
+	if err != nil || !hexKey.Key.Equals(&key.Key) {
+		t.Errorf("parse hex key failed: %v", err)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00",
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141",
+		"mkDLTBBRxdBv998612qipDYoTK3YUrqLe8uWw7gu3iXbSrn2m",
+	} {
+		if _, err := parseSV2SecretKey(invalid); err == nil {
+			t.Errorf("invalid key accepted: %s", invalid)
+		}
+	}
+}
+
+func TestSV2DifficultyToTarget(t *testing.T) {
+	target := sv2DifficultyToTarget(1)
+	if hex.EncodeToString(target) != "0000000000000000000000000000000000000000000000000000ffff00000000" {
+		t.Errorf("target of difficulty 1 mismatched: %x", target)
+	}
+
+	target = sv2DifficultyToTarget(2)
+	if hex.EncodeToString(target) != "0000000000000000000000000000000000000000000000000080ff7f00000000" {
+		t.Errorf("target of difficulty 2 mismatched: %x", target)
+	}
+}
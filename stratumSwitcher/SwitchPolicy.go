@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// CoinSwitchPolicy 币种切换策略
+//
+// Zookeeper中的币种改变后，会话不立即切换，而是等到以下时间之后：
+//   - 在当前币种上至少停留 minDwell（从上次连接或切换算起）；
+//   - 币种最后一次改变后 debounce 内没有再改变；
+//   - 再加上 [0, maxJitter) 内的随机延迟，使同一子账户的会话分散重连。
+//
+// 等待期间币种改回当前币种时取消切换。全部为0时立即切换。
+type CoinSwitchPolicy struct {
+	minDwell  time.Duration
+	debounce  time.Duration
+	maxJitter time.Duration
+}
+
+// NewCoinSwitchPolicy 创建币种切换策略
+func NewCoinSwitchPolicy(minDwellSeconds int, debounceSeconds int, jitterSeconds int) CoinSwitchPolicy {
+	return CoinSwitchPolicy{
+		minDwell:  time.Duration(minDwellSeconds) * time.Second,
+		debounce:  time.Duration(debounceSeconds) * time.Second,
+		maxJitter: time.Duration(jitterSeconds) * time.Second,
+	}
+}
+
+// isImmediate 是否立即切换
+func (policy CoinSwitchPolicy) isImmediate() bool {
+	return policy.minDwell <= 0 && policy.debounce <= 0 && policy.maxJitter <= 0
+}
+
+// jitter 生成一个随机延迟
+func (policy CoinSwitchPolicy) jitter() time.Duration {
+	if policy.maxJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(policy.maxJitter)))
+}
+
+// switchTime 计算切换时间
+// coinSince 为开始挖当前币种的时间，changedAt 为币种最后一次改变的时间
+func (policy CoinSwitchPolicy) switchTime(coinSince time.Time, changedAt time.Time, jitter time.Duration) time.Time {
+	switchAt := changedAt.Add(policy.debounce)
+	if dwellUntil := coinSince.Add(policy.minDwell); dwellUntil.After(switchAt) {
+		switchAt = dwellUntil
+	}
+	return switchAt.Add(jitter)
+}
+
+// getCoinSince 获取开始挖当前币种的时间（线程安全）
+func (session *StratumSession) getCoinSince() time.Time {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.coinSince
+}
+
+// waitCoinSwitch 按切换策略等待，返回最终要切换到的币种。
+// 等待期间继续监控Zookeeper，币种再次改变时以最新的币种为准并重新计算防抖时间。
+// 返回空字符串表示不再切换（币种改回了当前币种、无法读取Zookeeper，或会话已停止、已重连）。
+// manager 由调用者在会话运行时取得，会话停止后 session.manager 将被置空。
+func (session *StratumSession) waitCoinSwitch(manager *StratumSessionManager, newMiningCoin string, currentReconnectCounter uint32) string {
+	policy := manager.coinSwitchPolicy
+	if policy.isImmediate() {
+		return newMiningCoin
+	}
+
+	jitter := policy.jitter()
+	switchAt := policy.switchTime(session.getCoinSince(), time.Now(), jitter)
+	if glog.V(3) {
+		glog.Info("Coin Switch Delayed: ", session.fullWorkerName, "; ", session.getMiningCoin(), " -> ", newMiningCoin, "; ", time.Until(switchAt))
+	}
+
+	for {
+		timer := time.NewTimer(time.Until(switchAt))
+
+		var workerNode bool
+		select {
+		case <-timer.C:
+			return newMiningCoin
+
+		case <-session.zkWatchEvent:
+			timer.Stop()
+
+		case <-session.zkWorkerWatchEvent:
+			timer.Stop()
+			workerNode = true
+		}
+
+		if !session.IsRunning() || currentReconnectCounter != session.getReconnectCounter() {
+			return ""
+		}
+
+		changedCoin, err := session.rereadZKMiningCoin(manager, workerNode)
+		if err != nil {
+			// 不知道币种是否又被改变，放弃本次切换。
+			// 监控未能重新设置，已触发的监控channel处于关闭状态，调用者会立即重新读取
+			glog.Error("Read From Zookeeper Failed, give up switching: ", session.fullWorkerName, "; ", err)
+			return ""
+		}
+
+		if session.checkCoinOverride(changedCoin) {
+			return ""
+		}
+
+		miningCoin := session.getMiningCoin()
+		if changedCoin == miningCoin {
+			manager.metrics.coinSwitchesCancelled.Inc(miningCoin)
+			if glog.V(2) {
+				glog.Info("Coin Switch Cancelled: ", session.fullWorkerName, "; ", miningCoin, " -> ", newMiningCoin, " -> ", changedCoin)
+			}
+			return ""
+		}
+
+		if _, exists := manager.getStratumServerInfo(changedCoin); !exists {
+			glog.Error("Stratum Server Not Found for New Mining Coin: ", changedCoin)
+			continue
+		}
+
+		newMiningCoin = changedCoin
+		switchAt = policy.switchTime(session.getCoinSince(), time.Now(), jitter)
+		if glog.V(3) {
+			glog.Info("Coin Switch Delayed: ", session.fullWorkerName, "; ", miningCoin, " -> ", newMiningCoin, "; ", time.Until(switchAt))
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btccom/btcpool-go-modules/coordination"
+)
+
+func TestCoinSwitchPolicySwitchTime(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+
+	policy := NewCoinSwitchPolicy(0, 0, 0)
+	if !policy.isImmediate() || policy.jitter() != 0 {
+		t.Errorf("zero policy should switch immediately")
+	}
+	if switchAt := policy.switchTime(now.Add(-time.Hour), now, 0); !switchAt.Equal(now) {
+		t.Errorf("zero policy should switch now, but at %s", switchAt)
+	}
+
+	policy = NewCoinSwitchPolicy(60, 10, 5)
+	if policy.isImmediate() {
+		t.Errorf("policy should not switch immediately")
+	}
+
+	// 刚切换过，等待最短停留时间
+	if switchAt := policy.switchTime(now.Add(-20*time.Second), now, time.Second); !switchAt.Equal(now.Add(41 * time.Second)) {
+		t.Errorf("should wait for the min dwell time, but switch at %s", switchAt.Sub(now))
+	}
+	// 已停留足够久，只需防抖
+	if switchAt := policy.switchTime(now.Add(-time.Hour), now, time.Second); !switchAt.Equal(now.Add(11 * time.Second)) {
+		t.Errorf("should wait for the debounce time, but switch at %s", switchAt.Sub(now))
+	}
+
+	for i := 0; i < 100; i++ {
+		if jitter := policy.jitter(); jitter < 0 || jitter >= 5*time.Second {
+			t.Fatalf("jitter out of range: %s", jitter)
+		}
+	}
+}
+
+func TestStratumSessionWaitCoinSwitch(t *testing.T) {
+	manager, clientSides := newDrainTestManager(t, 1)
+	defer manager.tcpListener.Close()
+	defer clientSides[0].Close()
+
+	var session *StratumSession
+	for _, session = range manager.sessions {
+	}
+	session.miningCoin = "btc"
+	session.zkWatchEvent = make(chan coordination.Event)
+
+	manager.coinSwitchPolicy = CoinSwitchPolicy{debounce: 50 * time.Millisecond}
+	start := time.Now()
+	if coin := session.waitCoinSwitch(manager, "bcc", session.getReconnectCounter()); coin != "bcc" {
+		t.Errorf("should switch to bcc, but got %q", coin)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("should wait for the debounce time, but only waited %s", elapsed)
+	}
+
+	// 无法重新读取Zookeeper时放弃切换，而不是按原计划盲目切换
+	manager.coinSwitchPolicy = CoinSwitchPolicy{minDwell: time.Hour}
+	watchEvent := make(chan coordination.Event)
+	session.zkWatchEvent = watchEvent
+	conn := coordination.NewMemoryStore().Connect()
+	manager.zookeeperManager = newZookeeperManager(conn)
+	conn.Close()
+	session.zkWatchPath = "/switcher/aaaa"
+	close(watchEvent)
+	if coin := session.waitCoinSwitch(manager, "bcc", session.getReconnectCounter()); coin != "" {
+		t.Errorf("should give up switching when reading failed, but got %q", coin)
+	}
+
+	// 会话停止时放弃切换
+	watchEvent = make(chan coordination.Event)
+	session.zkWatchEvent = watchEvent
+	go func() {
+		session.Stop(StopReasonClientClosed)
+		close(watchEvent)
+	}()
+	if coin := session.waitCoinSwitch(manager, "bcc", session.getReconnectCounter()); coin != "" {
+		t.Errorf("stopped session should not switch, but got %q", coin)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// TLS握手超时时间
+const tlsHandshakeTimeoutSeconds = 15
+
+// NewTLSServerConfig 从证书和私钥文件创建TLS监听使用的配置
+func NewTLSServerConfig(certFile string, keyFile string) (config *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return
+	}
+
+	config = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return
+}
+
+// NewTLSClientConfig 创建连接上游服务器使用的TLS配置
+// caFile 不为空时，只信任该文件中的CA证书（CA固定），否则使用系统CA。
+// serverName 为空时使用服务器地址中的主机名进行验证。
+func NewTLSClientConfig(caFile string, serverName string) (config *tls.Config, err error) {
+	config = &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if len(caFile) > 0 {
+		var caPEM []byte
+		caPEM, err = ioutil.ReadFile(caFile)
+		if err != nil {
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			err = errors.New("no certificate found in " + caFile)
+			return
+		}
+		config.RootCAs = pool
+	}
+	return
+}
+
+// wrapTLSServerConn 在客户端连接上完成TLS握手（用做 ConnWrapper）
+func (manager *StratumSessionManager) wrapTLSServerConn(conn net.Conn) (net.Conn, error) {
+	tlsConn := tls.Server(conn, manager.tlsServerConfig)
+
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeoutSeconds * time.Second))
+	err := tlsConn.Handshake()
+	if err != nil {
+		return nil, errors.New("TLS handshake failed: " + err.Error())
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// dialStratumServer 连接一个服务器地址，若币种配置了TLS则完成TLS握手
+func (manager *StratumSessionManager) dialStratumServer(coin string, url string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", url, connectServerTimeoutSeconds*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	config, ok := manager.getUpstreamTLSConfig(coin)
+	if !ok {
+		return conn, nil
+	}
+
+	if len(config.ServerName) < 1 {
+		// 使用服务器地址中的主机名进行验证
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(url)
+	}
+
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(connectServerTimeoutSeconds * time.Second))
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, errors.New("TLS handshake failed: " + err.Error())
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate 生成自签名证书，返回证书和私钥文件路径
+func writeTestCertificate(t *testing.T, dir string, name string) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey failed: %s", err)
+	}
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return
+}
+
+func TestTLSUpstreamCAPinning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "switcher-tls")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	serverCert, serverKey := writeTestCertificate(t, dir, "sserver")
+	otherCA, _ := writeTestCertificate(t, dir, "other")
+
+	serverConfig, err := NewTLSServerConfig(serverCert, serverKey)
+	if err != nil {
+		t.Fatalf("NewTLSServerConfig failed: %s", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadBytes('\n')
+				if err == nil {
+					conn.Write(line)
+				}
+			}(conn)
+		}
+	}()
+
+	manager := new(StratumSessionManager)
+	manager.upstreamTLSConfigs = make(map[string]*tls.Config)
+
+	// 固定为签发服务器证书的CA，可以连接
+	manager.upstreamTLSConfigs["btc"], err = NewTLSClientConfig(serverCert, "")
+	if err != nil {
+		t.Fatalf("NewTLSClientConfig failed: %s", err)
+	}
+	conn, err := manager.dialStratumServer("btc", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dialStratumServer with pinned CA failed: %s", err)
+	}
+	conn.Write([]byte("ping\n"))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil || string(line) != "ping\n" {
+		t.Errorf("echo through TLS failed: %q, %v", line, err)
+	}
+	conn.Close()
+
+	// 固定为其他CA，证书验证失败
+	manager.upstreamTLSConfigs["btc"], err = NewTLSClientConfig(otherCA, "")
+	if err != nil {
+		t.Fatalf("NewTLSClientConfig failed: %s", err)
+	}
+	conn, err = manager.dialStratumServer("btc", listener.Addr().String())
+	if err == nil {
+		conn.Close()
+		t.Errorf("dialStratumServer should fail with a mismatched CA")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"net"
 	"os"
 
 	"github.com/golang/glog"
@@ -33,6 +34,12 @@ func (upgradable *Upgradable) upgradeStratumSwitcher() (err error) {
 	upgradable.sessionManager.lock.Lock()
 	err = func() error {
 		for _, session := range upgradable.sessionManager.sessions {
+			if !canHandoffSession(session) {
+				// 连接带有进程内的状态（如TLS或Stratum V2的加密状态），无法交给新进程，矿机将断线重连
+				glog.Warning("Session cannot be handed off, it will be disconnected: ", session.clientIPPort, "; ", session.fullWorkerName)
+				continue
+			}
+
 			var sessionData StratumSessionData
 
 			sessionData.SessionID = session.sessionID
@@ -40,6 +47,17 @@ func (upgradable *Upgradable) upgradeStratumSwitcher() (err error) {
 			sessionData.StratumSubscribeRequest = session.stratumSubscribeRequest
 			sessionData.StratumAuthorizeRequest = session.stratumAuthorizeRequest
 			sessionData.VersionMask = session.versionMask
+			sessionData.ConnectTime = session.connectTime.Unix()
+			sessionData.ServerURL = session.serverURL
+			sessionData.ClientIPPort = session.clientIPPort
+			session.lock.Lock()
+			if session.coinOverridden {
+				sessionData.OverriddenZKCoin = session.overriddenZKCoin
+			}
+			if session.btcAgent != nil {
+				sessionData.BTCAgentMessages = session.btcAgent.messages()
+			}
+			session.lock.Unlock()
 
 			sessionData.ClientConnFD, err = getConnFd(session.clientConn)
 			if err != nil {
@@ -89,3 +107,10 @@ func (upgradable *Upgradable) upgradeStratumSwitcher() (err error) {
 	err = execNewBin(os.Args[0], args)
 	return
 }
+
+// canHandoffSession 会话的连接是否可以通过文件描述符交给新进程
+func canHandoffSession(session *StratumSession) bool {
+	_, clientIsTCP := unwrapProxyProtocolConn(session.clientConn).(*net.TCPConn)
+	_, serverIsTCP := session.serverConn.(*net.TCPConn)
+	return clientIsTCP && serverIsTCP
+}
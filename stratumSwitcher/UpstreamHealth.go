@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 默认的上游服务器健康检查间隔
+const defaultUpstreamHealthCheckIntervalSeconds = 10
+
+// 默认的上游服务器健康检查超时
+const defaultUpstreamHealthCheckTimeoutSeconds = 3
+
+// GetURLs 获取按优先级排列的服务器地址列表
+// 配置了 URLs 时使用 URLs，否则使用单个的 URL。
+func (serverInfo StratumServerInfo) GetURLs() []string {
+	if len(serverInfo.URLs) > 0 {
+		return serverInfo.URLs
+	}
+	if len(serverInfo.URL) > 0 {
+		return []string{serverInfo.URL}
+	}
+	return nil
+}
+
+// UpstreamHealthChecker 上游服务器健康检查
+//
+// 定时对所有服务器地址进行TCP连接检查；会话连接服务器失败时也会立即将该地址标记为不健康。
+// 健康状态只影响新建连接（包括切换币种和重连）时的地址选择，已经连接的会话不会被迁移。
+type UpstreamHealthChecker struct {
+	lock sync.RWMutex
+	// 不健康的服务器地址（未出现的地址均视为健康）
+	unhealthy map[string]bool
+	// 检查间隔
+	interval time.Duration
+	// 连接超时
+	timeout time.Duration
+	// 进行检查的函数（可在测试中替换）
+	check func(url string, timeout time.Duration) error
+}
+
+// NewUpstreamHealthChecker 创建上游服务器健康检查对象
+func NewUpstreamHealthChecker(intervalSeconds int, timeoutSeconds int) (checker *UpstreamHealthChecker) {
+	if intervalSeconds <= 0 {
+		intervalSeconds = defaultUpstreamHealthCheckIntervalSeconds
+	}
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = defaultUpstreamHealthCheckTimeoutSeconds
+	}
+
+	checker = new(UpstreamHealthChecker)
+	checker.unhealthy = make(map[string]bool)
+	checker.interval = time.Duration(intervalSeconds) * time.Second
+	checker.timeout = time.Duration(timeoutSeconds) * time.Second
+	checker.check = checkUpstreamByTCP
+	return
+}
+
+// checkUpstreamByTCP 通过建立TCP连接检查服务器是否可用
+func checkUpstreamByTCP(url string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", url, timeout)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+// IsHealthy 服务器地址是否健康
+func (checker *UpstreamHealthChecker) IsHealthy(url string) bool {
+	checker.lock.RLock()
+	defer checker.lock.RUnlock()
+	return !checker.unhealthy[url]
+}
+
+// MarkHealthy 将服务器地址标记为健康
+func (checker *UpstreamHealthChecker) MarkHealthy(url string) {
+	checker.lock.Lock()
+	defer checker.lock.Unlock()
+
+	if checker.unhealthy[url] {
+		delete(checker.unhealthy, url)
+		glog.Info("Upstream Recovered: ", url)
+	}
+}
+
+// MarkUnhealthy 将服务器地址标记为不健康
+func (checker *UpstreamHealthChecker) MarkUnhealthy(url string, err error) {
+	checker.lock.Lock()
+	defer checker.lock.Unlock()
+
+	if !checker.unhealthy[url] {
+		checker.unhealthy[url] = true
+		glog.Warning("Upstream Down: ", url, "; ", err)
+	}
+}
+
+// SortURLs 返回按连接顺序排列的服务器地址：健康的地址在前，不健康的地址在后，各自保持配置顺序。
+// 不健康的地址仍会被尝试，以免在健康状态过时的情况下无服务器可连。
+func (checker *UpstreamHealthChecker) SortURLs(urls []string) []string {
+	sorted := make([]string, 0, len(urls))
+	var unhealthy []string
+
+	checker.lock.RLock()
+	for _, url := range urls {
+		if checker.unhealthy[url] {
+			unhealthy = append(unhealthy, url)
+		} else {
+			sorted = append(sorted, url)
+		}
+	}
+	checker.lock.RUnlock()
+
+	return append(sorted, unhealthy...)
+}
+
+// CheckAll 检查所有服务器地址
+func (checker *UpstreamHealthChecker) CheckAll(urls []string) {
+	var wg sync.WaitGroup
+	for _, url := range urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			err := checker.check(url, checker.timeout)
+			if err != nil {
+				checker.MarkUnhealthy(url, err)
+			} else {
+				checker.MarkHealthy(url)
+			}
+		}(url)
+	}
+	wg.Wait()
+}
+
+// Run 定时检查 getURLs 返回的所有服务器地址
+func (checker *UpstreamHealthChecker) Run(getURLs func() []string) {
+	for {
+		checker.CheckAll(getURLs())
+		time.Sleep(checker.interval)
+	}
+}
+
+// writeMetrics 以 Prometheus 文本格式输出各服务器地址的健康状态
+func (checker *UpstreamHealthChecker) writeMetrics(w io.Writer, name string, serverInfoMap StratumServerInfoMap) {
+	coins := make([]string, 0, len(serverInfoMap))
+	for coin := range serverInfoMap {
+		coins = append(coins, coin)
+	}
+	sort.Strings(coins)
+
+	writeMetricHeader(w, name, "Whether the stratum server endpoint is healthy (1) or down (0).", "gauge")
+	for _, coin := range coins {
+		for _, url := range serverInfoMap[coin].GetURLs() {
+			healthy := 0
+			if checker.IsHealthy(url) {
+				healthy = 1
+			}
+			fmt.Fprintf(w, "%s%s %d\n", name, formatMetricLabels([]string{"coin", "url"}, []string{coin, url}), healthy)
+		}
+	}
+}
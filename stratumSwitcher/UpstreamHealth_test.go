@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUpstreamHealthSortURLs(t *testing.T) {
+	checker := NewUpstreamHealthChecker(0, 0)
+	urls := []string{"primary:3333", "backup1:3333", "backup2:3333"}
+
+	if sorted := checker.SortURLs(urls); !reflect.DeepEqual(sorted, urls) {
+		t.Errorf("all healthy, order should be kept: %v", sorted)
+	}
+
+	checker.MarkUnhealthy("primary:3333", errors.New("down"))
+	expected := []string{"backup1:3333", "backup2:3333", "primary:3333"}
+	if sorted := checker.SortURLs(urls); !reflect.DeepEqual(sorted, expected) {
+		t.Errorf("primary down, sorted URLs should be %v, but is %v", expected, sorted)
+	}
+
+	// 主服务器恢复后重新排在最前
+	checker.MarkHealthy("primary:3333")
+	if sorted := checker.SortURLs(urls); !reflect.DeepEqual(sorted, urls) {
+		t.Errorf("primary recovered, order should be restored: %v", sorted)
+	}
+}
+
+func TestUpstreamHealthCheckAll(t *testing.T) {
+	checker := NewUpstreamHealthChecker(0, 0)
+	down := map[string]bool{"backup1:3333": true}
+	checker.check = func(url string, timeout time.Duration) error {
+		if down[url] {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	urls := []string{"primary:3333", "backup1:3333"}
+	checker.CheckAll(urls)
+	if !checker.IsHealthy("primary:3333") || checker.IsHealthy("backup1:3333") {
+		t.Errorf("wrong health state after the first check")
+	}
+
+	down = map[string]bool{}
+	checker.CheckAll(urls)
+	if !checker.IsHealthy("backup1:3333") {
+		t.Errorf("backup1 should be healthy after recovering")
+	}
+}
+
+func TestStratumServerInfoGetURLs(t *testing.T) {
+	single := StratumServerInfo{URL: "127.0.0.1:3333"}
+	if urls := single.GetURLs(); !reflect.DeepEqual(urls, []string{"127.0.0.1:3333"}) {
+		t.Errorf("GetURLs of single URL is wrong: %v", urls)
+	}
+
+	multi := StratumServerInfo{URL: "127.0.0.1:3333", URLs: []string{"10.0.0.1:3333", "10.0.0.2:3333"}}
+	if urls := multi.GetURLs(); !reflect.DeepEqual(urls, multi.URLs) {
+		t.Errorf("URLs should take place of URL: %v", urls)
+	}
+}
@@ -19,6 +19,31 @@ func IP2Long(ip string) uint32 {
 	return long
 }
 
+// SplitClientIP 从“IP:端口”中取出IP，支持IPv6（如“[2001:db8::1]:3333”）
+func SplitClientIP(ipPort string) string {
+	host, _, err := net.SplitHostPort(ipPort)
+	if err != nil {
+		return ipPort
+	}
+	return host
+}
+
+// ClientIPParams 生成转发给Stratum服务器的矿机IP参数
+// IPv4（包括IPv4映射的IPv6地址）返回其整数形式，ipv6 为空；
+// IPv6 的 ipLong 为0（与旧版服务器兼容），ipv6 为其规范的字符串形式。
+func ClientIPParams(ip string) (ipLong uint32, ipv6 string) {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return
+	}
+	if parsedIP.To4() != nil {
+		ipLong = IP2Long(ip)
+		return
+	}
+	ipv6 = parsedIP.String()
+	return
+}
+
 // Long2IP 整数转IP
 // 来自 <https://www.socketloop.com/tutorials/golang-convert-ip-address-string-to-long-unsigned-32-bit-integer>
 func Long2IP(ipLong uint32) string {
@@ -56,7 +56,7 @@ func execNewBin(binPath string, args []string) (err error) {
 }
 
 func getConnFd(conn net.Conn) (fd uintptr, err error) {
-	tc, ok := conn.(*net.TCPConn)
+	tc, ok := unwrapProxyProtocolConn(conn).(*net.TCPConn)
 	if !ok {
 		return 0, errors.New("getConnFd: conn is not a TCPConn")
 	}
@@ -117,3 +117,21 @@ func signalUSR2Listener(callback func()) {
 		callback()
 	}
 }
+
+func signalHUPListener(callback func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for {
+		<-c
+		callback()
+	}
+}
+
+func signalTERMListener(callback func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM)
+	for {
+		<-c
+		callback()
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSplitClientIP(t *testing.T) {
+	testCases := map[string]string{
+		"192.168.1.10:3333":    "192.168.1.10",
+		"[2001:db8::1]:3333":   "2001:db8::1",
+		"[::ffff:10.0.0.1]:80": "::ffff:10.0.0.1",
+		"192.168.1.10":         "192.168.1.10",
+	}
+
+	for ipPort, expected := range testCases {
+		if ip := SplitClientIP(ipPort); ip != expected {
+			t.Errorf("SplitClientIP(%s) = %s, expected %s", ipPort, ip, expected)
+		}
+	}
+}
+
+func TestClientIPParams(t *testing.T) {
+	testCases := []struct {
+		ip     string
+		ipLong uint32
+		ipv6   string
+	}{
+		{"192.168.1.10", 0xc0a8010a, ""},
+		{"::ffff:10.0.0.1", 0x0a000001, ""},
+		{"2001:db8::1", 0, "2001:db8::1"},
+		{"2001:0DB8:0000::0001", 0, "2001:db8::1"},
+		{"not an ip", 0, ""},
+	}
+
+	for _, testCase := range testCases {
+		ipLong, ipv6 := ClientIPParams(testCase.ip)
+		if ipLong != testCase.ipLong || ipv6 != testCase.ipv6 {
+			t.Errorf("ClientIPParams(%s) = (%d, %s), expected (%d, %s)", testCase.ip, ipLong, ipv6, testCase.ipLong, testCase.ipv6)
+		}
+	}
+
+	if ip := Long2IP(IP2Long("192.168.1.10")); ip != "192.168.1.10" {
+		t.Errorf("Long2IP(IP2Long(192.168.1.10)) = %s", ip)
+	}
+}
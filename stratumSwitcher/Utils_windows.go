@@ -59,3 +59,13 @@ func signalUSR2Listener(callback func()) {
 	glog.Info("Function signalUSR2Listener has not implement in Windows.")
 	return
 }
+
+func signalHUPListener(callback func()) {
+	glog.Info("Function signalHUPListener has not implement in Windows.")
+	return
+}
+
+func signalTERMListener(callback func()) {
+	glog.Info("Function signalTERMListener has not implement in Windows.")
+	return
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// 矿工级别的币种节点
+//
+// 除子账户节点（ZKSwitcherWatchDir/子账户名）外，还可以为单个矿工设置币种，
+// 节点路径为 ZKSwitcherWatchDir/子账户名.矿机名，与矿工名相同。
+// 矿工节点存在且币种有效时优先使用，节点被删除后恢复跟随子账户节点。
+
+// watchWorkerCoin 读取并监控矿工节点（未开启或矿机名为空时不监控）
+func (session *StratumSession) watchWorkerCoin() {
+	if !session.manager.enableWorkerCoinRouting || len(session.minerNameWithDot) < 2 {
+		return
+	}
+	// 矿机名中的“/”会被Zookeeper当做路径分隔符
+	if strings.Contains(session.minerNameWithDot, "/") {
+		return
+	}
+
+	path := session.manager.zookeeperSwitcherWatchDir + session.subaccountName + session.minerNameWithDot
+	data, exists, event, err := session.manager.zookeeperManager.GetExistsW(path, session.sessionID)
+	if err != nil {
+		// 不影响子账户级别的切换
+		glog.Warning("Watch Worker Coin Failed: ", path, "; ", err)
+		return
+	}
+
+	session.zkWorkerWatchPath = path
+	session.zkWorkerWatchEvent = event
+	session.zkWorkerCoin = ""
+	if exists {
+		session.zkWorkerCoin = string(data)
+	}
+}
+
+// getZKMiningCoin 根据Zookeeper中子账户和矿工节点的值，得到矿工应挖的币种
+func (session *StratumSession) getZKMiningCoin() string {
+	if len(session.zkWorkerCoin) > 0 {
+		if _, exists := session.manager.getStratumServerInfo(session.zkWorkerCoin); exists {
+			// 跟随矿工节点的会话不参与子账户的按比例分配
+			session.manager.unassignCoin(session)
+			return session.zkWorkerCoin
+		}
+		glog.Warning("Stratum Server Not Found for Worker Coin: ", session.zkWorkerWatchPath, "; ", session.zkWorkerCoin)
+	}
+	return session.getSubaccountCoin()
+}
+
+// waitZKEvent 等待子账户节点或矿工节点发生改变，返回发生改变的是否为矿工节点
+// 会话停止或重连时监控被释放，channel 被关闭，也会立即返回
+func (session *StratumSession) waitZKEvent() (workerNode bool) {
+	select {
+	case <-session.zkWatchEvent:
+		return false
+	case <-session.zkWorkerWatchEvent:
+		return true
+	}
+}
+
+// rereadZKMiningCoin 重新读取发生改变的节点并设置监控，返回矿工应挖的币种
+// manager 由调用者在会话运行时取得，会话停止后 session.manager 将被置空
+func (session *StratumSession) rereadZKMiningCoin(manager *StratumSessionManager, workerNode bool) (string, error) {
+	if workerNode {
+		data, exists, event, err := manager.zookeeperManager.GetExistsW(session.zkWorkerWatchPath, session.sessionID)
+		if err != nil {
+			return "", err
+		}
+		session.zkWorkerWatchEvent = event
+		session.zkWorkerCoin = ""
+		if exists {
+			session.zkWorkerCoin = string(data)
+		}
+	} else {
+		data, event, err := manager.zookeeperManager.GetW(session.zkWatchPath, session.sessionID)
+		if err != nil {
+			return "", err
+		}
+		session.zkWatchEvent = event
+		session.zkSubaccountCoin = string(data)
+	}
+
+	return session.getZKMiningCoin(), nil
+}
+
+// releaseZKWatch 释放子账户节点和矿工节点的监控
+func (manager *StratumSessionManager) releaseZKWatch(session *StratumSession) {
+	manager.zookeeperManager.ReleaseW(session.zkWatchPath, session.sessionID)
+	if len(session.zkWorkerWatchPath) > 0 {
+		manager.zookeeperManager.ReleaseW(session.zkWorkerWatchPath, session.sessionID)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/btccom/btcpool-go-modules/coordination"
+)
+
+func TestStratumSessionGetZKMiningCoin(t *testing.T) {
+	manager, clientSides := newDrainTestManager(t, 1)
+	defer manager.tcpListener.Close()
+	defer clientSides[0].Close()
+	manager.stratumServerInfoMap = StratumServerInfoMap{
+		"btc": {URL: "127.0.0.1:3333"},
+		"bcc": {URL: "127.0.0.1:3334"},
+	}
+
+	var session *StratumSession
+	for _, session = range manager.sessions {
+	}
+	session.zkSubaccountCoin = "btc"
+
+	for _, c := range []struct{ workerCoin, expected string }{
+		{"", "btc"},
+		{"bcc", "bcc"},
+		// 矿工节点中的币种无效时使用子账户的币种
+		{"ltc", "btc"},
+	} {
+		session.zkWorkerCoin = c.workerCoin
+		if coin := session.getZKMiningCoin(); coin != c.expected {
+			t.Errorf("worker coin %q: %s expected, but got %s", c.workerCoin, c.expected, coin)
+		}
+	}
+}
+
+func TestStratumSessionWatchWorkerCoinSkipped(t *testing.T) {
+	manager, clientSides := newDrainTestManager(t, 1)
+	defer manager.tcpListener.Close()
+	defer clientSides[0].Close()
+
+	var session *StratumSession
+	for _, session = range manager.sessions {
+	}
+	session.subaccountName = "aaaa"
+
+	// 未开启、矿机名为空或包含“/”时不访问Zookeeper
+	for _, c := range []struct {
+		enabled          bool
+		minerNameWithDot string
+	}{
+		{false, ".rig01"},
+		{true, ""},
+		{true, "."},
+		{true, ".rig/01"},
+	} {
+		manager.enableWorkerCoinRouting = c.enabled
+		session.minerNameWithDot = c.minerNameWithDot
+		session.watchWorkerCoin()
+		if session.zkWorkerWatchPath != "" || session.zkWorkerWatchEvent != nil {
+			t.Errorf("worker node should not be watched: %+v", c)
+		}
+	}
+}
+
+func TestStratumSessionWaitZKEvent(t *testing.T) {
+	session := new(StratumSession)
+
+	subaccountEvent := make(chan coordination.Event, 1)
+	session.zkWatchEvent = subaccountEvent
+	subaccountEvent <- coordination.Event{Type: coordination.EventNodeDataChanged}
+	if session.waitZKEvent() {
+		t.Errorf("the subaccount node should be changed")
+	}
+
+	workerEvent := make(chan coordination.Event, 1)
+	session.zkWorkerWatchEvent = workerEvent
+	workerEvent <- coordination.Event{Type: coordination.EventNodeCreated}
+	if !session.waitZKEvent() {
+		t.Errorf("the worker node should be changed")
+	}
+}
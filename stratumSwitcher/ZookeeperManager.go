@@ -1,13 +1,13 @@
 package main
 
 import (
-	"errors"
+	"bytes"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/btccom/btcpool-go-modules/coordination"
 	"github.com/golang/glog"
-	"github.com/samuel/go-zookeeper/zk"
 )
 
 // zookeeper连接超时时间
@@ -17,7 +17,7 @@ const zookeeperConnectingTimeoutSeconds = 60
 const zookeeperConnAliveTimeout = 5
 
 // NodeWatcherChannels 节点监控者的channel
-type NodeWatcherChannels map[uint32]chan zk.Event
+type NodeWatcherChannels map[uint32]chan coordination.Event
 
 // NodeWatcher 节点监控器
 type NodeWatcher struct {
@@ -27,10 +27,14 @@ type NodeWatcher struct {
 	nodePath string
 	// 被监控节点的当前值
 	nodeValue []byte
-	// 被监控的Zookeeper事件
-	zkWatchEvent <-chan zk.Event
+	// 被监控节点是否存在（监控不存在的节点时，节点被创建也会触发事件）
+	nodeExists bool
+	// 被监控的Zookeeper事件（监控因会话过期等原因失效时为空，会话恢复后重新设置）
+	zkWatchEvent <-chan coordination.Event
 	// 节点监控者的channel
 	watcherChannels NodeWatcherChannels
+	// 是否由变更日志通知（不设置Zookeeper监控，没有监控者时即被移除）
+	fed bool
 }
 
 // NewNodeWatcher 新建节点监控器
@@ -41,23 +45,68 @@ func NewNodeWatcher(zookeeperManager *ZookeeperManager) *NodeWatcher {
 	return watcher
 }
 
-// Run 开始监控
+// Run 开始监控，在持有 zookeeperManager.lock 时调用
 func (watcher *NodeWatcher) Run() {
+	zkWatchEvent := watcher.zkWatchEvent
+
 	go func() {
-		event := <-watcher.zkWatchEvent
+		event, ok := <-zkWatchEvent
 
 		watcher.zookeeperManager.lock.Lock()
 		defer watcher.zookeeperManager.lock.Unlock()
 
-		for _, eventChan := range watcher.watcherChannels {
-			eventChan <- event
-			close(eventChan)
+		// 监控已在会话恢复后重新设置，忽略旧监控的事件
+		if watcher.zkWatchEvent != zkWatchEvent {
+			return
+		}
+
+		// 监控因会话过期等原因失效，保留监控器，由 restoreWatchers 重新设置监控
+		if ok && event.Type == coordination.EventNotWatching && event.Err != coordination.ErrClosing {
+			glog.Warning("Zookeeper: watch lost: ", watcher.nodePath, "; ", event.Err)
+			watcher.zkWatchEvent = nil
+			if event.Err != coordination.ErrSessionExpired {
+				go watcher.zookeeperManager.restoreWatchers(false)
+			}
+			return
 		}
 
+		watcher.notify(event)
 		watcher.zookeeperManager.removeNodeWatcher(watcher)
 	}()
 }
 
+// notify 将事件发送给所有监控者并关闭其channel，在持有 zookeeperManager.lock 时调用
+func (watcher *NodeWatcher) notify(event coordination.Event) {
+	for sessionID, eventChan := range watcher.watcherChannels {
+		eventChan <- event
+		close(eventChan)
+		delete(watcher.watcherChannels, sessionID)
+	}
+}
+
+// update 更新节点的值，节点发生了改变时通知监控者重新读取节点，在持有 zookeeperManager.lock 时调用
+func (watcher *NodeWatcher) update(value []byte, exists bool) {
+	var event coordination.Event
+	switch {
+	case exists && !watcher.nodeExists:
+		event = coordination.Event{Type: coordination.EventNodeCreated, Path: watcher.nodePath}
+	case !exists && watcher.nodeExists:
+		event = coordination.Event{Type: coordination.EventNodeDeleted, Path: watcher.nodePath}
+	case exists && !bytes.Equal(value, watcher.nodeValue):
+		event = coordination.Event{Type: coordination.EventNodeDataChanged, Path: watcher.nodePath}
+	}
+
+	watcher.nodeValue = value
+	watcher.nodeExists = exists
+
+	if event.Type != 0 {
+		if glog.V(2) {
+			glog.Info("Zookeeper: node changed while not watching: ", watcher.nodePath, "; ", event.Type)
+		}
+		watcher.notify(event)
+	}
+}
+
 // NodeWatcherMap Zookeeper监控器Map
 type NodeWatcherMap map[string]*NodeWatcher
 
@@ -67,45 +116,125 @@ type ZookeeperManager struct {
 	lock sync.Mutex
 	// 监控器Map
 	watcherMap NodeWatcherMap
-	// Zookeeper连接
-	zookeeperConn *zk.Conn
+	// 协调服务连接（Zookeeper、etcd等）
+	zookeeperConn coordination.Backend
+	// 会话过期并恢复后调用的函数（如重建临时节点）
+	sessionExpiredHandlers []func()
+
+	// 变更日志模式下，由变更日志通知的节点所在的目录（为空表示未开启变更日志模式）
+	changeFeedWatchDir string
+	// 变更日志的路径
+	changeLogDir string
+	// 最后读取的变更记录
+	changeLogLast string
 }
 
 // NewZookeeperManager 新建Zookeeper管理器
-func NewZookeeperManager(brokers []string) (manager *ZookeeperManager, err error) {
-	manager = new(ZookeeperManager)
-	manager.watcherMap = make(NodeWatcherMap)
-
-	// 建立到Zookeeper集群的连接
-	var event <-chan zk.Event
-	manager.zookeeperConn, event, err = zk.Connect(brokers, time.Duration(zookeeperConnAliveTimeout)*time.Second)
+// backend 为协调服务后端名称（为空时使用Zookeeper），brokers 为其地址列表
+func NewZookeeperManager(backend string, brokers []string) (manager *ZookeeperManager, err error) {
+	// 建立到协调服务集群的连接
+	conn, err := coordination.Connect(backend, brokers, zookeeperConnectingTimeoutSeconds*time.Second)
 	if err != nil {
 		return
 	}
 
-	zkConnected := make(chan bool, 1)
+	manager = newZookeeperManager(conn)
+	return
+}
 
-	go func() {
-		glog.Info("Zookeeper: waiting for connecting to ", brokers, "...")
-		for {
-			e := <-event
-			glog.Info("Zookeeper: ", e)
-
-			if e.State == zk.StateConnected {
-				zkConnected <- true
-				return
+// newZookeeperManager 使用已建立的连接新建Zookeeper管理器，并开始处理会话状态事件
+func newZookeeperManager(conn coordination.Backend) *ZookeeperManager {
+	manager := new(ZookeeperManager)
+	manager.watcherMap = make(NodeWatcherMap)
+	manager.zookeeperConn = conn
+
+	go manager.handleSessionEvents(conn.SessionEvents())
+	return manager
+}
+
+// OnSessionExpired 添加会话过期并恢复后调用的函数
+func (manager *ZookeeperManager) OnSessionExpired(handler func()) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.sessionExpiredHandlers = append(manager.sessionExpiredHandlers, handler)
+}
+
+// handleSessionEvents 处理会话状态事件，直到连接关闭
+func (manager *ZookeeperManager) handleSessionEvents(events <-chan coordination.SessionEvent) {
+	for event := range events {
+		switch event {
+		case coordination.SessionDisconnected:
+			glog.Warning("Zookeeper: disconnected, reconnecting...")
+
+		case coordination.SessionReconnected:
+			glog.Info("Zookeeper: reconnected")
+			manager.restoreWatchers(false)
+
+		case coordination.SessionExpired:
+			glog.Warning("Zookeeper: session expired, restoring watches and ephemeral nodes")
+			manager.restoreWatchers(true)
+
+			manager.lock.Lock()
+			handlers := append([]func(){}, manager.sessionExpiredHandlers...)
+			manager.lock.Unlock()
+
+			for _, handler := range handlers {
+				handler()
 			}
 		}
-	}()
+	}
+}
+
+// restoreWatchers 重新设置已失效的监控（expired 为 true 时重新设置所有监控），
+// 并重新读取节点的值。节点在失去监控期间发生了改变时，通知监控者重新读取节点。
+// 重新设置失败的监控将在下一次会话状态事件时重试。
+func (manager *ZookeeperManager) restoreWatchers(expired bool) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	for path, watcher := range manager.watcherMap {
+		// 由变更日志通知的节点没有监控，变更记录在会话过期期间不会丢失
+		if watcher.fed {
+			continue
+		}
+		if !expired && watcher.zkWatchEvent != nil {
+			continue
+		}
+		// 使旧监控的事件被忽略
+		watcher.zkWatchEvent = nil
+
+		value, exists, zkWatchEvent, err := manager.readNode(path, true)
+		if err != nil {
+			glog.Error("Zookeeper: restore watch failed: ", path, "; ", err)
+			continue
+		}
 
-	select {
-	case <-zkConnected:
-		break
-	case <-time.After(zookeeperConnectingTimeoutSeconds * time.Second):
-		err = errors.New("Zookeeper: connecting timeout")
-		break
+		watcher.zkWatchEvent = zkWatchEvent
+		watcher.Run()
+		watcher.update(value, exists)
 	}
+}
 
+// readNode 获取可能不存在的节点的值，watch 为 true 时设置监控
+func (manager *ZookeeperManager) readNode(path string, watch bool) (value []byte, exists bool, event <-chan coordination.Event, err error) {
+	if !watch {
+		value, _, err = manager.zookeeperConn.Get(path)
+		if err == coordination.ErrNoNode {
+			return nil, false, nil, nil
+		}
+		return value, err == nil, nil, err
+	}
+
+	exists = true
+	value, _, event, err = manager.zookeeperConn.GetW(path)
+
+	if err == coordination.ErrNoNode {
+		exists, _, event, err = manager.zookeeperConn.ExistsW(path)
+		// 节点恰好在两次调用之间被创建，重新读取
+		if err == nil && exists {
+			value, _, event, err = manager.zookeeperConn.GetW(path)
+		}
+	}
 	return
 }
 
@@ -118,7 +247,7 @@ func (manager *ZookeeperManager) removeNodeWatcher(watcher *NodeWatcher) {
 }
 
 // GetW 获取Zookeeper节点的值并设置监控
-func (manager *ZookeeperManager) GetW(path string, sessionID uint32) (value []byte, event <-chan zk.Event, err error) {
+func (manager *ZookeeperManager) GetW(path string, sessionID uint32) (value []byte, event <-chan coordination.Event, err error) {
 	manager.lock.Lock()
 	defer manager.lock.Unlock()
 
@@ -127,7 +256,14 @@ func (manager *ZookeeperManager) GetW(path string, sessionID uint32) (value []by
 	if !exists {
 		watcher = NewNodeWatcher(manager)
 		watcher.nodePath = path
-		watcher.nodeValue, _, watcher.zkWatchEvent, err = manager.zookeeperConn.GetW(path)
+		watcher.nodeExists = true
+		watcher.fed = manager.isFedPath(path)
+
+		if watcher.fed {
+			watcher.nodeValue, _, err = manager.zookeeperConn.Get(path)
+		} else {
+			watcher.nodeValue, _, watcher.zkWatchEvent, err = manager.zookeeperConn.GetW(path)
+		}
 
 		if err != nil {
 			return
@@ -138,10 +274,16 @@ func (manager *ZookeeperManager) GetW(path string, sessionID uint32) (value []by
 			glog.Info("Zookeeper: add NodeWatcher: ", path)
 		}
 
-		defer watcher.Run()
+		if !watcher.fed {
+			defer watcher.Run()
+		}
+	} else if !watcher.nodeExists {
+		// 节点由 GetExistsW 监控且不存在
+		err = coordination.ErrNoNode
+		return
 	}
 
-	eventChan := make(chan zk.Event, 1)
+	eventChan := make(chan coordination.Event, 1)
 	watcher.watcherChannels[sessionID] = eventChan
 	if glog.V(3) {
 		glog.Info("Zookeeper: add WatcherChannel: ", path, "; ", Uint32ToHex(sessionID))
@@ -152,9 +294,46 @@ func (manager *ZookeeperManager) GetW(path string, sessionID uint32) (value []by
 	return
 }
 
+// GetExistsW 获取可能不存在的Zookeeper节点的值并设置监控
+// 节点不存在时 exists 为 false，节点被创建时会触发事件
+func (manager *ZookeeperManager) GetExistsW(path string, sessionID uint32) (value []byte, exists bool, event <-chan coordination.Event, err error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	watcher, watching := manager.watcherMap[path]
+
+	if !watching {
+		watcher = NewNodeWatcher(manager)
+		watcher.nodePath = path
+		watcher.fed = manager.isFedPath(path)
+		watcher.nodeValue, watcher.nodeExists, watcher.zkWatchEvent, err = manager.readNode(path, !watcher.fed)
+
+		if err != nil {
+			return
+		}
+
+		manager.watcherMap[path] = watcher
+		if glog.V(3) {
+			glog.Info("Zookeeper: add NodeWatcher: ", path, "; exists: ", watcher.nodeExists)
+		}
+
+		if !watcher.fed {
+			defer watcher.Run()
+		}
+	}
+
+	eventChan := make(chan coordination.Event, 1)
+	watcher.watcherChannels[sessionID] = eventChan
+
+	value = watcher.nodeValue
+	exists = watcher.nodeExists
+	event = eventChan
+	return
+}
+
 // Create 创建Zookeeper节点
 func (manager *ZookeeperManager) Create(path string, data []byte) (err error) {
-	_, err = manager.zookeeperConn.Create(path, data, 0, zk.WorldACL(zk.PermAll))
+	_, err = manager.zookeeperConn.Create(path, data, 0)
 	return
 }
 
@@ -190,6 +369,11 @@ func (manager *ZookeeperManager) ReleaseW(path string, sessionID uint32) {
 			manager.removeNodeWatcher(watcher)
 		}
 	*/
+
+	// 由变更日志通知的节点没有设置Zookeeper监控，可以立即释放
+	if watcher.fed && len(watcher.watcherChannels) == 0 {
+		manager.removeNodeWatcher(watcher)
+	}
 }
 
 // 递归创建Zookeeper Node
@@ -215,7 +399,7 @@ func (manager *ZookeeperManager) createZookeeperPath(path string) error {
 		}
 
 		// 不存在，创建
-		_, err = manager.zookeeperConn.Create(currPath, []byte{}, 0, zk.WorldACL(zk.PermAll))
+		_, err = manager.zookeeperConn.Create(currPath, []byte{}, 0)
 
 		if err != nil {
 			return err
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btccom/btcpool-go-modules/coordination"
+)
+
+func newMemoryZookeeperManager() *ZookeeperManager {
+	manager := new(ZookeeperManager)
+	manager.watcherMap = make(NodeWatcherMap)
+	manager.zookeeperConn = coordination.NewMemoryStore().Connect()
+	return manager
+}
+
+func TestZookeeperManagerGetW(t *testing.T) {
+	manager := newMemoryZookeeperManager()
+	defer manager.zookeeperConn.Close()
+
+	if err := manager.createZookeeperPath("/stratumSwitcher/btcbcc"); err != nil {
+		t.Fatalf("createZookeeperPath failed: %s", err)
+	}
+	if err := manager.Create("/stratumSwitcher/btcbcc/aaaa", []byte("btc")); err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+
+	// 两个会话监控同一个节点，只向后端设置一个监控
+	value1, event1, err := manager.GetW("/stratumSwitcher/btcbcc/aaaa", 1)
+	if err != nil || string(value1) != "btc" {
+		t.Fatalf("GetW failed: %s, %v", value1, err)
+	}
+	value2, event2, _ := manager.GetW("/stratumSwitcher/btcbcc/aaaa", 2)
+	if string(value2) != "btc" || len(manager.watcherMap) != 1 {
+		t.Errorf("wrong value or watcher count: %s, %d", value2, len(manager.watcherMap))
+	}
+
+	manager.zookeeperConn.Set("/stratumSwitcher/btcbcc/aaaa", []byte("bcc"), -1)
+
+	for _, event := range []<-chan coordination.Event{event1, event2} {
+		select {
+		case e := <-event:
+			if e.Type != coordination.EventNodeDataChanged {
+				t.Errorf("wrong event: %+v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("waiting for event timeout")
+		}
+	}
+
+	value1, _, _ = manager.GetW("/stratumSwitcher/btcbcc/aaaa", 1)
+	if string(value1) != "bcc" {
+		t.Errorf("wrong value after change: %s", value1)
+	}
+}
+
+func TestZookeeperManagerGetExistsW(t *testing.T) {
+	manager := newMemoryZookeeperManager()
+	defer manager.zookeeperConn.Close()
+
+	manager.createZookeeperPath("/stratumSwitcher/btcbcc")
+
+	_, exists, event, err := manager.GetExistsW("/stratumSwitcher/btcbcc/aaaa.rig01", 1)
+	if err != nil || exists {
+		t.Fatalf("GetExistsW failed: %v, %v", exists, err)
+	}
+	// 由 GetExistsW 监控且不存在的节点，GetW 返回 ErrNoNode
+	if _, _, err := manager.GetW("/stratumSwitcher/btcbcc/aaaa.rig01", 2); err != coordination.ErrNoNode {
+		t.Errorf("GetW of non-existent node: %v", err)
+	}
+
+	manager.Create("/stratumSwitcher/btcbcc/aaaa.rig01", []byte("bcc"))
+
+	select {
+	case e := <-event:
+		if e.Type != coordination.EventNodeCreated {
+			t.Errorf("wrong event: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting for event timeout")
+	}
+
+	value, exists, _, _ := manager.GetExistsW("/stratumSwitcher/btcbcc/aaaa.rig01", 1)
+	if !exists || string(value) != "bcc" {
+		t.Errorf("wrong value after creation: %s, %v", value, exists)
+	}
+}
+
+func TestZookeeperManagerRestoreWatchers(t *testing.T) {
+	manager := newMemoryZookeeperManager()
+	defer manager.zookeeperConn.Close()
+	conn := manager.zookeeperConn.(*coordination.MemoryBackend)
+
+	manager.createZookeeperPath("/stratumSwitcher/btcbcc")
+	manager.Create("/stratumSwitcher/btcbcc/aaaa", []byte("btc"))
+	manager.Create("/stratumSwitcher/btcbcc/bbbb", []byte("btc"))
+
+	_, unchangedEvent, _ := manager.GetW("/stratumSwitcher/btcbcc/aaaa", 1)
+	_, changedEvent, _ := manager.GetW("/stratumSwitcher/btcbcc/bbbb", 1)
+	_, _, createdEvent, _ := manager.GetExistsW("/stratumSwitcher/btcbcc/cccc", 1)
+
+	// 会话过期后、监控恢复前，节点被其他进程修改
+	conn.Expire()
+	conn.Set("/stratumSwitcher/btcbcc/bbbb", []byte("bcc"), -1)
+	conn.Create("/stratumSwitcher/btcbcc/cccc", []byte("bcc"), 0)
+
+	manager.restoreWatchers(true)
+
+	if e := <-changedEvent; e.Type != coordination.EventNodeDataChanged {
+		t.Errorf("wrong event of changed node: %+v", e)
+	}
+	if e := <-createdEvent; e.Type != coordination.EventNodeCreated {
+		t.Errorf("wrong event of created node: %+v", e)
+	}
+	select {
+	case e := <-unchangedEvent:
+		t.Fatalf("unchanged node should not fire event: %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// 监控已重新设置
+	value, _, _ := manager.GetW("/stratumSwitcher/btcbcc/bbbb", 1)
+	if string(value) != "bcc" {
+		t.Errorf("wrong value after restore: %s", value)
+	}
+	conn.Set("/stratumSwitcher/btcbcc/aaaa", []byte("bcc"), -1)
+	select {
+	case e := <-unchangedEvent:
+		if e.Type != coordination.EventNodeDataChanged {
+			t.Errorf("wrong event: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting for event of restored watch timeout")
+	}
+}
+
+func TestZookeeperManagerSessionExpired(t *testing.T) {
+	store := coordination.NewMemoryStore()
+	conn := store.Connect()
+	other := store.Connect()
+	defer other.Close()
+
+	manager := new(StratumSessionManager)
+	manager.zookeeperManager = newZookeeperManager(conn)
+	defer conn.Close()
+
+	serverID, err := manager.AssignServerIDFromZK("/stratumSwitcher/ids/", 0)
+	if err != nil || serverID != 1 {
+		t.Fatalf("AssignServerIDFromZK failed: %d, %v", serverID, err)
+	}
+	manager.zookeeperManager.OnSessionExpired(manager.recreateServerIDNode)
+
+	manager.zookeeperManager.createZookeeperPath("/stratumSwitcher/btcbcc")
+	manager.zookeeperManager.Create("/stratumSwitcher/btcbcc/aaaa", []byte("btc"))
+	_, event, _ := manager.zookeeperManager.GetW("/stratumSwitcher/btcbcc/aaaa", 1)
+
+	// 会话过期：服务器ID节点被删除，恢复后以相同的ID重建
+	_, _, idEvent, _ := other.ExistsW("/stratumSwitcher/ids/1")
+	conn.Expire()
+	if e := <-idEvent; e.Type != coordination.EventNodeDeleted {
+		t.Fatalf("wrong event of server id node: %+v", e)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if exists, _, _ := other.Exists("/stratumSwitcher/ids/1"); exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server id node is not recreated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 会话过期后的修改仍能通知到监控者
+	other.Set("/stratumSwitcher/btcbcc/aaaa", []byte("bcc"), -1)
+	select {
+	case e := <-event:
+		if e.Type != coordination.EventNodeDataChanged {
+			t.Errorf("wrong event: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting for event timeout")
+	}
+}
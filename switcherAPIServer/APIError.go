@@ -42,4 +42,41 @@ var (
 
 	// APIErrUserCoinsEmpty 用户币种数组为空
 	APIErrUserCoinsEmpty = NewAPIError(108, "usercoins is empty")
+
+	// APIErrWorkerInvalid worker不合法
+	APIErrWorkerInvalid = NewAPIError(109, "worker invalid")
+
+	// APIErrCoinWeightsInvalid 按比例分配的币种不合法
+	APIErrCoinWeightsInvalid = NewAPIError(110, "coin weights invalid")
+
+	// APIErrScheduleTypeInvalid 计划类型不合法
+	APIErrScheduleTypeInvalid = NewAPIError(111, "schedule type invalid")
+	// APIErrScheduleTimeInvalid 计划时间不合法
+	APIErrScheduleTimeInvalid = NewAPIError(112, "schedule time invalid")
+	// APIErrScheduleNotFound 计划不存在
+	APIErrScheduleNotFound = NewAPIError(113, "schedule not found")
+	// APIErrMethodNotAllowed 请求方法不允许
+	APIErrMethodNotAllowed = NewAPIError(114, "method not allowed")
+
+	// APIErrRecordNotFound 记录不存在
+	APIErrRecordNotFound = NewAPIError(115, "record not found")
+	// APIErrPageInvalid 分页参数不合法
+	APIErrPageInvalid = NewAPIError(116, "offset or limit invalid")
+
+	// APIErrPunameDuplicated 批量切换中子账户重复
+	APIErrPunameDuplicated = NewAPIError(117, "puname duplicated")
+	// APIErrSwitchPartiallyFailed 批量切换中部分子账户切换失败
+	APIErrSwitchPartiallyFailed = NewAPIError(118, "some punames failed to switch")
+	// APIErrSwitchConflict 批量切换期间记录被其他请求修改，多次重试后仍失败
+	APIErrSwitchConflict = NewAPIError(119, "records changed during switching")
+
+	// APIErrPermissionDenied API Key没有权限
+	APIErrPermissionDenied = NewAPIError(120, "permission denied")
+
+	// APIErrWebhookEventInvalid 推送事件缺少ID或序号
+	APIErrWebhookEventInvalid = NewAPIError(121, "webhook event id or seq invalid")
+	// APIErrWorkerIsEmpty worker为空
+	APIErrWorkerIsEmpty = NewAPIError(122, "worker is empty")
+	// APIErrTooManyRequests 请求过于频繁
+	APIErrTooManyRequests = NewAPIError(123, "too many requests")
 )
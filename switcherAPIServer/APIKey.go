@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btccom/btcpool-go-modules/coordination"
+	"github.com/golang/glog"
+)
+
+// API权限
+const (
+	// APIScopeRead 查询币种、计划和切换历史
+	APIScopeRead = "read"
+	// APIScopeSwitch 切换币种、创建和删除计划
+	APIScopeSwitch = "switch"
+)
+
+// 默认的API Key重新加载间隔
+const defaultAPIKeyReloadSeconds = 10
+
+// HMAC签名请求的时间戳与服务器时间的最大误差
+const apiSignatureMaxSkew = 5 * time.Minute
+
+// 清理已过期签名的间隔
+const apiSignatureSweepInterval = time.Minute
+
+// 默认的请求Body最大长度
+const defaultAPIMaxBodyBytes = 4 << 20
+
+// HMAC签名请求的HTTP头
+const (
+	apiKeyHeader       = "X-API-Key"
+	apiTimestampHeader = "X-API-Timestamp"
+	apiSignatureHeader = "X-API-Signature"
+)
+
+// APIKey API调用凭据
+type APIKey struct {
+	// Key ID，Basic认证时作为用户名
+	ID string `json:"id"`
+	// 密钥，Basic认证时作为密码，签名请求时作为HMAC密钥
+	Secret string `json:"secret"`
+	// 权限：read、switch
+	Scopes []string `json:"scopes"`
+	// 只允许访问以该前缀开头的子账户（为空时不限制）
+	PUNamePrefix string `json:"puname_prefix,omitempty"`
+	// 只允许切换到这些币种（为空时不限制）
+	Coins []string `json:"coins,omitempty"`
+	// 是否已吊销
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// hasScope 是否具有某项权限
+func (key *APIKey) hasScope(scope string) bool {
+	for _, s := range key.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccess 是否允许访问该子账户
+func (key *APIKey) canAccess(puname string) bool {
+	if len(key.PUNamePrefix) < 1 {
+		return true
+	}
+	prefix := key.PUNamePrefix
+	if configData.StratumServerCaseInsensitive {
+		puname = strings.ToLower(puname)
+		prefix = strings.ToLower(prefix)
+	}
+	return strings.HasPrefix(puname, prefix)
+}
+
+// canSwitch 是否允许将子账户切换到该币种（或按比例分配的币种）
+func (key *APIKey) canSwitch(puname string, coin string) *APIError {
+	if !key.hasScope(APIScopeSwitch) || !key.canAccess(puname) {
+		return APIErrPermissionDenied
+	}
+	if len(key.Coins) < 1 {
+		return nil
+	}
+
+	coins := []string{coin}
+	var weights map[string]float64
+	if strings.HasPrefix(strings.TrimSpace(coin), "{") && json.Unmarshal([]byte(coin), &weights) == nil {
+		coins = coins[:0]
+		for weightedCoin := range weights {
+			coins = append(coins, weightedCoin)
+		}
+	}
+
+	for _, c := range coins {
+		allowed := false
+		for _, allowedCoin := range key.Coins {
+			if c == allowedCoin {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return APIErrPermissionDenied
+		}
+	}
+	return nil
+}
+
+// canResetWorker 是否可以删除该子账户下矿工的币种
+// 删除后矿工跟随子账户的币种，因此不检查 Coins。
+func (key *APIKey) canResetWorker(puname string) *APIError {
+	if !key.hasScope(APIScopeSwitch) || !key.canAccess(puname) {
+		return APIErrPermissionDenied
+	}
+	return nil
+}
+
+// apiKeyStore 当前有效的API Key
+type apiKeyStore struct {
+	lock sync.RWMutex
+	keys map[string]*APIKey
+}
+
+var apiKeys apiKeyStore
+
+// get 获取一个未吊销的Key
+func (store *apiKeyStore) get(id string) (*APIKey, bool) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	key, ok := store.keys[id]
+	if !ok || key.Disabled {
+		return nil, false
+	}
+	return key, true
+}
+
+// set 替换所有Key
+func (store *apiKeyStore) set(keys map[string]*APIKey) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.keys = keys
+}
+
+// configAPIKeys 配置文件中的Key
+// 原有的 APIUser、APIPassword 作为一个具有所有权限的Key
+func configAPIKeys(config *ConfigData) map[string]*APIKey {
+	keys := make(map[string]*APIKey)
+	if len(config.APIUser) > 0 {
+		keys[config.APIUser] = &APIKey{
+			ID:     config.APIUser,
+			Secret: config.APIPassword,
+			Scopes: []string{APIScopeRead, APIScopeSwitch},
+		}
+	}
+	for i := range config.APIKeys {
+		key := config.APIKeys[i]
+		keys[key.ID] = &key
+	}
+	return keys
+}
+
+// zookeeperAPIKeys Zookeeper中的Key，节点名为Key ID，值为APIKey的JSON
+func zookeeperAPIKeys() (map[string]*APIKey, error) {
+	keys := make(map[string]*APIKey)
+
+	dir := strings.TrimSuffix(configData.ZKAPIKeyDir, "/")
+	ids, _, err := zookeeperConn.Children(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		data, _, err := zookeeperConn.Get(dir + "/" + id)
+		if err == coordination.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		key := new(APIKey)
+		err = json.Unmarshal(data, key)
+		if err != nil {
+			glog.Warning("Parse API Key Failed: ", dir, "/", id, "; ", err)
+			continue
+		}
+		key.ID = id
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// loadAPIKeys 从配置文件和Zookeeper加载Key，Zookeeper中的Key覆盖配置文件中ID相同的Key
+// 加载失败时保留原来的Key
+func loadAPIKeys() {
+	config, err := readConfig(configFilePath)
+	if err != nil {
+		glog.Error("Reload API Keys Failed: ", err)
+		return
+	}
+	keys := configAPIKeys(config)
+
+	if len(configData.ZKAPIKeyDir) > 0 {
+		zkKeys, err := zookeeperAPIKeys()
+		if err != nil {
+			glog.Error("Reload API Keys From Zookeeper Failed: ", err)
+			return
+		}
+		for id, key := range zkKeys {
+			keys[id] = key
+		}
+	}
+
+	apiKeys.set(keys)
+}
+
+// RunAPIKeyReloader 定时重新加载Key，吊销或添加Key无需重启
+func RunAPIKeyReloader() {
+	interval := time.Duration(configData.APIKeyReloadSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultAPIKeyReloadSeconds * time.Second
+	}
+
+	for {
+		time.Sleep(interval)
+		loadAPIKeys()
+	}
+}
+
+// apiSignature 计算请求签名：hex(HMAC-SHA256(secret, 方法\nURI\n时间戳\nBody))
+func apiSignature(secret string, method string, requestURI string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + requestURI + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// apiSignatureCache 时间戳仍在有效期内的已使用签名，用于拒绝重放的请求
+type apiSignatureCache struct {
+	lock sync.Mutex
+	// Key ID + "\n" + 签名 到该签名的过期时间
+	used      map[string]time.Time
+	nextSweep time.Time
+}
+
+var usedSignatures apiSignatureCache
+
+// use 记录一个签名，该Key的同一签名在过期前已被使用过时返回false
+func (cache *apiSignatureCache) use(keyID string, signature string, expire time.Time, now time.Time) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if cache.used == nil {
+		cache.used = make(map[string]time.Time)
+	}
+	if !now.Before(cache.nextSweep) {
+		for k, e := range cache.used {
+			if !now.Before(e) {
+				delete(cache.used, k)
+			}
+		}
+		cache.nextSweep = now.Add(apiSignatureSweepInterval)
+	}
+
+	k := keyID + "\n" + signature
+	if e, exists := cache.used[k]; exists && now.Before(e) {
+		return false
+	}
+	cache.used[k] = expire
+	return true
+}
+
+// authenticateSignature 验证HMAC签名请求
+// 同一签名在时间戳有效期内只能使用一次，被截获的请求不能重放。
+func authenticateSignature(r *http.Request) (*APIKey, bool) {
+	key, ok := apiKeys.get(r.Header.Get(apiKeyHeader))
+	if !ok {
+		return nil, false
+	}
+
+	timestamp := r.Header.Get(apiTimestampHeader)
+	unixTime, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	skew := now.Sub(time.Unix(unixTime, 0))
+	if skew > apiSignatureMaxSkew || skew < -apiSignatureMaxSkew {
+		return nil, false
+	}
+
+	// Body 的长度已由 apiAuth 限制
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		glog.Info("Read Signed Request Body Failed: ", key.ID, "; ", r.RequestURI, "; ", err)
+		return nil, false
+	}
+	// 还原Body以便处理函数读取
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	signature := apiSignature(key.Secret, r.Method, r.RequestURI, timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(strings.ToLower(r.Header.Get(apiSignatureHeader)))) {
+		return nil, false
+	}
+
+	if !usedSignatures.use(key.ID, signature, time.Unix(unixTime, 0).Add(apiSignatureMaxSkew), now) {
+		glog.Warning("Replayed Signed Request: ", key.ID, "; ", r.RequestURI)
+		return nil, false
+	}
+	return key, true
+}
+
+// authenticate 验证请求，支持Basic认证和HMAC签名
+func authenticate(r *http.Request) (*APIKey, bool) {
+	if len(r.Header.Get(apiKeyHeader)) > 0 {
+		return authenticateSignature(r)
+	}
+
+	user, passwd, ok := r.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+	key, ok := apiKeys.get(user)
+	if !ok || subtle.ConstantTimeCompare([]byte(key.Secret), []byte(passwd)) != 1 {
+		return nil, false
+	}
+	return key, true
+}
+
+type apiKeyContextKey struct{}
+
+// requestAPIKey 获取请求使用的Key
+func requestAPIKey(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+// apiAuth 执行认证并检查权限
+func apiAuth(scope string, f HTTPRequestHandle) HTTPRequestHandle {
+	return func(w http.ResponseWriter, r *http.Request) {
+		maxBodyBytes := configData.APIMaxBodyBytes
+		if maxBodyBytes <= 0 {
+			maxBodyBytes = defaultAPIMaxBodyBytes
+		}
+		// 签名验证和处理函数都会读取整个Body
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+
+		key, ok := authenticate(r)
+
+		if !ok {
+			// 认证失败，提示 401 Unauthorized
+			// Restricted 可以改成其他的值
+			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+			// 401 状态码
+			w.WriteHeader(http.StatusUnauthorized)
+			// 401 页面
+			w.Write([]byte(`<h1>401 - Unauthorized</h1>`))
+			return
+		}
+
+		r = withRequestID(w, r)
+
+		if !key.hasScope(scope) {
+			glog.Info(APIErrPermissionDenied, ": ", key.ID, "; ", r.RequestURI)
+			writeError(w, APIErrPermissionDenied.ErrNo, APIErrPermissionDenied.ErrMsg)
+			return
+		}
+
+		// 执行被装饰的函数
+		f(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}
+}
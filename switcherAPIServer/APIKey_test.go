@@ -0,0 +1,300 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newAPIKeyTestStore 设置测试用的Key
+func newAPIKeyTestStore(t *testing.T) {
+	newTestStore(t)
+	configData.APIUser = "admin"
+	configData.APIPassword = "admin"
+	configData.APIKeys = []APIKey{
+		{ID: "dashboard", Secret: "xxxx", Scopes: []string{APIScopeRead}},
+		{ID: "partner-a", Secret: "yyyy", Scopes: []string{APIScopeRead, APIScopeSwitch}, PUNamePrefix: "parta_", Coins: []string{"btc", "bcc"}},
+		{ID: "revoked", Secret: "zzzz", Scopes: []string{APIScopeRead, APIScopeSwitch}, Disabled: true},
+	}
+	apiKeys.set(configAPIKeys(configData))
+	usedSignatures = apiSignatureCache{}
+}
+
+// signedRequest 构造HMAC签名请求
+func signedRequest(keyID string, secret string, method string, uri string, timestamp time.Time, body string) *http.Request {
+	req := httptest.NewRequest(method, uri, strings.NewReader(body))
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	req.Header.Set(apiKeyHeader, keyID)
+	req.Header.Set(apiTimestampHeader, ts)
+	req.Header.Set(apiSignatureHeader, apiSignature(secret, method, req.RequestURI, ts, []byte(body)))
+	return req
+}
+
+// serveAuth 通过 apiAuth 处理请求，返回HTTP状态码、处理函数得到的Key和Body
+func serveAuth(scope string, req *http.Request) (status int, key *APIKey, body string) {
+	handled := false
+	handler := apiAuth(scope, func(w http.ResponseWriter, r *http.Request) {
+		handled = true
+		key = requestAPIKey(r)
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, APIErrReadRecordFailed.ErrNo, err.Error())
+			return
+		}
+		body = string(data)
+		writeSuccess(w)
+	})
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, req)
+	if !handled && recorder.Code == http.StatusOK {
+		// 认证通过但没有权限
+		return http.StatusForbidden, nil, ""
+	}
+	return recorder.Code, key, body
+}
+
+func TestAPISignature(t *testing.T) {
+	for _, c := range []struct {
+		secret, method, uri, timestamp, body string
+		expected                             string
+	}{
+		{"yyyy", "GET", "/switch?puname=parta_aaaa&coin=btc", "1527811200", "", "0068a351ce060773065a83bb5701c260438690332954bb42ae23b875c64bf0d5"},
+		{"zzzz", "POST", "/webhook", "1527811200", `{"events":[]}`, "dbe7b74cd2f758b51f7e2c3cc3cb5c6d714438e75d69bc9254a0e0fd2686c2fe"},
+	} {
+		if signature := apiSignature(c.secret, c.method, c.uri, c.timestamp, []byte(c.body)); signature != c.expected {
+			t.Errorf("%s %s: %s expected, but got %s", c.method, c.uri, c.expected, signature)
+		}
+	}
+}
+
+func TestAuthenticateBasic(t *testing.T) {
+	newAPIKeyTestStore(t)
+
+	for _, c := range []struct {
+		user, password string
+		expected       string
+	}{
+		{"admin", "admin", "admin"},
+		{"partner-a", "yyyy", "partner-a"},
+		{"partner-a", "xxxx", ""},
+		{"partner-a", "", ""},
+		{"revoked", "zzzz", ""},
+		{"nobody", "yyyy", ""},
+	} {
+		req := httptest.NewRequest("GET", "/coins", nil)
+		req.SetBasicAuth(c.user, c.password)
+		key, ok := authenticate(req)
+		if (len(c.expected) > 0) != ok || (ok && key.ID != c.expected) {
+			t.Errorf("%s:%s: %q expected, but got %v, %v", c.user, c.password, c.expected, key, ok)
+		}
+	}
+
+	if _, ok := authenticate(httptest.NewRequest("GET", "/coins", nil)); ok {
+		t.Error("request without credentials should be rejected")
+	}
+}
+
+func TestAuthenticateSignature(t *testing.T) {
+	newAPIKeyTestStore(t)
+	now := time.Now()
+	uri := "/switch?puname=parta_aaaa&coin=btc"
+
+	upperCase := signedRequest("partner-a", "yyyy", "GET", uri, now.Add(-time.Second), "")
+	upperCase.Header.Set(apiSignatureHeader, strings.ToUpper(upperCase.Header.Get(apiSignatureHeader)))
+	badTimestamp := signedRequest("partner-a", "yyyy", "GET", uri, now, "")
+	badTimestamp.Header.Set(apiTimestampHeader, "now")
+
+	for _, c := range []struct {
+		name string
+		req  *http.Request
+		ok   bool
+	}{
+		{"valid", signedRequest("partner-a", "yyyy", "GET", uri, now, ""), true},
+		{"upper case signature", upperCase, true},
+		{"wrong secret", signedRequest("partner-a", "xxxx", "GET", uri, now.Add(-2*time.Second), ""), false},
+		{"revoked key", signedRequest("revoked", "zzzz", "GET", uri, now, ""), false},
+		{"unknown key", signedRequest("nobody", "yyyy", "GET", uri, now, ""), false},
+		{"bad timestamp", badTimestamp, false},
+		{"timestamp too old", signedRequest("partner-a", "yyyy", "GET", uri, now.Add(-apiSignatureMaxSkew-time.Minute), ""), false},
+		{"timestamp too new", signedRequest("partner-a", "yyyy", "GET", uri, now.Add(apiSignatureMaxSkew+time.Minute), ""), false},
+	} {
+		status, key, _ := serveAuth(APIScopeSwitch, c.req)
+		if c.ok != (status == http.StatusOK) || (c.ok && key.ID != "partner-a") {
+			t.Errorf("%s: %v expected, but got %d, %v", c.name, c.ok, status, key)
+		}
+	}
+
+	// 签名与请求不符
+	tampered := signedRequest("partner-a", "yyyy", "GET", uri, now.Add(-3*time.Second), "")
+	tampered.RequestURI = "/switch?puname=parta_aaaa&coin=bcc"
+	if status, _, _ := serveAuth(APIScopeSwitch, tampered); status != http.StatusUnauthorized {
+		t.Errorf("tampered request: 401 expected, but got %d", status)
+	}
+}
+
+func TestAuthenticateSignatureReplay(t *testing.T) {
+	newAPIKeyTestStore(t)
+	now := time.Now()
+	body := `{"events":[{"id":"evt-1","seq":1,"puname":"parta_aaaa","coin":"btc"}]}`
+
+	req := signedRequest("partner-a", "yyyy", "POST", "/webhook", now, body)
+	replayed := signedRequest("partner-a", "yyyy", "POST", "/webhook", now, body)
+
+	status, _, handlerBody := serveAuth(APIScopeSwitch, req)
+	if status != http.StatusOK || handlerBody != body {
+		t.Fatalf("first request: 200 and body expected, but got %d, %q", status, handlerBody)
+	}
+	if status, _, _ := serveAuth(APIScopeSwitch, replayed); status != http.StatusUnauthorized {
+		t.Errorf("replayed request: 401 expected, but got %d", status)
+	}
+
+	// 使用新的时间戳重新签名后可以重试
+	retry := signedRequest("partner-a", "yyyy", "POST", "/webhook", now.Add(time.Second), body)
+	if status, _, _ := serveAuth(APIScopeSwitch, retry); status != http.StatusOK {
+		t.Errorf("re-signed request: 200 expected, but got %d", status)
+	}
+}
+
+func TestAPISignatureCache(t *testing.T) {
+	cache := &apiSignatureCache{}
+	now := time.Unix(1527811200, 0)
+	expire := now.Add(apiSignatureMaxSkew)
+
+	if !cache.use("a", "sig", expire, now) {
+		t.Error("first use should be allowed")
+	}
+	if cache.use("a", "sig", expire, now.Add(time.Minute)) {
+		t.Error("second use before expiry should be rejected")
+	}
+	if !cache.use("b", "sig", expire, now.Add(time.Minute)) {
+		t.Error("same signature of another key should be allowed")
+	}
+
+	// 过期后被清理
+	if !cache.use("c", "sig", now.Add(2*apiSignatureMaxSkew), expire) {
+		t.Error("use of a new signature should be allowed")
+	}
+	if len(cache.used) != 1 {
+		t.Errorf("expired signatures should be swept, but got %v", cache.used)
+	}
+}
+
+func TestAPIMaxBodyBytes(t *testing.T) {
+	newAPIKeyTestStore(t)
+	configData.APIMaxBodyBytes = 16
+	now := time.Now()
+
+	if status, _, _ := serveAuth(APIScopeSwitch, signedRequest("partner-a", "yyyy", "POST", "/webhook", now, strings.Repeat("a", 16))); status != http.StatusOK {
+		t.Errorf("body within limit: 200 expected, but got %d", status)
+	}
+	if status, _, _ := serveAuth(APIScopeSwitch, signedRequest("partner-a", "yyyy", "POST", "/webhook", now, strings.Repeat("a", 17))); status != http.StatusUnauthorized {
+		t.Errorf("signed body over limit: 401 expected, but got %d", status)
+	}
+
+	// Basic认证的请求由处理函数读取Body时失败
+	req := httptest.NewRequest("POST", "/webhook", strings.NewReader(strings.Repeat("a", 17)))
+	req.SetBasicAuth("admin", "admin")
+	if status, _, body := serveAuth(APIScopeSwitch, req); status != http.StatusOK || len(body) != 0 {
+		t.Errorf("basic body over limit should not be read, but got %d, %q", status, body)
+	}
+}
+
+func TestAPIAuthScope(t *testing.T) {
+	newAPIKeyTestStore(t)
+
+	for _, c := range []struct {
+		user, password, scope string
+		status                int
+	}{
+		{"dashboard", "xxxx", APIScopeRead, http.StatusOK},
+		{"dashboard", "xxxx", APIScopeSwitch, http.StatusForbidden},
+		{"partner-a", "yyyy", APIScopeSwitch, http.StatusOK},
+		{"admin", "admin", APIScopeSwitch, http.StatusOK},
+		{"dashboard", "yyyy", APIScopeRead, http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/coins", nil)
+		req.SetBasicAuth(c.user, c.password)
+		if status, _, _ := serveAuth(c.scope, req); status != c.status {
+			t.Errorf("%s %s: %d expected, but got %d", c.user, c.scope, c.status, status)
+		}
+	}
+}
+
+func TestAPIKeyCanAccess(t *testing.T) {
+	newAPIKeyTestStore(t)
+
+	for _, c := range []struct {
+		prefix          string
+		caseInsensitive bool
+		puname          string
+		expected        bool
+	}{
+		{"", false, "aaaa", true},
+		{"parta_", false, "parta_aaaa", true},
+		{"parta_", false, "parta_", true},
+		{"parta_", false, "partb_aaaa", false},
+		{"parta_", false, "parta", false},
+		{"parta_", false, "PARTA_aaaa", false},
+		{"parta_", true, "PARTA_aaaa", true},
+		{"PartA_", true, "parta_aaaa", true},
+	} {
+		configData.StratumServerCaseInsensitive = c.caseInsensitive
+		key := &APIKey{PUNamePrefix: c.prefix}
+		if accessible := key.canAccess(c.puname); accessible != c.expected {
+			t.Errorf("prefix %q, case insensitive %v, puname %q: %v expected, but got %v", c.prefix, c.caseInsensitive, c.puname, c.expected, accessible)
+		}
+	}
+}
+
+func TestAPIKeyCanSwitch(t *testing.T) {
+	newAPIKeyTestStore(t)
+
+	readOnly := &APIKey{Scopes: []string{APIScopeRead}}
+	unlimited := &APIKey{Scopes: []string{APIScopeSwitch}}
+	partner := &APIKey{Scopes: []string{APIScopeSwitch}, PUNamePrefix: "parta_", Coins: []string{"btc", "bcc"}}
+
+	for _, c := range []struct {
+		name   string
+		key    *APIKey
+		puname string
+		coin   string
+		err    *APIError
+	}{
+		{"no switch scope", readOnly, "aaaa", "btc", APIErrPermissionDenied},
+		{"unlimited", unlimited, "aaaa", "ltc", nil},
+		{"unlimited weights", unlimited, "aaaa", `{"btc":70,"ltc":30}`, nil},
+		{"allowed coin", partner, "parta_aaaa", "btc", nil},
+		{"coin not allowed", partner, "parta_aaaa", "ltc", APIErrPermissionDenied},
+		{"prefix mismatch", partner, "aaaa", "btc", APIErrPermissionDenied},
+		{"allowed weights", partner, "parta_aaaa", `{"btc":70,"bcc":30}`, nil},
+		{"allowed weights with spaces", partner, "parta_aaaa", ` { "bcc": 1 }`, nil},
+		{"weights with coin not allowed", partner, "parta_aaaa", `{"btc":70,"ltc":30}`, APIErrPermissionDenied},
+		{"weights with prefix mismatch", partner, "aaaa", `{"btc":70,"bcc":30}`, APIErrPermissionDenied},
+		// 无法解析的JSON作为普通币种检查
+		{"invalid weights", partner, "parta_aaaa", `{"btc":70`, APIErrPermissionDenied},
+	} {
+		if err := c.key.canSwitch(c.puname, c.coin); err != c.err {
+			t.Errorf("%s: %v expected, but got %v", c.name, c.err, err)
+		}
+	}
+
+	for _, c := range []struct {
+		name   string
+		key    *APIKey
+		puname string
+		err    *APIError
+	}{
+		{"no switch scope", readOnly, "parta_aaaa", APIErrPermissionDenied},
+		{"prefix mismatch", partner, "aaaa", APIErrPermissionDenied},
+		{"coins not checked", partner, "parta_aaaa", nil},
+	} {
+		if err := c.key.canResetWorker(c.puname); err != c.err {
+			t.Errorf("reset %s: %v expected, but got %v", c.name, c.err, err)
+		}
+	}
+}
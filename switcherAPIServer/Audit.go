@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/btccom/btcpool-go-modules/coordination"
+	"github.com/golang/glog"
+)
+
+// 每个子账户默认保留的切换记录数
+const defaultAuditMaxRecords = 100
+
+// 切换的来源
+const (
+	AuditSourceAPI      = "api"
+	AuditSourceCron     = "cron"
+	AuditSourceSchedule = "schedule"
+	AuditSourceWebhook  = "webhook"
+)
+
+// 请求ID的HTTP头
+const requestIDHeader = "X-Request-ID"
+
+// AuditSource 切换的发起者
+type AuditSource struct {
+	// api、cron、schedule 或 webhook
+	Source string
+	// API Key ID，或计划ID
+	User string
+	// 请求ID，同一请求或同一轮定时任务中的切换具有相同的请求ID
+	RequestID string
+}
+
+// AuditRecord 切换记录
+type AuditRecord struct {
+	Time      int64  `json:"time"`
+	Source    string `json:"source"`
+	User      string `json:"user,omitempty"`
+	PUName    string `json:"puname"`
+	Worker    string `json:"worker,omitempty"`
+	OldCoin   string `json:"old_coin"`
+	Coin      string `json:"coin"`
+	RequestID string `json:"request_id"`
+}
+
+type requestIDKey struct{}
+
+// newRequestID 生成一个随机的请求ID
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// withRequestID 为请求分配请求ID（使用客户端提供的 X-Request-ID，或随机生成），并在响应头中返回
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	requestID := r.Header.Get(requestIDHeader)
+	if len(requestID) < 1 || len(requestID) > 64 {
+		requestID = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, requestID)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID))
+}
+
+// apiAuditSource 由API请求发起的切换
+func apiAuditSource(r *http.Request) AuditSource {
+	requestID, _ := r.Context().Value(requestIDKey{}).(string)
+	return AuditSource{AuditSourceAPI, requestAPIKey(r).ID, requestID}
+}
+
+// auditDir 子账户的切换记录在Zookeeper中的路径
+func auditDir(puname string) string {
+	if configData.StratumServerCaseInsensitive {
+		puname = strings.ToLower(puname)
+	}
+	return configData.ZKAuditDir + puname
+}
+
+// recordSwitch 记录一次成功的切换
+// 切换已经完成，写入记录失败时只记录日志。
+func recordSwitch(source AuditSource, puname string, worker string, oldCoin string, coin string) {
+	if !configData.EnableAudit {
+		return
+	}
+
+	record := AuditRecord{
+		Time:      time.Now().Unix(),
+		Source:    source.Source,
+		User:      source.User,
+		PUName:    puname,
+		Worker:    worker,
+		OldCoin:   oldCoin,
+		Coin:      coin,
+		RequestID: source.RequestID,
+	}
+	data, _ := json.Marshal(record)
+
+	dir := auditDir(puname)
+	_, err := zookeeperConn.Create(dir+"/r-", data, coordination.FlagSequence)
+
+	if err == coordination.ErrNoNode {
+		// 该子账户的第一条记录
+		_, err = zookeeperConn.Create(dir, []byte{}, 0)
+		if err == nil || err == coordination.ErrNodeExists {
+			_, err = zookeeperConn.Create(dir+"/r-", data, coordination.FlagSequence)
+		}
+	}
+
+	if err != nil {
+		glog.Error("Write Audit Record Failed: ", dir, "; ", string(data), "; ", err)
+		return
+	}
+
+	trimAuditRecords(dir)
+}
+
+// trimAuditRecords 只保留最新的 AuditMaxRecords 条记录
+func trimAuditRecords(dir string) {
+	maxRecords := configData.AuditMaxRecords
+	if maxRecords <= 0 {
+		maxRecords = defaultAuditMaxRecords
+	}
+
+	children, _, err := zookeeperConn.Children(dir)
+	if err != nil || len(children) <= maxRecords {
+		return
+	}
+
+	// 顺序节点的序号是定长的，按名称排序即按时间排序
+	sort.Strings(children)
+	for _, child := range children[:len(children)-maxRecords] {
+		err = zookeeperConn.Delete(dir+"/"+child, -1)
+		if err != nil && err != coordination.ErrNoNode {
+			glog.Warning("Delete Audit Record Failed: ", dir, "/", child, "; ", err)
+		}
+	}
+}
+
+// ListSwitchHistory 列出子账户最新的 limit 条切换记录，新的在前
+func ListSwitchHistory(puname string, limit int) ([]AuditRecord, error) {
+	dir := auditDir(puname)
+	children, _, err := zookeeperConn.Children(dir)
+
+	if err == coordination.ErrNoNode {
+		return []AuditRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(children)))
+	if len(children) > limit {
+		children = children[:limit]
+	}
+
+	records := make([]AuditRecord, 0, len(children))
+	for _, child := range children {
+		data, _, err := zookeeperConn.Get(dir + "/" + child)
+		if err == coordination.ErrNoNode {
+			// 刚被删除
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var record AuditRecord
+		err = json.Unmarshal(data, &record)
+		if err != nil {
+			glog.Warning("Parse Audit Record Failed: ", dir, "/", child, "; ", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// historyHandle 查询子账户的切换记录
+func historyHandle(w http.ResponseWriter, req *http.Request) {
+	puname := req.FormValue("puname")
+	if len(puname) < 1 {
+		writeError(w, APIErrPunameIsEmpty.ErrNo, APIErrPunameIsEmpty.ErrMsg)
+		return
+	}
+	if strings.Contains(puname, "/") {
+		writeError(w, APIErrPunameInvalid.ErrNo, APIErrPunameInvalid.ErrMsg)
+		return
+	}
+	if !requestAPIKey(req).canAccess(puname) {
+		writeError(w, APIErrPermissionDenied.ErrNo, APIErrPermissionDenied.ErrMsg)
+		return
+	}
+
+	limit, ok := parsePageParam(req.FormValue("limit"), defaultPageLimit)
+	if !ok || limit < 1 || limit > maxPageLimit {
+		writeError(w, APIErrPageInvalid.ErrNo, APIErrPageInvalid.ErrMsg)
+		return
+	}
+
+	records, err := ListSwitchHistory(puname, limit)
+	if err != nil {
+		glog.Error("List Switch History Failed: ", puname, "; ", err)
+		writeError(w, APIErrReadRecordFailed.ErrNo, APIErrReadRecordFailed.ErrMsg)
+		return
+	}
+
+	writeData(w, records)
+}
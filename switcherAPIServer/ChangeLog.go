@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/btccom/btcpool-go-modules/coordination"
+	"github.com/golang/glog"
+)
+
+// 币种变更日志
+//
+// 开启后，每次修改 ZKSwitcherWatchDir 下的币种节点时，在同一事务中向 ZKChangeLogDir 追加一个顺序节点。
+// stratumSwitcher 只需监控该目录的子节点，而不必为每个子账户设置一个监控。
+
+// 默认保留的变更记录数
+const defaultChangeLogMaxEntries = 10000
+
+// 每追加多少条记录清理一次旧记录
+const changeLogTrimInterval = 100
+
+// 变更记录节点名的前缀
+const changeLogEntryPrefix = "c-"
+
+// ChangeLogEntry 变更记录
+type ChangeLogEntry struct {
+	Time int64 `json:"time"`
+	// 币种节点相对于 ZKSwitcherWatchDir 的名称（子账户名，或 子账户名.矿机名）
+	Name string `json:"name"`
+	Coin string `json:"coin"`
+}
+
+// 自上次清理以来追加的记录数
+var changeLogAppended int64
+
+// changeLogRequest 追加变更记录的操作，zkPath 为币种节点的路径
+func changeLogRequest(zkPath string, coin string) *coordination.CreateRequest {
+	entry := ChangeLogEntry{
+		Time: time.Now().Unix(),
+		Name: strings.TrimPrefix(zkPath, configData.ZKSwitcherWatchDir),
+		Coin: coin,
+	}
+	data, _ := json.Marshal(entry)
+	return &coordination.CreateRequest{Path: configData.ZKChangeLogDir + changeLogEntryPrefix, Data: data, Flags: coordination.FlagSequence}
+}
+
+// deleteCoinNode 删除币种节点，version 为 -1 时不检查版本。开启变更日志时，在同一事务中追加变更记录（coin 为空）
+func deleteCoinNode(zkPath string, version int32) (err error) {
+	if !configData.EnableChangeLog {
+		return zookeeperConn.Delete(zkPath, version)
+	}
+
+	err = zookeeperConn.Multi(&coordination.DeleteRequest{Path: zkPath, Version: version}, changeLogRequest(zkPath, ""))
+	if err == nil {
+		countChangeLogAppends(1)
+	}
+	return
+}
+
+// countChangeLogAppends 记录追加的记录数，每 changeLogTrimInterval 条清理一次旧记录
+func countChangeLogAppends(num int) {
+	appended := atomic.AddInt64(&changeLogAppended, int64(num))
+	if appended >= changeLogTrimInterval && atomic.CompareAndSwapInt64(&changeLogAppended, appended, 0) {
+		go trimChangeLog()
+	}
+}
+
+// trimChangeLog 只保留最新的 ChangeLogMaxEntries 条记录
+// 落后太多的 stratumSwitcher 会发现记录缺失，并重新读取所有子账户节点。
+func trimChangeLog() {
+	maxEntries := configData.ChangeLogMaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultChangeLogMaxEntries
+	}
+
+	dir := strings.TrimSuffix(configData.ZKChangeLogDir, "/")
+	children, _, err := zookeeperConn.Children(dir)
+	if err != nil {
+		glog.Warning("List Change Log Failed: ", dir, "; ", err)
+		return
+	}
+	if len(children) <= maxEntries {
+		return
+	}
+
+	// 顺序节点的序号是定长的，按名称排序即按时间排序
+	sort.Strings(children)
+	for _, child := range children[:len(children)-maxEntries] {
+		err = zookeeperConn.Delete(dir+"/"+child, -1)
+		if err != nil && err != coordination.ErrNoNode {
+			glog.Warning("Delete Change Log Entry Failed: ", dir, "/", child, "; ", err)
+		}
+	}
+}
@@ -74,9 +74,12 @@ func RunCronJob() {
 
 			glog.Info("HTTP GET Success. TimeStamp: ", userCoinMapResponse.Data.NowDate, "; UserCoin Num: ", len(userCoinMapResponse.Data.UserCoin))
 
+			// 同一轮任务中的切换使用相同的请求ID
+			source := AuditSource{AuditSourceCron, "", newRequestID()}
+
 			// 遍历用户币种列表
 			for puname, coin := range userCoinMapResponse.Data.UserCoin {
-				oldCoin, err := changeMiningCoin(puname, coin)
+				oldCoin, err := changeMiningCoin(puname, "", coin, source)
 
 				if err != nil {
 					glog.Info(err.ErrMsg, ": ", puname, ": ", oldCoin, " -> ", coin)
@@ -1,14 +1,14 @@
 package main
 
 import (
-	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"strings"
 
+	"github.com/btccom/btcpool-go-modules/coordination"
 	"github.com/golang/glog"
-	"github.com/samuel/go-zookeeper/zk"
 )
 
 // SwitchUserCoins 欲切换的用户和币种
@@ -20,6 +20,8 @@ type SwitchUserCoins struct {
 // SwitchMultiUserRequest 多用户切换请求数据结构
 type SwitchMultiUserRequest struct {
 	UserCoins []SwitchUserCoins `json:"usercoins"`
+	// 是否全部切换或全部不切换，默认为 true
+	Atomic *bool `json:"atomic"`
 }
 
 // APIResponse API响应数据结构
@@ -29,6 +31,14 @@ type APIResponse struct {
 	Success bool   `json:"success"`
 }
 
+// APIDataResponse 带数据的API响应数据结构
+type APIDataResponse struct {
+	ErrNo   int         `json:"err_no"`
+	ErrMsg  string      `json:"err_msg"`
+	Success bool        `json:"success"`
+	Data    interface{} `json:"data"`
+}
+
 // HTTPRequestHandle HTTP请求处理函数
 type HTTPRequestHandle func(http.ResponseWriter, *http.Request)
 
@@ -39,8 +49,28 @@ func runAPIServer() {
 	// HTTP监听
 	glog.Info("Listen HTTP ", configData.ListenAddr)
 
-	http.HandleFunc("/switch", basicAuth(switchHandle))
-	http.HandleFunc("/switch-multi-user", basicAuth(switchMultiUserHandle))
+	http.HandleFunc("/switch", apiAuth(APIScopeSwitch, switchHandle))
+	http.HandleFunc("/switch/reset", apiAuth(APIScopeSwitch, resetWorkerCoinHandle))
+	http.HandleFunc("/switch-multi-user", apiAuth(APIScopeSwitch, switchMultiUserHandle))
+
+	if configData.EnableScheduler {
+		http.HandleFunc("/schedules", apiAuth(APIScopeRead, listSchedulesHandle))
+		http.HandleFunc("/schedules/add", apiAuth(APIScopeSwitch, addScheduleHandle))
+		http.HandleFunc("/schedules/delete", apiAuth(APIScopeSwitch, deleteScheduleHandle))
+	}
+
+	http.HandleFunc("/coin", apiAuth(APIScopeRead, getCoinHandle))
+	http.HandleFunc("/coins", apiAuth(APIScopeRead, listCoinsHandle))
+	http.HandleFunc("/coins/stats", apiAuth(APIScopeRead, coinStatsHandle))
+	http.HandleFunc("/available-coins", apiAuth(APIScopeRead, availableCoinsHandle))
+
+	if configData.EnableAudit {
+		http.HandleFunc("/history", apiAuth(APIScopeRead, historyHandle))
+	}
+
+	if configData.EnableWebhook {
+		http.HandleFunc("/webhook", apiAuth(APIScopeSwitch, webhookHandle))
+	}
 
 	err := http.ListenAndServe(configData.ListenAddr, nil)
 
@@ -50,37 +80,46 @@ func runAPIServer() {
 	}
 }
 
-// basicAuth 执行Basic认证
-func basicAuth(f HTTPRequestHandle) HTTPRequestHandle {
-	return func(w http.ResponseWriter, r *http.Request) {
-		apiUser := []byte(configData.APIUser)
-		apiPasswd := []byte(configData.APIPassword)
+// switchHandle 处理币种切换请求
+func switchHandle(w http.ResponseWriter, req *http.Request) {
+	puname := req.FormValue("puname")
+	worker := req.FormValue("worker")
+	coin := req.FormValue("coin")
 
-		user, passwd, ok := r.BasicAuth()
+	if err := requestAPIKey(req).canSwitch(puname, coin); err != nil {
+		glog.Info(err, ": ", requestAPIKey(req).ID, "; ", req.RequestURI)
+		writeError(w, err.ErrNo, err.ErrMsg)
+		return
+	}
 
-		// 检查用户名密码是否正确
-		if ok && subtle.ConstantTimeCompare(apiUser, []byte(user)) == 1 && subtle.ConstantTimeCompare(apiPasswd, []byte(passwd)) == 1 {
-			// 执行被装饰的函数
-			f(w, r)
-			return
-		}
+	oldCoin, err := changeMiningCoin(puname, worker, coin, apiAuditSource(req))
 
-		// 认证失败，提示 401 Unauthorized
-		// Restricted 可以改成其他的值
-		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-		// 401 状态码
-		w.WriteHeader(http.StatusUnauthorized)
-		// 401 页面
-		w.Write([]byte(`<h1>401 - Unauthorized</h1>`))
+	if err != nil {
+		glog.Info(err, ": ", req.RequestURI)
+		writeError(w, err.ErrNo, err.ErrMsg)
+		return
 	}
+
+	if len(worker) > 0 {
+		glog.Info("[single-switch] ", puname, ".", worker, ": ", oldCoin, " -> ", coin)
+	} else {
+		glog.Info("[single-switch] ", puname, ": ", oldCoin, " -> ", coin)
+	}
+	writeSuccess(w)
 }
 
-// switchHandle 处理币种切换请求
-func switchHandle(w http.ResponseWriter, req *http.Request) {
+// resetWorkerCoinHandle 处理删除矿工币种的请求
+func resetWorkerCoinHandle(w http.ResponseWriter, req *http.Request) {
 	puname := req.FormValue("puname")
-	coin := req.FormValue("coin")
+	worker := req.FormValue("worker")
+
+	if err := requestAPIKey(req).canResetWorker(puname); err != nil {
+		glog.Info(err, ": ", requestAPIKey(req).ID, "; ", req.RequestURI)
+		writeError(w, err.ErrNo, err.ErrMsg)
+		return
+	}
 
-	oldCoin, err := changeMiningCoin(puname, coin)
+	oldCoin, err := resetWorkerCoin(puname, worker, apiAuditSource(req))
 
 	if err != nil {
 		glog.Info(err, ": ", req.RequestURI)
@@ -88,7 +127,7 @@ func switchHandle(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	glog.Info("[single-switch] ", puname, ": ", oldCoin, " -> ", coin)
+	glog.Info("[single-reset] ", puname, ".", worker, ": ", oldCoin, " -> (subaccount)")
 	writeSuccess(w)
 }
 
@@ -118,23 +157,26 @@ func switchMultiUserHandle(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	for _, usercoin := range reqData.UserCoins {
-		coin := usercoin.Coin
-
-		for _, puname := range usercoin.PUNames {
-			oldCoin, err := changeMiningCoin(puname, coin)
-
-			if err != nil {
-				glog.Info(err, ": ", req.RequestURI, " {puname=", puname, ", coin=", coin, "}")
-				writeError(w, err.ErrNo, err.ErrMsg)
-				return
-			}
+	// 先检查所有子账户和币种
+	results, apiErr := checkSwitchResults(reqData.UserCoins, requestAPIKey(req))
 
-			glog.Info("[multi-switch] ", puname, ": ", oldCoin, " -> ", coin)
+	if reqData.Atomic == nil || *reqData.Atomic {
+		// 任一检查失败则都不切换
+		if apiErr == nil {
+			apiErr = changeMiningCoinsAtomic(results, apiAuditSource(req))
 		}
+	} else {
+		// 切换检查通过的子账户
+		apiErr = changeMiningCoins(results, apiAuditSource(req))
 	}
 
-	writeSuccess(w)
+	if apiErr != nil {
+		glog.Info(apiErr, ": ", req.RequestURI)
+		writeErrorData(w, apiErr.ErrNo, apiErr.ErrMsg, results)
+		return
+	}
+
+	writeData(w, results)
 }
 
 func writeSuccess(w http.ResponseWriter) {
@@ -144,6 +186,13 @@ func writeSuccess(w http.ResponseWriter) {
 	w.Write(responseJSON)
 }
 
+func writeData(w http.ResponseWriter, data interface{}) {
+	response := APIDataResponse{0, "", true, data}
+	responseJSON, _ := json.Marshal(response)
+
+	w.Write(responseJSON)
+}
+
 func writeError(w http.ResponseWriter, errNo int, errMsg string) {
 	response := APIResponse{errNo, errMsg, false}
 	responseJSON, _ := json.Marshal(response)
@@ -151,97 +200,226 @@ func writeError(w http.ResponseWriter, errNo int, errMsg string) {
 	w.Write(responseJSON)
 }
 
-func changeMiningCoin(puname string, coin string) (oldCoin string, apiErr *APIError) {
-	oldCoin = ""
+func writeErrorData(w http.ResponseWriter, errNo int, errMsg string, data interface{}) {
+	response := APIDataResponse{errNo, errMsg, false, data}
+	responseJSON, _ := json.Marshal(response)
 
+	w.Write(responseJSON)
+}
+
+// checkSwitchParams 检查切换币种的参数
+func checkSwitchParams(puname string, worker string, coin string) *APIError {
+	if apiErr := checkNodeName(puname, worker); apiErr != nil {
+		return apiErr
+	}
+
+	if len(coin) < 1 {
+		return APIErrCoinIsEmpty
+	}
+
+	// 检查币种是否存在
+	return checkCoinSpec(coin)
+}
+
+// checkNodeName 检查子账户名和矿机名能否作为Zookeeper节点名
+func checkNodeName(puname string, worker string) *APIError {
 	if len(puname) < 1 {
-		apiErr = APIErrPunameIsEmpty
-		return
+		return APIErrPunameIsEmpty
 	}
 
 	if strings.Contains(puname, "/") {
-		apiErr = APIErrPunameInvalid
-		return
+		return APIErrPunameInvalid
 	}
 
-	if len(coin) < 1 {
-		apiErr = APIErrCoinIsEmpty
+	if strings.Contains(worker, "/") {
+		return APIErrWorkerInvalid
+	}
+
+	return nil
+}
+
+// 币种节点被并发修改后的重试次数
+const changeMiningCoinMaxRetries = 5
+
+// errSkipCoinWrite changeMiningCoinWith 的 prepare 返回该错误时放弃写入
+var errSkipCoinWrite = errors.New("skip writing coin node")
+
+// changeMiningCoin 修改子账户的币种，worker 不为空时修改该矿工的币种
+// 修改成功后以 source 为发起者写入切换记录
+func changeMiningCoin(puname string, worker string, coin string, source AuditSource) (oldCoin string, apiErr *APIError) {
+	oldCoin, _, apiErr = changeMiningCoinWith(puname, worker, coin, source, nil)
+	return
+}
+
+// changeMiningCoinWith 与 changeMiningCoin 相同，prepare 不为空时在每次写入前调用，
+// 返回需要与币种节点在同一事务中执行的其他操作（应当带有读取时的版本，如推送事件的游标）。
+// prepare 返回 errSkipCoinWrite 时放弃写入，此时 changed 为 false 且 apiErr 为 nil。
+//
+// 币种节点带有读取时的版本，开启变更日志时在同一事务中追加变更记录。
+// 事务中的节点被其他请求修改时重新读取并重试，事务失败时什么都不会改变。
+func changeMiningCoinWith(puname string, worker string, coin string, source AuditSource, prepare func() ([]interface{}, error)) (oldCoin string, changed bool, apiErr *APIError) {
+	apiErr = checkSwitchParams(puname, worker, coin)
+
+	if apiErr != nil {
 		return
 	}
 
-	// 检查币种是否存在
-	exists := false
+	// stratumSwitcher 监控的键
+	zkPath := coinNodePath(puname, worker)
+
+	for retry := 0; retry < changeMiningCoinMaxRetries; retry++ {
+		var ops []interface{}
+		if prepare != nil {
+			var err error
+			ops, err = prepare()
+			if err == errSkipCoinWrite {
+				return "", false, nil
+			}
+			if err != nil {
+				glog.Error("Prepare Writing ", zkPath, " Failed: ", err)
+				return "", false, APIErrReadRecordFailed
+			}
+		}
 
-	for _, availableCoin := range configData.AvailableCoins {
-		if availableCoin == coin {
-			exists = true
-			break
+		// 读取zookeeper看看原来的值是多少，不存在时直接创建
+		// 没有改变也照常写入，这样一来，如果stratumSwitcher错过了前一个切换消息，可以再收到一次切换消息以完成切换
+		// 在stratumSwitcher那里，如果币种确实没有发生改变，切换就不会发生
+		data, stat, err := zookeeperConn.Get(zkPath)
+		if err == coordination.ErrNoNode {
+			oldCoin = ""
+			ops = append(ops, &coordination.CreateRequest{Path: zkPath, Data: []byte(coin)})
+		} else if err != nil {
+			glog.Error("zk.Get(", zkPath, ") Failed: ", err)
+			return "", false, APIErrReadRecordFailed
+		} else {
+			oldCoin = string(data)
+			ops = append(ops, &coordination.SetDataRequest{Path: zkPath, Data: []byte(coin), Version: stat.Version})
+		}
+
+		if configData.EnableChangeLog {
+			ops = append(ops, changeLogRequest(zkPath, coin))
+		}
+
+		err = zookeeperConn.Multi(ops...)
+
+		if err == coordination.ErrBadVersion || err == coordination.ErrNodeExists || err == coordination.ErrNoNode {
+			glog.Warning("zk.Multi() Conflicted, Retry: ", zkPath, "; ", err)
+			continue
+		}
+		if err != nil {
+			glog.Error("zk.Multi(", zkPath, ",", coin, ") Failed: ", err)
+			return "", false, APIErrWriteRecordFailed
 		}
+
+		if configData.EnableChangeLog {
+			countChangeLogAppends(1)
+		}
+		recordSwitch(source, puname, worker, oldCoin, coin)
+		return oldCoin, true, nil
 	}
 
-	if !exists {
-		apiErr = APIErrCoinIsInexistent
-		return
+	glog.Error("Change Mining Coin Conflicted: ", zkPath)
+	return "", false, APIErrSwitchConflict
+}
+
+// resetWorkerCoin 删除矿工的币种节点，使矿工恢复跟随子账户的币种
+// 节点不存在时直接返回成功，不写入切换记录。删除成功后以 source 为发起者写入切换记录（新币种为空）
+func resetWorkerCoin(puname string, worker string, source AuditSource) (oldCoin string, apiErr *APIError) {
+	if len(worker) < 1 {
+		return "", APIErrWorkerIsEmpty
 	}
 
-	if configData.StratumServerCaseInsensitive {
-		// stratum server对子账户名大小写不敏感
-		// 简单的将子账户名转换为小写即可
-		puname = strings.ToLower(puname)
+	apiErr = checkNodeName(puname, worker)
+	if apiErr != nil {
+		return
 	}
 
-	// stratumSwitcher 监控的键
-	zkPath := configData.ZKSwitcherWatchDir + puname
+	zkPath := coinNodePath(puname, worker)
+
+	oldCoinData, stat, err := zookeeperConn.Get(zkPath)
 
-	// 看看键是否存在
-	exists, _, err := zookeeperConn.Exists(zkPath)
+	if err == coordination.ErrNoNode {
+		return
+	}
 
 	if err != nil {
-		glog.Error("zk.Exists(", zkPath, ") Failed: ", err)
+		glog.Error("zk.Get(", zkPath, ") Failed: ", err)
 		apiErr = APIErrReadRecordFailed
 		return
 	}
 
-	if exists {
-		// 读取zookeeper看看原来的值是多少
-		oldCoinData, _, err := zookeeperConn.Get(zkPath)
+	oldCoin = string(oldCoinData)
 
-		if err != nil {
-			glog.Error("zk.Get(", zkPath, ") Failed: ", err)
-			apiErr = APIErrReadRecordFailed
-			return
+	// 检查版本，以免删除读取后被修改的节点
+	err = deleteCoinNode(zkPath, stat.Version)
+
+	if err == coordination.ErrNoNode {
+		// 已被其他请求删除
+		return
+	}
+
+	if err != nil {
+		glog.Error("zk.Delete(", zkPath, ") Failed: ", err)
+		if err == coordination.ErrBadVersion {
+			apiErr = APIErrSwitchConflict
+		} else {
+			apiErr = APIErrWriteRecordFailed
 		}
+		return
+	}
 
-		oldCoin = string(oldCoinData)
+	recordSwitch(source, puname, worker, oldCoin, "")
+	return
+}
 
-		// 没有改变
-		// 没有改变不再返回错误，这样一来，如果stratumSwitcher错过了前一个切换消息，可以再收到一次切换消息以完成切换
-		// 在stratumSwitcher那里，如果币种确实没有发生改变，切换就不会发生
-		/*if oldCoin == coin {
-			apiErr = APIErrCoinNoChange
-			return
-		}*/
+// coinNodePath 子账户或矿工的币种在Zookeeper中的路径
+func coinNodePath(puname string, worker string) string {
+	if configData.StratumServerCaseInsensitive {
+		// stratum server对子账户名大小写不敏感
+		// 简单的将子账户名转换为小写即可
+		puname = strings.ToLower(puname)
+	}
 
-		// 写入新值
-		_, err = zookeeperConn.Set(zkPath, []byte(coin), -1)
+	zkPath := configData.ZKSwitcherWatchDir + puname
+	if len(worker) > 0 {
+		// 矿工级别的键，与矿工名相同（stratumSwitcher 需开启 EnableWorkerCoinRouting）
+		zkPath += "." + worker
+	}
+	return zkPath
+}
 
-		if err != nil {
-			glog.Error("zk.Set(", zkPath, ",", coin, ") Failed: ", err)
-			apiErr = APIErrWriteRecordFailed
-			return
+// isAvailableCoin 检查币种是否在可用币种列表中
+func isAvailableCoin(coin string) bool {
+	for _, availableCoin := range configData.AvailableCoins {
+		if availableCoin == coin {
+			return true
 		}
+	}
+	return false
+}
 
-	} else {
-		// 不存在，直接创建
-		_, err = zookeeperConn.Create(zkPath, []byte(coin), 0, zk.WorldACL(zk.PermAll))
-
-		if err != nil {
-			glog.Error("zk.Create(", zkPath, ",", coin, ") Failed: ", err)
-			apiErr = APIErrWriteRecordFailed
-			return
+// checkCoinSpec 检查币种，或按比例分配的币种（币种到权重的JSON对象，如 {"btc":70,"bch":30}）
+func checkCoinSpec(coin string) *APIError {
+	if !strings.HasPrefix(strings.TrimSpace(coin), "{") {
+		if !isAvailableCoin(coin) {
+			return APIErrCoinIsInexistent
 		}
+		return nil
 	}
 
-	apiErr = nil
-	return
+	var weights map[string]float64
+	err := json.Unmarshal([]byte(coin), &weights)
+	if err != nil || len(weights) < 1 {
+		return APIErrCoinWeightsInvalid
+	}
+
+	for weightedCoin, weight := range weights {
+		if weight <= 0 {
+			return APIErrCoinWeightsInvalid
+		}
+		if !isAvailableCoin(weightedCoin) {
+			return APIErrCoinIsInexistent
+		}
+	}
+	return nil
 }
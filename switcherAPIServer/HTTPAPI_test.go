@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/btccom/btcpool-go-modules/coordination"
+)
+
+func TestResetWorkerCoin(t *testing.T) {
+	newTestStore(t)
+	configData.EnableChangeLog = true
+	configData.EnableAudit = true
+	source := AuditSource{AuditSourceAPI, "admin", "test"}
+
+	if _, apiErr := changeMiningCoin("aaaa", "", "btc", source); apiErr != nil {
+		t.Fatal("switch failed: ", apiErr)
+	}
+	if _, apiErr := changeMiningCoin("aaaa", "rig01", "bcc", source); apiErr != nil {
+		t.Fatal("switch failed: ", apiErr)
+	}
+
+	for _, c := range []struct {
+		puname, worker string
+		err            *APIError
+	}{
+		{"aaaa", "", APIErrWorkerIsEmpty},
+		{"", "rig01", APIErrPunameIsEmpty},
+		{"aa/aa", "rig01", APIErrPunameInvalid},
+		{"aaaa", "rig/01", APIErrWorkerInvalid},
+	} {
+		if _, apiErr := resetWorkerCoin(c.puname, c.worker, source); apiErr != c.err {
+			t.Errorf("reset %q.%q: %v expected, but got %v", c.puname, c.worker, c.err, apiErr)
+		}
+	}
+
+	oldCoin, apiErr := resetWorkerCoin("aaaa", "rig01", source)
+	if apiErr != nil || oldCoin != "bcc" {
+		t.Fatalf("reset failed: %q, %v", oldCoin, apiErr)
+	}
+	if exists, _, _ := zookeeperConn.Exists(coinNodePath("aaaa", "rig01")); exists {
+		t.Error("worker node should be deleted")
+	}
+	if coin := readCoinNode(t, "aaaa", ""); coin != "btc" {
+		t.Errorf("subaccount node should not change, but got %q", coin)
+	}
+
+	// 删除写入了变更记录和切换记录
+	entries, _, _ := zookeeperConn.Children(strings.TrimSuffix(configData.ZKChangeLogDir, "/"))
+	if len(entries) != 3 {
+		t.Fatalf("3 change log entries expected, but got %v", entries)
+	}
+	data, _, _ := zookeeperConn.Get(configData.ZKChangeLogDir + entries[len(entries)-1])
+	var entry ChangeLogEntry
+	if json.Unmarshal(data, &entry) != nil || entry.Name != "aaaa.rig01" || entry.Coin != "" {
+		t.Errorf("unexpected change log entry: %s", data)
+	}
+	records, err := ListSwitchHistory("aaaa", 10)
+	if err != nil || len(records) != 3 || records[0].Worker != "rig01" || records[0].OldCoin != "bcc" || records[0].Coin != "" {
+		t.Errorf("unexpected audit records: %+v, %v", records, err)
+	}
+
+	// 节点不存在时返回成功，不写入记录
+	if oldCoin, apiErr := resetWorkerCoin("aaaa", "rig01", source); apiErr != nil || oldCoin != "" {
+		t.Errorf("reset inexistent node: %q, %v", oldCoin, apiErr)
+	}
+	if records, _ := ListSwitchHistory("aaaa", 10); len(records) != 3 {
+		t.Errorf("no audit record expected, but got %+v", records)
+	}
+	if _, _, err := zookeeperConn.Get(coinNodePath("aaaa", "")); err == coordination.ErrNoNode {
+		t.Error("subaccount node should not be deleted")
+	}
+}
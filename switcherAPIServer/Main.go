@@ -7,12 +7,12 @@ import (
 	"sync"
 	"time"
 
+	"github.com/btccom/btcpool-go-modules/coordination"
 	"github.com/golang/glog"
-	"github.com/samuel/go-zookeeper/zk"
 )
 
-// Zookeeper连接超时时间
-const zookeeperConnTimeout = 5
+// 协调服务连接超时时间（秒）
+const zookeeperConnectingTimeout = 60
 
 // ConfigData 配置数据
 type ConfigData struct {
@@ -22,17 +22,32 @@ type ConfigData struct {
 	APIUser string
 	// API 密码
 	APIPassword string
+	// 其他API Key
+	APIKeys []APIKey
+	// 保存API Key的Zookeeper路径（为空时只使用配置文件中的Key）
+	ZKAPIKeyDir string
+	// 重新加载API Key的间隔时间
+	APIKeyReloadSeconds int
 	// API Server 的监听IP:端口
 	ListenAddr string
+	// 请求Body的最大长度（字节）
+	APIMaxBodyBytes int64
 
 	// AvailableCoins 可用币种，形如 {"btc", "bcc", ...}
 	AvailableCoins []string
 
-	// Zookeeper集群的IP:端口列表
+	// 协调服务后端：zookeeper（默认）、etcd、memory
+	CoordinationBackend string
+	// Zookeeper（或所选协调服务）集群的IP:端口列表
 	ZKBroker []string
 	// ZKSwitcherWatchDir Switcher监控的Zookeeper路径，以斜杠结尾
 	ZKSwitcherWatchDir string
 
+	// 币种统计（/coins/stats）的缓存有效期
+	CoinStatsCacheSeconds int
+	// 币种统计每秒最多处理的请求数
+	CoinStatsRequestsPerSecond int
+
 	// 是否启用定时检测任务
 	EnableCronJob bool
 	// 定时检测间隔时间
@@ -41,45 +56,85 @@ type ConfigData struct {
 	UserCoinMapURL string
 	// 挖矿服务器对子账户名大小写不敏感，此时将总是写入小写的子账户名
 	StratumServerCaseInsensitive bool
+
+	// 是否启用定时切换计划
+	EnableScheduler bool
+	// 保存计划和调度器选主的Zookeeper路径，以斜杠结尾
+	ZKScheduleDir string
+	// 调度器检查计划的间隔时间
+	SchedulerIntervalSeconds int
+
+	// 是否记录切换历史
+	EnableAudit bool
+	// 保存切换记录的Zookeeper路径，以斜杠结尾
+	ZKAuditDir string
+	// 每个子账户保留的切换记录数
+	AuditMaxRecords int
+
+	// 是否接收用户中心推送的切换事件
+	EnableWebhook bool
+	// 保存各子账户已处理事件序号的Zookeeper路径，以斜杠结尾
+	ZKWebhookDir string
+
+	// 是否写入币种变更日志（供 stratumSwitcher 以变更日志模式监控）
+	EnableChangeLog bool
+	// 保存变更日志的Zookeeper路径，以斜杠结尾
+	ZKChangeLogDir string
+	// 保留的变更记录数
+	ChangeLogMaxEntries int
 }
 
-// zookeeperConn Zookeeper连接对象
-var zookeeperConn *zk.Conn
+// zookeeperConn 协调服务（Zookeeper、etcd等）连接对象
+var zookeeperConn coordination.Backend
 
 // 配置数据
 var configData *ConfigData
 
+// 配置文件路径
+var configFilePath string
+
 // 用于等待goroutine结束
 var waitGroup sync.WaitGroup
 
+// readConfig 读取配置文件
+func readConfig(path string) (*ConfigData, error) {
+	configJSON, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(ConfigData)
+	err = json.Unmarshal(configJSON, config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
 func main() {
 	// 解析命令行参数
-	configFilePath := flag.String("config", "./config.json", "Path of config file")
+	flag.StringVar(&configFilePath, "config", "./config.json", "Path of config file")
 	flag.Parse()
 
 	// 读取配置文件
-	configJSON, err := ioutil.ReadFile(*configFilePath)
+	var err error
+	configData, err = readConfig(configFilePath)
 
 	if err != nil {
 		glog.Fatal("read config failed: ", err)
 		return
 	}
 
-	configData = new(ConfigData)
-	err = json.Unmarshal(configJSON, configData)
-
-	if err != nil {
-		glog.Fatal("parse config failed: ", err)
-		return
-	}
-
 	// 若zookeeper路径不以“/”结尾，则添加
 	if configData.ZKSwitcherWatchDir[len(configData.ZKSwitcherWatchDir)-1] != '/' {
 		configData.ZKSwitcherWatchDir += "/"
 	}
 
-	// 建立到Zookeeper集群的连接
-	conn, _, err := zk.Connect(configData.ZKBroker, time.Duration(zookeeperConnTimeout)*time.Second)
+	// 建立到Zookeeper（或所选协调服务）集群的连接
+	conn, err := coordination.Connect(configData.CoordinationBackend, configData.ZKBroker, zookeeperConnectingTimeout*time.Second)
 
 	if err != nil {
 		glog.Fatal("Connect Zookeeper Failed: ", err)
@@ -96,7 +151,97 @@ func main() {
 		return
 	}
 
+	if configData.EnableAudit {
+		if len(configData.ZKAuditDir) < 1 {
+			glog.Fatal("ZKAuditDir is empty")
+			return
+		}
+		if configData.ZKAuditDir[len(configData.ZKAuditDir)-1] != '/' {
+			configData.ZKAuditDir += "/"
+		}
+
+		// 检查并创建保存切换记录的Zookeeper路径
+		err = createZookeeperPath(configData.ZKAuditDir)
+
+		if err != nil {
+			glog.Fatal("Create Zookeeper Path Failed: ", err)
+			return
+		}
+	}
+
+	if configData.EnableWebhook {
+		if len(configData.ZKWebhookDir) < 1 {
+			glog.Fatal("ZKWebhookDir is empty")
+			return
+		}
+		if configData.ZKWebhookDir[len(configData.ZKWebhookDir)-1] != '/' {
+			configData.ZKWebhookDir += "/"
+		}
+
+		// 检查并创建保存事件序号的Zookeeper路径
+		err = createZookeeperPath(configData.ZKWebhookDir)
+
+		if err != nil {
+			glog.Fatal("Create Zookeeper Path Failed: ", err)
+			return
+		}
+	}
+
+	if configData.EnableChangeLog {
+		if len(configData.ZKChangeLogDir) < 1 {
+			glog.Fatal("ZKChangeLogDir is empty")
+			return
+		}
+		if configData.ZKChangeLogDir[len(configData.ZKChangeLogDir)-1] != '/' {
+			configData.ZKChangeLogDir += "/"
+		}
+
+		// 检查并创建保存变更日志的Zookeeper路径
+		err = createZookeeperPath(configData.ZKChangeLogDir)
+
+		if err != nil {
+			glog.Fatal("Create Zookeeper Path Failed: ", err)
+			return
+		}
+	}
+
+	if configData.EnableScheduler {
+		if len(configData.ZKScheduleDir) < 1 {
+			glog.Fatal("ZKScheduleDir is empty")
+			return
+		}
+		if configData.ZKScheduleDir[len(configData.ZKScheduleDir)-1] != '/' {
+			configData.ZKScheduleDir += "/"
+		}
+
+		// 检查并创建保存计划和选主的Zookeeper路径
+		for _, path := range []string{scheduleNodeDir(), scheduleElectionDir()} {
+			err = createZookeeperPath(path)
+
+			if err != nil {
+				glog.Fatal("Create Zookeeper Path Failed: ", err)
+				return
+			}
+		}
+
+		waitGroup.Add(1)
+		go RunScheduler()
+	}
+
 	if configData.EnableAPIServer {
+		if len(configData.ZKAPIKeyDir) > 0 {
+			// 检查并创建保存API Key的Zookeeper路径
+			err = createZookeeperPath(configData.ZKAPIKeyDir)
+
+			if err != nil {
+				glog.Fatal("Create Zookeeper Path Failed: ", err)
+				return
+			}
+		}
+
+		loadAPIKeys()
+		go RunAPIKeyReloader()
+
 		waitGroup.Add(1)
 		go runAPIServer()
 	}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btccom/btcpool-go-modules/coordination"
+	"github.com/golang/glog"
+)
+
+// 分页查询的默认及最大条数
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// 币种统计缓存的默认有效期
+const defaultCoinStatsCacheSeconds = 30
+
+// 币种统计接口默认每秒最多处理的请求数
+const defaultCoinStatsRequestsPerSecond = 5
+
+// CoinRecord 子账户或矿工的币种
+type CoinRecord struct {
+	PUName string `json:"puname"`
+	Worker string `json:"worker,omitempty"`
+	Coin   string `json:"coin"`
+}
+
+// CoinListData 子账户币种列表
+type CoinListData struct {
+	Total  int          `json:"total"`
+	Offset int          `json:"offset"`
+	Limit  int          `json:"limit"`
+	Items  []CoinRecord `json:"items"`
+}
+
+// parsePageParam 解析分页参数，参数为空时使用默认值
+func parsePageParam(value string, defaultValue int) (int, bool) {
+	if len(value) < 1 {
+		return defaultValue, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// listPUNames 列出 key 可以访问的所有子账户节点（按名称排序，不含矿工节点）
+func listPUNames(key *APIKey) ([]string, error) {
+	children, _, err := zookeeperConn.Children(strings.TrimSuffix(configData.ZKSwitcherWatchDir, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	// 子账户名中不含“.”，含“.”的是矿工节点（子账户名.矿机名）
+	punames := make([]string, 0, len(children))
+	for _, child := range children {
+		if !strings.Contains(child, ".") && key.canAccess(child) {
+			punames = append(punames, child)
+		}
+	}
+	sort.Strings(punames)
+	return punames, nil
+}
+
+// getCoinHandle 查询子账户或矿工当前的币种
+func getCoinHandle(w http.ResponseWriter, req *http.Request) {
+	puname := req.FormValue("puname")
+	worker := req.FormValue("worker")
+
+	if len(puname) < 1 {
+		writeError(w, APIErrPunameIsEmpty.ErrNo, APIErrPunameIsEmpty.ErrMsg)
+		return
+	}
+	if strings.Contains(puname, "/") {
+		writeError(w, APIErrPunameInvalid.ErrNo, APIErrPunameInvalid.ErrMsg)
+		return
+	}
+	if strings.Contains(worker, "/") {
+		writeError(w, APIErrWorkerInvalid.ErrNo, APIErrWorkerInvalid.ErrMsg)
+		return
+	}
+	if !requestAPIKey(req).canAccess(puname) {
+		writeError(w, APIErrPermissionDenied.ErrNo, APIErrPermissionDenied.ErrMsg)
+		return
+	}
+
+	zkPath := coinNodePath(puname, worker)
+	coin, _, err := zookeeperConn.Get(zkPath)
+
+	if err == coordination.ErrNoNode {
+		writeError(w, APIErrRecordNotFound.ErrNo, APIErrRecordNotFound.ErrMsg)
+		return
+	}
+	if err != nil {
+		glog.Error("zk.Get(", zkPath, ") Failed: ", err)
+		writeError(w, APIErrReadRecordFailed.ErrNo, APIErrReadRecordFailed.ErrMsg)
+		return
+	}
+
+	writeData(w, CoinRecord{puname, worker, string(coin)})
+}
+
+// listCoinsHandle 分页列出所有子账户及其币种
+func listCoinsHandle(w http.ResponseWriter, req *http.Request) {
+	offset, offsetOK := parsePageParam(req.FormValue("offset"), 0)
+	limit, limitOK := parsePageParam(req.FormValue("limit"), defaultPageLimit)
+	if !offsetOK || !limitOK || limit < 1 || limit > maxPageLimit {
+		writeError(w, APIErrPageInvalid.ErrNo, APIErrPageInvalid.ErrMsg)
+		return
+	}
+
+	punames, err := listPUNames(requestAPIKey(req))
+	if err != nil {
+		glog.Error("List PUNames Failed: ", err)
+		writeError(w, APIErrReadRecordFailed.ErrNo, APIErrReadRecordFailed.ErrMsg)
+		return
+	}
+
+	data := CoinListData{Total: len(punames), Offset: offset, Limit: limit, Items: []CoinRecord{}}
+	if offset < len(punames) {
+		punames = punames[offset:]
+		if len(punames) > limit {
+			punames = punames[:limit]
+		}
+
+		for _, puname := range punames {
+			coin, _, err := zookeeperConn.Get(configData.ZKSwitcherWatchDir + puname)
+			if err == coordination.ErrNoNode {
+				// 刚被删除
+				continue
+			}
+			if err != nil {
+				glog.Error("zk.Get(", configData.ZKSwitcherWatchDir+puname, ") Failed: ", err)
+				writeError(w, APIErrReadRecordFailed.ErrNo, APIErrReadRecordFailed.ErrMsg)
+				return
+			}
+			data.Items = append(data.Items, CoinRecord{PUName: puname, Coin: string(coin)})
+		}
+	}
+
+	writeData(w, data)
+}
+
+// coinStatsCache 所有子账户币种的缓存
+// 统计需要读取所有子账户节点，有效期内的请求只使用缓存，同时只有一个请求读取Zookeeper。
+type coinStatsCache struct {
+	lock sync.Mutex
+	// 子账户名到币种
+	coins     map[string]string
+	updatedAt time.Time
+
+	// 限流：当前一秒的开始时间及其中已处理的请求数（刷新缓存时不阻塞限流）
+	limitLock      sync.Mutex
+	windowStart    time.Time
+	windowRequests int
+}
+
+var coinStats coinStatsCache
+
+// allow 是否处理本次请求，每秒最多处理 CoinStatsRequestsPerSecond 个请求
+func (cache *coinStatsCache) allow(now time.Time) bool {
+	limit := configData.CoinStatsRequestsPerSecond
+	if limit <= 0 {
+		limit = defaultCoinStatsRequestsPerSecond
+	}
+
+	cache.limitLock.Lock()
+	defer cache.limitLock.Unlock()
+
+	if now.Sub(cache.windowStart) >= time.Second || now.Before(cache.windowStart) {
+		cache.windowStart = now
+		cache.windowRequests = 0
+	}
+	if cache.windowRequests >= limit {
+		return false
+	}
+	cache.windowRequests++
+	return true
+}
+
+// get 获取所有子账户的币种，缓存超过 CoinStatsCacheSeconds 时重新读取
+func (cache *coinStatsCache) get(now time.Time) (map[string]string, error) {
+	ttl := time.Duration(configData.CoinStatsCacheSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = defaultCoinStatsCacheSeconds * time.Second
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if cache.coins != nil && now.Sub(cache.updatedAt) < ttl && !now.Before(cache.updatedAt) {
+		return cache.coins, nil
+	}
+
+	// 不限制子账户名前缀，按请求的Key过滤
+	punames, err := listPUNames(&APIKey{})
+	if err != nil {
+		return nil, err
+	}
+
+	coins := make(map[string]string, len(punames))
+	for _, puname := range punames {
+		coin, _, err := zookeeperConn.Get(configData.ZKSwitcherWatchDir + puname)
+		if err == coordination.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			glog.Error("zk.Get(", configData.ZKSwitcherWatchDir+puname, ") Failed: ", err)
+			return nil, err
+		}
+		coins[puname] = string(coin)
+	}
+
+	cache.coins = coins
+	cache.updatedAt = now
+	return coins, nil
+}
+
+// coinStatsHandle 统计各币种的子账户数
+// 按比例分配的子账户以其原始值（JSON对象）为键单独统计
+func coinStatsHandle(w http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	if !coinStats.allow(now) {
+		writeError(w, APIErrTooManyRequests.ErrNo, APIErrTooManyRequests.ErrMsg)
+		return
+	}
+
+	coins, err := coinStats.get(now)
+	if err != nil {
+		glog.Error("Read Coin Stats Failed: ", err)
+		writeError(w, APIErrReadRecordFailed.ErrNo, APIErrReadRecordFailed.ErrMsg)
+		return
+	}
+
+	key := requestAPIKey(req)
+	stats := make(map[string]int)
+	for puname, coin := range coins {
+		if key.canAccess(puname) {
+			stats[coin]++
+		}
+	}
+
+	writeData(w, stats)
+}
+
+// availableCoinsHandle 列出可用币种
+func availableCoinsHandle(w http.ResponseWriter, req *http.Request) {
+	coins := configData.AvailableCoins
+	if coins == nil {
+		coins = []string{}
+	}
+	writeData(w, coins)
+}
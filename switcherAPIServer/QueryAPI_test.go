@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCoinStatsCache(t *testing.T) {
+	newTestStore(t)
+	configData.CoinStatsCacheSeconds = 30
+	cache := &coinStatsCache{}
+	source := AuditSource{AuditSourceAPI, "admin", "test"}
+
+	for puname, coin := range map[string]string{"aaaa": "btc", "bbbb": "bcc", "parta_cccc": "btc"} {
+		if _, apiErr := changeMiningCoin(puname, "", coin, source); apiErr != nil {
+			t.Fatal("switch failed: ", apiErr)
+		}
+	}
+	// 矿工节点不参与统计
+	if _, apiErr := changeMiningCoin("aaaa", "rig01", "bcc", source); apiErr != nil {
+		t.Fatal("switch failed: ", apiErr)
+	}
+
+	now := time.Unix(1527811200, 0)
+	coins, err := cache.get(now)
+	if err != nil || len(coins) != 3 || coins["aaaa"] != "btc" || coins["bbbb"] != "bcc" || coins["parta_cccc"] != "btc" {
+		t.Fatalf("unexpected coins: %v, %v", coins, err)
+	}
+
+	// 有效期内不重新读取
+	if _, apiErr := changeMiningCoin("bbbb", "", "btc", source); apiErr != nil {
+		t.Fatal("switch failed: ", apiErr)
+	}
+	if coins, _ := cache.get(now.Add(29 * time.Second)); coins["bbbb"] != "bcc" {
+		t.Errorf("cached coin expected, but got %v", coins)
+	}
+	if coins, _ := cache.get(now.Add(30 * time.Second)); coins["bbbb"] != "btc" {
+		t.Errorf("refreshed coin expected, but got %v", coins)
+	}
+	// 时钟回拨时重新读取
+	if _, apiErr := changeMiningCoin("bbbb", "", "bcc", source); apiErr != nil {
+		t.Fatal("switch failed: ", apiErr)
+	}
+	if coins, _ := cache.get(now); coins["bbbb"] != "bcc" {
+		t.Errorf("refreshed coin expected, but got %v", coins)
+	}
+}
+
+func TestCoinStatsRateLimit(t *testing.T) {
+	newTestStore(t)
+	configData.CoinStatsRequestsPerSecond = 3
+	cache := &coinStatsCache{}
+
+	now := time.Unix(1527811200, 0)
+	for i, c := range []struct {
+		offset  time.Duration
+		allowed bool
+	}{
+		{0, true},
+		{100 * time.Millisecond, true},
+		{200 * time.Millisecond, true},
+		{999 * time.Millisecond, false},
+		{time.Second, true},
+		{1500 * time.Millisecond, true},
+		{1900 * time.Millisecond, true},
+		{1950 * time.Millisecond, false},
+	} {
+		if allowed := cache.allow(now.Add(c.offset)); allowed != c.allowed {
+			t.Errorf("request %d at +%v: %v expected, but got %v", i, c.offset, c.allowed, allowed)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btccom/btcpool-go-modules/coordination"
+	"github.com/golang/glog"
+)
+
+// parseScheduleTime 解析一次性计划的执行时间，可以是Unix时间戳或RFC3339格式
+func parseScheduleTime(str string) (int64, bool) {
+	if len(str) < 1 {
+		return 0, false
+	}
+	if at, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return at, true
+	}
+	at, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return 0, false
+	}
+	return at.Unix(), true
+}
+
+// listSchedulesHandle 列出计划（puname 为空时列出所有计划）
+func listSchedulesHandle(w http.ResponseWriter, req *http.Request) {
+	puname := req.FormValue("puname")
+	if configData.StratumServerCaseInsensitive {
+		puname = strings.ToLower(puname)
+	}
+
+	schedules, err := ListSchedules(puname)
+	if err != nil {
+		glog.Error("List Schedules Failed: ", err)
+		writeError(w, APIErrReadRecordFailed.ErrNo, APIErrReadRecordFailed.ErrMsg)
+		return
+	}
+
+	// 只返回 API Key 可以访问的子账户的计划
+	key := requestAPIKey(req)
+	accessible := schedules[:0]
+	for _, schedule := range schedules {
+		if key.canAccess(schedule.PUName) {
+			accessible = append(accessible, schedule)
+		}
+	}
+
+	writeData(w, accessible)
+}
+
+// addScheduleHandle 创建计划
+func addScheduleHandle(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, APIErrMethodNotAllowed.ErrNo, APIErrMethodNotAllowed.ErrMsg)
+		return
+	}
+
+	schedule := Schedule{
+		PUName:    req.FormValue("puname"),
+		Worker:    req.FormValue("worker"),
+		Type:      req.FormValue("type"),
+		Coin:      req.FormValue("coin"),
+		Start:     req.FormValue("start"),
+		End:       req.FormValue("end"),
+		OtherCoin: req.FormValue("other_coin"),
+	}
+
+	if schedule.Type == ScheduleTypeOnce {
+		at, ok := parseScheduleTime(req.FormValue("at"))
+		if !ok {
+			writeError(w, APIErrScheduleTimeInvalid.ErrNo, APIErrScheduleTimeInvalid.ErrMsg)
+			return
+		}
+		schedule.At = at
+	}
+
+	if configData.StratumServerCaseInsensitive {
+		schedule.PUName = strings.ToLower(schedule.PUName)
+	}
+
+	apiErr := schedule.Check()
+	if apiErr == nil {
+		apiErr = requestAPIKey(req).canSwitch(schedule.PUName, schedule.Coin)
+	}
+	if apiErr == nil && schedule.Type == ScheduleTypeDaily {
+		apiErr = requestAPIKey(req).canSwitch(schedule.PUName, schedule.OtherCoin)
+	}
+	if apiErr != nil {
+		glog.Info(apiErr, ": ", req.RequestURI)
+		writeError(w, apiErr.ErrNo, apiErr.ErrMsg)
+		return
+	}
+
+	id, err := AddSchedule(schedule)
+	if err != nil {
+		glog.Error("Add Schedule Failed: ", err)
+		writeError(w, APIErrWriteRecordFailed.ErrNo, APIErrWriteRecordFailed.ErrMsg)
+		return
+	}
+	schedule.ID = id
+
+	glog.Info("[schedule-add] ", id, "; ", schedule.PUName, "; ", schedule.Type, "; ", schedule.Coin)
+	writeData(w, schedule)
+}
+
+// deleteScheduleHandle 删除计划
+func deleteScheduleHandle(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, APIErrMethodNotAllowed.ErrNo, APIErrMethodNotAllowed.ErrMsg)
+		return
+	}
+
+	id := req.FormValue("id")
+	if len(id) < 1 || strings.Contains(id, "/") {
+		writeError(w, APIErrScheduleNotFound.ErrNo, APIErrScheduleNotFound.ErrMsg)
+		return
+	}
+
+	schedule, _, err := getSchedule(id)
+	if err == nil && !requestAPIKey(req).canAccess(schedule.PUName) {
+		writeError(w, APIErrPermissionDenied.ErrNo, APIErrPermissionDenied.ErrMsg)
+		return
+	}
+	if err == nil {
+		err = DeleteSchedule(id)
+	}
+	if err == coordination.ErrNoNode {
+		writeError(w, APIErrScheduleNotFound.ErrNo, APIErrScheduleNotFound.ErrMsg)
+		return
+	}
+	if err != nil {
+		glog.Error("Delete Schedule Failed: ", id, "; ", err)
+		writeError(w, APIErrWriteRecordFailed.ErrNo, APIErrWriteRecordFailed.ErrMsg)
+		return
+	}
+
+	glog.Info("[schedule-delete] ", id)
+	writeSuccess(w)
+}
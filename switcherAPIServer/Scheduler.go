@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/btccom/btcpool-go-modules/coordination"
+	"github.com/golang/glog"
+)
+
+// 默认的调度检查间隔
+const defaultSchedulerIntervalSeconds = 10
+
+// 计划类型
+const (
+	// ScheduleTypeDaily 每天在 Start~End（UTC）之间挖 Coin，其余时间挖 OtherCoin
+	ScheduleTypeDaily = "daily"
+	// ScheduleTypeOnce 在 At 时刻切换到 Coin，执行后删除
+	ScheduleTypeOnce = "once"
+)
+
+// Schedule 币种切换计划
+type Schedule struct {
+	// 计划ID（Zookeeper节点名，创建时生成）
+	ID     string `json:"id,omitempty"`
+	PUName string `json:"puname"`
+	// 矿机名，不为空时只切换该矿工
+	Worker string `json:"worker,omitempty"`
+	Type   string `json:"type"`
+	Coin   string `json:"coin"`
+	// daily：时间窗口（UTC，HH:MM），Start 大于 End 时表示跨过零点
+	Start     string `json:"start,omitempty"`
+	End       string `json:"end,omitempty"`
+	OtherCoin string `json:"other_coin,omitempty"`
+	// once：执行时间（Unix时间戳）
+	At int64 `json:"at,omitempty"`
+	// 上次执行时切换到的币种及执行时间（由调度器更新）
+	LastAppliedCoin string `json:"last_applied_coin,omitempty"`
+	LastAppliedAt   int64  `json:"last_applied_at,omitempty"`
+}
+
+// parseMinuteOfDay 解析 HH:MM 格式的时间，返回从零点开始的分钟数
+func parseMinuteOfDay(str string) (minutes int, ok bool) {
+	var hour, minute int
+	n, err := fmt.Sscanf(str, "%d:%d", &hour, &minute)
+	if err != nil || n != 2 || len(str) != 5 || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, false
+	}
+	return hour*60 + minute, true
+}
+
+// Check 检查计划是否合法
+func (schedule *Schedule) Check() *APIError {
+	if len(schedule.PUName) < 1 {
+		return APIErrPunameIsEmpty
+	}
+	if strings.Contains(schedule.PUName, "/") {
+		return APIErrPunameInvalid
+	}
+	if strings.Contains(schedule.Worker, "/") {
+		return APIErrWorkerInvalid
+	}
+	if len(schedule.Coin) < 1 {
+		return APIErrCoinIsEmpty
+	}
+	if apiErr := checkCoinSpec(schedule.Coin); apiErr != nil {
+		return apiErr
+	}
+
+	switch schedule.Type {
+	case ScheduleTypeDaily:
+		start, startOK := parseMinuteOfDay(schedule.Start)
+		end, endOK := parseMinuteOfDay(schedule.End)
+		if !startOK || !endOK || start == end {
+			return APIErrScheduleTimeInvalid
+		}
+		if len(schedule.OtherCoin) < 1 {
+			return APIErrCoinIsEmpty
+		}
+		return checkCoinSpec(schedule.OtherCoin)
+
+	case ScheduleTypeOnce:
+		if schedule.At <= 0 {
+			return APIErrScheduleTimeInvalid
+		}
+		return nil
+
+	default:
+		return APIErrScheduleTypeInvalid
+	}
+}
+
+// Due 计算在 now 时刻计划是否需要执行，以及要切换到的币种
+// daily 计划只在应挖的币种与上次执行时不同时执行，因此不会覆盖两次执行之间通过API进行的切换。
+func (schedule *Schedule) Due(now time.Time) (coin string, due bool) {
+	switch schedule.Type {
+	case ScheduleTypeDaily:
+		start, _ := parseMinuteOfDay(schedule.Start)
+		end, _ := parseMinuteOfDay(schedule.End)
+		now = now.UTC()
+		minute := now.Hour()*60 + now.Minute()
+
+		var inWindow bool
+		if start < end {
+			inWindow = minute >= start && minute < end
+		} else {
+			inWindow = minute >= start || minute < end
+		}
+
+		coin = schedule.OtherCoin
+		if inWindow {
+			coin = schedule.Coin
+		}
+		return coin, coin != schedule.LastAppliedCoin
+
+	case ScheduleTypeOnce:
+		return schedule.Coin, schedule.LastAppliedAt == 0 && now.Unix() >= schedule.At
+
+	default:
+		return "", false
+	}
+}
+
+// scheduleNodeDir 保存计划的Zookeeper目录
+func scheduleNodeDir() string {
+	return configData.ZKScheduleDir + "schedules"
+}
+
+// scheduleElectionDir 调度器选主的Zookeeper目录
+func scheduleElectionDir() string {
+	return configData.ZKScheduleDir + "election"
+}
+
+// AddSchedule 保存新的计划，返回计划ID
+func AddSchedule(schedule Schedule) (id string, err error) {
+	schedule.ID = ""
+	schedule.LastAppliedCoin = ""
+	schedule.LastAppliedAt = 0
+
+	data, err := json.Marshal(schedule)
+	if err != nil {
+		return
+	}
+
+	// 顺序节点保证多个API Server同时创建时ID不重复
+	nodePath, err := zookeeperConn.Create(scheduleNodeDir()+"/s-", data, coordination.FlagSequence)
+	if err != nil {
+		return
+	}
+	id = path.Base(nodePath)
+	return
+}
+
+// getSchedule 读取一个计划及其节点版本
+func getSchedule(id string) (schedule Schedule, version int32, err error) {
+	data, stat, err := zookeeperConn.Get(scheduleNodeDir() + "/" + id)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &schedule)
+	schedule.ID = id
+	version = stat.Version
+	return
+}
+
+// ListSchedules 列出计划，puname 为空表示列出所有计划
+func ListSchedules(puname string) (schedules []Schedule, err error) {
+	ids, _, err := zookeeperConn.Children(scheduleNodeDir())
+	if err != nil {
+		return
+	}
+	sort.Strings(ids)
+
+	schedules = make([]Schedule, 0, len(ids))
+	for _, id := range ids {
+		schedule, _, getErr := getSchedule(id)
+		if getErr != nil {
+			// 可能刚被删除
+			if getErr != coordination.ErrNoNode {
+				glog.Warning("Read Schedule Failed: ", id, "; ", getErr)
+			}
+			continue
+		}
+		if len(puname) > 0 && schedule.PUName != puname {
+			continue
+		}
+		schedules = append(schedules, schedule)
+	}
+	return
+}
+
+// DeleteSchedule 删除计划
+func DeleteSchedule(id string) error {
+	return zookeeperConn.Delete(scheduleNodeDir()+"/"+id, -1)
+}
+
+// LeaderElection 基于Zookeeper临时顺序节点的选主
+// 序号最小的节点为主，只有主节点执行计划，避免多个API Server重复执行。
+type LeaderElection struct {
+	dir      string
+	nodeName string
+}
+
+// IsLeader 检查自己是否为主（节点因会话过期丢失时重新创建）
+func (election *LeaderElection) IsLeader() (bool, error) {
+	children, _, err := zookeeperConn.Children(election.dir)
+	if err != nil {
+		return false, err
+	}
+	sort.Strings(children)
+
+	exists := false
+	for _, child := range children {
+		if child == election.nodeName {
+			exists = true
+			break
+		}
+	}
+
+	if !exists {
+		nodePath, err := zookeeperConn.Create(election.dir+"/n-", []byte{}, coordination.FlagEphemeral|coordination.FlagSequence)
+		if err != nil {
+			return false, err
+		}
+		election.nodeName = path.Base(nodePath)
+		glog.Info("Scheduler: joined leader election: ", nodePath)
+		// 重新检查，其他节点可能序号更小
+		return election.IsLeader()
+	}
+
+	return children[0] == election.nodeName, nil
+}
+
+// RunScheduler 运行调度器
+func RunScheduler() {
+	defer waitGroup.Done()
+
+	interval := time.Duration(configData.SchedulerIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultSchedulerIntervalSeconds * time.Second
+	}
+
+	election := &LeaderElection{dir: scheduleElectionDir()}
+	wasLeader := false
+
+	for {
+		isLeader, err := election.IsLeader()
+		if err != nil {
+			glog.Error("Scheduler: leader election failed: ", err)
+		} else if isLeader != wasLeader {
+			glog.Info("Scheduler: leader: ", isLeader)
+			wasLeader = isLeader
+		}
+
+		if isLeader {
+			runSchedules(time.Now())
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// runSchedules 执行到期的计划
+func runSchedules(now time.Time) {
+	schedules, err := ListSchedules("")
+	if err != nil {
+		glog.Error("Scheduler: list schedules failed: ", err)
+		return
+	}
+
+	for _, listed := range schedules {
+		// 重新读取以获得节点版本，防止与删除或其他修改冲突
+		schedule, version, err := getSchedule(listed.ID)
+		if err != nil {
+			continue
+		}
+
+		coin, due := schedule.Due(now)
+		if !due {
+			continue
+		}
+
+		source := AuditSource{AuditSourceSchedule, schedule.ID, newRequestID()}
+		oldCoin, apiErr := changeMiningCoin(schedule.PUName, schedule.Worker, coin, source)
+		if apiErr != nil {
+			glog.Error("[schedule] ", schedule.ID, "; ", schedule.PUName, "; ", apiErr.ErrMsg, ": ", oldCoin, " -> ", coin)
+			continue
+		}
+		if len(schedule.Worker) > 0 {
+			glog.Info("[schedule] ", schedule.ID, "; ", schedule.PUName, ".", schedule.Worker, ": ", oldCoin, " -> ", coin)
+		} else {
+			glog.Info("[schedule] ", schedule.ID, "; ", schedule.PUName, ": ", oldCoin, " -> ", coin)
+		}
+
+		nodePath := scheduleNodeDir() + "/" + schedule.ID
+		if schedule.Type == ScheduleTypeOnce {
+			err = zookeeperConn.Delete(nodePath, version)
+		} else {
+			schedule.ID = ""
+			schedule.LastAppliedCoin = coin
+			schedule.LastAppliedAt = now.Unix()
+			data, _ := json.Marshal(schedule)
+			_, err = zookeeperConn.Set(nodePath, data, version)
+		}
+		if err != nil {
+			// 节点已被删除或修改（coordination.ErrNoNode、coordination.ErrBadVersion），下一轮按最新的值执行
+			glog.Warning("Scheduler: update schedule failed: ", nodePath, "; ", err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btccom/btcpool-go-modules/coordination"
+)
+
+// newTestStore 使用内存存储代替Zookeeper，并设置测试用的配置
+func newTestStore(t *testing.T) *coordination.MemoryStore {
+	store := coordination.NewMemoryStore()
+	zookeeperConn = store.Connect()
+	configData = &ConfigData{
+		AvailableCoins:     []string{"btc", "bcc"},
+		ZKSwitcherWatchDir: "/stratumSwitcher/test/",
+		ZKScheduleDir:      "/switcherAPIServer/scheduler/",
+		ZKAuditDir:         "/switcherAPIServer/audit/",
+		ZKChangeLogDir:     "/stratumSwitcher/changelog/",
+		ZKWebhookDir:       "/switcherAPIServer/webhook/",
+	}
+
+	for _, dir := range []string{configData.ZKSwitcherWatchDir, scheduleNodeDir(), scheduleElectionDir(), configData.ZKAuditDir, configData.ZKChangeLogDir, configData.ZKWebhookDir} {
+		if err := createZookeeperPath(dir); err != nil {
+			t.Fatal("create ", dir, " failed: ", err)
+		}
+	}
+	return store
+}
+
+// readCoinNode 读取子账户或矿工的币种，节点不存在时返回空
+func readCoinNode(t *testing.T, puname string, worker string) string {
+	data, _, err := zookeeperConn.Get(coinNodePath(puname, worker))
+	if err == coordination.ErrNoNode {
+		return ""
+	}
+	if err != nil {
+		t.Fatal("read coin node failed: ", err)
+	}
+	return string(data)
+}
+
+func TestScheduleDue(t *testing.T) {
+	at := func(clock string) time.Time {
+		now, err := time.Parse("2006-01-02 15:04", "2018-06-01 "+clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return now
+	}
+
+	daily := func(start, end, lastApplied string) *Schedule {
+		return &Schedule{Type: ScheduleTypeDaily, Coin: "btc", OtherCoin: "bcc", Start: start, End: end, LastAppliedCoin: lastApplied}
+	}
+
+	for _, c := range []struct {
+		schedule *Schedule
+		now      time.Time
+		coin     string
+		due      bool
+	}{
+		// 不跨零点的窗口，不含 end
+		{daily("09:00", "17:00", ""), at("08:59"), "bcc", true},
+		{daily("09:00", "17:00", ""), at("09:00"), "btc", true},
+		{daily("09:00", "17:00", ""), at("16:59"), "btc", true},
+		{daily("09:00", "17:00", ""), at("17:00"), "bcc", true},
+		// 跨零点的窗口
+		{daily("22:00", "06:00", ""), at("21:59"), "bcc", true},
+		{daily("22:00", "06:00", ""), at("22:00"), "btc", true},
+		{daily("22:00", "06:00", ""), at("23:59"), "btc", true},
+		{daily("22:00", "06:00", ""), at("00:00"), "btc", true},
+		{daily("22:00", "06:00", ""), at("05:59"), "btc", true},
+		{daily("22:00", "06:00", ""), at("06:00"), "bcc", true},
+		{daily("22:00", "06:00", ""), at("12:00"), "bcc", true},
+		// 应挖的币种与上次执行时相同，不再执行
+		{daily("22:00", "06:00", "btc"), at("23:00"), "btc", false},
+		{daily("22:00", "06:00", "btc"), at("03:00"), "btc", false},
+		{daily("22:00", "06:00", "btc"), at("06:00"), "bcc", true},
+		{daily("22:00", "06:00", "bcc"), at("12:00"), "bcc", false},
+		{daily("22:00", "06:00", "bcc"), at("22:00"), "btc", true},
+		// 按 UTC 计算
+		{daily("22:00", "06:00", ""), at("23:00").In(time.FixedZone("UTC+8", 8*3600)), "btc", true},
+		// once
+		{&Schedule{Type: ScheduleTypeOnce, Coin: "btc", At: at("12:00").Unix()}, at("11:59"), "btc", false},
+		{&Schedule{Type: ScheduleTypeOnce, Coin: "btc", At: at("12:00").Unix()}, at("12:00"), "btc", true},
+		{&Schedule{Type: ScheduleTypeOnce, Coin: "btc", At: at("12:00").Unix(), LastAppliedAt: at("12:00").Unix()}, at("12:01"), "btc", false},
+		// 未知类型
+		{&Schedule{Type: "weekly", Coin: "btc"}, at("12:00"), "", false},
+	} {
+		coin, due := c.schedule.Due(c.now)
+		if coin != c.coin || due != c.due {
+			t.Errorf("%s %s-%s (last %q) at %s: (%s, %v) expected, but got (%s, %v)",
+				c.schedule.Type, c.schedule.Start, c.schedule.End, c.schedule.LastAppliedCoin, c.now.Format("15:04 MST"), c.coin, c.due, coin, due)
+		}
+	}
+}
+
+func TestRunSchedules(t *testing.T) {
+	newTestStore(t)
+
+	dailyID, err := AddSchedule(Schedule{PUName: "aaaa", Type: ScheduleTypeDaily, Coin: "btc", OtherCoin: "bcc", Start: "22:00", End: "06:00"})
+	if err != nil {
+		t.Fatal("add schedule failed: ", err)
+	}
+	onceID, err := AddSchedule(Schedule{PUName: "bbbb", Worker: "rig01", Type: ScheduleTypeOnce, Coin: "bcc", At: time.Date(2018, 6, 1, 23, 30, 0, 0, time.UTC).Unix()})
+	if err != nil {
+		t.Fatal("add schedule failed: ", err)
+	}
+
+	runSchedules(time.Date(2018, 6, 1, 23, 0, 0, 0, time.UTC))
+	if coin := readCoinNode(t, "aaaa", ""); coin != "btc" {
+		t.Errorf("daily schedule: btc expected, but got %q", coin)
+	}
+	if coin := readCoinNode(t, "bbbb", "rig01"); coin != "" {
+		t.Errorf("once schedule should not be due yet, but got %q", coin)
+	}
+	schedule, _, err := getSchedule(dailyID)
+	if err != nil || schedule.LastAppliedCoin != "btc" {
+		t.Errorf("last applied coin should be updated: %+v, %v", schedule, err)
+	}
+
+	// 两次执行之间通过API进行的切换保留到下一个时间点
+	if _, apiErr := changeMiningCoin("aaaa", "", "bcc", AuditSource{AuditSourceAPI, "admin", "test"}); apiErr != nil {
+		t.Fatal("switch failed: ", apiErr)
+	}
+	runSchedules(time.Date(2018, 6, 1, 23, 30, 0, 0, time.UTC))
+	if coin := readCoinNode(t, "aaaa", ""); coin != "bcc" {
+		t.Errorf("manual switch should be kept: bcc expected, but got %q", coin)
+	}
+
+	// once 计划执行后被删除
+	if coin := readCoinNode(t, "bbbb", "rig01"); coin != "bcc" {
+		t.Errorf("once schedule: bcc expected, but got %q", coin)
+	}
+	if _, _, err := getSchedule(onceID); err != coordination.ErrNoNode {
+		t.Errorf("once schedule should be deleted, but got %v", err)
+	}
+
+	// 离开时间窗口后切换到 other_coin，再次进入窗口时切换回来
+	if _, apiErr := changeMiningCoin("aaaa", "", "btc", AuditSource{AuditSourceAPI, "admin", "test"}); apiErr != nil {
+		t.Fatal("switch failed: ", apiErr)
+	}
+	runSchedules(time.Date(2018, 6, 2, 6, 0, 0, 0, time.UTC))
+	if coin := readCoinNode(t, "aaaa", ""); coin != "bcc" {
+		t.Errorf("daily schedule: bcc expected, but got %q", coin)
+	}
+	runSchedules(time.Date(2018, 6, 2, 22, 0, 0, 0, time.UTC))
+	if coin := readCoinNode(t, "aaaa", ""); coin != "btc" {
+		t.Errorf("daily schedule: btc expected, but got %q", coin)
+	}
+}
+
+func TestLeaderElectionIsLeader(t *testing.T) {
+	store := newTestStore(t)
+	connA := zookeeperConn.(*coordination.MemoryBackend)
+	connB := store.Connect()
+
+	isLeader := func(election *LeaderElection, conn coordination.Backend) bool {
+		zookeeperConn = conn
+		leader, err := election.IsLeader()
+		if err != nil {
+			t.Fatal("IsLeader failed: ", err)
+		}
+		return leader
+	}
+
+	a := &LeaderElection{dir: scheduleElectionDir()}
+	b := &LeaderElection{dir: scheduleElectionDir()}
+	if !isLeader(a, connA) {
+		t.Error("the first node should be the leader")
+	}
+	if isLeader(b, connB) {
+		t.Error("the second node should not be the leader")
+	}
+	if !isLeader(a, connA) || isLeader(b, connB) {
+		t.Error("leader should not change")
+	}
+
+	// a 的会话过期，临时节点被删除，b 成为主
+	nodeA := a.nodeName
+	connA.Expire()
+	if !isLeader(b, connB) {
+		t.Error("b should be the leader after a's session expired")
+	}
+
+	// a 重新加入选主，排在 b 之后
+	if isLeader(a, connA) {
+		t.Error("a should not be the leader after rejoining")
+	}
+	if a.nodeName == nodeA || a.nodeName <= b.nodeName {
+		t.Errorf("a should recreate a node after b's: %s, %s -> %s", b.nodeName, nodeA, a.nodeName)
+	}
+	zookeeperConn = connA
+	if children, _, _ := zookeeperConn.Children(scheduleElectionDir()); len(children) != 2 {
+		t.Errorf("2 nodes expected, but got %v", children)
+	}
+
+	connB.Close()
+	if !isLeader(a, connA) {
+		t.Error("a should be the leader after b left")
+	}
+}
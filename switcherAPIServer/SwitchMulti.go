@@ -0,0 +1,143 @@
+package main
+
+import (
+	"github.com/btccom/btcpool-go-modules/coordination"
+	"github.com/golang/glog"
+)
+
+// 批量原子切换时记录被并发修改后的重试次数
+const atomicSwitchMaxRetries = 3
+
+// SwitchResult 批量切换中单个子账户的结果
+type SwitchResult struct {
+	PUName  string `json:"puname"`
+	OldCoin string `json:"old_coin"`
+	Coin    string `json:"coin"`
+	// 是否已切换
+	Switched bool   `json:"switched"`
+	ErrNo    int    `json:"err_no"`
+	ErrMsg   string `json:"err_msg"`
+
+	zkPath string
+}
+
+func (result *SwitchResult) setError(apiErr *APIError) {
+	result.ErrNo = apiErr.ErrNo
+	result.ErrMsg = apiErr.ErrMsg
+}
+
+// checkSwitchResults 在切换前检查所有子账户、币种及 key 的权限，返回每个子账户的结果及第一个错误
+func checkSwitchResults(userCoins []SwitchUserCoins, key *APIKey) (results []SwitchResult, firstErr *APIError) {
+	paths := make(map[string]bool)
+
+	for _, usercoin := range userCoins {
+		for _, puname := range usercoin.PUNames {
+			result := SwitchResult{PUName: puname, Coin: usercoin.Coin}
+
+			apiErr := checkSwitchParams(puname, "", usercoin.Coin)
+			if apiErr == nil {
+				apiErr = key.canSwitch(puname, usercoin.Coin)
+			}
+			if apiErr == nil {
+				result.zkPath = coinNodePath(puname, "")
+				if paths[result.zkPath] {
+					apiErr = APIErrPunameDuplicated
+				}
+				paths[result.zkPath] = true
+			}
+
+			if apiErr != nil {
+				result.setError(apiErr)
+				if firstErr == nil {
+					firstErr = apiErr
+				}
+			}
+			results = append(results, result)
+		}
+	}
+	return
+}
+
+// changeMiningCoins 逐个切换检查通过的子账户，任一子账户失败时返回 APIErrSwitchPartiallyFailed
+func changeMiningCoins(results []SwitchResult, source AuditSource) (apiErr *APIError) {
+	for i := range results {
+		result := &results[i]
+		if result.ErrNo != 0 {
+			apiErr = APIErrSwitchPartiallyFailed
+			continue
+		}
+
+		oldCoin, err := changeMiningCoin(result.PUName, "", result.Coin, source)
+		result.OldCoin = oldCoin
+
+		if err != nil {
+			glog.Info(err, ": {puname=", result.PUName, ", coin=", result.Coin, "}")
+			result.setError(err)
+			apiErr = APIErrSwitchPartiallyFailed
+			continue
+		}
+
+		result.Switched = true
+		glog.Info("[multi-switch] ", result.PUName, ": ", oldCoin, " -> ", result.Coin)
+	}
+	return
+}
+
+// changeMiningCoinsAtomic 在一个Zookeeper事务中切换所有子账户，全部成功或全部不切换
+// 事务中的每个修改都带有读取时的节点版本，期间记录被其他请求修改时重新读取并重试。
+func changeMiningCoinsAtomic(results []SwitchResult, source AuditSource) *APIError {
+	for retry := 0; retry < atomicSwitchMaxRetries; retry++ {
+		ops := make([]interface{}, 0, len(results))
+
+		for i := range results {
+			result := &results[i]
+			data, stat, err := zookeeperConn.Get(result.zkPath)
+
+			if err == coordination.ErrNoNode {
+				result.OldCoin = ""
+				ops = append(ops, &coordination.CreateRequest{Path: result.zkPath, Data: []byte(result.Coin)})
+				continue
+			}
+
+			if err != nil {
+				glog.Error("zk.Get(", result.zkPath, ") Failed: ", err)
+				result.setError(APIErrReadRecordFailed)
+				return APIErrReadRecordFailed
+			}
+
+			result.OldCoin = string(data)
+			ops = append(ops, &coordination.SetDataRequest{Path: result.zkPath, Data: []byte(result.Coin), Version: stat.Version})
+		}
+
+		if configData.EnableChangeLog {
+			for i := range results {
+				ops = append(ops, changeLogRequest(results[i].zkPath, results[i].Coin))
+			}
+		}
+
+		err := zookeeperConn.Multi(ops...)
+
+		if err == coordination.ErrBadVersion || err == coordination.ErrNodeExists || err == coordination.ErrNoNode {
+			glog.Warning("zk.Multi() Conflicted, Retry: ", err)
+			continue
+		}
+
+		if err != nil {
+			glog.Error("zk.Multi() Failed: ", err)
+			return APIErrWriteRecordFailed
+		}
+
+		if configData.EnableChangeLog {
+			countChangeLogAppends(len(results))
+		}
+
+		for i := range results {
+			results[i].Switched = true
+			glog.Info("[multi-switch] ", results[i].PUName, ": ", results[i].OldCoin, " -> ", results[i].Coin)
+			recordSwitch(source, results[i].PUName, "", results[i].OldCoin, results[i].Coin)
+		}
+		return nil
+	}
+
+	return APIErrSwitchConflict
+}
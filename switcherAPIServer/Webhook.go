@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/btccom/btcpool-go-modules/coordination"
+	"github.com/golang/glog"
+)
+
+// 推送事件的处理结果
+const (
+	WebhookEventApplied   = "applied"
+	WebhookEventDuplicate = "duplicate"
+	WebhookEventFailed    = "failed"
+)
+
+// 游标中保留的最近已处理的事件ID数
+const webhookCursorMaxIDs = 100
+
+// WebhookEvent 用户中心推送的币种切换事件
+type WebhookEvent struct {
+	// 事件ID（幂等键），写入切换记录的 request_id。ID已处理过的事件即使序号更大也被忽略
+	ID string `json:"id"`
+	// 序号，同一子账户（或矿工）的事件按序号递增，序号不大于已处理序号的事件会被忽略
+	Seq    int64  `json:"seq"`
+	PUName string `json:"puname"`
+	Worker string `json:"worker,omitempty"`
+	Coin   string `json:"coin"`
+}
+
+// WebhookRequest 推送请求数据结构
+type WebhookRequest struct {
+	Events []WebhookEvent `json:"events"`
+}
+
+// WebhookEventResult 单个事件的处理结果
+type WebhookEventResult struct {
+	ID      string `json:"id"`
+	Seq     int64  `json:"seq"`
+	PUName  string `json:"puname"`
+	Worker  string `json:"worker,omitempty"`
+	OldCoin string `json:"old_coin"`
+	Coin    string `json:"coin"`
+	Status  string `json:"status"`
+	ErrNo   int    `json:"err_no"`
+	ErrMsg  string `json:"err_msg"`
+}
+
+// webhookCursor 每个子账户（或矿工）已处理的最新事件，保存在 ZKWebhookDir 下
+type webhookCursor struct {
+	Seq  int64  `json:"seq"`
+	ID   string `json:"id"`
+	Coin string `json:"coin"`
+	// 最近已处理的事件ID（最新的在前，最多 webhookCursorMaxIDs 个）
+	RecentIDs []string `json:"recent_ids,omitempty"`
+}
+
+// isApplied 事件是否已处理过：序号不大于已处理序号，或事件ID已处理过
+func (cursor *webhookCursor) isApplied(event WebhookEvent) bool {
+	if event.Seq <= cursor.Seq || event.ID == cursor.ID {
+		return true
+	}
+	for _, id := range cursor.RecentIDs {
+		if id == event.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// advance 处理事件后的游标
+func (cursor *webhookCursor) advance(event WebhookEvent) webhookCursor {
+	recentIDs := append([]string{event.ID}, cursor.RecentIDs...)
+	if len(recentIDs) > webhookCursorMaxIDs {
+		recentIDs = recentIDs[:webhookCursorMaxIDs]
+	}
+	return webhookCursor{event.Seq, event.ID, event.Coin, recentIDs}
+}
+
+// 同一进程中的推送逐个处理
+var webhookLock sync.Mutex
+
+// webhookCursorPath 游标在Zookeeper中的路径，节点名与币种节点相同
+func webhookCursorPath(puname string, worker string) string {
+	return configData.ZKWebhookDir + strings.TrimPrefix(coinNodePath(puname, worker), configData.ZKSwitcherWatchDir)
+}
+
+// getWebhookCursor 读取游标，不存在时 version 为 -1
+func getWebhookCursor(path string) (cursor webhookCursor, version int32, err error) {
+	data, stat, err := zookeeperConn.Get(path)
+	if err == coordination.ErrNoNode {
+		return cursor, -1, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &cursor)
+	version = stat.Version
+	return
+}
+
+// commitWebhookEvent 通过 changeMiningCoinWith 写入币种节点，并在同一事务中推进游标
+// 游标带有读取时的版本，期间被其他请求修改时重新读取并重试。事务失败时什么都不会改变，事件可以重新推送。
+// 返回 applied 为 false 且 apiErr 为 nil 表示是重复或过期的事件。
+func commitWebhookEvent(cursorPath string, event WebhookEvent, source AuditSource) (applied bool, oldCoin string, apiErr *APIError) {
+	prepare := func() ([]interface{}, error) {
+		cursor, cursorVersion, err := getWebhookCursor(cursorPath)
+		if err != nil {
+			return nil, err
+		}
+		if cursor.isApplied(event) {
+			return nil, errSkipCoinWrite
+		}
+
+		cursorData, _ := json.Marshal(cursor.advance(event))
+		if cursorVersion < 0 {
+			return []interface{}{&coordination.CreateRequest{Path: cursorPath, Data: cursorData}}, nil
+		}
+		return []interface{}{&coordination.SetDataRequest{Path: cursorPath, Data: cursorData, Version: cursorVersion}}, nil
+	}
+
+	oldCoin, applied, apiErr = changeMiningCoinWith(event.PUName, event.Worker, event.Coin, source, prepare)
+	return
+}
+
+// applyWebhookEvent 处理一个事件
+func applyWebhookEvent(event WebhookEvent, key *APIKey) (result WebhookEventResult) {
+	result = WebhookEventResult{ID: event.ID, Seq: event.Seq, PUName: event.PUName, Worker: event.Worker, Coin: event.Coin}
+
+	fail := func(apiErr *APIError) WebhookEventResult {
+		result.Status = WebhookEventFailed
+		result.ErrNo = apiErr.ErrNo
+		result.ErrMsg = apiErr.ErrMsg
+		return result
+	}
+
+	if len(event.ID) < 1 || event.Seq <= 0 {
+		return fail(APIErrWebhookEventInvalid)
+	}
+	apiErr := checkSwitchParams(event.PUName, event.Worker, event.Coin)
+	if apiErr == nil {
+		apiErr = key.canSwitch(event.PUName, event.Coin)
+	}
+	if apiErr != nil {
+		return fail(apiErr)
+	}
+
+	path := webhookCursorPath(event.PUName, event.Worker)
+	applied, oldCoin, apiErr := commitWebhookEvent(path, event, AuditSource{AuditSourceWebhook, key.ID, event.ID})
+	if apiErr != nil {
+		glog.Error("Apply Webhook Event Failed: ", path, "; ", event.ID, "; ", apiErr.ErrMsg)
+		return fail(apiErr)
+	}
+	if !applied {
+		result.Status = WebhookEventDuplicate
+		return
+	}
+
+	result.OldCoin = oldCoin
+	result.Status = WebhookEventApplied
+	return
+}
+
+// webhookHandle 处理用户中心推送的币种切换事件
+// 事件按序号顺序处理，已处理过的事件（序号不大于游标，或ID已处理过）被忽略，因此用户中心可以安全地重新推送。
+func webhookHandle(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, APIErrMethodNotAllowed.ErrNo, APIErrMethodNotAllowed.ErrMsg)
+		return
+	}
+
+	var reqData WebhookRequest
+
+	requestJSON, err := ioutil.ReadAll(req.Body)
+
+	if err != nil {
+		glog.Warning(err, ": ", req.RequestURI)
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	err = json.Unmarshal(requestJSON, &reqData)
+
+	if err != nil {
+		glog.Info(err, ": ", req.RequestURI)
+		writeError(w, 400, err.Error())
+		return
+	}
+
+	sort.SliceStable(reqData.Events, func(i, j int) bool {
+		return reqData.Events[i].Seq < reqData.Events[j].Seq
+	})
+
+	webhookLock.Lock()
+	defer webhookLock.Unlock()
+
+	key := requestAPIKey(req)
+	results := make([]WebhookEventResult, 0, len(reqData.Events))
+	var apiErr *APIError
+
+	for _, event := range reqData.Events {
+		result := applyWebhookEvent(event, key)
+		results = append(results, result)
+
+		switch result.Status {
+		case WebhookEventApplied:
+			glog.Info("[webhook] ", event.ID, "; ", event.Seq, "; ", event.PUName, ": ", result.OldCoin, " -> ", event.Coin)
+		case WebhookEventFailed:
+			glog.Info("[webhook] ", event.ID, "; ", event.Seq, "; ", event.PUName, ": ", result.ErrMsg)
+			apiErr = APIErrSwitchPartiallyFailed
+		}
+	}
+
+	if apiErr != nil {
+		writeErrorData(w, apiErr.ErrNo, apiErr.ErrMsg, results)
+		return
+	}
+
+	writeData(w, results)
+}
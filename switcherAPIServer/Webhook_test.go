@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/btccom/btcpool-go-modules/coordination"
+)
+
+// postWebhook 以 admin 身份推送事件，返回错误号和每个事件的处理结果
+func postWebhook(t *testing.T, events ...WebhookEvent) (int, []WebhookEventResult) {
+	body, _ := json.Marshal(WebhookRequest{events})
+	req := httptest.NewRequest("POST", "/webhook", strings.NewReader(string(body)))
+	req.SetBasicAuth("admin", "admin")
+	recorder := httptest.NewRecorder()
+	apiAuth(APIScopeSwitch, webhookHandle)(recorder, req)
+
+	var response struct {
+		ErrNo int                  `json:"err_no"`
+		Data  []WebhookEventResult `json:"data"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response: %s", recorder.Body.String())
+	}
+	return response.ErrNo, response.Data
+}
+
+// checkWebhookResults 检查每个事件（按序号排序后）的处理结果
+func checkWebhookResults(t *testing.T, results []WebhookEventResult, statuses ...string) {
+	if len(results) != len(statuses) {
+		t.Fatalf("%d results expected, but got %+v", len(statuses), results)
+	}
+	for i, status := range statuses {
+		if results[i].Status != status {
+			t.Errorf("event %s (seq %d): %s expected, but got %+v", results[i].ID, results[i].Seq, status, results[i])
+		}
+	}
+}
+
+// readWebhookCursor 读取子账户的游标
+func readWebhookCursor(t *testing.T, puname string, worker string) webhookCursor {
+	cursor, _, err := getWebhookCursor(webhookCursorPath(puname, worker))
+	if err != nil {
+		t.Fatal("read webhook cursor failed: ", err)
+	}
+	return cursor
+}
+
+// checkWebhookCursor 检查游标中最新事件的序号、ID和币种
+func checkWebhookCursor(t *testing.T, cursor webhookCursor, seq int64, id string, coin string) {
+	t.Helper()
+	if cursor.Seq != seq || cursor.ID != id || cursor.Coin != coin || len(cursor.RecentIDs) < 1 || cursor.RecentIDs[0] != id {
+		t.Errorf("unexpected cursor: %+v", cursor)
+	}
+}
+
+func TestWebhookDuplicate(t *testing.T) {
+	newAPIKeyTestStore(t)
+	configData.EnableAudit = true
+
+	errNo, results := postWebhook(t, WebhookEvent{ID: "evt-1", Seq: 1, PUName: "aaaa", Coin: "btc"})
+	if errNo != 0 {
+		t.Errorf("0 expected, but got %d", errNo)
+	}
+	checkWebhookResults(t, results, WebhookEventApplied)
+
+	// 重新推送同一事件，以及序号相同的其他事件
+	_, results = postWebhook(t, WebhookEvent{ID: "evt-1", Seq: 1, PUName: "aaaa", Coin: "btc"}, WebhookEvent{ID: "evt-1b", Seq: 1, PUName: "aaaa", Coin: "bcc"})
+	checkWebhookResults(t, results, WebhookEventDuplicate, WebhookEventDuplicate)
+	if coin := readCoinNode(t, "aaaa", ""); coin != "btc" {
+		t.Errorf("btc expected, but got %q", coin)
+	}
+
+	// 已处理过的事件ID即使序号更大也被忽略
+	_, results = postWebhook(t, WebhookEvent{ID: "evt-0", Seq: 2, PUName: "aaaa", Coin: "bcc"})
+	checkWebhookResults(t, results, WebhookEventApplied)
+	_, results = postWebhook(t, WebhookEvent{ID: "evt-1", Seq: 3, PUName: "aaaa", Coin: "btc"})
+	checkWebhookResults(t, results, WebhookEventDuplicate)
+	if coin := readCoinNode(t, "aaaa", ""); coin != "bcc" {
+		t.Errorf("bcc expected, but got %q", coin)
+	}
+	if cursor := readWebhookCursor(t, "aaaa", ""); cursor.Seq != 2 || len(cursor.RecentIDs) != 2 {
+		t.Errorf("unexpected cursor: %+v", cursor)
+	}
+
+	// 子账户和矿工的游标互相独立
+	_, results = postWebhook(t, WebhookEvent{ID: "evt-2", Seq: 1, PUName: "aaaa", Worker: "rig01", Coin: "bcc"})
+	checkWebhookResults(t, results, WebhookEventApplied)
+	if coin := readCoinNode(t, "aaaa", "rig01"); coin != "bcc" {
+		t.Errorf("bcc expected, but got %q", coin)
+	}
+
+	// 重复的事件不写入切换记录
+	records, err := ListSwitchHistory("aaaa", 10)
+	if err != nil || len(records) != 3 || records[2].Source != AuditSourceWebhook || records[2].RequestID != "evt-1" {
+		t.Errorf("unexpected audit records: %+v, %v", records, err)
+	}
+}
+
+func TestWebhookOutOfOrder(t *testing.T) {
+	newAPIKeyTestStore(t)
+
+	// 同一批中的事件按序号处理
+	_, results := postWebhook(t,
+		WebhookEvent{ID: "evt-3", Seq: 3, PUName: "aaaa", Coin: "btc"},
+		WebhookEvent{ID: "evt-1", Seq: 1, PUName: "aaaa", Coin: "bcc"},
+		WebhookEvent{ID: "evt-2", Seq: 2, PUName: "aaaa", Coin: "bcc"},
+	)
+	checkWebhookResults(t, results, WebhookEventApplied, WebhookEventApplied, WebhookEventApplied)
+	if results[0].ID != "evt-1" || results[2].OldCoin != "bcc" {
+		t.Errorf("events should be applied in seq order: %+v", results)
+	}
+	if coin := readCoinNode(t, "aaaa", ""); coin != "btc" {
+		t.Errorf("coin of the latest event expected, but got %q", coin)
+	}
+
+	// 较晚到达的旧事件被忽略，不会覆盖更新的事件
+	_, results = postWebhook(t, WebhookEvent{ID: "evt-5", Seq: 5, PUName: "aaaa", Coin: "bcc"})
+	checkWebhookResults(t, results, WebhookEventApplied)
+	_, results = postWebhook(t, WebhookEvent{ID: "evt-4", Seq: 4, PUName: "aaaa", Coin: "btc"})
+	checkWebhookResults(t, results, WebhookEventDuplicate)
+	if coin := readCoinNode(t, "aaaa", ""); coin != "bcc" {
+		t.Errorf("bcc expected, but got %q", coin)
+	}
+	checkWebhookCursor(t, readWebhookCursor(t, "aaaa", ""), 5, "evt-5", "bcc")
+}
+
+func TestWebhookRetryAfterFailure(t *testing.T) {
+	newAPIKeyTestStore(t)
+	configData.EnableChangeLog = true
+
+	_, results := postWebhook(t, WebhookEvent{ID: "evt-1", Seq: 1, PUName: "aaaa", Coin: "btc"})
+	checkWebhookResults(t, results, WebhookEventApplied)
+
+	// 变更日志目录不存在，事务失败：币种和游标都不改变
+	changeLogDir := strings.TrimSuffix(configData.ZKChangeLogDir, "/")
+	entries, _, _ := zookeeperConn.Children(changeLogDir)
+	for _, entry := range entries {
+		if err := zookeeperConn.Delete(changeLogDir+"/"+entry, -1); err != nil {
+			t.Fatal("delete change log entry failed: ", err)
+		}
+	}
+	if err := zookeeperConn.Delete(changeLogDir, -1); err != nil {
+		t.Fatal("delete change log dir failed: ", err)
+	}
+	errNo, results := postWebhook(t,
+		WebhookEvent{ID: "evt-2", Seq: 2, PUName: "aaaa", Coin: "bcc"},
+		WebhookEvent{ID: "evt-9", Seq: 9, PUName: "bbbb", Coin: "ltc"},
+	)
+	if errNo != APIErrSwitchPartiallyFailed.ErrNo {
+		t.Errorf("%d expected, but got %d", APIErrSwitchPartiallyFailed.ErrNo, errNo)
+	}
+	checkWebhookResults(t, results, WebhookEventFailed, WebhookEventFailed)
+	if results[1].ErrNo != APIErrCoinIsInexistent.ErrNo {
+		t.Errorf("invalid coin: %d expected, but got %+v", APIErrCoinIsInexistent.ErrNo, results[1])
+	}
+	if coin := readCoinNode(t, "aaaa", ""); coin != "btc" {
+		t.Errorf("coin should not change after failure, but got %q", coin)
+	}
+	if cursor := readWebhookCursor(t, "aaaa", ""); cursor.Seq != 1 {
+		t.Errorf("cursor should not advance after failure: %+v", cursor)
+	}
+	if cursor := readWebhookCursor(t, "bbbb", ""); cursor.Seq != 0 {
+		t.Errorf("cursor should not be created for invalid event: %+v", cursor)
+	}
+
+	// 恢复后重新推送
+	if err := createZookeeperPath(configData.ZKChangeLogDir); err != nil {
+		t.Fatal("create change log dir failed: ", err)
+	}
+	errNo, results = postWebhook(t, WebhookEvent{ID: "evt-2", Seq: 2, PUName: "aaaa", Coin: "bcc"})
+	if errNo != 0 {
+		t.Errorf("0 expected, but got %d", errNo)
+	}
+	checkWebhookResults(t, results, WebhookEventApplied)
+	if results[0].OldCoin != "btc" || readCoinNode(t, "aaaa", "") != "bcc" {
+		t.Errorf("retried event should be applied: %+v", results[0])
+	}
+	checkWebhookCursor(t, readWebhookCursor(t, "aaaa", ""), 2, "evt-2", "bcc")
+
+	// 币种节点、游标和变更记录在同一事务中写入
+	entries, _, err := zookeeperConn.Children(changeLogDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("1 change log entry expected, but got %v, %v", entries, err)
+	}
+	data, _, _ := zookeeperConn.Get(configData.ZKChangeLogDir + entries[0])
+	var entry ChangeLogEntry
+	if json.Unmarshal(data, &entry) != nil || entry.Name != "aaaa" || entry.Coin != "bcc" {
+		t.Errorf("unexpected change log entry: %s", data)
+	}
+}
+
+func TestCommitWebhookEventConflict(t *testing.T) {
+	newTestStore(t)
+
+	// 游标被其他请求推进后，旧事件作为重复事件处理
+	path := webhookCursorPath("aaaa", "")
+	if _, err := zookeeperConn.Create(path, []byte(`{"seq":7,"id":"evt-7","coin":"bcc"}`), 0); err != nil {
+		t.Fatal(err)
+	}
+	source := AuditSource{AuditSourceWebhook, "admin", "evt-6"}
+	applied, _, apiErr := commitWebhookEvent(path, WebhookEvent{ID: "evt-6", Seq: 6, PUName: "aaaa", Coin: "btc"}, source)
+	if applied || apiErr != nil {
+		t.Errorf("stale event should not be applied: %v, %v", applied, apiErr)
+	}
+	if _, _, err := zookeeperConn.Get(coinNodePath("aaaa", "")); err != coordination.ErrNoNode {
+		t.Errorf("coin node should not be written, but got %v", err)
+	}
+}